@@ -1,12 +1,15 @@
 package main
 
 import (
+	"OpcUaTimeSeriesHub/hub-api/internal/browsejob"
 	"OpcUaTimeSeriesHub/hub-api/internal/configupdate"
 	"OpcUaTimeSeriesHub/hub-api/internal/database"
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
 	"OpcUaTimeSeriesHub/hub-api/internal/webapi"
 	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/gorilla/mux"
 	"log"
 	"net/http"
 	"time"
@@ -14,38 +17,84 @@ import (
 
 func main() {
 
-	a := configupdate.CreateConfig(util.LoadConfig().TelegrafConfigPath)
+	// The settings are read from the environment once, a missing one stops the hub here
+	config := util.LoadConfig()
+
+	a := configupdate.CreateConfig(config.TelegrafConfigPath)
 	fmt.Println(a)
 
 	time.Sleep(15 * time.Second) // Need this to start after the database. This is a hack. Should be fixed in the future.
-	r := mux.NewRouter()
-	_, err := database.InitDB(false)
+	// The API and the background jobs share one database handle
+	db, err := database.InitDB(config, false)
 	if err != nil {
 		return
 	}
-	err = database.UpdateHierarchy()
+	defer db.Close()
+
+	// Watched nodes share one subscription per server
+	subscriptionInterval, err := time.ParseDuration(config.OpcUaSubscriptionInterval)
 	if err != nil {
-		return
+		log.Printf("Invalid OPCUA_SUBSCRIPTION_INTERVAL, publishing every second: %s", err)
+		subscriptionInterval = time.Second
+	}
+
+	// Events of the history enabled notifiers are written to InfluxDB by the hub
+	eventFilter, err := opcuaclient.NewEventFilterConfig(config)
+	if err != nil {
+		log.Printf("Invalid event filter, selecting the default fields of all events: %s", err)
+		eventFilter, _ = opcuaclient.NewEventFilterConfig(util.Config{})
+	}
+
+	// The sessions are kept alive and connect again when the connection is lost
+	sessionOptions, err := opcuaclient.NewSessionOptions(config)
+	if err != nil {
+		log.Printf("Invalid session options, using the defaults: %s", err)
 	}
-	// Create a ticker that fires every 30 minutes
-	//ticker := time.NewTicker(30 * time.Minute)
-	//go func() {
-	//	for {
-	//		select {
-	//		case <-ticker.C:
-	//			err := database.UpdateHierarchy()
-	//			if err != nil {
-	//				log.Fatalf("Failed to update hierarchy: %v", err)
-	//			}
-	//		}
-	//	}
-	//}()
+
+	// Browsing, live reads and subscriptions share one session with each server
+	pool := opcuaclient.NewSessionPool(func(ctx context.Context, id int) (opcuaclient.SecurityConfig, error) {
+		return database.LookupServerSecurity(ctx, db, config, id)
+	}, sessionOptions, subscriptionInterval, eventFilter, configupdate.NewEventWriter(config, db))
+
+	// Browse in the background so that the API is available while the server is browsed
+	interval, err := time.ParseDuration(config.OpcUaBrowseInterval)
+	if err != nil {
+		log.Printf("Invalid OPCUA_BROWSE_INTERVAL, browsing at startup only: %s", err)
+		interval = 0
+	}
+	scheduler := browsejob.NewScheduler(func(ctx context.Context, serverID int, progress func(nodes int)) error {
+		return database.UpdateHierarchy(ctx, db, pool, config, serverID, progress)
+	}, interval)
+	scheduler.Start(context.Background())
+
+	// The health of the servers is read periodically and, with OPCUA_HEALTH_MEASUREMENT, written to InfluxDB
+	healthInterval, err := time.ParseDuration(config.OpcUaHealthInterval)
+	if err != nil {
+		log.Printf("Invalid OPCUA_HEALTH_INTERVAL, reading the health on request only: %s", err)
+		healthInterval = 0
+	}
+	monitor := opcuaclient.NewHealthMonitor(pool, func(ctx context.Context) ([]int, error) {
+		return database.EnabledServerIDs(ctx, db)
+	}, healthInterval, configupdate.NewHealthWriter(config, db))
+	monitor.Start(context.Background())
+
+	go func() {
+		for {
+			err := webapi.SubscribeEventNotifiers(context.Background(), db, pool)
+			if err == nil {
+				return
+			}
+			if errors.Is(err, opcuaclient.ErrEventsRefused) {
+				log.Printf("Subscribed to events: %s", err)
+				return
+			}
+			log.Printf("Failed to subscribe to events, retrying in a minute: %s", err)
+			time.Sleep(time.Minute)
+		}
+	}()
 
 	// Register the handlers
-	r.HandleFunc("/api/nodes", webapi.GetNodesHandler).Methods("GET")
-	r.HandleFunc("/api/updated-required", webapi.GetUpdatesRequired).Methods("GET")
-	r.HandleFunc("/api/update-node-history", webapi.UpdateNodeHistoryHandler).Methods("POST")
-	r.HandleFunc("/api/update-telegraf-config", webapi.UpdateConfigFileWithHistoryNodes).Methods("POST")
+	r := webapi.NewRouter(db, config, pool, scheduler, monitor)
 
 	// Start the server
 	log.Println("Starting server on :9090")
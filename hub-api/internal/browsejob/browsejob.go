@@ -0,0 +1,167 @@
+package browsejob
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"sync"
+	"time"
+)
+
+// maxJobs is the number of finished jobs kept for the job status API.
+const maxJobs = 20
+
+// Job states.
+const (
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+)
+
+// Job triggers.
+const (
+	TriggerStartup  = "startup"
+	TriggerSchedule = "schedule"
+	TriggerAPI      = "api"
+)
+
+// Job is a single browse of an OPC UA server, or of every enabled server when ServerID is 0.
+type Job struct {
+	ID           int        `json:"id"`
+	ServerID     int        `json:"serverID,omitempty"`
+	Trigger      string     `json:"trigger"`
+	State        string     `json:"state"`
+	StartedAt    time.Time  `json:"startedAt"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty"`
+	Duration     string     `json:"duration"`
+	NodesVisited int        `json:"nodesVisited"`
+	Errors       []string   `json:"errors"`
+}
+
+// BrowseFunc browses a server, or every server when serverID is 0, calling progress with the
+// number of nodes visited so far.
+type BrowseFunc func(ctx context.Context, serverID int, progress func(nodes int)) error
+
+// Scheduler runs browses in the background, one at a time, on an interval and on demand.
+type Scheduler struct {
+	browse   BrowseFunc
+	interval time.Duration
+
+	mu      sync.Mutex
+	nextID  int
+	running *Job
+	jobs    []*Job
+	trigger chan *Job
+}
+
+// NewScheduler returns a scheduler that calls browse every interval. An interval of 0 only
+// browses at startup and when triggered.
+func NewScheduler(browse BrowseFunc, interval time.Duration) *Scheduler {
+	// A single job can be pending at a time, so triggering never blocks
+	return &Scheduler{browse: browse, interval: interval, trigger: make(chan *Job, 1)}
+}
+
+// Start browses once and then runs scheduled and triggered browses until ctx is cancelled.
+func (s *Scheduler) Start(ctx context.Context) {
+	go func() {
+		var tick <-chan time.Time
+		if s.interval > 0 {
+			ticker := time.NewTicker(s.interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		if job, _, ok := s.newJob(TriggerStartup, 0); ok {
+			s.run(ctx, job)
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+				if job, _, ok := s.newJob(TriggerSchedule, 0); ok {
+					s.run(ctx, job)
+				}
+			case job := <-s.trigger:
+				s.run(ctx, job)
+			}
+		}
+	}()
+}
+
+// Trigger starts a browse of a server now, or of every server when serverID is 0. It returns the
+// running job and false if a browse is already running.
+func (s *Scheduler) Trigger(serverID int) (Job, bool) {
+	job, snapshot, ok := s.newJob(TriggerAPI, serverID)
+	if ok {
+		s.trigger <- job
+	}
+	return snapshot, ok
+}
+
+// Jobs returns the running job and the most recent finished jobs, newest first.
+func (s *Scheduler) Jobs() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]Job, 0, len(s.jobs))
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, s.jobs[i].snapshot())
+	}
+	return jobs
+}
+
+// newJob registers a new running job and returns it with a snapshot of it, or returns
+// the job that is already running and false.
+func (s *Scheduler) newJob(trigger string, serverID int) (*Job, Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running != nil {
+		return s.running, s.running.snapshot(), false
+	}
+	s.nextID++
+	job := &Job{ID: s.nextID, ServerID: serverID, Trigger: trigger, State: StateRunning, StartedAt: time.Now(), Errors: []string{}}
+	s.running = job
+	s.jobs = append(s.jobs, job)
+	if len(s.jobs) > maxJobs {
+		s.jobs = s.jobs[len(s.jobs)-maxJobs:]
+	}
+	return job, job.snapshot(), true
+}
+
+// run browses and records the outcome in job.
+func (s *Scheduler) run(ctx context.Context, job *Job) {
+	util.Logger.Infof("Starting %s browse job %d", job.Trigger, job.ID)
+
+	err := s.browse(ctx, job.ServerID, func(nodes int) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		job.NodesVisited = nodes
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now()
+	job.FinishedAt = &finished
+	job.State = StateSucceeded
+	if err != nil {
+		job.State = StateFailed
+		job.Errors = append(job.Errors, err.Error())
+		util.Logger.Errorf("Browse job %d failed: %s", job.ID, err)
+	} else {
+		util.Logger.Infof("Browse job %d visited %d nodes in %s", job.ID, job.NodesVisited, finished.Sub(job.StartedAt))
+	}
+	s.running = nil
+}
+
+// snapshot returns a copy of the job with its duration so far. The scheduler lock must be held.
+func (job *Job) snapshot() Job {
+	j := *job
+	j.Errors = append([]string{}, job.Errors...)
+	end := time.Now()
+	if job.FinishedAt != nil {
+		end = *job.FinishedAt
+	}
+	j.Duration = end.Sub(job.StartedAt).Round(time.Millisecond).String()
+	return j
+}
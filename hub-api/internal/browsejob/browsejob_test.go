@@ -0,0 +1,91 @@
+package browsejob
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitFor polls until cond is true or fails the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerRunsOneBrowseAtATime(t *testing.T) {
+	release := make(chan struct{})
+	calls := 0
+	s := NewScheduler(func(ctx context.Context, serverID int, progress func(int)) error {
+		calls++
+		progress(42)
+		if calls == 2 {
+			if serverID != 2 {
+				t.Errorf("browsed server %d, want 2", serverID)
+			}
+			return errors.New("server went away")
+		}
+		<-release
+		return nil
+	}, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	// The startup browse is still running
+	waitFor(t, func() bool { jobs := s.Jobs(); return len(jobs) == 1 && jobs[0].NodesVisited == 42 })
+	if job, ok := s.Trigger(0); ok || job.ID != 1 || job.State != StateRunning {
+		t.Fatalf("expected the running startup job, got %+v", job)
+	}
+	close(release)
+	waitFor(t, func() bool { return s.Jobs()[0].State == StateSucceeded })
+
+	job, ok := s.Trigger(2)
+	if !ok || job.ID != 2 || job.ServerID != 2 || job.Trigger != TriggerAPI {
+		t.Fatalf("expected a new api job, got %+v", job)
+	}
+	waitFor(t, func() bool { return s.Jobs()[0].State == StateFailed })
+
+	jobs := s.Jobs()
+	if len(jobs) != 2 || jobs[0].ID != 2 || jobs[1].Trigger != TriggerStartup {
+		t.Fatalf("unexpected jobs %+v", jobs)
+	}
+	if len(jobs[0].Errors) != 1 || jobs[0].Errors[0] != "server went away" || jobs[0].FinishedAt == nil {
+		t.Errorf("unexpected failed job %+v", jobs[0])
+	}
+}
+
+func TestSchedulerInterval(t *testing.T) {
+	runs := make(chan struct{}, 10)
+	s := NewScheduler(func(ctx context.Context, serverID int, progress func(int)) error {
+		runs <- struct{}{}
+		return nil
+	}, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-runs:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d browses ran", i)
+		}
+	}
+	waitFor(t, func() bool {
+		for _, job := range s.Jobs() {
+			if job.Trigger == TriggerSchedule {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,252 @@
+package configupdate
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/database"
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua/ua"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// telegrafMeasurement is the measurement inputs.opcua writes to when it has no name configured.
+const telegrafMeasurement = "opcua"
+
+// Sizes of the requests written to InfluxDB.
+const (
+	linesPerWrite          = 5000
+	backfillRequestTimeout = 30 * time.Second
+)
+
+// NewInfluxOutput returns the InfluxDB output written to the Telegraf config by CreateConfig.
+func NewInfluxOutput(config util.Config) Output {
+	return Output{
+		URLs:         []string{config.TelegrafInfluxUrl},
+		Token:        config.TelegrafInfluxToken,
+		Organization: config.TelegrafInfluxOrg,
+		Bucket:       config.TelegrafInfluxBucket,
+	}
+}
+
+// BackfillNodes returns the nodes whose history is worth backfilling: the Added nodes that the
+// server historizes and allows reading the history of.
+func BackfillNodes(nodes []*database.Node) []*database.Node {
+	var backfill []*database.Node
+	for _, node := range database.FilterNodesByAction(nodes, []database.Action{database.Added}) {
+		if node.Historizing && node.HistoryReadable {
+			backfill = append(backfill, node)
+		}
+	}
+	return backfill
+}
+
+// Backfill reads the history the server stored for the nodes between start and end and writes it
+// to the InfluxDB output as line protocol, named and tagged as Telegraf's inputs.opcua section of
+// the server names the values it collects. Each page of history is written as soon as it is read.
+// It returns the number of points written. A node whose history cannot be read is skipped with a
+// warning.
+func Backfill(ctx context.Context, c opcuaclient.HistoryClient, config util.Config, server database.Server, output Output, nodes []*database.Node, start, end time.Time) (int, error) {
+	written := 0
+	for _, stored := range nodes {
+		simpleNodes := ConvertToSimpleNodes([]*database.Node{stored})
+		if len(simpleNodes) == 0 {
+			continue
+		}
+		setNamespaces(config, simpleNodes)
+		node := simpleNodes[0]
+		// Telegraf reads the name unescaped from its config
+		node.Name = stored.BrowseName
+		if node.DefaultTags == nil {
+			node.DefaultTags = map[string]string{}
+		}
+		for key, value := range ServerTags(server) {
+			node.DefaultTags[key] = value
+		}
+		nodeID, err := ua.ParseNodeID(stored.NodeID)
+		if err != nil {
+			util.Logger.Warnf("Not backfilling %s: %s", stored.NodeID, err)
+			continue
+		}
+
+		var writeErr error
+		err = opcuaclient.HistoryReadRawPages(ctx, c, nodeID, start, end, func(values []opcuaclient.LiveValue) error {
+			var lines []string
+			for _, v := range values {
+				if line, ok := telegrafLine(node, v); ok {
+					lines = append(lines, line)
+				}
+			}
+			if len(lines) == 0 {
+				return nil
+			}
+			if writeErr = writeLines(ctx, output, lines); writeErr != nil {
+				return writeErr
+			}
+			written += len(lines)
+			return nil
+		})
+		if writeErr != nil {
+			return written, writeErr
+		}
+		if err != nil {
+			util.Logger.Warnf("Stopped backfilling %s: %s", nodeID, err)
+			continue
+		}
+		util.Logger.Infof("Backfilled %s from %s", nodeID, start.Format(time.RFC3339))
+	}
+	return written, nil
+}
+
+// telegrafID returns the id tag Telegraf gives the values of a node.
+func telegrafID(node *SimpleNode) string {
+	if node.NamespaceURI != "" {
+		return fmt.Sprintf("nsu=%s;%s=%s", node.NamespaceURI, node.IdentifierType, node.Identifier)
+	}
+	return fmt.Sprintf("ns=%s;%s=%s", node.Namespace, node.IdentifierType, node.Identifier)
+}
+
+// telegrafLine formats a value as the line protocol Telegraf writes for it: the value in a field
+// named after the node, its status in the Quality field and the id and default tags of the node.
+// Values without a timestamp are skipped.
+func telegrafLine(node *SimpleNode, v opcuaclient.LiveValue) (string, bool) {
+	t := v.SourceTimestamp
+	if t == nil {
+		t = v.ServerTimestamp
+	}
+	if t == nil {
+		return "", false
+	}
+
+	tags := map[string]string{"id": telegrafID(node)}
+	for key, value := range node.DefaultTags {
+		tags[key] = value
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(escapeLine(telegrafMeasurement, ", "))
+	for _, key := range keys {
+		if tags[key] == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, ",%s=%s", escapeLine(key, ",= "), escapeLine(tags[key], ",= "))
+	}
+	sb.WriteByte(' ')
+	if field, ok := fieldValue(v.Value); ok {
+		fmt.Fprintf(&sb, "%s=%s,", escapeLine(node.Name, ",= "), field)
+	}
+	fmt.Fprintf(&sb, "Quality=%s %d", quoteField(qualityName(v.Status)), t.UnixNano())
+	return sb.String(), true
+}
+
+// qualityNames are the OPC UA names of the status codes history values commonly have, written to
+// the Quality field independently of how the OPC UA library describes them.
+var qualityNames = map[ua.StatusCode]string{
+	ua.StatusGood:              "Good",
+	ua.StatusGoodClamped:       "GoodClamped",
+	ua.StatusGoodLocalOverride: "GoodLocalOverride",
+	ua.StatusGoodNoData:        "GoodNoData",
+	ua.StatusUncertain:         "Uncertain",
+	ua.StatusUncertainNoCommunicationLastUsableValue: "UncertainNoCommunicationLastUsableValue",
+	ua.StatusUncertainLastUsableValue:                "UncertainLastUsableValue",
+	ua.StatusUncertainInitialValue:                   "UncertainInitialValue",
+	ua.StatusUncertainSensorNotAccurate:              "UncertainSensorNotAccurate",
+	ua.StatusUncertainEngineeringUnitsExceeded:       "UncertainEngineeringUnitsExceeded",
+	ua.StatusUncertainSubNormal:                      "UncertainSubNormal",
+	ua.StatusBad:                                     "Bad",
+	ua.StatusBadNoCommunication:                      "BadNoCommunication",
+	ua.StatusBadWaitingForInitialData:                "BadWaitingForInitialData",
+	ua.StatusBadConfigurationError:                   "BadConfigurationError",
+	ua.StatusBadNotConnected:                         "BadNotConnected",
+	ua.StatusBadDeviceFailure:                        "BadDeviceFailure",
+	ua.StatusBadSensorFailure:                        "BadSensorFailure",
+	ua.StatusBadOutOfService:                         "BadOutOfService",
+	ua.StatusBadNoData:                               "BadNoData",
+}
+
+// qualityName returns the name of a status code in qualityNames, or the code in hexadecimal.
+func qualityName(code ua.StatusCode) string {
+	if name, ok := qualityNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%08X", uint32(code))
+}
+
+// fieldValue formats a value as a line protocol field value, converting it as Telegraf does.
+func fieldValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case bool:
+		return strconv.FormatBool(v), true
+	case int8, int16, int32, int64:
+		return fmt.Sprintf("%di", v), true
+	case byte, uint16, uint32, uint64:
+		return fmt.Sprintf("%du", v), true
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case string:
+		return quoteField(v), true
+	case []byte:
+		return quoteField(string(v)), true
+	}
+	return "", false
+}
+
+// quoteField quotes a string field value.
+func quoteField(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// escapeLine escapes the special characters of a line protocol measurement, tag or field key.
+func escapeLine(s, special string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(special, c) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// writeLines writes line protocol to the InfluxDB v2 write API of the output.
+func writeLines(ctx context.Context, output Output, lines []string) error {
+	if len(output.URLs) == 0 || output.URLs[0] == "" {
+		return fmt.Errorf("no InfluxDB URL configured")
+	}
+	query := url.Values{"org": {output.Organization}, "bucket": {output.Bucket}, "precision": {"ns"}}
+	endpoint := strings.TrimSuffix(output.URLs[0], "/") + "/api/v2/write?" + query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, backfillRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBufferString(strings.Join(lines, "\n")))
+	if err != nil {
+		return fmt.Errorf("creating InfluxDB request: %w", err)
+	}
+	req.Header.Set("Authorization", "Token "+output.Token)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("writing to InfluxDB: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("writing to InfluxDB: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
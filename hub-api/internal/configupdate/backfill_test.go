@@ -0,0 +1,130 @@
+package configupdate
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/database"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"github.com/gopcua/opcua/ua"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeHistory serves the same history for every node, with the offset of the next value as the
+// continuation point.
+type fakeHistory struct {
+	values []*ua.DataValue
+	reads  int
+}
+
+func (h *fakeHistory) HistoryReadRawModified(ctx context.Context, nodes []*ua.HistoryReadValueID, details *ua.ReadRawModifiedDetails) (*ua.HistoryReadResponse, error) {
+	h.reads++
+	offset, _ := strconv.Atoi(string(nodes[0].ContinuationPoint))
+	values := h.values[offset:]
+	result := &ua.HistoryReadResult{StatusCode: ua.StatusOK}
+	if len(values) > int(details.NumValuesPerNode) {
+		values = values[:details.NumValuesPerNode]
+		result.ContinuationPoint = []byte(strconv.Itoa(offset + len(values)))
+	}
+	result.HistoryData = ua.NewExtensionObject(&ua.HistoryData{DataValues: values})
+	return &ua.HistoryReadResponse{Results: []*ua.HistoryReadResult{result}}, nil
+}
+
+func (h *fakeHistory) Send(ctx context.Context, req ua.Request, f func(ua.Response) error) error {
+	return f(&ua.HistoryReadResponse{Results: []*ua.HistoryReadResult{{StatusCode: ua.StatusOK}}})
+}
+
+func TestBackfill(t *testing.T) {
+	var requests []*http.Request
+	var bodies []string
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	history := &fakeHistory{values: []*ua.DataValue{
+		{Value: ua.MustVariant(21.5), Status: ua.StatusOK, SourceTimestamp: start},
+		{Value: ua.MustVariant(22.0), Status: ua.StatusUncertain, SourceTimestamp: start.Add(time.Second)},
+	}}
+	nodes := []*database.Node{
+		{NodeID: "ns=2;s=Temperature", Namespace: 2, IdentifierType: "s", Identifier: "Temperature", BrowseName: "Boiler Temperature", Storable: true, Unit: "°C", Historizing: true, HistoryReadable: true, DBActionRequired: database.Added},
+		{NodeID: "ns=2;s=Pressure", Namespace: 2, IdentifierType: "s", Identifier: "Pressure", BrowseName: "Pressure", Storable: true, HistoryReadable: true, DBActionRequired: database.Added},
+		{NodeID: "ns=2;s=Level", Namespace: 2, IdentifierType: "s", Identifier: "Level", BrowseName: "Level", Storable: true, Historizing: true, HistoryReadable: true, DBActionRequired: database.HistoryEnabledNoChange},
+	}
+
+	backfill := BackfillNodes(nodes)
+	if len(backfill) != 1 || backfill[0].Identifier != "Temperature" {
+		t.Fatalf("expected only the added historizing node to be backfilled, got %+v", backfill)
+	}
+
+	output := Output{URLs: []string{influx.URL}, Token: "token", Organization: "Home", Bucket: "OPCUA"}
+	written, err := Backfill(context.Background(), history, util.Config{}, database.DefaultServer(util.Config{}), output, backfill, start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 2 || len(requests) != 1 {
+		t.Fatalf("expected 2 points in 1 request, got %d in %d", written, len(requests))
+	}
+
+	r := requests[0]
+	if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("bucket") != "OPCUA" || r.URL.Query().Get("org") != "Home" || r.URL.Query().Get("precision") != "ns" {
+		t.Errorf("unexpected request %s", r.URL)
+	}
+	if r.Header.Get("Authorization") != "Token token" {
+		t.Errorf("unexpected authorization %q", r.Header.Get("Authorization"))
+	}
+	lines := strings.Split(bodies[0], "\n")
+	want := `opcua,id=ns\=2;s\=Temperature,server=default,unit=°C Boiler\ Temperature=21.5,Quality="Good" 1714564800000000000`
+	if lines[0] != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, lines[0])
+	}
+	want = `opcua,id=ns\=2;s\=Temperature,server=default,unit=°C Boiler\ Temperature=22,Quality="Uncertain" 1714564801000000000`
+	if lines[1] != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, lines[1])
+	}
+}
+
+func TestBackfillPages(t *testing.T) {
+	var bodies []string
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	// the values of every page share one timestamp, so paging by time would skip most of them
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	history := &fakeHistory{}
+	for i := 0; i < 2500; i++ {
+		history.values = append(history.values, &ua.DataValue{Value: ua.MustVariant(float64(i)), Status: ua.StatusCode(0x12345678), SourceTimestamp: start})
+	}
+	nodes := []*database.Node{
+		{NodeID: "ns=2;s=Temperature", Namespace: 2, IdentifierType: "s", Identifier: "Temperature", BrowseName: "Temperature", Storable: true, Historizing: true, HistoryReadable: true, DBActionRequired: database.Added},
+	}
+
+	output := Output{URLs: []string{influx.URL}, Token: "token", Organization: "Home", Bucket: "OPCUA"}
+	written, err := Backfill(context.Background(), history, util.Config{}, database.DefaultServer(util.Config{}), output, nodes, start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 2500 || history.reads != 3 || len(bodies) != 3 {
+		t.Fatalf("expected 2500 points read and written in 3 pages, got %d in %d reads and %d writes", written, history.reads, len(bodies))
+	}
+	if lines := strings.Split(bodies[2], "\n"); len(lines) != 500 || !strings.Contains(lines[499], `Temperature=2499,Quality="0x12345678"`) {
+		t.Errorf("unexpected last page ending with %s", lines[len(lines)-1])
+	}
+
+	influx.Close()
+	if _, err := Backfill(context.Background(), history, util.Config{}, database.DefaultServer(util.Config{}), output, nodes, start, start.Add(time.Hour)); err == nil {
+		t.Error("expected an error when InfluxDB cannot be written")
+	}
+}
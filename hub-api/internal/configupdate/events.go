@@ -0,0 +1,132 @@
+package configupdate
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/database"
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// eventTagFields are the event fields written as tags rather than fields, so that the events
+// of a source or condition can be selected.
+var eventTagFields = []string{"SourceName", "ConditionName"}
+
+// eventBuffer is the number of event notifications queued for writing. Notifications that arrive
+// while the queue is full are dropped rather than holding up the subscription they came from.
+const eventBuffer = 256
+
+// NewEventWriter returns a SessionPool event handler that writes events to the measurement
+// OPCUA_EVENT_MEASUREMENT of the InfluxDB output of the Telegraf config, tagged with their server
+// as stored in db. The events are queued and written by a goroutine of their own, so that a slow
+// InfluxDB does not hold up the notifications of the server.
+func NewEventWriter(config util.Config, db *sql.DB) func(serverID int, events []opcuaclient.Event) {
+	output := NewInfluxOutput(config)
+	type notification struct {
+		serverID int
+		events   []opcuaclient.Event
+	}
+	queue := make(chan notification, eventBuffer)
+	go func() {
+		for n := range queue {
+			server := database.Server{Name: strconv.Itoa(n.serverID)}
+			if s, err := database.GetServer(db, n.serverID); err == nil {
+				server = *s
+			}
+			if err := WriteEvents(context.Background(), output, config.OpcUaEventMeasurement, ServerTags(server), n.events); err != nil {
+				util.Logger.Errorf("Failed to write %d events: %s", len(n.events), err)
+			}
+		}
+	}()
+	return func(serverID int, events []opcuaclient.Event) {
+		select {
+		case queue <- notification{serverID, events}:
+		default:
+			util.Logger.Warnf("Dropped %d events of server %d, the events are not written to InfluxDB fast enough", len(events), serverID)
+		}
+	}
+}
+
+// WriteEvents writes events to the measurement of the InfluxDB output as line protocol, tagged
+// with the id of their notifier, the tags given, their SourceName and ConditionName.
+func WriteEvents(ctx context.Context, output Output, measurement string, tags map[string]string, events []opcuaclient.Event) error {
+	var lines []string
+	for _, ev := range events {
+		if line, ok := eventLine(measurement, tags, ev); ok {
+			lines = append(lines, line)
+		}
+	}
+	for len(lines) > 0 {
+		n := len(lines)
+		if n > linesPerWrite {
+			n = linesPerWrite
+		}
+		if err := writeLines(ctx, output, lines[:n]); err != nil {
+			return err
+		}
+		lines = lines[n:]
+	}
+	return nil
+}
+
+// eventLine formats an event as line protocol. Events without fields are skipped, as line
+// protocol requires at least one.
+func eventLine(measurement string, tags map[string]string, ev opcuaclient.Event) (string, bool) {
+	var sb strings.Builder
+	sb.WriteString(escapeLine(measurement, ", "))
+	fmt.Fprintf(&sb, ",id=%s", escapeLine(ev.NotifierID, ",= "))
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if tags[key] != "" {
+			fmt.Fprintf(&sb, ",%s=%s", escapeLine(key, ",= "), escapeLine(tags[key], ",= "))
+		}
+	}
+
+	var names []string
+	for name := range ev.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	isTag := func(name string) bool {
+		for _, tag := range eventTagFields {
+			if name == tag {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range names {
+		if s, ok := ev.Fields[name].(string); ok && isTag(name) && s != "" {
+			fmt.Fprintf(&sb, ",%s=%s", escapeLine(name, ",= "), escapeLine(s, ",= "))
+		}
+	}
+
+	sep := byte(' ')
+	for _, name := range names {
+		if isTag(name) {
+			continue
+		}
+		field, ok := fieldValue(ev.Fields[name])
+		if !ok {
+			continue
+		}
+		sb.WriteByte(sep)
+		fmt.Fprintf(&sb, "%s=%s", escapeLine(name, ",= "), field)
+		sep = ','
+	}
+	if sep == ' ' {
+		return "", false
+	}
+	fmt.Fprintf(&sb, " %d", ev.Time.UnixNano())
+	return sb.String(), true
+}
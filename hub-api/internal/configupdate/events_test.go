@@ -0,0 +1,93 @@
+package configupdate
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteEvents(t *testing.T) {
+	var body string
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	events := []opcuaclient.Event{
+		{NotifierID: "ns=2;s=Boiler", Time: at, Fields: map[string]interface{}{
+			"Severity":       uint16(700),
+			"Message":        "Temperature high",
+			"SourceName":     "Boiler 1",
+			"ConditionName":  "HighTemperature",
+			"ActiveState/Id": true,
+		}},
+		// Line protocol needs at least one field
+		{NotifierID: "ns=2;s=Boiler", Time: at, Fields: map[string]interface{}{"SourceName": "Boiler 1"}},
+	}
+	output := Output{URLs: []string{influx.URL}, Token: "token", Organization: "Home", Bucket: "OPCUA"}
+	if err := WriteEvents(context.Background(), output, "opcua_events", map[string]string{"server": "line 2"}, events); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `opcua_events,id=ns\=2;s\=Boiler,server=line\ 2,ConditionName=HighTemperature,SourceName=Boiler\ 1 ActiveState/Id=true,Message="Temperature high",Severity=700u 1714564800000000000`
+	if body != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, body)
+	}
+}
+
+func TestEventWriterQueue(t *testing.T) {
+	received := make(chan string, eventBuffer+2)
+	release := make(chan struct{})
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received <- string(b)
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	// the servers cannot be looked up, so the events are tagged with the server id
+	db, err := sql.Open("mysql", "hub:hub@tcp(127.0.0.1:1)/hub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	write := NewEventWriter(util.Config{TelegrafInfluxUrl: influx.URL, OpcUaEventMeasurement: "opcua_events"}, db)
+	events := []opcuaclient.Event{{NotifierID: "i=2253", Time: time.Now(), Fields: map[string]interface{}{"Severity": uint16(100)}}}
+	write(1, events)
+	<-received
+
+	// the InfluxDB write blocks, so the queue fills up and the last notification is dropped
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < eventBuffer+1; i++ {
+			write(1, events)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing events blocked the notifications")
+	}
+
+	close(release)
+	for i := 0; i < eventBuffer; i++ {
+		<-received
+	}
+	select {
+	case body := <-received:
+		t.Errorf("expected the notification after the full queue to be dropped, got %s", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
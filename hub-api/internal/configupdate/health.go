@@ -0,0 +1,89 @@
+package configupdate
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/database"
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NewHealthWriter returns a HealthMonitor handler that writes the health of the servers to the
+// measurement OPCUA_HEALTH_MEASUREMENT of the InfluxDB output of the Telegraf config, tagged with
+// their server as stored in db. It returns nil if no measurement is configured, so that nothing
+// is written.
+func NewHealthWriter(config util.Config, db *sql.DB) func(serverID int, h opcuaclient.ServerHealth) {
+	if config.OpcUaHealthMeasurement == "" {
+		return nil
+	}
+	output := NewInfluxOutput(config)
+	return func(serverID int, h opcuaclient.ServerHealth) {
+		server := database.Server{Name: strconv.Itoa(serverID)}
+		if s, err := database.GetServer(db, serverID); err == nil {
+			server = *s
+		}
+		if err := WriteHealth(context.Background(), output, config.OpcUaHealthMeasurement, ServerTags(server), h); err != nil {
+			util.Logger.Errorf("Failed to write the health of server %s: %s", server.Name, err)
+		}
+	}
+}
+
+// WriteHealth writes the health of a server to the measurement of the InfluxDB output as a line
+// of line protocol with the tags given. An unreachable server is written with reachable=false,
+// so that it can be alarmed on.
+func WriteHealth(ctx context.Context, output Output, measurement string, tags map[string]string, h opcuaclient.ServerHealth) error {
+	return writeLines(ctx, output, []string{healthLine(measurement, tags, h)})
+}
+
+// healthLine formats the health of a server as line protocol.
+func healthLine(measurement string, tags map[string]string, h opcuaclient.ServerHealth) string {
+	var sb strings.Builder
+	sb.WriteString(escapeLine(measurement, ", "))
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if tags[key] != "" {
+			fmt.Fprintf(&sb, ",%s=%s", escapeLine(key, ",= "), escapeLine(tags[key], ",= "))
+		}
+	}
+
+	fields := []string{fmt.Sprintf("reachable=%t", h.Reachable()), fmt.Sprintf("restarts=%di", h.Restarts)}
+	if h.State != "" {
+		fields = append(fields, "state="+quoteField(h.State))
+	}
+	if h.StartTime != nil {
+		fields = append(fields, fmt.Sprintf("start_time=%di", h.StartTime.Unix()))
+	}
+	if h.ClockDrift != nil {
+		fields = append(fields, "clock_drift="+strconv.FormatFloat(*h.ClockDrift, 'f', -1, 64))
+	}
+	if h.ServiceLevel != nil {
+		fields = append(fields, fmt.Sprintf("service_level=%du", *h.ServiceLevel))
+	}
+	if d := h.Diagnostics; d != nil {
+		fields = append(fields,
+			fmt.Sprintf("current_session_count=%du", d.CurrentSessionCount),
+			fmt.Sprintf("cumulated_session_count=%du", d.CumulatedSessionCount),
+			fmt.Sprintf("rejected_session_count=%du", d.RejectedSessionCount),
+			fmt.Sprintf("security_rejected_session_count=%du", d.SecurityRejectedSessionCount),
+			fmt.Sprintf("session_timeout_count=%du", d.SessionTimeoutCount),
+			fmt.Sprintf("session_abort_count=%du", d.SessionAbortCount),
+			fmt.Sprintf("current_subscription_count=%du", d.CurrentSubscriptionCount),
+			fmt.Sprintf("rejected_requests_count=%du", d.RejectedRequestsCount),
+			fmt.Sprintf("security_rejected_requests_count=%du", d.SecurityRejectedRequestsCount),
+		)
+	}
+	if h.Error != "" {
+		fields = append(fields, "error="+quoteField(h.Error))
+	}
+	fmt.Fprintf(&sb, " %s %d", strings.Join(fields, ","), h.ReadAt.UnixNano())
+	return sb.String()
+}
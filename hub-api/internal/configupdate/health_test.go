@@ -0,0 +1,52 @@
+package configupdate
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteHealth(t *testing.T) {
+	var body string
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	start := at.Add(-time.Hour)
+	drift := -1.5
+	level := uint8(255)
+	output := Output{URLs: []string{influx.URL}, Token: "token", Organization: "Home", Bucket: "OPCUA"}
+
+	h := opcuaclient.ServerHealth{ReadAt: at, State: "Running", StartTime: &start, ClockDrift: &drift, ServiceLevel: &level, Restarts: 2}
+	if err := WriteHealth(context.Background(), output, "opcua_health", map[string]string{"server": "line 2"}, h); err != nil {
+		t.Fatal(err)
+	}
+	want := `opcua_health,server=line\ 2 reachable=true,restarts=2i,state="Running",start_time=1714561200i,clock_drift=-1.5,service_level=255u 1714564800000000000`
+	if body != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, body)
+	}
+
+	h = opcuaclient.ServerHealth{ReadAt: at, Error: "connection refused"}
+	if err := WriteHealth(context.Background(), output, "opcua_health", map[string]string{"server": "line 2"}, h); err != nil {
+		t.Fatal(err)
+	}
+	want = `opcua_health,server=line\ 2 reachable=false,restarts=0i,error="connection refused" 1714564800000000000`
+	if body != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, body)
+	}
+}
+
+func TestNewHealthWriterWithoutMeasurement(t *testing.T) {
+	if NewHealthWriter(util.Config{}, nil) != nil {
+		t.Error("expected no writer without a measurement")
+	}
+}
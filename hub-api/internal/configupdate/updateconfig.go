@@ -2,10 +2,12 @@ package configupdate
 
 import (
 	"OpcUaTimeSeriesHub/hub-api/internal/database"
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
 	"bytes"
 	"fmt"
 	"github.com/BurntSushi/toml"
-	"log"
+	"github.com/gopcua/opcua/ua"
 	"os"
 	"strconv"
 	"strings"
@@ -52,80 +54,219 @@ type Inputs struct {
 }
 
 type Opcua struct {
-	Endpoint       string        `toml:"endpoint"`
-	ConnectTimeout string        `toml:"connect_timeout"`
-	RequestTimeout string        `toml:"request_timeout"`
-	SecurityPolicy string        `toml:"security_policy"`
-	SecurityMode   string        `toml:"security_mode"`
-	Nodes          []*SimpleNode `toml:"nodes"`
+	Endpoint       string            `toml:"endpoint"`
+	ConnectTimeout string            `toml:"connect_timeout"`
+	RequestTimeout string            `toml:"request_timeout"`
+	SecurityPolicy string            `toml:"security_policy"`
+	SecurityMode   string            `toml:"security_mode"`
+	Certificate    string            `toml:"certificate,omitempty"`
+	PrivateKey     string            `toml:"private_key,omitempty"`
+	AuthMethod     string            `toml:"auth_method,omitempty"`
+	Username       string            `toml:"username,omitempty"`
+	Password       string            `toml:"password,omitempty"`
+	Tags           map[string]string `toml:"tags,omitempty"`
+	Nodes          []*SimpleNode     `toml:"nodes"`
 }
 
 type SimpleNode struct {
-	Name           string `toml:"name"`
-	Namespace      string `toml:"namespace"`
-	IdentifierType string `toml:"identifier_type"`
-	Identifier     string `toml:"identifier"`
+	Name           string            `toml:"name"`
+	Namespace      string            `toml:"namespace,omitempty"`
+	NamespaceURI   string            `toml:"namespace_uri,omitempty"`
+	IdentifierType string            `toml:"identifier_type"`
+	Identifier     string            `toml:"identifier"`
+	DefaultTags    map[string]string `toml:"default_tags,omitempty"`
 }
 
 func ConvertToSimpleNodes(nodes []*database.Node) []*SimpleNode {
-	simpleNodes := make([]*SimpleNode, len(nodes))
-	for i, node := range nodes {
-		simpleNodes[i] = &SimpleNode{
+	simpleNodes := make([]*SimpleNode, 0, len(nodes))
+	for _, node := range nodes {
+		// The hub subscribes to the events of notifiers itself
+		if node.EventNotifier {
+			continue
+		}
+		// Telegraf would drop the values of these nodes
+		if !node.Storable {
+			util.Logger.Warnf("Leaving %s out of the Telegraf config: %s", node.NodeID, node.TypeWarning)
+			continue
+		}
+		simpleNodes = append(simpleNodes, &SimpleNode{
 			Name:           escapeString(node.BrowseName),
 			Namespace:      strconv.Itoa(node.Namespace),
+			NamespaceURI:   node.NamespaceURI,
 			IdentifierType: node.IdentifierType,
 			Identifier:     node.Identifier,
-		}
+			DefaultTags:    nodeTags(node),
+		})
 	}
 	return simpleNodes
 }
 
-func UpdateConfig(configFile string, nodes []*database.Node) error {
+// nodeTags returns the engineering unit metadata of a node as Telegraf tags, or nil if it has none.
+func nodeTags(node *database.Node) map[string]string {
+	tags := map[string]string{}
+	for key, value := range map[string]string{
+		"unit":   node.Unit,
+		"eu_min": node.EUMin,
+		"eu_max": node.EUMax,
+	} {
+		if value != "" {
+			tags[key] = value
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// ServerTags returns the tags that tell the values of a server apart from those of the other
+// servers managed by the hub.
+func ServerTags(server database.Server) map[string]string {
+	return map[string]string{"server": server.Name}
+}
+
+// Paths of the client certificate and key in the Telegraf container, which mounts the pki
+// directory of the hub at /etc/telegraf/pki.
+const (
+	telegrafCertificateFile = "/etc/telegraf/pki/own/cert.pem"
+	telegrafPrivateKeyFile  = "/etc/telegraf/pki/own/key.pem"
+)
+
+// telegrafSecurityModes and telegrafAuthMethods are the spellings the Telegraf opcua input
+// accepts for the security modes and user token types.
+var (
+	telegrafSecurityModes = map[ua.MessageSecurityMode]string{
+		ua.MessageSecurityModeNone:           "None",
+		ua.MessageSecurityModeSign:           "Sign",
+		ua.MessageSecurityModeSignAndEncrypt: "SignAndEncrypt",
+	}
+	telegrafAuthMethods = map[ua.UserTokenType]string{
+		ua.UserTokenTypeAnonymous:   "Anonymous",
+		ua.UserTokenTypeUserName:    "UserName",
+		ua.UserTokenTypeCertificate: "Certificate",
+	}
+)
+
+// NewOpcuaInput builds the inputs.opcua section of a server using the same security settings
+// the hub uses to browse it. Credentials are written as references that Telegraf resolves at
+// runtime, never as plaintext: OPCUA_USERNAME and OPCUA_PASSWORD for the default server, and
+// OPCUA_USERNAME_<id> and OPCUA_PASSWORD_<id> for the others.
+func NewOpcuaInput(config util.Config, server database.Server, nodes []*SimpleNode) Opcua {
+	input := Opcua{
+		Endpoint:       server.Endpoint,
+		ConnectTimeout: config.TelegrafOpcUaConnectTimeout,
+		RequestTimeout: config.TelegrafOpcUaRequestTimeout,
+		Tags:           ServerTags(server),
+		Nodes:          nodes,
+	}
+
+	setNamespaces(config, nodes)
+
+	// Telegraf picks an endpoint itself if the stored settings are not valid
+	policy, mode, err := opcuaclient.ParseSecurity(server.SecurityPolicy, server.SecurityMode)
+	if err != nil {
+		util.Logger.Warnf("Letting Telegraf choose the security of server %s: %v", server.Name, err)
+		input.SecurityPolicy = "auto"
+		input.SecurityMode = "auto"
+	} else {
+		input.SecurityPolicy = strings.TrimPrefix(policy, ua.SecurityPolicyURIPrefix)
+		input.SecurityMode = telegrafSecurityModes[mode]
+	}
+
+	authMethod, err := opcuaclient.ParseAuthMethod(server.AuthMethod)
+	if err != nil {
+		util.Logger.Warnf("Using anonymous authentication for server %s in Telegraf: %v", server.Name, err)
+	}
+	input.AuthMethod = telegrafAuthMethods[authMethod]
+
+	if input.SecurityPolicy != "None" || authMethod == ua.UserTokenTypeCertificate {
+		input.Certificate = config.TelegrafOpcUaCertificate
+		if input.Certificate == "" {
+			input.Certificate = telegrafCertificateFile
+		}
+		input.PrivateKey = config.TelegrafOpcUaPrivateKey
+		if input.PrivateKey == "" {
+			input.PrivateKey = telegrafPrivateKeyFile
+		}
+	}
+
+	if authMethod == ua.UserTokenTypeUserName {
+		suffix := ""
+		if server.ID != database.DefaultServerID {
+			suffix = fmt.Sprintf("_%d", server.ID)
+		}
+		input.Username = secretReference(config, "opcua_username"+suffix, "OPCUA_USERNAME"+strings.ToUpper(suffix))
+		input.Password = secretReference(config, "opcua_password"+suffix, "OPCUA_PASSWORD"+strings.ToUpper(suffix))
+	}
+
+	return input
+}
+
+// setNamespaces identifies the nodes by namespace URI if Telegraf is told to, otherwise by the
+// index the namespace had when the server was last browsed.
+func setNamespaces(config util.Config, nodes []*SimpleNode) {
+	for _, node := range nodes {
+		if config.TelegrafOpcUaNamespaceURIs == "true" && node.NamespaceURI != "" {
+			node.Namespace = ""
+		} else {
+			node.NamespaceURI = ""
+		}
+	}
+}
+
+// secretReference returns a Telegraf secret-store reference when a secret store is
+// configured, otherwise a reference to the environment variable of the Telegraf process.
+func secretReference(config util.Config, key, envVar string) string {
+	if config.TelegrafSecretStoreID != "" {
+		return fmt.Sprintf("@{%s:%s}", config.TelegrafSecretStoreID, key)
+	}
+	return fmt.Sprintf("${%s}", envVar)
+}
+
+// UpdateConfig writes an inputs.opcua section to the Telegraf config for every server with
+// nodes in nodes, with the timeouts and certificates of settings.
+func UpdateConfig(settings util.Config, configFile string, nodes []*database.Node, servers []*database.Server) error {
 
-	simpleNodes := ConvertToSimpleNodes(nodes)
+	byServer := map[int][]*database.Node{}
+	for _, node := range nodes {
+		byServer[node.ServerID] = append(byServer[node.ServerID], node)
+	}
 
 	// Load TOML file
 	data, err := os.ReadFile(configFile)
 	if err != nil {
-		log.Fatal(err)
-		return err
+		return fmt.Errorf("reading %s: %w", configFile, err)
 	}
 
 	// Unmarshal the TOML data into our Config struct
 	var config Config
 	if _, err := toml.Decode(string(data), &config); err != nil {
-		log.Fatal(err)
-		return err
-	}
-
-	// If there are nodes, replace the inputs.opcua section with new data
-	if len(simpleNodes) > 0 {
-		config.Inputs.Opcua = []Opcua{
-			{
-				Endpoint:       os.Getenv("TELEGRAF_OPCUA_ENDPOINT"),
-				ConnectTimeout: "10s",
-				RequestTimeout: "5s",
-				SecurityPolicy: "None",
-				SecurityMode:   "None",
-				Nodes:          simpleNodes,
-			},
+		return fmt.Errorf("parsing %s: %w", configFile, err)
+	}
+
+	// Replace the inputs.opcua sections with one per server with nodes, removing them entirely
+	// if there are no nodes
+	config.Inputs.Opcua = nil
+	for _, server := range servers {
+		simpleNodes := ConvertToSimpleNodes(byServer[server.ID])
+		delete(byServer, server.ID)
+		if len(simpleNodes) > 0 {
+			config.Inputs.Opcua = append(config.Inputs.Opcua, NewOpcuaInput(settings, *server, simpleNodes))
 		}
-	} else {
-		// If there are no nodes, remove the inputs.opcua section entirely
-		config.Inputs.Opcua = nil
+	}
+	for serverID, serverNodes := range byServer {
+		util.Logger.Warnf("Leaving %d nodes of unknown server %d out of the Telegraf config", len(serverNodes), serverID)
 	}
 
 	// Marshal the modified config back to TOML
 	var buf bytes.Buffer
 	if err := toml.NewEncoder(&buf).Encode(config); err != nil {
-		log.Fatal(err)
-		return err
+		return fmt.Errorf("encoding the Telegraf config: %w", err)
 	}
 
 	// Write the new TOML to the file (or to a new file)
 	if err := os.WriteFile(configFile, buf.Bytes(), 0644); err != nil {
-		log.Fatal(err)
-		return err
+		return fmt.Errorf("writing %s: %w", configFile, err)
 	}
 	return nil
 }
@@ -171,14 +312,12 @@ func CreateConfig(configFile string) error {
 	// Marshal the modified config back to TOML
 	var buf bytes.Buffer
 	if err := toml.NewEncoder(&buf).Encode(cfg); err != nil {
-		log.Fatal(err)
-		return err
+		return fmt.Errorf("encoding the Telegraf config: %w", err)
 	}
 
 	// Write the new TOML to the file (or to a new file)
 	if err := os.WriteFile(configFile, buf.Bytes(), 0644); err != nil {
-		log.Fatal(err)
-		return err
+		return fmt.Errorf("writing %s: %w", configFile, err)
 	}
 	return nil
 }
@@ -1,13 +1,144 @@
 package configupdate
 
 import (
+	"OpcUaTimeSeriesHub/hub-api/internal/database"
 	"OpcUaTimeSeriesHub/hub-api/util"
-
-	"fmt"
+	"github.com/BurntSushi/toml"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
-func TestYourFunction(t *testing.T) {
-	a := CreateConfig(util.LoadConfig().TelegrafConfigPath)
-	fmt.Println(a)
+func TestNewOpcuaInputWritesSecretReferences(t *testing.T) {
+	config := util.Config{
+		TelegrafOpcUaEndpoint:       "opc.tcp://plc:4840",
+		TelegrafOpcUaConnectTimeout: "10s",
+		TelegrafOpcUaRequestTimeout: "5s",
+		OpcUaSecurityPolicy:         "Basic256Sha256",
+		OpcUaSecurityMode:           "SignAndEncrypt",
+		OpcUaAuthMethod:             "UserName",
+		OpcUaUsername:               "operator",
+		OpcUaPassword:               "secret",
+		OpcUaCertificateFile:        "pki/own/cert.pem",
+		OpcUaPrivateKeyFile:         "pki/own/key.pem",
+	}
+
+	server := database.DefaultServer(config)
+	input := NewOpcuaInput(config, server, nil)
+	if input.Username != "${OPCUA_USERNAME}" || input.Password != "${OPCUA_PASSWORD}" {
+		t.Fatalf("expected environment references, got %q and %q", input.Username, input.Password)
+	}
+	if input.Certificate != "/etc/telegraf/pki/own/cert.pem" || input.PrivateKey != "/etc/telegraf/pki/own/key.pem" {
+		t.Fatalf("expected the certificate paths of the Telegraf container, got %q and %q", input.Certificate, input.PrivateKey)
+	}
+	if input.Endpoint != "opc.tcp://plc:4840" || input.Tags["server"] != "default" {
+		t.Fatalf("unexpected endpoint %q and tags %v", input.Endpoint, input.Tags)
+	}
+
+	other := database.Server{ID: 2, Name: "line2", Endpoint: "opc.tcp://line2:4840", SecurityPolicy: "None", SecurityMode: "None", AuthMethod: "UserName"}
+	input = NewOpcuaInput(config, other, nil)
+	if input.Username != "${OPCUA_USERNAME_2}" || input.Password != "${OPCUA_PASSWORD_2}" || input.Certificate != "" {
+		t.Fatalf("expected references of server 2 without certificate, got %q, %q and %q", input.Username, input.Password, input.Certificate)
+	}
+
+	config.TelegrafSecretStoreID = "vault"
+	input = NewOpcuaInput(config, server, nil)
+	if input.Password != "@{vault:opcua_password}" {
+		t.Fatalf("expected secret-store reference, got %q", input.Password)
+	}
+	input = NewOpcuaInput(config, other, nil)
+	if input.Password != "@{vault:opcua_password_2}" {
+		t.Fatalf("expected secret-store reference of server 2, got %q", input.Password)
+	}
+}
+
+func TestNewOpcuaInputUsesTelegrafSpellings(t *testing.T) {
+	config := util.Config{TelegrafOpcUaCertificate: "/certs/cert.pem", TelegrafOpcUaPrivateKey: "/certs/key.pem"}
+	server := database.Server{ID: 2, Name: "line2", SecurityPolicy: "Basic256Sha256", SecurityMode: "signandencrypt", AuthMethod: "certificate"}
+
+	input := NewOpcuaInput(config, server, nil)
+	if input.SecurityPolicy != "Basic256Sha256" || input.SecurityMode != "SignAndEncrypt" || input.AuthMethod != "Certificate" {
+		t.Fatalf("expected Telegraf spellings, got %q, %q and %q", input.SecurityPolicy, input.SecurityMode, input.AuthMethod)
+	}
+	if input.Certificate != "/certs/cert.pem" || input.PrivateKey != "/certs/key.pem" {
+		t.Fatalf("expected the configured certificate paths, got %q and %q", input.Certificate, input.PrivateKey)
+	}
+
+	server.SecurityPolicy, server.SecurityMode, server.AuthMethod = "None", "none", "username"
+	input = NewOpcuaInput(config, server, nil)
+	if input.SecurityPolicy != "None" || input.SecurityMode != "None" || input.AuthMethod != "UserName" {
+		t.Fatalf("expected Telegraf spellings, got %q, %q and %q", input.SecurityPolicy, input.SecurityMode, input.AuthMethod)
+	}
+}
+
+func TestConvertToSimpleNodesSkipsNodesTelegrafCannotStore(t *testing.T) {
+	nodes := []*database.Node{
+		{NodeID: "ns=2;s=Temperature", Namespace: 2, IdentifierType: "s", Identifier: "Temperature", BrowseName: "Temperature", Storable: true, Unit: "°C"},
+		{NodeID: "ns=2;s=Samples", Namespace: 2, IdentifierType: "s", Identifier: "Samples", BrowseName: "Samples", TypeWarning: "Telegraf cannot store arrays of Double as fields"},
+	}
+
+	simpleNodes := ConvertToSimpleNodes(nodes)
+	if len(simpleNodes) != 1 || simpleNodes[0].Identifier != "Temperature" {
+		t.Fatalf("expected only Temperature, got %+v", simpleNodes)
+	}
+	if simpleNodes[0].DefaultTags["unit"] != "°C" {
+		t.Errorf("expected unit tag, got %v", simpleNodes[0].DefaultTags)
+	}
+}
+
+func TestNewOpcuaInputNamespaceURIs(t *testing.T) {
+	newNodes := func() []*SimpleNode {
+		return ConvertToSimpleNodes([]*database.Node{
+			{NodeID: "ns=3;s=Temperature", Namespace: 3, NamespaceURI: "urn:plc", IdentifierType: "s", Identifier: "Temperature", BrowseName: "Temperature", Storable: true},
+			{NodeID: "ns=4;s=Pressure", Namespace: 4, IdentifierType: "s", Identifier: "Pressure", BrowseName: "Pressure", Storable: true},
+		})
+	}
+
+	input := NewOpcuaInput(util.Config{}, database.Server{}, newNodes())
+	if n := input.Nodes[0]; n.Namespace != "3" || n.NamespaceURI != "" {
+		t.Errorf("expected namespace index, got %q and %q", n.Namespace, n.NamespaceURI)
+	}
+
+	input = NewOpcuaInput(util.Config{TelegrafOpcUaNamespaceURIs: "true"}, database.Server{}, newNodes())
+	if n := input.Nodes[0]; n.Namespace != "" || n.NamespaceURI != "urn:plc" {
+		t.Errorf("expected namespace URI, got %q and %q", n.Namespace, n.NamespaceURI)
+	}
+	if n := input.Nodes[1]; n.Namespace != "4" {
+		t.Errorf("expected namespace index for a node without URI, got %q", n.Namespace)
+	}
+}
+
+func TestUpdateConfigWritesAnInputPerServer(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "telegraf.conf")
+	if err := os.WriteFile(configFile, []byte("[agent]\n  interval = \"10s\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	servers := []*database.Server{
+		{ID: 1, Name: "default", Endpoint: "opc.tcp://plc:4840", SecurityPolicy: "None", SecurityMode: "None", AuthMethod: "Anonymous"},
+		{ID: 2, Name: "line2", Endpoint: "opc.tcp://line2:4840", SecurityPolicy: "None", SecurityMode: "None", AuthMethod: "Anonymous"},
+		{ID: 3, Name: "idle", Endpoint: "opc.tcp://idle:4840", SecurityPolicy: "None", SecurityMode: "None", AuthMethod: "Anonymous"},
+	}
+	nodes := []*database.Node{
+		{ServerID: 2, NodeID: "ns=2;s=Speed", Namespace: 2, IdentifierType: "s", Identifier: "Speed", BrowseName: "Speed", Storable: true},
+		{ServerID: 1, NodeID: "ns=2;s=Temperature", Namespace: 2, IdentifierType: "s", Identifier: "Temperature", BrowseName: "Temperature", Storable: true},
+		{ServerID: 2, NodeID: "ns=2;s=Temperature", Namespace: 2, IdentifierType: "s", Identifier: "Temperature", BrowseName: "Temperature", Storable: true},
+	}
+
+	if err := UpdateConfig(util.Config{TelegrafOpcUaConnectTimeout: "10s", TelegrafOpcUaRequestTimeout: "5s"}, configFile, nodes, servers); err != nil {
+		t.Fatal(err)
+	}
+	var config Config
+	if _, err := toml.DecodeFile(configFile, &config); err != nil {
+		t.Fatal(err)
+	}
+	inputs := config.Inputs.Opcua
+	if len(inputs) != 2 {
+		t.Fatalf("expected an input for each server with nodes, got %d", len(inputs))
+	}
+	if inputs[0].Endpoint != "opc.tcp://plc:4840" || inputs[0].Tags["server"] != "default" || len(inputs[0].Nodes) != 1 {
+		t.Errorf("unexpected input of the default server %+v", inputs[0])
+	}
+	if inputs[1].Endpoint != "opc.tcp://line2:4840" || inputs[1].Tags["server"] != "line2" || len(inputs[1].Nodes) != 2 {
+		t.Errorf("unexpected input of server 2 %+v", inputs[1])
+	}
 }
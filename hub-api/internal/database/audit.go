@@ -0,0 +1,41 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// InsertNodeWrite records a value written to a node of a server. The old and new values are stored as JSON.
+// writeErr is the error of a write the server did not answer, empty if it returned a status code.
+// caller is the user named by a trusted proxy, if any, and remoteAddr the address the request came from.
+func InsertNodeWrite(db *sql.DB, serverID int, nodeID string, oldValue, newValue interface{}, statusCode, writeErr, caller, remoteAddr string) error {
+	_, err := db.Exec(`INSERT INTO node_writes (server_id, node_id, old_value, new_value, status_code, error, caller, remote_addr) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		serverID, nodeID, encodeJSON(oldValue), encodeJSON(newValue), statusCode, writeErr, caller, remoteAddr)
+	if err != nil {
+		return fmt.Errorf("recording write to %s: %w", nodeID, err)
+	}
+	return nil
+}
+
+// GetNodeWrites returns the most recent writes to a node of a server, newest first.
+func GetNodeWrites(db *sql.DB, serverID int, nodeID string, limit int) ([]NodeWrite, error) {
+	rows, err := db.Query(`SELECT id, node_id, COALESCE(old_value, ''), COALESCE(new_value, ''), COALESCE(status_code, ''), COALESCE(error, ''), COALESCE(caller, ''), COALESCE(remote_addr, ''), written_at
+		FROM node_writes WHERE server_id = ? AND node_id = ? ORDER BY id DESC LIMIT ?`, serverID, nodeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("querying writes to %s: %w", nodeID, err)
+	}
+	defer rows.Close()
+
+	writes := []NodeWrite{}
+	for rows.Next() {
+		var w NodeWrite
+		if err := rows.Scan(&w.ID, &w.NodeID, &w.OldValue, &w.NewValue, &w.StatusCode, &w.Error, &w.Caller, &w.RemoteAddr, &w.WrittenAt); err != nil {
+			return nil, fmt.Errorf("scanning write: %w", err)
+		}
+		writes = append(writes, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading rows: %w", err)
+	}
+	return writes, nil
+}
@@ -0,0 +1,237 @@
+package database
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gopcua/opcua/ua"
+	"sort"
+)
+
+// ErrNoBrowsePath is returned when binding the selection of a node that has no browse path,
+// such as a browse root or a node not browsed since browse paths were stored.
+var ErrNoBrowsePath = errors.New("node has no browse path")
+
+// PathBinding is a selection bound to the browse path of a node, and the node id the path
+// resolved to. ResolvedID is empty if the path no longer resolves, Status tells why.
+type PathBinding struct {
+	ServerID   int    `json:"serverID"`
+	Path       string `json:"path"`
+	NodeID     string `json:"nodeID"`
+	ResolvedID string `json:"resolvedID,omitempty"`
+	Status     string `json:"status,omitempty"`
+}
+
+// PathResolution lists the bound selections that moved to a new node id, and those whose
+// browse path no longer resolves.
+type PathResolution struct {
+	Rebound    []PathBinding `json:"rebound"`
+	Unresolved []PathBinding `json:"unresolved"`
+}
+
+// boundPath is the stored selection of a node bound to its browse path.
+type boundPath struct {
+	id             int
+	nodeID         string
+	nodePath       string
+	namespace      int
+	namespaceURI   string
+	historyEnabled bool
+	path           opcuaclient.BrowsePath
+}
+
+// pathMove moves a bound selection to the node id its browse path resolves to.
+type pathMove struct {
+	from   boundPath
+	to     *ua.NodeID
+	stored bool
+}
+
+// SetNodeBindPath binds the selection of a node of a server to its browse path, or back to its
+// node id. A bound selection follows its node when the server gives it a new node id: every
+// browse of the server and every update of the Telegraf config resolve the path again with
+// TranslateBrowsePathsToNodeIds and move the selection to the node found.
+func SetNodeBindPath(db *sql.DB, serverID int, nodeID string, bind bool) error {
+	n, err := GetNode(db, serverID, nodeID)
+	if err != nil {
+		return err
+	}
+	if bind && (n.BrowseRoot == "" || len(n.BrowsePath) == 0) {
+		return fmt.Errorf("%w: %s", ErrNoBrowsePath, nodeID)
+	}
+	if _, err := db.Exec(`UPDATE nodes SET bind_path = ? WHERE id = ?`, bind, n.ID); err != nil {
+		return fmt.Errorf("updating node bind_path: %w", err)
+	}
+	return nil
+}
+
+// ResolveBoundPaths resolves the browse paths of the bound selections of a server through its
+// session in pool, and moves the selections whose node id changed. The server is only asked if
+// it has bound selections.
+func ResolveBoundPaths(ctx context.Context, db *sql.DB, pool *opcuaclient.SessionPool, s *Server) (*PathResolution, error) {
+	bound, err := loadBoundPaths(db, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(bound) == 0 {
+		return &PathResolution{Rebound: []PathBinding{}, Unresolved: []PathBinding{}}, nil
+	}
+
+	session, err := pool.Session(ctx, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	c, err := session.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return resolveBoundPaths(ctx, db, c, s.ID, bound)
+}
+
+// loadBoundPaths returns the bound selections of a server that are not removed.
+func loadBoundPaths(db *sql.DB, serverID int) ([]boundPath, error) {
+	rows, err := db.Query(`SELECT id, node_id, COALESCE(node_path, ''), COALESCE(namespace, 0), COALESCE(namespace_uri, ''), history_enabled, COALESCE(browse_root, ''), COALESCE(browse_path, '') FROM nodes WHERE server_id = ? AND bind_path = 1 AND removed = 0`, serverID)
+	if err != nil {
+		return nil, fmt.Errorf("querying bound nodes: %w", err)
+	}
+	defer rows.Close()
+
+	var bound []boundPath
+	for rows.Next() {
+		var b boundPath
+		var root, path string
+		if err := rows.Scan(&b.id, &b.nodeID, &b.nodePath, &b.namespace, &b.namespaceURI, &b.historyEnabled, &root, &path); err != nil {
+			return nil, fmt.Errorf("scanning bound node: %w", err)
+		}
+		b.path.Names = decodeStrings(path)
+		b.path.StartingNode, err = ua.ParseNodeID(root)
+		if err != nil || len(b.path.Names) == 0 {
+			util.Logger.Warnf("Not resolving node %s, it has no browse path", b.nodeID)
+			continue
+		}
+		bound = append(bound, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading rows: %w", err)
+	}
+	return bound, nil
+}
+
+// resolveBoundPaths translates the browse paths of the bound selections of a server through c
+// and moves the selections whose path resolves to another node id. Selections whose path no
+// longer resolves are left where they are and reported.
+func resolveBoundPaths(ctx context.Context, db *sql.DB, c opcuaclient.PathClient, serverID int, bound []boundPath) (*PathResolution, error) {
+	resolution := &PathResolution{Rebound: []PathBinding{}, Unresolved: []PathBinding{}}
+	if len(bound) == 0 {
+		return resolution, nil
+	}
+
+	paths := make([]opcuaclient.BrowsePath, len(bound))
+	for i, b := range bound {
+		paths[i] = b.path
+	}
+	results, err := opcuaclient.TranslateBrowsePaths(ctx, c, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var moves []pathMove
+	for i, r := range results {
+		b := bound[i]
+		binding := PathBinding{ServerID: serverID, Path: b.nodePath, NodeID: b.nodeID}
+		if r.Status != ua.StatusOK {
+			binding.Status = opcuaclient.StatusName(r.Status)
+			resolution.Unresolved = append(resolution.Unresolved, binding)
+			util.Logger.Warnf("Browse path %s of node %s no longer resolves: %s", b.nodePath, b.nodeID, binding.Status)
+			continue
+		}
+		binding.ResolvedID = r.NodeID.String()
+		if binding.ResolvedID == b.nodeID {
+			continue
+		}
+		resolution.Rebound = append(resolution.Rebound, binding)
+		util.Logger.Infof("Browse path %s moved from node %s to %s", b.nodePath, b.nodeID, binding.ResolvedID)
+		moves = append(moves, pathMove{from: b, to: r.NodeID})
+	}
+
+	if err := rebindPaths(db, serverID, moves); err != nil {
+		return nil, err
+	}
+	return resolution, nil
+}
+
+// rebindPaths moves bound selections to their new node ids. A selection moves onto the stored
+// node with the new id, which is then pending addition to the Telegraf config, while the node
+// it leaves keeps its place in the config until the next update removes it. If no node with
+// the new id is stored, because the server was not browsed since, the node is given the new id.
+func rebindPaths(db *sql.DB, serverID int, moves []pathMove) error {
+	if len(moves) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for i, m := range moves {
+		var count int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM nodes WHERE server_id = ? AND node_id = ?`, serverID, m.to.String()).Scan(&count); err != nil {
+			return fmt.Errorf("querying node %s: %w", m.to, err)
+		}
+		moves[i].stored = count > 0
+	}
+	// Clear every selection first, so that selections swapping node ids do not overwrite each other
+	for _, m := range moves {
+		if _, err := tx.Exec(`UPDATE nodes SET history_enabled = 0, bind_path = 0 WHERE id = ?`, m.from.id); err != nil {
+			return fmt.Errorf("unbinding node %s: %w", m.from.nodeID, err)
+		}
+	}
+	// Nodes are given new ids first, which frees the ids they leave for the selections moving there
+	sort.SliceStable(moves, func(i, j int) bool { return !moves[i].stored && moves[j].stored })
+
+	for _, m := range moves {
+		var targetID int
+		var historyEnabled bool
+		err := tx.QueryRow(`SELECT id, history_enabled FROM nodes WHERE server_id = ? AND node_id = ?`, serverID, m.to.String()).Scan(&targetID, &historyEnabled)
+		switch {
+		case err == sql.ErrNoRows:
+			err = renumberNode(tx, serverID, m.from, m.to)
+		case err == nil:
+			historyEnabled = historyEnabled || m.from.historyEnabled
+			_, err = tx.Exec(`UPDATE nodes SET history_enabled = ?, bind_path = 1, removed = 0, included_in_config = IF(? = 1, 0, included_in_config) WHERE id = ?`, historyEnabled, historyEnabled, targetID)
+		}
+		if err != nil {
+			return fmt.Errorf("binding node %s: %w", m.to, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing bound paths: %w", err)
+	}
+	return nil
+}
+
+// renumberNode gives the stored node of a bound selection a new node id, moving its children
+// with it. The node is pending addition to the Telegraf config under its new id.
+func renumberNode(tx *sql.Tx, serverID int, b boundPath, to *ua.NodeID) error {
+	parts, err := ParseNodeIDString(to.String())
+	if err != nil {
+		return err
+	}
+	namespaceURI := b.namespaceURI
+	if parts.Namespace != b.namespace {
+		namespaceURI = ""
+	}
+	_, err = tx.Exec(`UPDATE nodes SET node_id = ?, namespace = ?, identifier_type = ?, identifier = ?, namespace_uri = ?, expanded_node_id = ?, history_enabled = ?, bind_path = 1, included_in_config = 0 WHERE id = ?`,
+		to.String(), parts.Namespace, parts.IdentifierType, parts.Identifier, namespaceURI, opcuaclient.ExpandedNodeID(to, namespaceURI), b.historyEnabled, b.id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE nodes SET parent_id = ? WHERE server_id = ? AND parent_id = ? AND id <> ?`, to.String(), serverID, b.nodeID, b.id)
+	return err
+}
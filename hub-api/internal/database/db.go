@@ -5,22 +5,30 @@ import (
 	"OpcUaTimeSeriesHub/hub-api/util"
 	"context"
 	"database/sql"
-	"flag"
+	"encoding/json"
+	"errors"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/gopcua/opcua"
-	"github.com/gopcua/opcua/debug"
-	"github.com/gopcua/opcua/ua"
 	"log"
 	"regexp"
+	"sort"
+	"sync"
 	"time"
 )
 
 type Action int
 
-func LoadDatabase() (*sql.DB, error) {
+// browseConnectTimeout is how long a browse waits for the session with its server to connect.
+const browseConnectTimeout = time.Minute
 
-	config := util.LoadConfig()
+var (
+	browseReportsMu sync.Mutex
+	browseReports   = map[int][]*opcuaclient.BrowseReport{}
+	browseChanges   = map[int]*BrowseChanges{}
+)
+
+// LoadDatabase opens the database in config.
+func LoadDatabase(config util.Config) (*sql.DB, error) {
 
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", config.DbUser,
 		config.DbPassword, config.DbHost, config.DbPort, config.DbName)
@@ -34,8 +42,8 @@ func LoadDatabase() (*sql.DB, error) {
 	return db, nil
 }
 
-// InitDB initializes and returns the database connection.
-func InitDB(dropTable bool) (*sql.DB, error) {
+// InitDB initializes and returns the database connection of config.
+func InitDB(config util.Config, dropTable bool) (*sql.DB, error) {
 
 	util.Logger.Info("Initializing database")
 
@@ -43,7 +51,7 @@ func InitDB(dropTable bool) (*sql.DB, error) {
 	var err error
 
 	for i := 0; i < 10; i++ {
-		db, err = LoadDatabase()
+		db, err = LoadDatabase(config)
 		if err == nil {
 			break
 		}
@@ -69,10 +77,47 @@ func InitDB(dropTable bool) (*sql.DB, error) {
 		}
 	}
 
+	// The OPC UA servers managed by the hub
+	createServersSQL := `
+CREATE TABLE IF NOT EXISTS servers (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    endpoint TEXT NOT NULL,
+    root_node TEXT NOT NULL,
+    browse_roots TEXT,
+    security_policy VARCHAR(255),
+    security_mode VARCHAR(255),
+    auth_method VARCHAR(255),
+    username VARCHAR(255),
+    password TEXT,
+    enabled INT DEFAULT 1,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(name)
+);
+`
+	_, err = db.Exec(createServersSQL)
+	if err != nil {
+		util.Logger.Error("Error creating servers table", err)
+		return nil, err
+	}
+
+	err = ensureDefaultServer(db, config)
+	if err != nil {
+		util.Logger.Error("Error adding default server", err)
+		return nil, err
+	}
+
+	err = encryptStoredPasswords(db, config)
+	if err != nil {
+		util.Logger.Error("Error encrypting server passwords", err)
+		return nil, err
+	}
+
 	createNodesSQL := `
 CREATE TABLE IF NOT EXISTS nodes (
     id INT AUTO_INCREMENT PRIMARY KEY,
-    node_id TEXT(500) NOT NULL,
+    server_id INT NOT NULL DEFAULT 1,
+    node_id TEXT NOT NULL,
     namespace TEXT,
     identifier_type VARCHAR(255),
     identifier TEXT,
@@ -86,7 +131,33 @@ CREATE TABLE IF NOT EXISTS nodes (
     node_path TEXT,
     history_enabled INT DEFAULT 0,
     included_in_config INT DEFAULT 0,
-    UNIQUE(node_id(500))
+    other_parents TEXT,
+    reference_type VARCHAR(255),
+    unit VARCHAR(255),
+    eu_min VARCHAR(255),
+    eu_max VARCHAR(255),
+    instrument_min VARCHAR(255),
+    instrument_max VARCHAR(255),
+    scale VARCHAR(255),
+    data_type_name VARCHAR(255),
+    value_rank INT DEFAULT -1,
+    array_dimensions TEXT,
+    enum_values TEXT,
+    storable INT DEFAULT 1,
+    type_warning TEXT,
+    namespace_uri TEXT,
+    expanded_node_id TEXT,
+    input_arguments TEXT,
+    output_arguments TEXT,
+    historizing INT DEFAULT 0,
+    history_readable INT DEFAULT 0,
+    event_notifier INT DEFAULT 0,
+    description TEXT,
+    data_type_id VARCHAR(255),
+    browse_root TEXT,
+    browse_path TEXT,
+    bind_path INT DEFAULT 0,
+    UNIQUE server_node (server_id, node_id(500))
 );
 `
 
@@ -97,30 +168,218 @@ CREATE TABLE IF NOT EXISTS nodes (
 		return nil, err
 	}
 
+	for _, m := range nodesMigrations {
+		err = addColumnIfMissing(db, "nodes", m.column, m.definition)
+		if err != nil {
+			util.Logger.Error("Error migrating nodes table", err)
+			return nil, err
+		}
+	}
+
+	err = migrateNodesKey(db)
+	if err != nil {
+		util.Logger.Error("Error migrating nodes table", err)
+		return nil, err
+	}
+
+	err = migrateColumnType(db, "nodes", "node_id", "text", "TEXT NOT NULL")
+	if err != nil {
+		util.Logger.Error("Error migrating nodes table", err)
+		return nil, err
+	}
+
+	// Every value written to the server is recorded
+	createNodeWritesSQL := `
+CREATE TABLE IF NOT EXISTS node_writes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    server_id INT NOT NULL DEFAULT 1,
+    node_id TEXT NOT NULL,
+    old_value TEXT,
+    new_value TEXT,
+    status_code VARCHAR(255),
+    error TEXT,
+    caller VARCHAR(255),
+    remote_addr VARCHAR(255),
+    written_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+    INDEX(node_id(500))
+);
+`
+	_, err = db.Exec(createNodeWritesSQL)
+	if err != nil {
+		util.Logger.Error("Error creating node_writes table", err)
+		return nil, err
+	}
+
+	err = addColumnIfMissing(db, "node_writes", "server_id", "INT NOT NULL DEFAULT 1")
+	if err != nil {
+		util.Logger.Error("Error migrating node_writes table", err)
+		return nil, err
+	}
+
+	err = addColumnIfMissing(db, "node_writes", "error", "TEXT")
+	if err != nil {
+		util.Logger.Error("Error migrating node_writes table", err)
+		return nil, err
+	}
+
+	err = addColumnIfMissing(db, "node_writes", "remote_addr", "VARCHAR(255)")
+	if err != nil {
+		util.Logger.Error("Error migrating node_writes table", err)
+		return nil, err
+	}
+
+	err = migrateColumnType(db, "node_writes", "node_id", "text", "TEXT NOT NULL")
+	if err != nil {
+		util.Logger.Error("Error migrating node_writes table", err)
+		return nil, err
+	}
+
 	util.Logger.Info("Tables created successfully")
 	return db, nil
 }
 
+// nodesMigrations lists the columns added to the nodes table after it was first released,
+// so that existing databases are brought up to date.
+var nodesMigrations = []struct {
+	column     string
+	definition string
+}{
+	{"other_parents", "TEXT"},
+	{"reference_type", "VARCHAR(255)"},
+	{"unit", "VARCHAR(255)"},
+	{"eu_min", "VARCHAR(255)"},
+	{"eu_max", "VARCHAR(255)"},
+	{"instrument_min", "VARCHAR(255)"},
+	{"instrument_max", "VARCHAR(255)"},
+	{"scale", "VARCHAR(255)"},
+	{"data_type_name", "VARCHAR(255)"},
+	{"value_rank", "INT DEFAULT -1"},
+	{"array_dimensions", "TEXT"},
+	{"enum_values", "TEXT"},
+	{"storable", "INT DEFAULT 1"},
+	{"type_warning", "TEXT"},
+	{"namespace_uri", "TEXT"},
+	{"expanded_node_id", "TEXT"},
+	{"input_arguments", "TEXT"},
+	{"output_arguments", "TEXT"},
+	{"historizing", "INT DEFAULT 0"},
+	{"history_readable", "INT DEFAULT 0"},
+	{"event_notifier", "INT DEFAULT 0"},
+	{"server_id", "INT NOT NULL DEFAULT 1"},
+	{"description", "TEXT"},
+	{"data_type_id", "VARCHAR(255)"},
+	{"browse_root", "TEXT"},
+	{"browse_path", "TEXT"},
+	{"bind_path", "INT DEFAULT 0"},
+}
+
+// migrateNodesKey replaces the unique node_id key of databases created before the hub managed
+// several servers with a key on the server and node id. The existing nodes belong to the
+// default server.
+func migrateNodesKey(db *sql.DB) error {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'nodes' AND INDEX_NAME = 'server_node'`).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("checking key nodes.server_node: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	util.Logger.Info("Keying nodes by server")
+	_, err = db.Exec(`ALTER TABLE nodes DROP INDEX node_id, ADD UNIQUE server_node (server_id, node_id(500))`)
+	if err != nil {
+		return fmt.Errorf("adding key nodes.server_node: %w", err)
+	}
+	return nil
+}
+
+// migrateColumnType changes the type of a column unless it already has the given data type.
+// The node_id columns were declared as TEXT(500), which MySQL already stores as TEXT, so this
+// only alters databases where the column ended up with another type.
+func migrateColumnType(db *sql.DB, table, column, dataType, definition string) error {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ? AND DATA_TYPE = ?`, table, column, dataType).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("checking column %s.%s: %w", table, column, err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	util.Logger.Infof("Changing column %s.%s to %s", table, column, definition)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("changing column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to a table unless it already exists.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`, table, column).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("checking column %s.%s: %w", table, column, err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	util.Logger.Infof("Adding column %s to table %s", column, table)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("adding column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// InsertOrUpdateNode stores a browsed node. The history selection of a node that is already
+// stored is kept, so that browsing again does not change what is written to the Telegraf config.
 func InsertOrUpdateNode(db *sql.DB, node Node) error {
 	// Prepare the SQL statement
 	statement := `
-    INSERT INTO nodes (node_id, namespace, identifier_type, identifier, parent_id, browse_name, node_class, data_type, writable, node_path, history_enabled, included_in_config, removed)
-    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    INSERT INTO nodes (server_id, node_id, namespace, identifier_type, identifier, parent_id, browse_name, node_class, data_type, writable, node_path, history_enabled, included_in_config, removed, other_parents, reference_type, unit, eu_min, eu_max, instrument_min, instrument_max, scale, data_type_name, value_rank, array_dimensions, enum_values, storable, type_warning, namespace_uri, expanded_node_id, input_arguments, output_arguments, historizing, history_readable, event_notifier, description, data_type_id, browse_root, browse_path)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     ON DUPLICATE KEY UPDATE
+    namespace = VALUES(namespace),
     parent_id = VALUES(parent_id),
     browse_name = VALUES(browse_name),
     node_class = VALUES(node_class),
     data_type = VALUES(data_type),
     writable = VALUES(writable),
     node_path = VALUES(node_path),
-    history_enabled = VALUES(history_enabled),
-    included_in_config = VALUES(included_in_config),
-	removed = VALUES(removed);
+	removed = VALUES(removed),
+	other_parents = VALUES(other_parents),
+	reference_type = VALUES(reference_type),
+	unit = VALUES(unit),
+	eu_min = VALUES(eu_min),
+	eu_max = VALUES(eu_max),
+	instrument_min = VALUES(instrument_min),
+	instrument_max = VALUES(instrument_max),
+	scale = VALUES(scale),
+	data_type_name = VALUES(data_type_name),
+	value_rank = VALUES(value_rank),
+	array_dimensions = VALUES(array_dimensions),
+	enum_values = VALUES(enum_values),
+	storable = VALUES(storable),
+	type_warning = VALUES(type_warning),
+	namespace_uri = VALUES(namespace_uri),
+	expanded_node_id = VALUES(expanded_node_id),
+	input_arguments = VALUES(input_arguments),
+	output_arguments = VALUES(output_arguments),
+	historizing = VALUES(historizing),
+	history_readable = VALUES(history_readable),
+	event_notifier = VALUES(event_notifier),
+	description = VALUES(description),
+	data_type_id = VALUES(data_type_id),
+	browse_root = VALUES(browse_root),
+	browse_path = VALUES(browse_path);
     
 `
 
 	// Execute the SQL statement with the provided parameters
-	_, err := db.Exec(statement, node.NodeID, node.Namespace, node.IdentifierType, node.Identifier, node.ParentID, node.BrowseName, node.NodeClass, node.DataType, node.Writable, node.NodePath, node.HistoryEnabled, node.HistoryEnabledInConfig, node.Removed)
+	_, err := db.Exec(statement, node.ServerID, node.NodeID, node.Namespace, node.IdentifierType, node.Identifier, node.ParentID, node.BrowseName, node.NodeClass, node.DataType, node.Writable, node.NodePath, node.HistoryEnabled, node.HistoryEnabledInConfig, node.Removed, encodeStrings(node.OtherParents), node.ReferenceType, node.Unit, node.EUMin, node.EUMax, node.InstrumentMin, node.InstrumentMax, node.Scale, node.DataTypeName, node.ValueRank, encodeJSON(node.ArrayDimensions), encodeJSON(node.EnumValues), node.Storable, node.TypeWarning, node.NamespaceURI, node.ExpandedNodeID, encodeJSON(node.InputArguments), encodeJSON(node.OutputArguments), node.Historizing, node.HistoryReadable, node.EventNotifier, node.Description, node.DataTypeID, node.BrowseRoot, encodeStrings(node.BrowsePath))
 	if err != nil {
 		// If there's an error, wrap it with additional context and return
 		return fmt.Errorf("inserting or updating node: %w", err)
@@ -129,14 +388,14 @@ func InsertOrUpdateNode(db *sql.DB, node Node) error {
 	return nil
 }
 
-func MarkNodeAsRemoved(db *sql.DB, nodeID string) error {
+func MarkNodeAsRemoved(db *sql.DB, serverID int, nodeID string) error {
 
 	util.Logger.Info("Marking node as removed", nodeID)
-	_, err := db.Exec("UPDATE nodes SET removed = 1, last_updated = CURRENT_TIMESTAMP WHERE node_id = ?", nodeID)
+	_, err := db.Exec("UPDATE nodes SET removed = 1, last_updated = CURRENT_TIMESTAMP WHERE server_id = ? AND node_id = ?", serverID, nodeID)
 	if err != nil {
 		util.Logger.Error("Error marking node as removed", err)
 	}
-	_, err = db.Exec("UPDATE nodes SET history_enabled = 0, last_updated = CURRENT_TIMESTAMP WHERE node_id = ?", nodeID)
+	_, err = db.Exec("UPDATE nodes SET history_enabled = 0, last_updated = CURRENT_TIMESTAMP WHERE server_id = ? AND node_id = ?", serverID, nodeID)
 	if err != nil {
 		util.Logger.Error("Error disabling history on node", err)
 	}
@@ -157,32 +416,76 @@ func DropNodesTable(db *sql.DB) error {
 	return nil
 }
 
-// LoadHierarchy loads the node hierarchy from the database, adjusting for string ParentID.
-func LoadHierarchy(db *sql.DB) ([]*Node, error) {
+// nodeColumns are the columns read by scanNode.
+const nodeColumns = `id, server_id, node_id, parent_id, browse_name, node_class, data_type, writable, last_updated, removed, node_path, history_enabled, other_parents, reference_type, COALESCE(unit, ''), COALESCE(eu_min, ''), COALESCE(eu_max, ''), COALESCE(instrument_min, ''), COALESCE(instrument_max, ''), COALESCE(scale, ''), COALESCE(data_type_name, ''), COALESCE(value_rank, -1), COALESCE(array_dimensions, ''), COALESCE(enum_values, ''), COALESCE(storable, 1), COALESCE(type_warning, ''), COALESCE(namespace_uri, ''), COALESCE(expanded_node_id, ''), COALESCE(input_arguments, ''), COALESCE(output_arguments, ''), COALESCE(historizing, 0), COALESCE(history_readable, 0), COALESCE(event_notifier, 0), COALESCE(description, ''), COALESCE(data_type_id, ''), COALESCE(browse_root, ''), COALESCE(browse_path, ''), COALESCE(bind_path, 0)`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanNode reads a node selected with nodeColumns.
+func scanNode(row rowScanner) (*Node, error) {
+	var n Node
+	var otherParents, referenceType sql.NullString
+	var arrayDimensions, enumValues, inputArguments, outputArguments, browsePath string
+	err := row.Scan(&n.ID, &n.ServerID, &n.NodeID, &n.ParentID, &n.BrowseName, &n.NodeClass, &n.DataType, &n.Writable, &n.LastUpdated, &n.Removed, &n.NodePath, &n.HistoryEnabled, &otherParents, &referenceType, &n.Unit, &n.EUMin, &n.EUMax, &n.InstrumentMin, &n.InstrumentMax, &n.Scale, &n.DataTypeName, &n.ValueRank, &arrayDimensions, &enumValues, &n.Storable, &n.TypeWarning, &n.NamespaceURI, &n.ExpandedNodeID, &inputArguments, &outputArguments, &n.Historizing, &n.HistoryReadable, &n.EventNotifier, &n.Description, &n.DataTypeID, &n.BrowseRoot, &browsePath, &n.BindPath)
+	if err != nil {
+		return nil, err
+	}
+	n.OtherParents = decodeStrings(otherParents.String)
+	n.ReferenceType = referenceType.String
+	n.BrowsePath = decodeStrings(browsePath)
+	decodeJSON(arrayDimensions, &n.ArrayDimensions)
+	decodeJSON(enumValues, &n.EnumValues)
+	decodeJSON(inputArguments, &n.InputArguments)
+	decodeJSON(outputArguments, &n.OutputArguments)
+	return &n, nil
+}
+
+// ErrNodeNotFound is returned when a node is not stored.
+var ErrNodeNotFound = errors.New("node not found")
+
+// GetNode returns the stored node of a server with the given node id, including removed nodes.
+func GetNode(db *sql.DB, serverID int, nodeID string) (*Node, error) {
+	n, err := scanNode(db.QueryRow(`SELECT `+nodeColumns+` FROM nodes WHERE server_id = ? AND node_id = ?`, serverID, nodeID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrNodeNotFound, nodeID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying node %s: %w", nodeID, err)
+	}
+	return n, nil
+}
+
+// LoadHierarchy loads the node hierarchy of a server from the database, adjusting for string ParentID.
+func LoadHierarchy(db *sql.DB, serverID int) ([]*Node, error) {
 	// Temporary map to hold nodes by NodeID
 	nodesMap := make(map[string]*Node)
 	// Slice to hold all root nodes (there could be multiple roots)
 	var roots []*Node
+	// All nodes in the order of the query, so that children are sorted by browse name
+	var ordered []*Node
 
 	// Query all nodes from the database
-	rows, err := db.Query(`SELECT id, node_id, parent_id, browse_name, node_class, data_type, writable, last_updated, removed, node_path, history_enabled FROM nodes WHERE removed = 0 ORDER BY browse_name`)
+	rows, err := db.Query(`SELECT `+nodeColumns+` FROM nodes WHERE server_id = ? AND removed = 0 ORDER BY browse_name`, serverID)
 	if err != nil {
 		return nil, fmt.Errorf("querying nodes: %w", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var n Node
-		err := rows.Scan(&n.ID, &n.NodeID, &n.ParentID, &n.BrowseName, &n.NodeClass, &n.DataType, &n.Writable, &n.LastUpdated, &n.Removed, &n.NodePath, &n.HistoryEnabled)
+		n, err := scanNode(rows)
 		if err != nil {
 			return nil, fmt.Errorf("scanning node: %w", err)
 		}
 
-		nodesMap[n.NodeID] = &n
+		nodesMap[n.NodeID] = n
+		ordered = append(ordered, n)
 
 		// If ParentNodeID is its own NodeID, it's a root node
 		if n.NodeID == n.ParentID {
-			roots = append(roots, &n)
+			roots = append(roots, n)
 		}
 	}
 
@@ -191,7 +494,7 @@ func LoadHierarchy(db *sql.DB) ([]*Node, error) {
 	}
 
 	// Build the hierarchy
-	for _, n := range nodesMap {
+	for _, n := range ordered {
 		if n.ParentID != n.NodeID { // Ignore root nodes
 			parent, exists := nodesMap[n.ParentID]
 			if !exists {
@@ -206,16 +509,33 @@ func LoadHierarchy(db *sql.DB) ([]*Node, error) {
 	return roots, nil
 }
 
-// UpdateNodeHistory updates the history_enabled status of a node identified by nodeID.
-func UpdateNodeHistory(db *sql.DB, nodeID string, historyEnabled bool) error {
+// ErrNodeNotStorable is returned when history is enabled on a node whose values Telegraf cannot store.
+var ErrNodeNotStorable = errors.New("node cannot be stored by Telegraf")
+
+// UpdateNodeHistory updates the history_enabled status of a node of a server identified by nodeID.
+// History cannot be enabled on nodes whose values Telegraf cannot store as fields, except on
+// event notifiers, whose events are stored instead.
+func UpdateNodeHistory(db *sql.DB, serverID int, nodeID string, historyEnabled bool) error {
+	if historyEnabled {
+		var storable, eventNotifier bool
+		var warning sql.NullString
+		err := db.QueryRow(`SELECT COALESCE(storable, 1), type_warning, COALESCE(event_notifier, 0) FROM nodes WHERE server_id = ? AND node_id = ?`, serverID, nodeID).Scan(&storable, &warning, &eventNotifier)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("checking node data type: %w", err)
+		}
+		if err == nil && !storable && !eventNotifier {
+			return fmt.Errorf("%w: %s", ErrNodeNotStorable, warning.String)
+		}
+	}
+
 	// Convert the boolean to an integer because SQLite does not have a native boolean type
 	historyEnabledInt := 0
 	if historyEnabled {
 		historyEnabledInt = 1
 	}
 
-	statement := `UPDATE nodes SET history_enabled = ? WHERE node_id = ?`
-	_, err := db.Exec(statement, historyEnabledInt, nodeID)
+	statement := `UPDATE nodes SET history_enabled = ? WHERE server_id = ? AND node_id = ?`
+	_, err := db.Exec(statement, historyEnabledInt, serverID, nodeID)
 	if err != nil {
 		// If there's an error, wrap it with additional context and return
 		return fmt.Errorf("updating node history_enabled: %w", err)
@@ -228,6 +548,7 @@ func UpdateNodeHistory(db *sql.DB, nodeID string, historyEnabled bool) error {
 func GetHistoryNodes(db *sql.DB) ([]*Node, error) {
 	query := `SELECT 
 					n.id,
+					n.server_id,
 					n.node_id,
 					n.namespace,
 					n.identifier_type,
@@ -240,6 +561,15 @@ func GetHistoryNodes(db *sql.DB) ([]*Node, error) {
 					n.node_path,
 					n.history_enabled,
 					n.included_in_config,
+					COALESCE(n.unit, ''),
+					COALESCE(n.eu_min, ''),
+					COALESCE(n.eu_max, ''),
+					COALESCE(n.storable, 1),
+					COALESCE(n.type_warning, ''),
+					COALESCE(n.namespace_uri, ''),
+					COALESCE(n.historizing, 0),
+					COALESCE(n.history_readable, 0),
+					COALESCE(n.event_notifier, 0),
 					CASE 
 						WHEN history_enabled = 1 AND included_in_config = 0 THEN 'Added'
 						WHEN history_enabled = 0 AND included_in_config = 1 THEN 'Removed'
@@ -247,7 +577,8 @@ func GetHistoryNodes(db *sql.DB) ([]*Node, error) {
 					    WHEN history_enabled = 0 AND included_in_config = 0 THEN 'HistoryDisabledNoChange'
 					END AS status
 				FROM 
-					nodes n`
+					nodes n
+				ORDER BY n.server_id`
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, fmt.Errorf("querying history-enabled nodes: %w", err)
@@ -258,7 +589,7 @@ func GetHistoryNodes(db *sql.DB) ([]*Node, error) {
 	for rows.Next() {
 		var node Node
 		var status sql.NullString
-		if err := rows.Scan(&node.ID, &node.NodeID, &node.Namespace, &node.IdentifierType, &node.Identifier, &node.ParentID, &node.BrowseName, &node.NodeClass, &node.DataType, &node.Writable, &node.NodePath, &node.HistoryEnabled, &node.HistoryEnabledInConfig, &status); err != nil {
+		if err := rows.Scan(&node.ID, &node.ServerID, &node.NodeID, &node.Namespace, &node.IdentifierType, &node.Identifier, &node.ParentID, &node.BrowseName, &node.NodeClass, &node.DataType, &node.Writable, &node.NodePath, &node.HistoryEnabled, &node.HistoryEnabledInConfig, &node.Unit, &node.EUMin, &node.EUMax, &node.Storable, &node.TypeWarning, &node.NamespaceURI, &node.Historizing, &node.HistoryReadable, &node.EventNotifier, &status); err != nil {
 			return nil, fmt.Errorf("scanning node: %w", err)
 		}
 		switch status.String {
@@ -322,7 +653,7 @@ func SetDatabaseNodeStates(db *sql.DB, nodes []*Node) error {
 	for _, node := range nodes {
 		util.Logger.Info("Updating node in database", node.NodeID, "with status", node.DBActionRequired)
 		if node.DBActionRequired == Added {
-			_, err := db.Exec("UPDATE nodes SET included_in_config = 1 WHERE node_id = ?", node.NodeID)
+			_, err := db.Exec("UPDATE nodes SET included_in_config = 1 WHERE server_id = ? AND node_id = ?", node.ServerID, node.NodeID)
 			if err != nil {
 				util.Logger.Error("Error setting Telegraf config to up to date", err)
 				return fmt.Errorf("updating update state: %w", err)
@@ -330,7 +661,7 @@ func SetDatabaseNodeStates(db *sql.DB, nodes []*Node) error {
 
 		}
 		if node.DBActionRequired == Removed {
-			_, err := db.Exec("UPDATE nodes SET included_in_config = 0 WHERE node_id = ?", node.NodeID)
+			_, err := db.Exec("UPDATE nodes SET included_in_config = 0 WHERE server_id = ? AND node_id = ?", node.ServerID, node.NodeID)
 			if err != nil {
 				util.Logger.Error("Error setting Telegraf config to up to date", err)
 				return fmt.Errorf("updating update state: %w", err)
@@ -342,73 +673,201 @@ func SetDatabaseNodeStates(db *sql.DB, nodes []*Node) error {
 	return nil
 }
 
-func UpdateHierarchy() error {
+// UpdateHierarchy browses an OPC UA server from every configured root through its session in
+// pool and stores the nodes found in db, using the browse settings of config. A serverID of 0
+// browses every enabled server in turn. progress, if not nil, is called with the number of nodes
+// visited so far. A root that fails to browse does not stop the other roots, but then no nodes of
+// its server are marked as removed.
+func UpdateHierarchy(ctx context.Context, db *sql.DB, pool *opcuaclient.SessionPool, config util.Config, serverID int, progress func(nodes int)) error {
 
-	config := util.LoadConfig()
+	var servers []*Server
+	var err error
+	if serverID == 0 {
+		servers, err = GetServers(db)
+		if err != nil {
+			return err
+		}
+	} else {
+		s, err := GetServer(db, serverID)
+		if err != nil {
+			return err
+		}
+		if !s.Enabled {
+			return fmt.Errorf("%w: %s", ErrServerDisabled, s.Name)
+		}
+		servers = []*Server{s}
+	}
 
-	db, err := LoadDatabase()
-	if err != nil {
-		util.Logger.Error("Failed to initialize DB", err)
-		return err
+	var errs []error
+	finished := 0
+	for _, s := range servers {
+		if !s.Enabled {
+			continue
+		}
+		var serverProgress func(nodes int)
+		if progress != nil {
+			done := finished
+			serverProgress = func(nodes int) { progress(done + nodes) }
+		}
+		nodes, err := browseServer(ctx, db, pool, s, config, serverProgress)
+		finished += nodes
+		if err != nil {
+			util.Logger.Errorf("Failed to browse server %s: %s", s.Name, err)
+			errs = append(errs, fmt.Errorf("browsing server %s: %w", s.Name, err))
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	endpoint := flag.String("endpoint", config.TelegrafOpcUaEndpoint, "OPC UA Endpoint URL")
-	nodeID := flag.String("node", config.RootNode, "node id for the root node")
-	flag.BoolVar(&debug.Enable, "debug", false, "enable debug logging")
-	flag.Parse()
-	log.SetFlags(0)
+// browseServer browses a server from every configured root and stores the nodes found. It waits
+// up to browseConnectTimeout for the session with the server to connect. It returns the number
+// of nodes visited.
+func browseServer(ctx context.Context, db *sql.DB, pool *opcuaclient.SessionPool, s *Server, config util.Config, progress func(nodes int)) (int, error) {
+	config = s.BrowseConfig(config)
 
-	ctx := context.Background()
+	session, err := pool.Session(ctx, s.ID)
+	if err != nil {
+		return 0, err
+	}
+	connectCtx, cancel := context.WithTimeout(ctx, browseConnectTimeout)
+	c, err := session.WaitClient(connectCtx)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	return storeBrowse(ctx, db, c, s, config, progress)
+}
 
-	c, err := opcua.NewClient(*endpoint)
+// storeBrowse browses a server through c from every configured root, stores the nodes found and
+// marks the stored nodes that were not found as removed. If c can translate browse paths, the
+// selections bound to a browse path move to the node id it resolves to. It returns the number of
+// nodes visited.
+func storeBrowse(ctx context.Context, db *sql.DB, c opcuaclient.BrowseClient, s *Server, config util.Config, progress func(nodes int)) (int, error) {
+	namespaces, err := opcuaclient.ReadNamespaces(ctx, c)
 	if err != nil {
-		log.Fatal(err)
+		util.Logger.Error("Failed to read the namespace array", err)
+		return 0, err
+	}
+	remapped, err := RemapNamespaces(db, s.ID, namespaces)
+	if err != nil {
+		util.Logger.Error("Failed to remap namespaces", err)
+		return 0, err
+	}
+	if remapped > 0 {
+		util.Logger.Warnf("Namespace indexes of server %s changed, moved %d nodes to their new namespace index", s.Name, remapped)
 	}
 
-	for i := 0; i < 10; i++ {
-		err = c.Connect(ctx)
-		if err == nil {
-			break
-		}
-		util.Logger.Errorf("Attempt %d: Failed to connect: %s", i+1, err)
-		time.Sleep(time.Second * 2)
+	roots, err := opcuaclient.NewBrowseRoots(config)
+	if err != nil {
+		return 0, fmt.Errorf("invalid browse roots: %w", err)
 	}
 
+	stored, err := loadNodeStates(db, s.ID)
+	if err != nil {
+		util.Logger.Error("Failed to load the stored nodes", err)
+		return 0, err
+	}
+	// The browse overwrites the paths of node ids the server gave to other nodes, so the bound
+	// paths are loaded before it
+	bound, err := loadBoundPaths(db, s.ID)
 	if err != nil {
-		log.Fatalf("Failed to connect after 10 attempts: %s", err)
+		util.Logger.Error("Failed to load the bound nodes", err)
+		return 0, err
 	}
 
-	defer c.Close(ctx)
+	var (
+		reports  []*opcuaclient.BrowseReport
+		browsed  []Node
+		errs     []error
+		finished int
+	)
+	for _, root := range roots {
+		opts := opcuaclient.NewBrowseOptions(config)
+		opts.Namespaces = namespaces
+		if progress != nil {
+			opts.Progress = func(nodes int) { progress(finished + nodes) }
+		}
+		nodeList, report, err := opcuaclient.Browse(ctx, c, root, opts)
+		if err != nil {
+			util.Logger.Errorf("Failed to browse %s: %s", root.NodeID, err)
+			errs = append(errs, fmt.Errorf("browsing %s: %w", root.NodeID, err))
+			continue
+		}
+		finished += report.Nodes
 
-	id, err := ua.ParseNodeID(*nodeID)
-	if err != nil {
-		log.Fatalf("invalid node id: %s", err)
+		nodes, err := insertNodesRecursively(db, s.ID, nodeList, root.NodeID.String(), root.NodeID.String())
+		if err != nil {
+			util.Logger.Error("Failed to insert nodes", err)
+			return finished, err
+		}
+		browsed = append(browsed, nodes...)
+		reports = append(reports, report)
 	}
+	setBrowseReports(s.ID, reports)
 
-	nodeList, err := opcuaclient.Browse(ctx, c.Node(id), "", 0)
-	if err != nil {
-		util.Logger.Errorf("Failed to browse: %s", err)
-		log.Fatal(err)
+	if len(errs) > 0 {
+		util.Logger.Warn("Not checking for removed nodes because the browse was incomplete")
+		return finished, errors.Join(errs...)
 	}
 
-	util.Logger.Info("Checking for removed nodes form the OPC UA Server")
+	// Bound selections move to their new node ids before the nodes they leave are marked as removed
+	resolution := &PathResolution{Rebound: []PathBinding{}, Unresolved: []PathBinding{}}
+	if pc, ok := c.(opcuaclient.PathClient); ok {
+		resolution, err = resolveBoundPaths(ctx, db, pc, s.ID, bound)
+		if err != nil {
+			util.Logger.Error("Failed to resolve the bound browse paths", err)
+			return finished, err
+		}
+	}
+
+	util.Logger.Infof("Checking for removed nodes form the OPC UA Server %s", s.Name)
 
-	_, err = insertNodesRecursively(db, nodeList, config.RootNode)
+	changes, err := ReconcileNodes(db, s.ID, stored, browsed)
 	if err != nil {
-		util.Logger.Error("Failed to insert nodes", err)
-		return err
+		util.Logger.Error("Failed to mark removed nodes", err)
+		return finished, err
 	}
+	changes.Rebound, changes.Unresolved = resolution.Rebound, resolution.Unresolved
+	setBrowseChanges(s.ID, changes)
 
-	// Need to work on this
+	return finished, nil
+}
 
-	//err = MarkRemovedNodes(db, allOpcNodes)
-	//if err != nil {
-	//	util.Logger.Error("Failed to mark removed nodes", err)
-	//	return err
-	//}
+// setBrowseChanges stores the changes found by the last completed browse of a server.
+func setBrowseChanges(serverID int, changes *BrowseChanges) {
+	browseReportsMu.Lock()
+	defer browseReportsMu.Unlock()
+	if changes == nil {
+		delete(browseChanges, serverID)
+		return
+	}
+	browseChanges[serverID] = changes
+}
 
-	return err
+// GetBrowseChanges returns the changes found by the last completed browse of a server, or nil if
+// there was none.
+func GetBrowseChanges(serverID int) *BrowseChanges {
+	browseReportsMu.Lock()
+	defer browseReportsMu.Unlock()
+	return browseChanges[serverID]
+}
 
+// setBrowseReports stores the reports of the last completed browse of a server.
+func setBrowseReports(serverID int, reports []*opcuaclient.BrowseReport) {
+	browseReportsMu.Lock()
+	defer browseReportsMu.Unlock()
+	if reports == nil {
+		delete(browseReports, serverID)
+		return
+	}
+	browseReports[serverID] = reports
+}
+
+// GetBrowseReports returns the reports of the last completed browse of a server, one per root.
+func GetBrowseReports(serverID int) []*opcuaclient.BrowseReport {
+	browseReportsMu.Lock()
+	defer browseReportsMu.Unlock()
+	return browseReports[serverID]
 }
 
 // ParseNodeIDString parses the string representation of a NodeID.
@@ -440,16 +899,173 @@ func ParseNodeIDString(nodeIDStr string) (*opcuaclient.NodeIDParts, error) {
 	return parts, nil
 }
 
-func insertNodesRecursively(db *sql.DB, nodes []opcuaclient.NodeDef, parentID string) ([]Node, error) {
+// RemapNamespaces moves the stored nodes of a server to the namespace indexes of the server's current
+// NamespaceArray, using the namespace URI stored with each node. This keeps the identity of
+// nodes and their history selection when the server reorders its namespaces. Nodes whose
+// namespace is no longer on the server keep their index. A node stored at the new node id of a
+// moved node is replaced by it. Moved nodes with history enabled are pending addition to the
+// Telegraf config again, so that updating the config writes their new index. It returns the
+// number of nodes moved.
+func RemapNamespaces(db *sql.DB, serverID int, namespaces []string) (int, error) {
+	rows, err := db.Query(`SELECT id, node_id, parent_id, COALESCE(other_parents, ''), COALESCE(namespace_uri, '') FROM nodes WHERE server_id = ?`, serverID)
+	if err != nil {
+		return 0, fmt.Errorf("querying nodes: %w", err)
+	}
+
+	type storedNode struct {
+		id           int
+		nodeID       string
+		parentID     string
+		otherParents []string
+		namespace    int
+	}
+	var nodes []*storedNode
+	remapped := map[string]string{}
+	for rows.Next() {
+		var n storedNode
+		var otherParents, uri string
+		if err := rows.Scan(&n.id, &n.nodeID, &n.parentID, &otherParents, &uri); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scanning node: %w", err)
+		}
+		n.otherParents = decodeStrings(otherParents)
+		n.namespace = -1
+		if newID, ns, ok := remapNodeID(n.nodeID, uri, namespaces); ok && newID != n.nodeID {
+			remapped[n.nodeID] = newID
+			n.namespace = ns
+		}
+		nodes = append(nodes, &n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("reading rows: %w", err)
+	}
+	if len(remapped) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Move the nodes out of the way first, so that swapped indexes do not collide on the unique node_id
+	for _, n := range nodes {
+		if _, ok := remapped[n.nodeID]; ok {
+			if _, err := tx.Exec(`UPDATE nodes SET node_id = ? WHERE id = ?`, fmt.Sprintf("remap:%d", n.id), n.id); err != nil {
+				return 0, fmt.Errorf("remapping node %s: %w", n.nodeID, err)
+			}
+		}
+	}
+	// A node left at a new node id, for example removed by an earlier import or stored without its
+	// namespace URI, is replaced by the moved node. The moved node keeps the history selection of
+	// the node it replaces.
+	for _, n := range nodes {
+		newID, ok := remapped[n.nodeID]
+		if !ok {
+			continue
+		}
+		var id int
+		var historyEnabled, removed bool
+		err := tx.QueryRow(`SELECT id, COALESCE(history_enabled, 0), COALESCE(removed, 0) FROM nodes WHERE server_id = ? AND node_id = ?`, serverID, newID).Scan(&id, &historyEnabled, &removed)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("querying node %s: %w", newID, err)
+		}
+		if !removed {
+			util.Logger.Warnf("Replacing node %s of server %d with %s, which moved to its namespace index", newID, serverID, n.nodeID)
+		}
+		if _, err := tx.Exec(`DELETE FROM nodes WHERE id = ?`, id); err != nil {
+			return 0, fmt.Errorf("deleting node %s: %w", newID, err)
+		}
+		if historyEnabled && !removed {
+			if _, err := tx.Exec(`UPDATE nodes SET history_enabled = 1 WHERE id = ?`, n.id); err != nil {
+				return 0, fmt.Errorf("keeping the history selection of node %s: %w", newID, err)
+			}
+		}
+	}
+
+	for _, n := range nodes {
+		newID, moved := remapped[n.nodeID]
+		parentID, parentMoved := remapped[n.parentID]
+		if !parentMoved {
+			parentID = n.parentID
+		}
+		otherParents := make([]string, len(n.otherParents))
+		otherMoved := false
+		for i, p := range n.otherParents {
+			otherParents[i] = p
+			if v, ok := remapped[p]; ok {
+				otherParents[i] = v
+				otherMoved = true
+			}
+		}
+		if !moved && !parentMoved && !otherMoved {
+			continue
+		}
+
+		if moved {
+			_, err = tx.Exec(`UPDATE nodes SET node_id = ?, namespace = ?, parent_id = ?, other_parents = ?, included_in_config = IF(history_enabled = 1, 0, included_in_config) WHERE id = ?`, newID, n.namespace, parentID, encodeStrings(otherParents), n.id)
+		} else {
+			_, err = tx.Exec(`UPDATE nodes SET parent_id = ?, other_parents = ? WHERE id = ?`, parentID, encodeStrings(otherParents), n.id)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("remapping node %s: %w", n.nodeID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("committing namespace remap: %w", err)
+	}
+	return len(remapped), nil
+}
+
+// remapNodeID returns nodeID with the index of the namespace uri in namespaces, and that index.
+// It reports false if the node has no namespace URI or the namespace is not on the server.
+func remapNodeID(nodeID, uri string, namespaces []string) (string, int, bool) {
+	if uri == "" {
+		return "", 0, false
+	}
+	ns := -1
+	for i, v := range namespaces {
+		if v == uri {
+			ns = i
+			break
+		}
+	}
+	if ns < 0 {
+		return "", 0, false
+	}
+
+	parts, err := ParseNodeIDString(nodeID)
+	if err != nil || parts.IdentifierType == "" {
+		return "", 0, false
+	}
+	if ns == 0 {
+		return fmt.Sprintf("%s=%s", parts.IdentifierType, parts.Identifier), ns, true
+	}
+	return fmt.Sprintf("ns=%d;%s=%s", ns, parts.IdentifierType, parts.Identifier), ns, true
+}
+
+// insertNodesRecursively stores the nodes and their descendants, browsed from root, below the
+// node parentID. It returns the nodes stored.
+func insertNodesRecursively(db *sql.DB, serverID int, nodes []opcuaclient.NodeDef, root, parentID string) ([]Node, error) {
 	var result []Node
 
 	for _, node := range nodes {
 		util.Logger.Debugf("Inserting node: %s", node.NodeID)
 		NodeID := node.NodeID.String()
 		node.NodeIDParts, _ = ParseNodeIDString(NodeID)
+		var dataTypeID string
+		if node.DataTypeID != nil {
+			dataTypeID = node.DataTypeID.String()
+		}
 
-		// Insert the current node, using the provided parentID
-		err := InsertOrUpdateNode(db, Node{
+		stored := Node{
+			ServerID:               serverID,
 			NodeID:                 node.NodeID.String(),
 			Namespace:              node.NodeIDParts.Namespace,
 			IdentifierType:         node.NodeIDParts.IdentifierType,
@@ -460,34 +1076,48 @@ func insertNodesRecursively(db *sql.DB, nodes []opcuaclient.NodeDef, parentID st
 			DataType:               node.DataType,
 			Writable:               node.Writable,
 			NodePath:               node.Path,
+			BrowseRoot:             root,
+			BrowsePath:             node.BrowsePath,
+			OtherParents:           node.OtherParents,
+			ReferenceType:          node.ReferenceType,
+			Unit:                   node.Unit,
+			EUMin:                  node.Min,
+			EUMax:                  node.Max,
+			InstrumentMin:          node.InstrumentMin,
+			InstrumentMax:          node.InstrumentMax,
+			Scale:                  node.Scale,
+			DataTypeName:           node.DataTypeName,
+			ValueRank:              node.ValueRank,
+			ArrayDimensions:        node.ArrayDims,
+			EnumValues:             node.EnumValues,
+			Storable:               node.Storable,
+			TypeWarning:            node.TypeWarning,
+			NamespaceURI:           node.NamespaceURI,
+			ExpandedNodeID:         opcuaclient.ExpandedNodeID(node.NodeID, node.NamespaceURI),
+			InputArguments:         node.InputArguments,
+			OutputArguments:        node.OutputArguments,
+			Historizing:            node.Historizing,
+			HistoryReadable:        node.HistoryReadable,
+			EventNotifier:          node.EventNotifier,
+			Description:            node.Description,
+			DataTypeID:             dataTypeID,
 			Removed:                false,
 			HistoryEnabled:         false,
 			HistoryEnabledInConfig: false,
 			DBActionRequired:       NoAction,
-		})
+		}
+
+		// Insert the current node, using the provided parentID
+		err := InsertOrUpdateNode(db, stored)
 		if err != nil {
 			return nil, err
 		}
 
 		// Add the current node to the result slice
-		result = append(result, Node{
-			NodeID:                 node.NodeID.String(),
-			Namespace:              node.NodeIDParts.Namespace,
-			IdentifierType:         node.NodeIDParts.IdentifierType,
-			Identifier:             node.NodeIDParts.Identifier,
-			ParentID:               parentID,
-			BrowseName:             node.BrowseName,
-			NodeClass:              node.NodeClass.String(),
-			DataType:               node.DataType,
-			Writable:               node.Writable,
-			NodePath:               node.Path,
-			HistoryEnabled:         false,
-			HistoryEnabledInConfig: false,
-			DBActionRequired:       NoAction,
-		})
+		result = append(result, stored)
 
 		// Recursively insert the children of the current node
-		children, err := insertNodesRecursively(db, node.Children, node.NodeID.String())
+		children, err := insertNodesRecursively(db, serverID, node.Children, root, node.NodeID.String())
 		if err != nil {
 			return nil, err
 		}
@@ -499,48 +1129,127 @@ func insertNodesRecursively(db *sql.DB, nodes []opcuaclient.NodeDef, parentID st
 	return result, nil
 }
 
-//func MarkRemovedNodes(db *sql.DB, opcuaNodes []Node) error {
-//	// Retrieve all nodes from the database
-//	dbNodes, err := LoadHierarchy(db)
-//	if err != nil {
-//		return fmt.Errorf("loading hierarchy from database: %w", err)
-//	}
-//
-//	// Convert OPC UA nodes to a map for efficient lookup
-//	opcuaNodeMap := make(map[string]struct{})
-//	for _, node := range opcuaNodes {
-//		opcuaNodeMap[node.NodeID] = struct{}{}
-//	}
-//
-//	util.Logger.Debugf("OPC UA Nodes: %v", opcuaNodeMap)
-//
-//	// Call the recursive function to mark nodes as removed
-//	err = markNodesRecursively(db, dbNodes, opcuaNodeMap)
-//	if err != nil {
-//		return err
-//	}
-//
-//	return nil
-//}
-
-//func markNodesRecursively(db *sql.DB, dbNodes []*Node, opcuaNodeMap map[string]struct{}) error {
-//	// Iterate over the database nodes
-//	for _, dbNode := range dbNodes {
-//		util.Logger.Debugf("Checking node: %s", dbNode.NodeID)
-//		// If a database node doesn't exist in the OPC UA nodes, mark it as removed
-//		if _, exists := opcuaNodeMap[dbNode.NodeID]; !exists {
-//			err := MarkNodeAsRemoved(db, dbNode.NodeID)
-//			if err != nil {
-//				return fmt.Errorf("marking node as removed: %w", err)
-//			}
-//		}
-//
-//		// Recursively check the children of the current node
-//		err := markNodesRecursively(db, dbNode.Children, opcuaNodeMap)
-//		if err != nil {
-//			return err
-//		}
-//	}
-//
-//	return nil
-//}
+// nodeState is the stored state of a node that a browse is compared against.
+type nodeState struct {
+	ParentID         string
+	BrowseName       string
+	DataType         string
+	NodePath         string
+	Removed          bool
+	IncludedInConfig bool
+}
+
+// loadNodeStates returns the state of every stored node of a server, including removed nodes, by node id.
+func loadNodeStates(db *sql.DB, serverID int) (map[string]nodeState, error) {
+	rows, err := db.Query(`SELECT node_id, parent_id, browse_name, data_type, node_path, removed, included_in_config FROM nodes WHERE server_id = ?`, serverID)
+	if err != nil {
+		return nil, fmt.Errorf("querying nodes: %w", err)
+	}
+	defer rows.Close()
+
+	states := map[string]nodeState{}
+	for rows.Next() {
+		var nodeID string
+		var s nodeState
+		var parentID, browseName, dataType, nodePath sql.NullString
+		var included sql.NullBool
+		if err := rows.Scan(&nodeID, &parentID, &browseName, &dataType, &nodePath, &s.Removed, &included); err != nil {
+			return nil, fmt.Errorf("scanning node: %w", err)
+		}
+		s.ParentID, s.BrowseName, s.DataType, s.NodePath = parentID.String, browseName.String, dataType.String, nodePath.String
+		s.IncludedInConfig = included.Bool
+		states[nodeID] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading rows: %w", err)
+	}
+	return states, nil
+}
+
+// ReconcileNodes compares the nodes found by a browse with the nodes stored before it, and marks
+// the stored nodes that were not found again as removed. Removed nodes that are in the Telegraf
+// config are left there, pending removal, until the config is next updated.
+func ReconcileNodes(db *sql.DB, serverID int, stored map[string]nodeState, browsed []Node) (*BrowseChanges, error) {
+	changes := diffNodes(stored, browsed)
+	for _, nodeID := range changes.Removed {
+		if err := MarkNodeAsRemoved(db, serverID, nodeID); err != nil {
+			return nil, fmt.Errorf("marking node %s as removed: %w", nodeID, err)
+		}
+	}
+
+	util.Logger.Infof("Browse found %d added, %d removed and %d changed nodes", len(changes.Added), len(changes.Removed), len(changes.Changed))
+	for _, nodeID := range changes.PendingRemoval {
+		util.Logger.Warnf("Node %s was removed from the server and is pending removal from the Telegraf config", nodeID)
+	}
+	return changes, nil
+}
+
+// diffNodes lists the nodes that were added, removed or changed since the stored state.
+// A removed node that is browsed again counts as added.
+func diffNodes(stored map[string]nodeState, browsed []Node) *BrowseChanges {
+	changes := &BrowseChanges{Added: []string{}, Removed: []string{}, Changed: []string{}, PendingRemoval: []string{}, Rebound: []PathBinding{}, Unresolved: []PathBinding{}}
+	found := map[string]bool{}
+	for _, n := range browsed {
+		found[n.NodeID] = true
+		s, ok := stored[n.NodeID]
+		switch {
+		case !ok || s.Removed:
+			changes.Added = append(changes.Added, n.NodeID)
+		case s.ParentID != n.ParentID || s.BrowseName != n.BrowseName || s.DataType != n.DataType || s.NodePath != n.NodePath:
+			changes.Changed = append(changes.Changed, n.NodeID)
+		}
+	}
+
+	for nodeID, s := range stored {
+		if s.Removed || found[nodeID] {
+			continue
+		}
+		changes.Removed = append(changes.Removed, nodeID)
+		if s.IncludedInConfig {
+			changes.PendingRemoval = append(changes.PendingRemoval, nodeID)
+		}
+	}
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.PendingRemoval)
+	return changes
+}
+
+// encodeStrings stores a list of strings as JSON in a single column.
+func encodeStrings(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+// encodeJSON stores a value as JSON in a single column, or an empty string if there is no value.
+func encodeJSON(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil || string(data) == "null" {
+		return ""
+	}
+	return string(data)
+}
+
+// decodeJSON reads a value stored by encodeJSON into v.
+func decodeJSON(value string, v interface{}) {
+	if value == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		util.Logger.Errorf("Invalid JSON column %q: %s", value, err)
+	}
+}
+
+// decodeStrings reads a list of strings stored by encodeStrings.
+func decodeStrings(value string) []string {
+	var values []string
+	if value == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(value), &values); err != nil {
+		util.Logger.Errorf("Invalid string list %q: %s", value, err)
+	}
+	return values
+}
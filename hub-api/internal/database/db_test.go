@@ -3,9 +3,128 @@ package database
 // Action represents the action required for a node in the database.
 
 import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
 )
 
-func TestYourFunction(t *testing.T) {
+func TestRemapNodeID(t *testing.T) {
+	namespaces := []string{"http://opcfoundation.org/UA/", "urn:server", "urn:plc"}
+	for _, tt := range []struct {
+		nodeID, uri string
+		want        string
+		ns          int
+		ok          bool
+	}{
+		{"ns=3;s=Temperature", "urn:plc", "ns=2;s=Temperature", 2, true},
+		{"ns=2;i=1001", "urn:plc", "ns=2;i=1001", 2, true},
+		{"ns=5;g=5eac051c-c313-43d7-b790-24fa2fe4d6a5", "urn:server", "ns=1;g=5eac051c-c313-43d7-b790-24fa2fe4d6a5", 1, true},
+		{"i=85", "http://opcfoundation.org/UA/", "i=85", 0, true},
+		{"ns=3;s=Temperature", "urn:gone", "", 0, false},
+		{"ns=3;s=Temperature", "", "", 0, false},
+	} {
+		got, ns, ok := remapNodeID(tt.nodeID, tt.uri, namespaces)
+		if got != tt.want || ns != tt.ns || ok != tt.ok {
+			t.Errorf("remapNodeID(%s, %s) = %s, %d, %t, want %s, %d, %t", tt.nodeID, tt.uri, got, ns, ok, tt.want, tt.ns, tt.ok)
+		}
+	}
+}
+
+func TestDiffNodes(t *testing.T) {
+	stored := map[string]nodeState{
+		"ns=2;s=Plant":       {ParentID: "ns=2;s=Plant", BrowseName: "Plant", NodePath: "Plant"},
+		"ns=2;s=Temperature": {ParentID: "ns=2;s=Plant", BrowseName: "Temperature", DataType: "float64", NodePath: "Plant.Temperature"},
+		"ns=2;s=Pressure":    {ParentID: "ns=2;s=Plant", BrowseName: "Pressure", DataType: "float64", NodePath: "Plant.Pressure", IncludedInConfig: true},
+		"ns=2;s=Level":       {ParentID: "ns=2;s=Plant", BrowseName: "Level", DataType: "float64", NodePath: "Plant.Level"},
+		"ns=2;s=Flow":        {ParentID: "ns=2;s=Plant", BrowseName: "Flow", DataType: "float64", NodePath: "Plant.Flow", Removed: true},
+		"ns=2;s=Old":         {ParentID: "ns=2;s=Plant", BrowseName: "Old", NodePath: "Plant.Old", Removed: true, IncludedInConfig: true},
+	}
+	browsed := []Node{
+		{NodeID: "ns=2;s=Plant", ParentID: "ns=2;s=Plant", BrowseName: "Plant", NodePath: "Plant"},
+		{NodeID: "ns=2;s=Temperature", ParentID: "ns=2;s=Plant", BrowseName: "Temperature", DataType: "float64", NodePath: "Plant.Temperature"},
+		{NodeID: "ns=2;s=Level", ParentID: "ns=2;s=Plant", BrowseName: "Level", DataType: "int32", NodePath: "Plant.Level"},
+		{NodeID: "ns=2;s=Flow", ParentID: "ns=2;s=Plant", BrowseName: "Flow", DataType: "float64", NodePath: "Plant.Flow"},
+		{NodeID: "ns=2;s=Speed", ParentID: "ns=2;s=Plant", BrowseName: "Speed", DataType: "float64", NodePath: "Plant.Speed"},
+	}
+
+	got := diffNodes(stored, browsed)
+	want := &BrowseChanges{
+		Added:          []string{"ns=2;s=Flow", "ns=2;s=Speed"},
+		Removed:        []string{"ns=2;s=Pressure"},
+		Changed:        []string{"ns=2;s=Level"},
+		PendingRemoval: []string{"ns=2;s=Pressure"},
+		Rebound:        []PathBinding{},
+		Unresolved:     []PathBinding{},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestValidateServer(t *testing.T) {
+	valid := Server{Name: "line2", Endpoint: "opc.tcp://line2:4840", RootNode: "i=85", SecurityPolicy: "None", SecurityMode: "None", AuthMethod: "Anonymous"}
+	if err := ValidateServer(valid); err != nil {
+		t.Fatalf("expected a valid server, got %s", err)
+	}
+	for name, change := range map[string]func(s *Server){
+		"name":         func(s *Server) { s.Name = " " },
+		"endpoint":     func(s *Server) { s.Endpoint = "http://line2:4840" },
+		"root node":    func(s *Server) { s.RootNode = "ns=x;i=85" },
+		"browse roots": func(s *Server) { s.BrowseRoots = "[{" },
+		"policy":       func(s *Server) { s.SecurityPolicy = "Basic512" },
+		"mode":         func(s *Server) { s.SecurityMode = "Encrypt" },
+		"policy None":  func(s *Server) { s.SecurityMode = "SignAndEncrypt" },
+		"mode None":    func(s *Server) { s.SecurityPolicy = "Basic256Sha256" },
+		"auth method":  func(s *Server) { s.AuthMethod = "Token" },
+	} {
+		s := valid
+		change(&s)
+		if err := ValidateServer(s); err == nil {
+			t.Errorf("expected an invalid %s to be refused", name)
+		}
+	}
+}
+
+func TestServerSecurityConfig(t *testing.T) {
+	config := util.Config{TelegrafOpcUaEndpoint: "opc.tcp://plc:4840", OpcUaPassword: "secret", OpcUaTrustedCertsDir: "pki/trusted", HubSecretKey: "key"}
+	sec, err := DefaultServer(config).SecurityConfig(config)
+	if err != nil || sec.Endpoint != "opc.tcp://plc:4840" || sec.Password != "secret" || sec.TrustedCertsDir != "pki/trusted" {
+		t.Errorf("unexpected settings of the default server %+v: %v", sec, err)
+	}
+
+	other := Server{ID: 2, Endpoint: "opc.tcp://line2:4840", AuthMethod: "UserName", Username: "operator"}
+	sec, err = other.SecurityConfig(config)
+	if err != nil || sec.Endpoint != "opc.tcp://line2:4840" || sec.Username != "operator" || sec.Password != "" || sec.TrustedCertsDir != "pki/trusted" {
+		t.Errorf("unexpected settings of server 2 %+v: %v", sec, err)
+	}
+
+	other.StoredPassword, err = encryptPassword(config, "line2 secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(other.StoredPassword, "line2 secret") || !strings.HasPrefix(other.StoredPassword, encryptedPasswordPrefix) {
+		t.Errorf("expected the password to be encrypted, got %q", other.StoredPassword)
+	}
+	if sec, err = other.SecurityConfig(config); err != nil || sec.Password != "line2 secret" {
+		t.Errorf("expected the stored password to be decrypted, got %q: %v", sec.Password, err)
+	}
+	config.HubSecretKey = "other key"
+	if _, err := other.SecurityConfig(config); err == nil {
+		t.Error("expected an error for a password encrypted with another key")
+	}
+	config.HubSecretKey = ""
+	if _, err := other.SecurityConfig(config); !errors.Is(err, ErrNoSecretKey) {
+		t.Errorf("expected ErrNoSecretKey, got %v", err)
+	}
+	if _, err := encryptPassword(config, "line2 secret"); !errors.Is(err, ErrNoSecretKey) {
+		t.Errorf("expected ErrNoSecretKey, got %v", err)
+	}
 
+	// Passwords stored before they were encrypted are used as they are
+	other.StoredPassword = "plain"
+	if sec, err = other.SecurityConfig(config); err != nil || sec.Password != "plain" {
+		t.Errorf("expected the plain text password, got %q: %v", sec.Password, err)
+	}
 }
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"database/sql"
+	"fmt"
+	"github.com/gopcua/opcua/ua"
+	"strings"
+)
+
+// ExportNodes returns the stored hierarchy of a server as node definitions. If root is not empty
+// only the subtree of that node is returned, and if historyOnly is set only the nodes with history
+// enabled and their ancestors.
+func ExportNodes(db *sql.DB, serverID int, root string, historyOnly bool) ([]opcuaclient.NodeDef, error) {
+	nodes, err := LoadHierarchy(db, serverID)
+	if err != nil {
+		return nil, err
+	}
+	if root != "" {
+		n := findNode(nodes, root)
+		if n == nil {
+			return nil, fmt.Errorf("%w: %s", ErrNodeNotFound, root)
+		}
+		nodes = []*Node{n}
+	}
+	if historyOnly {
+		nodes = historyTree(nodes)
+	}
+
+	defs := make([]opcuaclient.NodeDef, 0, len(nodes))
+	for _, n := range nodes {
+		def, err := n.NodeDef()
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, def)
+	}
+	return defs, nil
+}
+
+// findNode returns the node with nodeID in the tree of nodes, or nil.
+func findNode(nodes []*Node, nodeID string) *Node {
+	for _, n := range nodes {
+		if n.NodeID == nodeID {
+			return n
+		}
+		if found := findNode(n.Children, nodeID); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// historyTree returns copies of the nodes that have history enabled or a descendant that has,
+// keeping only those children.
+func historyTree(nodes []*Node) []*Node {
+	var result []*Node
+	for _, n := range nodes {
+		children := historyTree(n.Children)
+		if !n.HistoryEnabled && len(children) == 0 {
+			continue
+		}
+		c := *n
+		c.Children = children
+		result = append(result, &c)
+	}
+	return result
+}
+
+// NodeDef returns the definition of the stored node and its children, as the browse found it.
+func (n *Node) NodeDef() (opcuaclient.NodeDef, error) {
+	nodeID, err := ua.ParseNodeID(n.NodeID)
+	if err != nil {
+		return opcuaclient.NodeDef{}, fmt.Errorf("parsing node id %s: %w", n.NodeID, err)
+	}
+	nodeClass, err := opcuaclient.ParseNodeClasses([]string{strings.TrimPrefix(n.NodeClass, "NodeClass")})
+	if err != nil {
+		return opcuaclient.NodeDef{}, fmt.Errorf("node %s: %w", n.NodeID, err)
+	}
+	def := opcuaclient.NodeDef{
+		NodeID:          nodeID,
+		NamespaceURI:    n.NamespaceURI,
+		NodeClass:       nodeClass,
+		BrowseName:      n.BrowseName,
+		Description:     n.Description,
+		Path:            n.NodePath,
+		DataType:        n.DataType,
+		DataTypeName:    n.DataTypeName,
+		ValueRank:       n.ValueRank,
+		ArrayDims:       n.ArrayDimensions,
+		EnumValues:      n.EnumValues,
+		Storable:        n.Storable,
+		TypeWarning:     n.TypeWarning,
+		Writable:        n.Writable,
+		Historizing:     n.Historizing,
+		HistoryReadable: n.HistoryReadable,
+		EventNotifier:   n.EventNotifier,
+		Unit:            n.Unit,
+		Scale:           n.Scale,
+		Min:             n.EUMin,
+		Max:             n.EUMax,
+		InstrumentMin:   n.InstrumentMin,
+		InstrumentMax:   n.InstrumentMax,
+		OtherParents:    n.OtherParents,
+		ReferenceType:   n.ReferenceType,
+		InputArguments:  n.InputArguments,
+		OutputArguments: n.OutputArguments,
+	}
+	def.NodeIDParts, _ = ParseNodeIDString(n.NodeID)
+	if n.DataTypeID != "" {
+		def.DataTypeID, err = ua.ParseNodeID(n.DataTypeID)
+		if err != nil {
+			return def, fmt.Errorf("parsing data type of node %s: %w", n.NodeID, err)
+		}
+	}
+	if nodeClass == ua.NodeClassVariable {
+		def.AccessLevel = ua.AccessLevelTypeCurrentRead
+		if n.Writable {
+			def.AccessLevel |= ua.AccessLevelTypeCurrentWrite
+		}
+		if n.HistoryReadable {
+			def.AccessLevel |= ua.AccessLevelTypeHistoryRead
+		}
+	}
+
+	for _, child := range n.Children {
+		c, err := child.NodeDef()
+		if err != nil {
+			return def, err
+		}
+		def.Children = append(def.Children, c)
+	}
+	return def, nil
+}
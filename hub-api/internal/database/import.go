@@ -0,0 +1,121 @@
+package database
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInvalidImport is returned when an imported document cannot be read.
+var ErrInvalidImport = errors.New("invalid import")
+
+// ImportNodeSet2 builds the hierarchy of a server from a NodeSet2 document instead of the server
+// itself. The document is browsed from the roots configured for the server, and the nodes found
+// are stored like those of a browse of the server. Namespaces the server's stored nodes already
+// use keep their index; other namespaces of the document get the next free indexes, which the
+// first browse of the server moves to its actual indexes. The browse settings other than the
+// roots are those of config. It returns the number of nodes stored.
+func ImportNodeSet2(ctx context.Context, db *sql.DB, config util.Config, serverID int, r io.Reader) (int, error) {
+	s, err := GetServer(db, serverID)
+	if err != nil {
+		return 0, err
+	}
+	namespaces, err := storedNamespaces(db, serverID)
+	if err != nil {
+		return 0, err
+	}
+	set, err := opcuaclient.ReadNodeSet2(r, namespaces)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+
+	config = s.BrowseConfig(config)
+	// The document is in memory, so there is nothing to throttle
+	config.OpcUaBrowseRequestsPerSecond = "0"
+	util.Logger.Infof("Importing a NodeSet2 document into server %s", s.Name)
+	return storeBrowse(ctx, db, set, s, config, nil)
+}
+
+// ImportSnapshot builds the hierarchy of a server from the node definitions of a JSON export.
+// Every top level definition is stored as a root. It returns the number of nodes stored.
+func ImportSnapshot(db *sql.DB, serverID int, r io.Reader) (int, error) {
+	s, err := GetServer(db, serverID)
+	if err != nil {
+		return 0, err
+	}
+	var roots []opcuaclient.NodeDef
+	if err := json.NewDecoder(r).Decode(&roots); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	if err := checkSnapshot(roots); err != nil {
+		return 0, err
+	}
+
+	util.Logger.Infof("Importing a snapshot of %d roots into server %s", len(roots), s.Name)
+	stored, err := loadNodeStates(db, s.ID)
+	if err != nil {
+		return 0, err
+	}
+	var browsed []Node
+	for _, root := range roots {
+		nodes, err := insertNodesRecursively(db, s.ID, []opcuaclient.NodeDef{root}, root.NodeID.String(), root.NodeID.String())
+		if err != nil {
+			return len(browsed), err
+		}
+		browsed = append(browsed, nodes...)
+	}
+	changes, err := ReconcileNodes(db, s.ID, stored, browsed)
+	if err != nil {
+		return len(browsed), err
+	}
+	setBrowseChanges(s.ID, changes)
+	return len(browsed), nil
+}
+
+// checkSnapshot checks that every node of a snapshot has a node id.
+func checkSnapshot(nodes []opcuaclient.NodeDef) error {
+	for _, n := range nodes {
+		if n.NodeID == nil {
+			return fmt.Errorf("%w: node %q has no node id", ErrInvalidImport, n.BrowseName)
+		}
+		if err := checkSnapshot(n.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedNamespaces returns the namespace URIs of the stored nodes of a server by index, with
+// empty entries for the indexes no node uses.
+func storedNamespaces(db *sql.DB, serverID int) ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT COALESCE(namespace, -1), namespace_uri FROM nodes WHERE server_id = ? AND removed = 0 AND namespace_uri <> ''`, serverID)
+	if err != nil {
+		return nil, fmt.Errorf("querying namespaces: %w", err)
+	}
+	defer rows.Close()
+
+	var namespaces []string
+	for rows.Next() {
+		var ns int
+		var uri string
+		if err := rows.Scan(&ns, &uri); err != nil {
+			return nil, fmt.Errorf("scanning namespace: %w", err)
+		}
+		if ns < 0 {
+			continue
+		}
+		for len(namespaces) <= ns {
+			namespaces = append(namespaces, "")
+		}
+		namespaces[ns] = uri
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading rows: %w", err)
+	}
+	return namespaces, nil
+}
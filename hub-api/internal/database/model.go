@@ -1,5 +1,7 @@
 package database
 
+import "OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+
 const (
 	NoAction Action = iota
 	Added
@@ -28,20 +30,47 @@ func (a Action) String() string {
 // Node represents a node in the OPC UA hierarchy.
 type Node struct {
 	ID                     int
+	ServerID               int
 	NodeID                 string
 	ParentID               string
 	BrowseName             string
+	Description            string
 	NodeClass              string
 	DataType               string
+	DataTypeID             string
+	DataTypeName           string
+	ValueRank              int32
+	ArrayDimensions        []uint32
+	EnumValues             map[int64]string
+	Storable               bool
+	TypeWarning            string
 	Writable               bool
+	Historizing            bool
+	HistoryReadable        bool
+	EventNotifier          bool
 	HistoryEnabled         bool
 	LastUpdated            string
 	Removed                bool
 	Children               []*Node
 	Namespace              int
+	NamespaceURI           string
+	ExpandedNodeID         string
 	IdentifierType         string
 	Identifier             string
 	NodePath               string
+	BrowseRoot             string
+	BrowsePath             []string
+	BindPath               bool
+	OtherParents           []string
+	ReferenceType          string
+	InputArguments         []opcuaclient.MethodArgument
+	OutputArguments        []opcuaclient.MethodArgument
+	Unit                   string
+	EUMin                  string
+	EUMax                  string
+	InstrumentMin          string
+	InstrumentMax          string
+	Scale                  string
 	HistoryEnabledInConfig bool
 	DBActionRequired       Action
 }
@@ -64,3 +93,51 @@ func FilterNodesByAction(nodes []*Node, actions []Action) []*Node {
 
 	return filteredNodes
 }
+
+// BrowseChanges lists the node ids that a browse added, removed or changed compared to the stored nodes.
+type BrowseChanges struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+	// PendingRemoval are the removed nodes that are still in the Telegraf config.
+	PendingRemoval []string `json:"pendingRemoval"`
+	// Rebound are the selections bound to a browse path that moved to a new node id, and
+	// Unresolved those whose browse path no longer resolves.
+	Rebound    []PathBinding `json:"rebound"`
+	Unresolved []PathBinding `json:"unresolved"`
+}
+
+// NodeWrite records a value written to a node, with the values encoded as JSON.
+type NodeWrite struct {
+	ID         int    `json:"id"`
+	NodeID     string `json:"nodeID"`
+	OldValue   string `json:"oldValue"`
+	NewValue   string `json:"newValue"`
+	StatusCode string `json:"statusCode"`
+	Error      string `json:"error,omitempty"`
+	Caller     string `json:"caller"`
+	RemoteAddr string `json:"remoteAddr"`
+	WrittenAt  string `json:"writtenAt"`
+}
+
+// Server is an OPC UA server managed by the hub. Its nodes are stored with its id and written
+// to their own inputs.opcua section of the Telegraf config. The password is never returned by
+// the API, HasPassword tells whether one is stored. Password is only set to store a new password,
+// servers read from the table have the stored password, encrypted with HUB_SECRET_KEY, in
+// StoredPassword.
+type Server struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Endpoint       string `json:"endpoint"`
+	RootNode       string `json:"rootNode"`
+	BrowseRoots    string `json:"browseRoots,omitempty"`
+	SecurityPolicy string `json:"securityPolicy"`
+	SecurityMode   string `json:"securityMode"`
+	AuthMethod     string `json:"authMethod"`
+	Username       string `json:"username,omitempty"`
+	Password       string `json:"password,omitempty"`
+	StoredPassword string `json:"-"`
+	HasPassword    bool   `json:"hasPassword"`
+	Enabled        bool   `json:"enabled"`
+	CreatedAt      string `json:"createdAt"`
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedPasswordPrefix marks the passwords in the servers table that are encrypted with
+// HUB_SECRET_KEY. Passwords stored before they were encrypted have no prefix.
+const encryptedPasswordPrefix = "aes256gcm:"
+
+// ErrNoSecretKey is returned when a password is stored or read without HUB_SECRET_KEY.
+var ErrNoSecretKey = errors.New("HUB_SECRET_KEY is not set")
+
+// passwordCipher returns the AES-256-GCM cipher keyed with the SHA-256 hash of HUB_SECRET_KEY.
+func passwordCipher(config util.Config) (cipher.AEAD, error) {
+	if config.HubSecretKey == "" {
+		return nil, ErrNoSecretKey
+	}
+	key := sha256.Sum256([]byte(config.HubSecretKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptPassword returns a password as it is stored in the servers table: encrypted with a
+// random nonce, which is stored in front of it.
+func encryptPassword(config util.Config, password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	aead, err := passwordCipher(config)
+	if err != nil {
+		return "", fmt.Errorf("encrypting password: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("encrypting password: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(password), nil)
+	return encryptedPasswordPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptPassword returns the password stored in the servers table. A password stored before
+// passwords were encrypted is returned as it is.
+func decryptPassword(config util.Config, stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedPasswordPrefix) {
+		return stored, nil
+	}
+	aead, err := passwordCipher(config)
+	if err != nil {
+		return "", fmt.Errorf("decrypting password: %w", err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedPasswordPrefix))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("decrypting password: invalid encrypted password")
+	}
+	password, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting password, was HUB_SECRET_KEY changed?: %w", err)
+	}
+	return string(password), nil
+}
+
+// encryptStoredPasswords encrypts the passwords stored in plain text before passwords were
+// encrypted. Without HUB_SECRET_KEY they are left as they are, with a warning.
+func encryptStoredPasswords(db *sql.DB, config util.Config) error {
+	rows, err := db.Query(`SELECT id, password FROM servers WHERE password <> '' AND password NOT LIKE ?`, encryptedPasswordPrefix+"%")
+	if err != nil {
+		return fmt.Errorf("querying passwords: %w", err)
+	}
+	passwords := map[int]string{}
+	for rows.Next() {
+		var id int
+		var password string
+		if err := rows.Scan(&id, &password); err != nil {
+			rows.Close()
+			return fmt.Errorf("scanning password: %w", err)
+		}
+		passwords[id] = password
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("reading rows: %w", err)
+	}
+	if len(passwords) == 0 {
+		return nil
+	}
+	if config.HubSecretKey == "" {
+		util.Logger.Warnf("The passwords of %d servers are stored in plain text, set HUB_SECRET_KEY to encrypt them", len(passwords))
+		return nil
+	}
+
+	for id, password := range passwords {
+		encrypted, err := encryptPassword(config, password)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(`UPDATE servers SET password = ? WHERE id = ?`, encrypted, id); err != nil {
+			return fmt.Errorf("encrypting password of server %d: %w", id, err)
+		}
+	}
+	util.Logger.Infof("Encrypted the passwords of %d servers", len(passwords))
+	return nil
+}
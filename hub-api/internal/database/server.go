@@ -0,0 +1,273 @@
+package database
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gopcua/opcua/ua"
+	"strings"
+)
+
+// DefaultServerID is the id of the server created from TELEGRAF_OPCUA_ENDPOINT and ROOT_NODE
+// when the hub first starts. Nodes stored before servers existed belong to it, and requests
+// that do not name a server use it.
+const DefaultServerID = 1
+
+// ErrServerNotFound is returned when a server is not stored.
+var ErrServerNotFound = errors.New("server not found")
+
+// ErrServerDisabled is returned when connecting to a server that is disabled.
+var ErrServerDisabled = errors.New("server is disabled")
+
+// ErrServerInUse is returned when deleting a server whose nodes are in the Telegraf config.
+var ErrServerInUse = errors.New("server has nodes in the Telegraf config")
+
+// DefaultServer returns the server configured in the environment.
+func DefaultServer(config util.Config) Server {
+	return Server{
+		ID:             DefaultServerID,
+		Name:           "default",
+		Endpoint:       config.TelegrafOpcUaEndpoint,
+		RootNode:       config.RootNode,
+		BrowseRoots:    config.OpcUaBrowseRoots,
+		SecurityPolicy: config.OpcUaSecurityPolicy,
+		SecurityMode:   config.OpcUaSecurityMode,
+		AuthMethod:     config.OpcUaAuthMethod,
+		Username:       config.OpcUaUsername,
+		Enabled:        true,
+	}
+}
+
+// ensureDefaultServer stores the default server if no server is stored yet. Its password is
+// not stored, OPCUA_PASSWORD is used instead.
+func ensureDefaultServer(db *sql.DB, config util.Config) error {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM servers`).Scan(&count); err != nil {
+		return fmt.Errorf("counting servers: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	util.Logger.Infof("Adding default server %s", config.TelegrafOpcUaEndpoint)
+	s := DefaultServer(config)
+	_, err := db.Exec(`INSERT INTO servers (id, name, endpoint, root_node, browse_roots, security_policy, security_mode, auth_method, username, password, enabled) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, '', 1)`,
+		s.ID, s.Name, s.Endpoint, s.RootNode, s.BrowseRoots, s.SecurityPolicy, s.SecurityMode, s.AuthMethod, s.Username)
+	if err != nil {
+		return fmt.Errorf("adding default server: %w", err)
+	}
+	return nil
+}
+
+// ValidateServer checks the settings of a server before it is stored.
+func ValidateServer(s Server) error {
+	if strings.TrimSpace(s.Name) == "" {
+		return errors.New("a name is required")
+	}
+	if !strings.HasPrefix(s.Endpoint, "opc.tcp://") {
+		return fmt.Errorf("invalid endpoint %q, expected opc.tcp://host:port", s.Endpoint)
+	}
+	if s.RootNode == "" {
+		return errors.New("a root node is required")
+	}
+	if _, err := ua.ParseNodeID(s.RootNode); err != nil {
+		return fmt.Errorf("invalid root node %q: %w", s.RootNode, err)
+	}
+	if s.BrowseRoots != "" && !json.Valid([]byte(s.BrowseRoots)) {
+		return errors.New("browse roots must be a JSON array")
+	}
+	if _, _, err := opcuaclient.ParseSecurity(s.SecurityPolicy, s.SecurityMode); err != nil {
+		return err
+	}
+	if _, err := opcuaclient.ParseAuthMethod(s.AuthMethod); err != nil {
+		return err
+	}
+	return nil
+}
+
+// serverColumns are the columns read by scanServer.
+const serverColumns = `id, name, endpoint, root_node, COALESCE(browse_roots, ''), security_policy, security_mode, auth_method, COALESCE(username, ''), COALESCE(password, ''), enabled, created_at`
+
+// scanServer reads a server selected with serverColumns.
+func scanServer(row rowScanner) (*Server, error) {
+	var s Server
+	err := row.Scan(&s.ID, &s.Name, &s.Endpoint, &s.RootNode, &s.BrowseRoots, &s.SecurityPolicy, &s.SecurityMode, &s.AuthMethod, &s.Username, &s.StoredPassword, &s.Enabled, &s.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	s.HasPassword = s.StoredPassword != ""
+	return &s, nil
+}
+
+// GetServers returns all servers ordered by id.
+func GetServers(db *sql.DB) ([]*Server, error) {
+	rows, err := db.Query(`SELECT ` + serverColumns + ` FROM servers ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("querying servers: %w", err)
+	}
+	defer rows.Close()
+
+	servers := []*Server{}
+	for rows.Next() {
+		s, err := scanServer(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scanning server: %w", err)
+		}
+		servers = append(servers, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading rows: %w", err)
+	}
+	return servers, nil
+}
+
+// GetServer returns the server with the given id.
+func GetServer(db *sql.DB, id int) (*Server, error) {
+	s, err := scanServer(db.QueryRow(`SELECT `+serverColumns+` FROM servers WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrServerNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying server %d: %w", id, err)
+	}
+	return s, nil
+}
+
+// InsertServer stores a new server and returns its id. Its password is encrypted with
+// HUB_SECRET_KEY, ErrNoSecretKey is returned for a password without it.
+func InsertServer(db *sql.DB, config util.Config, s Server) (int, error) {
+	password, err := encryptPassword(config, s.Password)
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec(`INSERT INTO servers (name, endpoint, root_node, browse_roots, security_policy, security_mode, auth_method, username, password, enabled) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.Name, s.Endpoint, s.RootNode, s.BrowseRoots, s.SecurityPolicy, s.SecurityMode, s.AuthMethod, s.Username, password, s.Enabled)
+	if err != nil {
+		return 0, fmt.Errorf("inserting server: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("inserting server: %w", err)
+	}
+	return int(id), nil
+}
+
+// UpdateServer stores the settings of a server. The stored password is kept when s has none, a
+// new one is encrypted as by InsertServer.
+func UpdateServer(db *sql.DB, config util.Config, s Server) error {
+	password, err := encryptPassword(config, s.Password)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec(`UPDATE servers SET name = ?, endpoint = ?, root_node = ?, browse_roots = ?, security_policy = ?, security_mode = ?, auth_method = ?, username = ?, password = IF(? = '', password, ?), enabled = ? WHERE id = ?`,
+		s.Name, s.Endpoint, s.RootNode, s.BrowseRoots, s.SecurityPolicy, s.SecurityMode, s.AuthMethod, s.Username, password, password, s.Enabled, s.ID)
+	if err != nil {
+		return fmt.Errorf("updating server %d: %w", s.ID, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		if _, err := GetServer(db, s.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteServer deletes a server with its nodes and recorded writes. A server whose nodes have
+// history enabled or are still in the Telegraf config cannot be deleted.
+func DeleteServer(db *sql.DB, id int) error {
+	if _, err := GetServer(db, id); err != nil {
+		return err
+	}
+	var inUse int
+	err := db.QueryRow(`SELECT COUNT(*) FROM nodes WHERE server_id = ? AND (history_enabled = 1 OR included_in_config = 1)`, id).Scan(&inUse)
+	if err != nil {
+		return fmt.Errorf("checking nodes of server %d: %w", id, err)
+	}
+	if inUse > 0 {
+		return fmt.Errorf("%w: disable the history of its %d nodes and update the config first", ErrServerInUse, inUse)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, statement := range []string{
+		`DELETE FROM nodes WHERE server_id = ?`,
+		`DELETE FROM node_writes WHERE server_id = ?`,
+		`DELETE FROM servers WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(statement, id); err != nil {
+			return fmt.Errorf("deleting server %d: %w", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("deleting server %d: %w", id, err)
+	}
+	setBrowseReports(id, nil)
+	setBrowseChanges(id, nil)
+	return nil
+}
+
+// SecurityConfig returns the settings used to connect to the server, with its password or else
+// its stored password decrypted. The client certificate and trust lists of the hub are shared by
+// all servers. The default server uses OPCUA_PASSWORD unless a password is stored for it.
+func (s Server) SecurityConfig(config util.Config) (opcuaclient.SecurityConfig, error) {
+	sec := opcuaclient.NewSecurityConfig(config)
+	sec.Endpoint = s.Endpoint
+	sec.SecurityPolicy = s.SecurityPolicy
+	sec.SecurityMode = s.SecurityMode
+	sec.AuthMethod = s.AuthMethod
+	sec.Username = s.Username
+	sec.Password = s.Password
+	if sec.Password == "" {
+		password, err := decryptPassword(config, s.StoredPassword)
+		if err != nil {
+			return opcuaclient.SecurityConfig{}, fmt.Errorf("server %s: %w", s.Name, err)
+		}
+		sec.Password = password
+	}
+	if s.ID == DefaultServerID && sec.Password == "" {
+		sec.Password = config.OpcUaPassword
+	}
+	return sec, nil
+}
+
+// BrowseConfig returns config with the root node and browse roots of the server.
+func (s Server) BrowseConfig(config util.Config) util.Config {
+	config.RootNode = s.RootNode
+	config.OpcUaBrowseRoots = s.BrowseRoots
+	return config
+}
+
+// LookupServerSecurity returns the settings used to connect to an enabled server stored in db,
+// with the client certificate and trust settings of config, for opcuaclient.NewSessionPool.
+func LookupServerSecurity(ctx context.Context, db *sql.DB, config util.Config, id int) (opcuaclient.SecurityConfig, error) {
+	s, err := GetServer(db, id)
+	if err != nil {
+		return opcuaclient.SecurityConfig{}, err
+	}
+	if !s.Enabled {
+		return opcuaclient.SecurityConfig{}, fmt.Errorf("%w: %s", ErrServerDisabled, s.Name)
+	}
+	return s.SecurityConfig(config)
+}
+
+// EnabledServerIDs returns the ids of the enabled servers stored in db, for example to check
+// their health.
+func EnabledServerIDs(ctx context.Context, db *sql.DB) ([]int, error) {
+	servers, err := GetServers(db)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, s := range servers {
+		if s.Enabled {
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,56 @@
+package hubtest
+
+import (
+	"fmt"
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	"github.com/dolthub/go-mysql-server/sql"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// databaseName is the name of the database created by StartDatabase.
+const databaseName = "opcua"
+
+// StartDatabase starts an in-memory MySQL compatible server with an empty database and points the
+// DB_* environment variables at it, so that database.LoadDatabase connects to it. The server is
+// stopped when the test ends.
+func StartDatabase(t testing.TB) {
+	t.Helper()
+
+	// The server logs every connection and query to the standard logger
+	logrus.SetLevel(logrus.ErrorLevel)
+
+	db := memory.NewDatabase(databaseName)
+	db.BaseDatabase.EnablePrimaryKeyIndexes()
+	provider := memory.NewDBProvider(db)
+	engine := sqle.NewDefault(provider)
+
+	port := freePort(t)
+	s, err := server.NewServer(server.Config{Protocol: "tcp", Address: fmt.Sprintf("127.0.0.1:%d", port)}, engine, sql.NewContext, memory.NewSessionBuilder(provider), nil)
+	if err != nil {
+		t.Fatalf("starting the database: %v", err)
+	}
+	go s.Start()
+	t.Cleanup(func() { s.Close() })
+
+	t.Setenv("DB_HOST", "127.0.0.1")
+	t.Setenv("DB_PORT", strconv.Itoa(port))
+	t.Setenv("DB_USER", "root")
+	t.Setenv("DB_PASSWORD", "")
+	t.Setenv("DB_NAME", databaseName)
+}
+
+// freePort returns a TCP port that is free on the loopback interface.
+func freePort(t testing.TB) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("finding a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
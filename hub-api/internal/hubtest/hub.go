@@ -0,0 +1,138 @@
+// Package hubtest runs the hub against an in-process OPC UA server, an in-memory database and a
+// Telegraf config in a temporary directory, so that tests need neither Docker nor a network.
+package hubtest
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/browsejob"
+	"OpcUaTimeSeriesHub/hub-api/internal/configupdate"
+	"OpcUaTimeSeriesHub/hub-api/internal/database"
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Hub is the state shared by the API handlers of a hub started by StartHub.
+type Hub struct {
+	// Server is the OPC UA server of the default server of the hub.
+	Server *Server
+	// ConfigFile is the Telegraf config written by the hub.
+	ConfigFile string
+	// Config holds the settings of the hub, loaded once from its environment.
+	Config util.Config
+	// DB is the database handle shared by the hub.
+	DB        *sql.DB
+	Pool      *opcuaclient.SessionPool
+	Scheduler *browsejob.Scheduler
+	// Health reads the health of the servers on request only.
+	Health *opcuaclient.HealthMonitor
+}
+
+// environment are the settings of a hub started by StartHub, apart from the database, the OPC UA
+// server and the Telegraf config file.
+var environment = map[string]string{
+	"TELEGRAF_INTERVAL":             "10s",
+	"TELEGRAF_ROUND_INTERVAL":       "true",
+	"TELEGRAF_METRIC_BATCH_SIZE":    "1000",
+	"TELEGRAF_METRIC_BUFFER_LIMIT":  "10000",
+	"TELEGRAF_COLLECTION_JITTER":    "0s",
+	"TELEGRAF_FLUSH_INTERVAL":       "10s",
+	"TELEGRAF_FLUSH_JITTER":         "0s",
+	"TELEGRAF_PRECISION":            "0s",
+	"TELEGRAF_INFLUX_URL":           "http://127.0.0.1:1",
+	"TELEGRAF_INFLUX_TOKEN":         "token",
+	"TELEGRAF_INFLUX_ORG":           "org",
+	"TELEGRAF_INFLUX_BUCKET":        "bucket",
+	"TELEGRAF_PER_CPU":              "false",
+	"TELEGRAF_TOTAL_CPU":            "true",
+	"TELEGRAF_COLLECT_CPU_TIME":     "false",
+	"TELEGRAF_REPORT_ACTIVE":        "false",
+	"TELEGRAF_CORE_TAGS":            "false",
+	"OPCUA_BROWSE_INTERVAL":         "0",
+	"OPCUA_BROWSE_WORKERS":          "1",
+	"OPCUA_KEEPALIVE_INTERVAL":      "1s",
+	"OPCUA_RECONNECT_MIN_INTERVAL":  "100ms",
+	"OPCUA_RECONNECT_MAX_INTERVAL":  "1s",
+	"OPCUA_GENERATE_CERTIFICATE":    "false",
+	"OPCUA_AUTO_ACCEPT_SERVER_CERT": "false",
+	"HUB_SECRET_KEY":                "hubtest",
+}
+
+// StartHub starts an OPC UA server with nodes and a database, points the environment at them
+// and at a new Telegraf config and log file in a temporary directory, and creates the tables and
+// the default server as the hub does at startup. The browse scheduler is started without
+// browsing at an interval, so the nodes are browsed once in the background. Everything is
+// stopped when the test ends.
+func StartHub(t testing.TB, nodes ...Node) *Hub {
+	t.Helper()
+
+	srv := StartServer(t, nodes...)
+	StartDatabase(t)
+
+	dir := t.TempDir()
+	for key, value := range environment {
+		t.Setenv(key, value)
+	}
+	t.Setenv("LOG_FILE_PATH", filepath.Join(dir, "hub.log"))
+	t.Setenv("TELEGRAF_CONFIG_FILE", filepath.Join(dir, "telegraf.conf"))
+	t.Setenv("TELEGRAF_OPCUA_ENDPOINT", srv.Endpoint)
+	t.Setenv("ROOT_NODE", srv.NodeID())
+	t.Setenv("OPCUA_CERTIFICATE_FILE", filepath.Join(dir, "pki", "own", "cert.pem"))
+	t.Setenv("OPCUA_PRIVATE_KEY_FILE", filepath.Join(dir, "pki", "own", "key.pem"))
+	t.Setenv("OPCUA_TRUSTED_CERTS_DIR", filepath.Join(dir, "pki", "trusted"))
+	t.Setenv("OPCUA_REJECTED_CERTS_DIR", filepath.Join(dir, "pki", "rejected"))
+	config := util.LoadConfig()
+
+	if err := configupdate.CreateConfig(config.TelegrafConfigPath); err != nil {
+		t.Fatalf("creating the Telegraf config: %v", err)
+	}
+	db, err := database.InitDB(config, false)
+	if err != nil {
+		t.Fatalf("initializing the database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	opts, err := opcuaclient.NewSessionOptions(config)
+	if err != nil {
+		t.Fatalf("invalid session options: %v", err)
+	}
+	eventFilter, err := opcuaclient.NewEventFilterConfig(config)
+	if err != nil {
+		t.Fatalf("invalid event filter: %v", err)
+	}
+	pool := opcuaclient.NewSessionPool(func(ctx context.Context, id int) (opcuaclient.SecurityConfig, error) {
+		return database.LookupServerSecurity(ctx, db, config, id)
+	}, opts, 100*time.Millisecond, eventFilter, func(int, []opcuaclient.Event) {})
+	t.Cleanup(func() { pool.Close(context.Background(), database.DefaultServerID) })
+
+	scheduler := browsejob.NewScheduler(func(ctx context.Context, serverID int, progress func(nodes int)) error {
+		return database.UpdateHierarchy(ctx, db, pool, config, serverID, progress)
+	}, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	scheduler.Start(ctx)
+	t.Cleanup(cancel)
+
+	health := opcuaclient.NewHealthMonitor(pool, func(ctx context.Context) ([]int, error) {
+		return database.EnabledServerIDs(ctx, db)
+	}, 0, nil)
+
+	return &Hub{Server: srv, ConfigFile: config.TelegrafConfigPath, Config: config, DB: db, Pool: pool, Scheduler: scheduler, Health: health}
+}
+
+// WaitForBrowse waits until no browse is running and returns the last finished job.
+func (h *Hub) WaitForBrowse(t testing.TB) browsejob.Job {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		jobs := h.Scheduler.Jobs()
+		if len(jobs) > 0 && jobs[0].State != browsejob.StateRunning {
+			return jobs[0]
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("browse did not finish in time")
+	return browsejob.Job{}
+}
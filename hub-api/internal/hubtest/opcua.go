@@ -0,0 +1,459 @@
+package hubtest
+
+import (
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/server"
+	"github.com/gopcua/opcua/server/attrs"
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uasc"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// NamespaceURI is the URI of the namespace holding the nodes of the test server.
+const NamespaceURI = "urn:opc-ua-time-series-hub:test"
+
+// Node is a node in the address space of a test server. A node with a Value is a Variable, any
+// other node is an Object organizing its Children.
+type Node struct {
+	Name     string
+	Value    interface{}
+	Writable bool
+	Children []Node
+}
+
+// Folder returns an Object node organizing children.
+func Folder(name string, children ...Node) Node {
+	return Node{Name: name, Children: children}
+}
+
+// Variable returns a read only Variable node holding value. The data type of the node is the
+// builtin type of value.
+func Variable(name string, value interface{}) Node {
+	return Node{Name: name, Value: value}
+}
+
+// Server is an OPC UA server started by StartServer.
+type Server struct {
+	// Endpoint is the URL clients connect to.
+	Endpoint string
+	// Namespace is the index of NamespaceURI on the server.
+	Namespace uint16
+
+	srv *server.Server
+	ns  *addressSpace
+}
+
+// StartServer starts an OPC UA server on the loopback interface that accepts anonymous
+// sessions without security. The nodes are organized by a folder named Plant in the Objects
+// folder. Each node has a string node id made of the browse names from Plant down to it, so the
+// node Line1/Speed is ns=<Namespace>;s=Plant.Line1.Speed. The server is stopped when the test
+// ends.
+func StartServer(t testing.TB, nodes ...Node) *Server {
+	t.Helper()
+
+	port := freePort(t)
+	srv := server.New(
+		server.EnableSecurity("None", ua.MessageSecurityModeNone),
+		server.EnableAuthMode(ua.UserTokenTypeAnonymous),
+		server.EndPoint("localhost", port),
+	)
+
+	ns := newAddressSpace()
+	srv.AddNamespace(ns)
+	ns.add(Folder("Plant", nodes...), "")
+
+	objects, err := srv.Namespace(0)
+	if err != nil {
+		t.Fatalf("finding namespace 0: %v", err)
+	}
+	objects.Objects().AddRef(ns.Objects(), id.Organizes, true)
+	// The server does not implement TranslateBrowsePathsToNodeIds, so the namespace answers it
+	srv.RegisterHandler(id.TranslateBrowsePathsToNodeIDsRequest_Encoding_DefaultBinary, ns.translate)
+
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("starting the OPC UA server: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	return &Server{
+		Endpoint:  fmt.Sprintf("opc.tcp://localhost:%d", port),
+		Namespace: ns.ID(),
+		srv:       srv,
+		ns:        ns,
+	}
+}
+
+// NodeID returns the node id of the node at path below Plant, or of Plant if path is empty.
+func (s *Server) NodeID(path ...string) string {
+	return s.ns.nodeID(append([]string{"Plant"}, path...)).String()
+}
+
+// SetValue changes the value of the Variable at path below Plant.
+func (s *Server) SetValue(t testing.TB, value interface{}, path ...string) {
+	t.Helper()
+	nodeID := s.ns.nodeID(append([]string{"Plant"}, path...))
+	n := s.ns.Node(nodeID)
+	if n == nil {
+		t.Fatalf("no node %s", nodeID)
+	}
+	n.SetAttribute(ua.AttributeIDValue, server.DataValueFromValue(value))
+	s.srv.ChangeNotification(nodeID)
+}
+
+// Renumber gives the node nodeID the string identifier identifier, as a server that generates
+// its node ids does when its program is downloaded again, and returns the new node id. The
+// browse path of the node does not change, but SetValue no longer finds it.
+func (s *Server) Renumber(t testing.TB, nodeID, identifier string) string {
+	t.Helper()
+	from, err := ua.ParseNodeID(nodeID)
+	if err != nil {
+		t.Fatalf("invalid node id %s: %v", nodeID, err)
+	}
+	to := ua.NewStringNodeID(s.ns.id, identifier)
+	if !s.ns.renumber(from, to) {
+		t.Fatalf("no node %s", from)
+	}
+	return to.String()
+}
+
+// Remove removes the node at path below Plant from the address space of the server.
+func (s *Server) Remove(t testing.TB, path ...string) {
+	t.Helper()
+	nodeID := s.ns.nodeID(append([]string{"Plant"}, path...))
+	if !s.ns.remove(nodeID) {
+		t.Fatalf("no node %s", nodeID)
+	}
+}
+
+// addressSpace is a namespace of nodes with string node ids. Unlike server.NodeNameSpace, it
+// returns the DataType attribute of its variables as a NodeID, as the specification requires.
+type addressSpace struct {
+	mu        sync.RWMutex
+	id        uint16
+	nodes     map[string]*server.Node
+	dataTypes map[string]*ua.NodeID
+	refs      map[string][]*ua.ReferenceDescription
+	root      *server.Node
+}
+
+// newAddressSpace returns an empty namespace.
+func newAddressSpace() *addressSpace {
+	return &addressSpace{
+		nodes:     map[string]*server.Node{},
+		dataTypes: map[string]*ua.NodeID{},
+		refs:      map[string][]*ua.ReferenceDescription{},
+	}
+}
+
+// nodeID returns the node id of the node at path.
+func (as *addressSpace) nodeID(path []string) *ua.NodeID {
+	return ua.NewStringNodeID(as.id, strings.Join(path, "."))
+}
+
+// add adds n and its children below the node with the string identifier parent, or as the
+// root of the namespace if parent is empty, and returns the node added for n.
+func (as *addressSpace) add(n Node, parent string) *server.Node {
+	identifier := n.Name
+	if parent != "" {
+		identifier = parent + "." + n.Name
+	}
+	nodeID := ua.NewStringNodeID(as.id, identifier)
+
+	attributes := map[ua.AttributeID]*ua.DataValue{
+		ua.AttributeIDBrowseName:  server.DataValueFromValue(attrs.BrowseName(n.Name)),
+		ua.AttributeIDDisplayName: server.DataValueFromValue(attrs.DisplayName(n.Name, "")),
+	}
+	var value server.ValueFunc
+	if n.Value != nil {
+		access := ua.AccessLevelTypeCurrentRead
+		if n.Writable {
+			access |= ua.AccessLevelTypeCurrentWrite
+		}
+		attributes[ua.AttributeIDNodeClass] = server.DataValueFromValue(uint32(ua.NodeClassVariable))
+		attributes[ua.AttributeIDAccessLevel] = server.DataValueFromValue(byte(access))
+		attributes[ua.AttributeIDUserAccessLevel] = server.DataValueFromValue(byte(access))
+		attributes[ua.AttributeIDValueRank] = server.DataValueFromValue(int32(-1))
+		attributes[ua.AttributeIDHistorizing] = server.DataValueFromValue(false)
+		initial := server.DataValueFromValue(n.Value)
+		value = func() *ua.DataValue { return initial }
+	} else {
+		attributes[ua.AttributeIDNodeClass] = server.DataValueFromValue(uint32(ua.NodeClassObject))
+	}
+
+	node := server.NewNode(nodeID, attributes, nil, value)
+	as.mu.Lock()
+	as.nodes[nodeID.String()] = node
+	if n.Value != nil {
+		as.dataTypes[nodeID.String()] = ua.NewNumericNodeID(0, uint32(ua.MustVariant(n.Value).Type()))
+	}
+	if parent == "" {
+		as.root = node
+	}
+	as.mu.Unlock()
+
+	for _, child := range n.Children {
+		as.addRef(nodeID, as.add(child, identifier))
+	}
+	return node
+}
+
+// addRef adds a forward reference from the node from to the node to: a folder Organizes its
+// objects and has its variables as components.
+func (as *addressSpace) addRef(from *ua.NodeID, to *server.Node) {
+	refType := uint32(id.HasComponent)
+	typeDefinition := ua.NewNumericExpandedNodeID(0, id.BaseDataVariableType)
+	if to.NodeClass() == ua.NodeClassObject {
+		refType = id.Organizes
+		typeDefinition = ua.NewNumericExpandedNodeID(0, id.FolderType)
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.refs[from.String()] = append(as.refs[from.String()], &ua.ReferenceDescription{
+		ReferenceTypeID: ua.NewNumericNodeID(0, refType),
+		IsForward:       true,
+		NodeID:          ua.NewExpandedNodeID(to.ID(), "", 0),
+		BrowseName:      to.BrowseName(),
+		DisplayName:     to.DisplayName(),
+		NodeClass:       to.NodeClass(),
+		TypeDefinition:  typeDefinition,
+	})
+}
+
+// renumber moves the node from to the node id to, together with the references from and to it.
+// It reports false if there is no node from.
+func (as *addressSpace) renumber(from, to *ua.NodeID) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	n, ok := as.nodes[from.String()]
+	if !ok {
+		return false
+	}
+
+	attributes := map[ua.AttributeID]*ua.DataValue{}
+	for _, attr := range []ua.AttributeID{ua.AttributeIDBrowseName, ua.AttributeIDDisplayName, ua.AttributeIDNodeClass, ua.AttributeIDAccessLevel, ua.AttributeIDUserAccessLevel, ua.AttributeIDValueRank, ua.AttributeIDHistorizing} {
+		if v, err := n.Attribute(attr); err == nil {
+			attributes[attr] = v.Value
+		}
+	}
+	var value server.ValueFunc
+	if n.NodeClass() == ua.NodeClassVariable {
+		value = n.Value
+	}
+	moved := server.NewNode(to, attributes, nil, value)
+
+	delete(as.nodes, from.String())
+	as.nodes[to.String()] = moved
+	if dt, ok := as.dataTypes[from.String()]; ok {
+		delete(as.dataTypes, from.String())
+		as.dataTypes[to.String()] = dt
+	}
+	if refs, ok := as.refs[from.String()]; ok {
+		delete(as.refs, from.String())
+		as.refs[to.String()] = refs
+	}
+	for _, refs := range as.refs {
+		for i, r := range refs {
+			if r.NodeID.NodeID.String() == from.String() {
+				ref := *r
+				ref.NodeID = ua.NewExpandedNodeID(to, "", 0)
+				refs[i] = &ref
+			}
+		}
+	}
+	if as.root == n {
+		as.root = moved
+	}
+	return true
+}
+
+// remove removes the node nodeID and the references to it. It reports false if there is no such
+// node.
+func (as *addressSpace) remove(nodeID *ua.NodeID) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if _, ok := as.nodes[nodeID.String()]; !ok {
+		return false
+	}
+	delete(as.nodes, nodeID.String())
+	delete(as.dataTypes, nodeID.String())
+	delete(as.refs, nodeID.String())
+	for source, refs := range as.refs {
+		kept := refs[:0]
+		for _, r := range refs {
+			if r.NodeID.NodeID.String() != nodeID.String() {
+				kept = append(kept, r)
+			}
+		}
+		as.refs[source] = kept
+	}
+	return true
+}
+
+// translate answers TranslateBrowsePathsToNodeIds requests for paths starting in the namespace.
+// Every reference is followed, whatever the reference type of the path.
+func (as *addressSpace) translate(sc *uasc.SecureChannel, r ua.Request, reqID uint32) (ua.Response, error) {
+	req, ok := r.(*ua.TranslateBrowsePathsToNodeIDsRequest)
+	if !ok {
+		return nil, ua.StatusBadRequestTypeInvalid
+	}
+	res := &ua.TranslateBrowsePathsToNodeIDsResponse{
+		ResponseHeader: &ua.ResponseHeader{
+			Timestamp:          time.Now(),
+			RequestHandle:      req.RequestHeader.RequestHandle,
+			ServiceResult:      ua.StatusOK,
+			ServiceDiagnostics: &ua.DiagnosticInfo{},
+			StringTable:        []string{},
+			AdditionalHeader:   ua.NewExtensionObject(nil),
+		},
+		Results:         []*ua.BrowsePathResult{},
+		DiagnosticInfos: []*ua.DiagnosticInfo{},
+	}
+	for _, p := range req.BrowsePaths {
+		res.Results = append(res.Results, as.translatePath(p))
+	}
+	return res, nil
+}
+
+// translatePath follows the browse names of a path from its starting node.
+func (as *addressSpace) translatePath(p *ua.BrowsePath) *ua.BrowsePathResult {
+	if as.Node(p.StartingNode) == nil {
+		return &ua.BrowsePathResult{StatusCode: ua.StatusBadNodeIDUnknown, Targets: []*ua.BrowsePathTarget{}}
+	}
+
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	current := p.StartingNode
+	for _, e := range p.RelativePath.Elements {
+		var next *ua.NodeID
+		for _, r := range as.refs[current.String()] {
+			if r.BrowseName.NamespaceIndex == e.TargetName.NamespaceIndex && r.BrowseName.Name == e.TargetName.Name {
+				next = r.NodeID.NodeID
+				break
+			}
+		}
+		if next == nil {
+			return &ua.BrowsePathResult{StatusCode: ua.StatusBadNoMatch, Targets: []*ua.BrowsePathTarget{}}
+		}
+		current = next
+	}
+	return &ua.BrowsePathResult{
+		StatusCode: ua.StatusOK,
+		Targets:    []*ua.BrowsePathTarget{{TargetID: ua.NewExpandedNodeID(current, "", 0), RemainingPathIndex: math.MaxUint32}},
+	}
+}
+
+func (as *addressSpace) Name() string { return NamespaceURI }
+
+func (as *addressSpace) ID() uint16 { return as.id }
+
+func (as *addressSpace) SetID(id uint16) { as.id = id }
+
+// AddNode adds a node without references. The nodes of the test server are added with add.
+func (as *addressSpace) AddNode(n *server.Node) *server.Node {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.nodes[n.ID().String()] = n
+	return n
+}
+
+func (as *addressSpace) Node(nodeID *ua.NodeID) *server.Node {
+	if nodeID == nil {
+		return nil
+	}
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	return as.nodes[nodeID.String()]
+}
+
+func (as *addressSpace) Objects() *server.Node {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	return as.root
+}
+
+func (as *addressSpace) Root() *server.Node { return as.Objects() }
+
+// Browse returns the forward references of a node matching the reference type, without
+// following subtypes, and the node class mask of the description.
+func (as *addressSpace) Browse(bd *ua.BrowseDescription) *ua.BrowseResult {
+	if as.Node(bd.NodeID) == nil {
+		return &ua.BrowseResult{StatusCode: ua.StatusBadNodeIDUnknown}
+	}
+
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	refs := []*ua.ReferenceDescription{}
+	for _, r := range as.refs[bd.NodeID.String()] {
+		if bd.BrowseDirection == ua.BrowseDirectionInverse {
+			continue
+		}
+		if bd.ReferenceTypeID != nil && bd.ReferenceTypeID.IntID() != 0 && !bd.ReferenceTypeID.Equal(r.ReferenceTypeID) {
+			continue
+		}
+		if bd.NodeClassMask != 0 && bd.NodeClassMask&uint32(r.NodeClass) == 0 {
+			continue
+		}
+		refs = append(refs, r)
+	}
+	return &ua.BrowseResult{StatusCode: ua.StatusOK, References: refs}
+}
+
+func (as *addressSpace) Attribute(nodeID *ua.NodeID, attr ua.AttributeID) *ua.DataValue {
+	n := as.Node(nodeID)
+	if n == nil {
+		return statusValue(ua.StatusBadNodeIDUnknown)
+	}
+
+	switch attr {
+	case ua.AttributeIDNodeID:
+		return server.DataValueFromValue(nodeID)
+	case ua.AttributeIDNodeClass:
+		return server.DataValueFromValue(int32(n.NodeClass()))
+	case ua.AttributeIDEventNotifier:
+		if n.NodeClass() != ua.NodeClassObject {
+			return statusValue(ua.StatusBadAttributeIDInvalid)
+		}
+		return server.DataValueFromValue(byte(0))
+	case ua.AttributeIDDataType:
+		as.mu.RLock()
+		dt, ok := as.dataTypes[nodeID.String()]
+		as.mu.RUnlock()
+		if !ok {
+			return statusValue(ua.StatusBadAttributeIDInvalid)
+		}
+		return server.DataValueFromValue(dt)
+	}
+
+	v, err := n.Attribute(attr)
+	if err != nil {
+		return statusValue(ua.StatusBadAttributeIDInvalid)
+	}
+	return v.Value
+}
+
+func (as *addressSpace) SetAttribute(nodeID *ua.NodeID, attr ua.AttributeID, val *ua.DataValue) ua.StatusCode {
+	n := as.Node(nodeID)
+	if n == nil {
+		return ua.StatusBadNodeIDUnknown
+	}
+	if attr != ua.AttributeIDValue || !n.Access(ua.AccessLevelTypeCurrentWrite) {
+		return ua.StatusBadNotWritable
+	}
+	n.SetAttribute(attr, val)
+	return ua.StatusOK
+}
+
+// statusValue returns a DataValue holding only a status code.
+func statusValue(code ua.StatusCode) *ua.DataValue {
+	return &ua.DataValue{
+		EncodingMask:    ua.DataValueServerTimestamp | ua.DataValueStatusCode,
+		ServerTimestamp: time.Now(),
+		Status:          code,
+	}
+}
@@ -0,0 +1,541 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gopcua/opcua/ua"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultMaxDepth is the deepest level of the tree that is browsed when a root does
+// not set its own limit, the root being level 0.
+const defaultMaxDepth = 10
+
+// BrowseClient is the part of *opcua.Client used to browse an address space.
+type BrowseClient interface {
+	Read(ctx context.Context, req *ua.ReadRequest) (*ua.ReadResponse, error)
+	Browse(ctx context.Context, req *ua.BrowseRequest) (*ua.BrowseResponse, error)
+	BrowseNext(ctx context.Context, req *ua.BrowseNextRequest) (*ua.BrowseNextResponse, error)
+}
+
+// BrowseOptions controls how much load a browse puts on the server.
+type BrowseOptions struct {
+	// Workers is the number of requests that may be in flight at the same time.
+	Workers int
+	// BatchSize is the number of nodes sent in a single Read or Browse request.
+	BatchSize int
+	// RequestsPerSecond limits the request rate across all workers, 0 means no limit.
+	RequestsPerSecond float64
+	// EngineeringUnits reads the EngineeringUnits, EURange and InstrumentRange properties of variables.
+	EngineeringUnits bool
+	// Namespaces is the NamespaceArray of the server used to fill in the NamespaceURI of every node.
+	// It is read from the server when nil.
+	Namespaces []string
+	// Progress, if not nil, is called with the number of nodes visited after every level of the tree.
+	Progress func(nodes int)
+}
+
+// NewBrowseOptions builds BrowseOptions from the application configuration.
+func NewBrowseOptions(config util.Config) BrowseOptions {
+	opts := BrowseOptions{Workers: 4, BatchSize: 100, EngineeringUnits: config.OpcUaBrowseEngineeringUnits != "false"}
+	if v, err := strconv.Atoi(config.OpcUaBrowseWorkers); err == nil && v > 0 {
+		opts.Workers = v
+	}
+	if v, err := strconv.Atoi(config.OpcUaBrowseBatchSize); err == nil && v > 0 {
+		opts.BatchSize = v
+	}
+	if v, err := strconv.ParseFloat(config.OpcUaBrowseRequestsPerSecond, 64); err == nil && v > 0 {
+		opts.RequestsPerSecond = v
+	}
+	return opts
+}
+
+// BrowseRoot is a node the browse starts from.
+type BrowseRoot struct {
+	NodeID *ua.NodeID
+	// MaxDepth is the deepest level below the root that is browsed, 0 means no limit.
+	MaxDepth int
+	// ReferenceTypes are the forward references followed to find the children of a node.
+	// Children are stored in the order of this list. Defaults to defaultReferenceTypes.
+	ReferenceTypes []*ua.NodeID
+	// IncludeSubtypes also follows references that are subtypes of ReferenceTypes.
+	IncludeSubtypes bool
+	// NodeClasses is the mask of node classes that are stored and browsed further.
+	// Defaults to defaultNodeClasses.
+	NodeClasses ua.NodeClass
+}
+
+// browseRootConfig is the JSON representation of a BrowseRoot in OPCUA_BROWSE_ROOTS.
+type browseRootConfig struct {
+	NodeID          string   `json:"nodeId"`
+	MaxDepth        *int     `json:"maxDepth"`
+	ReferenceTypes  []string `json:"referenceTypes"`
+	IncludeSubtypes *bool    `json:"includeSubtypes"`
+	NodeClasses     []string `json:"nodeClasses"`
+}
+
+// NewBrowseRoots returns the roots configured in OPCUA_BROWSE_ROOTS, or the single
+// ROOT_NODE browsed to OPCUA_BROWSE_MAX_DEPTH if no roots are configured.
+func NewBrowseRoots(config util.Config) ([]BrowseRoot, error) {
+	maxDepth := defaultMaxDepth
+	if v, err := strconv.Atoi(config.OpcUaBrowseMaxDepth); err == nil && v >= 0 {
+		maxDepth = v
+	}
+
+	rootConfigs := []browseRootConfig{{NodeID: config.RootNode}}
+	if config.OpcUaBrowseRoots != "" {
+		rootConfigs = nil
+		if err := json.Unmarshal([]byte(config.OpcUaBrowseRoots), &rootConfigs); err != nil {
+			return nil, fmt.Errorf("parsing browse roots: %w", err)
+		}
+	}
+
+	referenceTypes := splitList(config.OpcUaBrowseReferenceTypes)
+	if referenceTypes == nil {
+		referenceTypes = defaultReferenceTypes
+	}
+	nodeClasses := splitList(config.OpcUaBrowseNodeClasses)
+	if nodeClasses == nil {
+		nodeClasses = defaultNodeClasses
+	}
+
+	var roots []BrowseRoot
+	for _, rc := range rootConfigs {
+		nodeID, err := ua.ParseNodeID(rc.NodeID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root node id %q: %w", rc.NodeID, err)
+		}
+		root := BrowseRoot{NodeID: nodeID, MaxDepth: maxDepth, IncludeSubtypes: config.OpcUaBrowseIncludeSubtypes != "false"}
+		if rc.MaxDepth != nil {
+			root.MaxDepth = *rc.MaxDepth
+		}
+		if rc.IncludeSubtypes != nil {
+			root.IncludeSubtypes = *rc.IncludeSubtypes
+		}
+
+		if rc.ReferenceTypes == nil {
+			rc.ReferenceTypes = referenceTypes
+		}
+		if root.ReferenceTypes, err = ParseReferenceTypes(rc.ReferenceTypes); err != nil {
+			return nil, fmt.Errorf("root %s: %w", rc.NodeID, err)
+		}
+
+		if rc.NodeClasses == nil {
+			rc.NodeClasses = nodeClasses
+		}
+		if root.NodeClasses, err = ParseNodeClasses(rc.NodeClasses); err != nil {
+			return nil, fmt.Errorf("root %s: %w", rc.NodeID, err)
+		}
+
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// BrowseCut is a place where the browse stopped following references.
+type BrowseCut struct {
+	// NodeID and Path identify the node whose references were not followed.
+	NodeID string `json:"nodeID"`
+	Path   string `json:"path"`
+	// Target is the ancestor a cyclic reference points back to.
+	Target string `json:"target,omitempty"`
+}
+
+// BrowseReport summarises a browse from a single root.
+type BrowseReport struct {
+	Root         string      `json:"root"`
+	Nodes        int         `json:"nodes"`
+	MaxDepth     int         `json:"maxDepth"`
+	DepthLimited []BrowseCut `json:"depthLimited"`
+	Cycles       []BrowseCut `json:"cycles"`
+}
+
+// browseItem is a node found during a browse whose children may still be unknown.
+type browseItem struct {
+	def      NodeDef
+	parent   *browseItem
+	level    int
+	refs     [][]*ua.ReferenceDescription
+	children []*browseItem
+}
+
+// nodeDef converts the item and its descendants into a NodeDef tree.
+func (item *browseItem) nodeDef() NodeDef {
+	def := item.def
+	for _, child := range item.children {
+		def.Children = append(def.Children, child.nodeDef())
+	}
+	return def
+}
+
+// hasAncestor reports whether other is item or one of its ancestors.
+func (item *browseItem) hasAncestor(other *browseItem) bool {
+	for p := item; p != nil; p = p.parent {
+		if p == other {
+			return true
+		}
+	}
+	return false
+}
+
+// browser issues batched Read and Browse requests on a bounded pool of workers.
+type browser struct {
+	client BrowseClient
+	root   BrowseRoot
+	opts   BrowseOptions
+	ticker *time.Ticker
+	// types caches the data types resolved during the browse by node id.
+	types map[string]*dataType
+}
+
+// Browse retrieves the attributes of the root node and all of its descendants.
+// The tree is walked one level at a time so that the attributes and references of
+// many nodes can be requested together.
+//
+// Every node is visited once. A node referenced by more than one parent is stored
+// under the first parent found and the other parents are recorded in OtherParents.
+// References back to an ancestor and nodes below the maximum depth are not followed
+// and are listed in the returned report.
+func Browse(ctx context.Context, c BrowseClient, root BrowseRoot, opts BrowseOptions) ([]NodeDef, *BrowseReport, error) {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+	if len(root.ReferenceTypes) == 0 {
+		root.ReferenceTypes, _ = ParseReferenceTypes(defaultReferenceTypes)
+	}
+	if root.NodeClasses == 0 {
+		root.NodeClasses, _ = ParseNodeClasses(defaultNodeClasses)
+	}
+
+	if opts.Namespaces == nil {
+		namespaces, err := ReadNamespaces(ctx, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.Namespaces = namespaces
+	}
+
+	b := &browser{client: c, root: root, opts: opts, types: map[string]*dataType{}}
+	if opts.RequestsPerSecond > 0 {
+		b.ticker = time.NewTicker(time.Duration(float64(time.Second) / opts.RequestsPerSecond))
+		defer b.ticker.Stop()
+	}
+
+	report := &BrowseReport{Root: root.NodeID.String(), MaxDepth: root.MaxDepth}
+	rootItem := &browseItem{def: NodeDef{NodeID: root.NodeID}}
+	visited := map[string]*browseItem{root.NodeID.String(): rootItem}
+
+	level := []*browseItem{rootItem}
+	for len(level) > 0 {
+		if err := b.readAttributes(ctx, level); err != nil {
+			return nil, nil, err
+		}
+		if err := b.resolveDataTypes(ctx, level); err != nil {
+			return nil, nil, err
+		}
+		if err := b.readMethodArguments(ctx, level); err != nil {
+			return nil, nil, err
+		}
+		if b.opts.EngineeringUnits {
+			if err := b.readAnalogMetadata(ctx, level); err != nil {
+				return nil, nil, err
+			}
+		}
+		report.Nodes += len(level)
+		if opts.Progress != nil {
+			opts.Progress(report.Nodes)
+		}
+
+		if err := b.browseReferences(ctx, level); err != nil {
+			return nil, nil, err
+		}
+
+		// Children are assigned in browse order so the result does not depend on which worker finished first
+		var next []*browseItem
+		for _, item := range level {
+			next = append(next, item.addChildren(visited, root.MaxDepth, report)...)
+		}
+		level = next
+	}
+
+	for _, cut := range report.DepthLimited {
+		util.Logger.Warnf("Browse depth limit of %d reached at %s (%s)", root.MaxDepth, cut.Path, cut.NodeID)
+	}
+	for _, cut := range report.Cycles {
+		util.Logger.Warnf("Browse cycle from %s (%s) back to %s", cut.Path, cut.NodeID, cut.Target)
+	}
+	util.Logger.Infof("Browsed %d nodes below %s", report.Nodes, root.NodeID)
+
+	return []NodeDef{rootItem.nodeDef()}, report, nil
+}
+
+// addChildren turns the browsed references of item into children, skipping nodes that
+// have already been visited. It returns the new children.
+func (item *browseItem) addChildren(visited map[string]*browseItem, maxDepth int, report *BrowseReport) []*browseItem {
+	nodeID := item.def.NodeID.String()
+	limited := false
+	for _, refs := range item.refs {
+		for _, ref := range refs {
+			target := ref.NodeID.NodeID.String()
+
+			if seen, ok := visited[target]; ok {
+				switch {
+				case item.hasAncestor(seen):
+					report.Cycles = append(report.Cycles, BrowseCut{NodeID: nodeID, Path: item.def.Path, Target: target})
+				case seen.parent != item && !contains(seen.def.OtherParents, nodeID):
+					seen.def.OtherParents = append(seen.def.OtherParents, nodeID)
+				}
+				continue
+			}
+
+			// Past the depth limit the remaining references are still checked for visited targets
+			if maxDepth > 0 && item.level >= maxDepth {
+				if !limited {
+					report.DepthLimited = append(report.DepthLimited, BrowseCut{NodeID: nodeID, Path: item.def.Path})
+					limited = true
+				}
+				continue
+			}
+
+			child := &browseItem{
+				def:    NodeDef{NodeID: ref.NodeID.NodeID, ReferenceType: ReferenceTypeName(ref.ReferenceTypeID)},
+				parent: item,
+				level:  item.level + 1,
+			}
+			visited[target] = child
+			item.children = append(item.children, child)
+		}
+	}
+	item.refs = nil
+	return item.children
+}
+
+// readAttributes reads browseAttributes for every item and fills in its definition.
+func (b *browser) readAttributes(ctx context.Context, items []*browseItem) error {
+	batches := batch(items, b.opts.BatchSize)
+	return b.run(ctx, len(batches), func(ctx context.Context, i int) error {
+		req := &ua.ReadRequest{TimestampsToReturn: ua.TimestampsToReturnNeither}
+		for _, item := range batches[i] {
+			for _, attr := range browseAttributes {
+				req.NodesToRead = append(req.NodesToRead, &ua.ReadValueID{NodeID: item.def.NodeID, AttributeID: attr})
+			}
+		}
+
+		if err := b.wait(ctx); err != nil {
+			return err
+		}
+		res, err := b.client.Read(ctx, req)
+		if err != nil {
+			util.Logger.Errorf("Failed the get the attributes of %d nodes starting at %s", len(batches[i]), batches[i][0].def.NodeID)
+			return err
+		}
+		if len(res.Results) != len(req.NodesToRead) {
+			return fmt.Errorf("read returned %d results for %d attributes", len(res.Results), len(req.NodesToRead))
+		}
+
+		n := len(browseAttributes)
+		for j, item := range batches[i] {
+			def, err := nodeDefFromAttributes(item.def.NodeID, res.Results[j*n:(j+1)*n])
+			if err != nil {
+				util.Logger.Errorf("Failed the get the attributes of node: %s", item.def.NodeID)
+				return err
+			}
+			if item.parent != nil {
+				def.Path = join(item.parent.def.Path, def.BrowseName)
+				def.BrowsePath = append(append([]string{}, item.parent.def.BrowsePath...), qualifiedBrowseName(res.Results[j*n+1], def.BrowseName))
+			} else {
+				def.Path = def.BrowseName
+			}
+			def.NamespaceURI = NamespaceURI(def.NodeID, b.opts.Namespaces)
+			def.OtherParents = item.def.OtherParents
+			def.ReferenceType = item.def.ReferenceType
+			item.def = def
+		}
+		return nil
+	})
+}
+
+// qualifiedBrowseName formats the BrowseName read for a node with its namespace index, falling
+// back to namespace 0 if the server did not return a QualifiedName.
+func qualifiedBrowseName(dv *ua.DataValue, name string) string {
+	if dv.Value != nil {
+		if qn, ok := dv.Value.Value().(*ua.QualifiedName); ok && qn != nil {
+			return FormatQualifiedName(qn)
+		}
+	}
+	return FormatQualifiedName(&ua.QualifiedName{Name: name})
+}
+
+// browseReferences follows the reference types of the root from every item and stores the references
+// to nodes of the configured node classes.
+func (b *browser) browseReferences(ctx context.Context, items []*browseItem) error {
+	batches := batch(items, b.opts.BatchSize)
+	return b.run(ctx, len(batches), func(ctx context.Context, i int) error {
+		req := &ua.BrowseRequest{View: &ua.ViewDescription{ViewID: ua.NewTwoByteNodeID(0)}}
+		for _, item := range batches[i] {
+			for _, refType := range b.root.ReferenceTypes {
+				req.NodesToBrowse = append(req.NodesToBrowse, &ua.BrowseDescription{
+					NodeID:          item.def.NodeID,
+					BrowseDirection: ua.BrowseDirectionForward,
+					ReferenceTypeID: refType,
+					IncludeSubtypes: b.root.IncludeSubtypes,
+					NodeClassMask:   uint32(b.root.NodeClasses),
+					ResultMask:      uint32(ua.BrowseResultMaskAll),
+				})
+			}
+		}
+
+		refs, err := b.browse(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		n := len(b.root.ReferenceTypes)
+		for j, item := range batches[i] {
+			item.refs = refs[j*n : (j+1)*n]
+		}
+		return nil
+	})
+}
+
+// browse sends a Browse request and follows continuation points with BrowseNext until
+// all references are known. The references are returned per BrowseDescription.
+func (b *browser) browse(ctx context.Context, req *ua.BrowseRequest) ([][]*ua.ReferenceDescription, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	res, err := b.client.Browse(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("browse: %w", err)
+	}
+	if len(res.Results) != len(req.NodesToBrowse) {
+		return nil, fmt.Errorf("browse returned %d results for %d nodes", len(res.Results), len(req.NodesToBrowse))
+	}
+
+	refs := make([][]*ua.ReferenceDescription, len(res.Results))
+	pending := map[int][]byte{}
+	for i, r := range res.Results {
+		if r.StatusCode != ua.StatusOK {
+			util.Logger.Warnf("Browse of %s returned %s", req.NodesToBrowse[i].NodeID, r.StatusCode)
+		}
+		refs[i] = r.References
+		if len(r.ContinuationPoint) > 0 {
+			pending[i] = r.ContinuationPoint
+		}
+	}
+
+	for len(pending) > 0 {
+		next := &ua.BrowseNextRequest{}
+		var indexes []int
+		for i, cp := range pending {
+			indexes = append(indexes, i)
+			next.ContinuationPoints = append(next.ContinuationPoints, cp)
+		}
+
+		if err := b.wait(ctx); err != nil {
+			return nil, err
+		}
+		res, err := b.client.BrowseNext(ctx, next)
+		if err != nil {
+			return nil, fmt.Errorf("browse next: %w", err)
+		}
+		if len(res.Results) != len(indexes) {
+			return nil, fmt.Errorf("browse next returned %d results for %d continuation points", len(res.Results), len(indexes))
+		}
+
+		pending = map[int][]byte{}
+		for j, r := range res.Results {
+			i := indexes[j]
+			refs[i] = append(refs[i], r.References...)
+			if len(r.ContinuationPoint) > 0 {
+				pending[i] = r.ContinuationPoint
+			}
+		}
+	}
+	return refs, nil
+}
+
+// run calls fn for every index in [0, n) on at most opts.Workers goroutines.
+// The first error cancels the remaining calls and is returned.
+func (b *browser) run(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	jobs := make(chan int)
+	for w := 0; w < min(b.opts.Workers, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fn(workerCtx, i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+		case <-workerCtx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// wait blocks until the rate limit allows another request.
+func (b *browser) wait(ctx context.Context) error {
+	if b.ticker == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-b.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// batch splits items into slices of at most size elements.
+func batch[T any](items []T, size int) [][]T {
+	var batches [][]T
+	for size < len(items) {
+		items, batches = items[size:], append(batches, items[:size])
+	}
+	if len(items) > 0 {
+		batches = append(batches, items)
+	}
+	return batches
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
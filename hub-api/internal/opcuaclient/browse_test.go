@@ -0,0 +1,467 @@
+package opcuaclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"sync"
+	"testing"
+)
+
+// fakeNode is a node in the address space served by fakeServer.
+type fakeNode struct {
+	class       ua.NodeClass
+	browseName  string
+	dataType    uint32
+	dataTypeID  string
+	value       interface{}
+	array       bool
+	accessLevel ua.AccessLevelType
+	historizing bool
+	notifier    ua.EventNotifierType
+	history     []*ua.DataValue
+	refs        map[uint32][]string
+}
+
+// fakeServer answers Read, Browse and BrowseNext requests from an in-memory address space.
+// Browse results are split into pages of pageSize references to exercise continuation points.
+type fakeServer struct {
+	mu          sync.Mutex
+	nodes       map[string]*fakeNode
+	pageSize    int
+	pages       map[string][]*ua.ReferenceDescription
+	lastPage    int
+	reads       int
+	browses     int
+	browseNexts int
+	released    [][]byte
+}
+
+func (s *fakeServer) Read(ctx context.Context, req *ua.ReadRequest) (*ua.ReadResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+
+	res := &ua.ReadResponse{}
+	for _, rv := range req.NodesToRead {
+		n, ok := s.nodes[rv.NodeID.String()]
+		if !ok {
+			res.Results = append(res.Results, &ua.DataValue{Status: ua.StatusBadNodeIDUnknown})
+			continue
+		}
+		var v interface{}
+		switch rv.AttributeID {
+		case ua.AttributeIDNodeClass:
+			v = int32(n.class)
+		case ua.AttributeIDBrowseName:
+			v = &ua.QualifiedName{Name: n.browseName}
+		case ua.AttributeIDDescription:
+			v = &ua.LocalizedText{Text: n.browseName + " description"}
+		case ua.AttributeIDDataType:
+			if n.class != ua.NodeClassVariable {
+				res.Results = append(res.Results, &ua.DataValue{Status: ua.StatusBadAttributeIDInvalid})
+				continue
+			}
+			v = ua.NewNumericNodeID(0, n.dataType)
+			if n.dataTypeID != "" {
+				v = ua.MustParseNodeID(n.dataTypeID)
+			}
+		case ua.AttributeIDValueRank:
+			if n.class != ua.NodeClassVariable {
+				res.Results = append(res.Results, &ua.DataValue{Status: ua.StatusBadAttributeIDInvalid})
+				continue
+			}
+			v = int32(-1)
+			if n.array {
+				v = int32(1)
+			}
+		case ua.AttributeIDAccessLevel:
+			if n.class != ua.NodeClassVariable {
+				res.Results = append(res.Results, &ua.DataValue{Status: ua.StatusBadAttributeIDInvalid})
+				continue
+			}
+			v = byte(n.accessLevel)
+		case ua.AttributeIDHistorizing:
+			if n.class != ua.NodeClassVariable {
+				res.Results = append(res.Results, &ua.DataValue{Status: ua.StatusBadAttributeIDInvalid})
+				continue
+			}
+			v = n.historizing
+		case ua.AttributeIDEventNotifier:
+			if n.class != ua.NodeClassObject {
+				res.Results = append(res.Results, &ua.DataValue{Status: ua.StatusBadAttributeIDInvalid})
+				continue
+			}
+			v = byte(n.notifier)
+		case ua.AttributeIDValue:
+			if n.value == nil {
+				res.Results = append(res.Results, &ua.DataValue{Status: ua.StatusBadAttributeIDInvalid})
+				continue
+			}
+			v = n.value
+		default:
+			res.Results = append(res.Results, &ua.DataValue{Status: ua.StatusBadAttributeIDInvalid})
+			continue
+		}
+		res.Results = append(res.Results, &ua.DataValue{Status: ua.StatusOK, Value: ua.MustVariant(v)})
+	}
+	return res, nil
+}
+
+func (s *fakeServer) Browse(ctx context.Context, req *ua.BrowseRequest) (*ua.BrowseResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.browses++
+
+	res := &ua.BrowseResponse{}
+	for _, desc := range req.NodesToBrowse {
+		var refs []*ua.ReferenceDescription
+		if n, ok := s.nodes[desc.NodeID.String()]; ok {
+			targets := n.refs[desc.ReferenceTypeID.IntID()]
+			if desc.BrowseDirection == ua.BrowseDirectionInverse {
+				targets = s.sources(desc.ReferenceTypeID.IntID(), desc.NodeID.String())
+			}
+			for _, target := range targets {
+				if desc.NodeClassMask != 0 && uint32(s.nodes[target].class)&desc.NodeClassMask == 0 {
+					continue
+				}
+				refs = append(refs, &ua.ReferenceDescription{
+					ReferenceTypeID: desc.ReferenceTypeID,
+					IsForward:       desc.BrowseDirection != ua.BrowseDirectionInverse,
+					NodeID:          ua.NewExpandedNodeID(ua.MustParseNodeID(target), "", 0),
+					BrowseName:      &ua.QualifiedName{Name: s.nodes[target].browseName},
+				})
+			}
+		}
+		res.Results = append(res.Results, s.page(refs))
+	}
+	return res, nil
+}
+
+func (s *fakeServer) BrowseNext(ctx context.Context, req *ua.BrowseNextRequest) (*ua.BrowseNextResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.browseNexts++
+
+	res := &ua.BrowseNextResponse{}
+	for _, cp := range req.ContinuationPoints {
+		refs, ok := s.pages[string(cp)]
+		if !ok {
+			res.Results = append(res.Results, &ua.BrowseResult{StatusCode: ua.StatusBadContinuationPointInvalid})
+			continue
+		}
+		delete(s.pages, string(cp))
+		res.Results = append(res.Results, s.page(refs))
+	}
+	return res, nil
+}
+
+// sources returns the nodes with a reference of type refType to target.
+func (s *fakeServer) sources(refType uint32, target string) []string {
+	var sources []string
+	for nodeID, n := range s.nodes {
+		if contains(n.refs[refType], target) {
+			sources = append(sources, nodeID)
+		}
+	}
+	return sources
+}
+
+// page returns the first page of refs and stores the rest behind a continuation point.
+func (s *fakeServer) page(refs []*ua.ReferenceDescription) *ua.BrowseResult {
+	if s.pageSize == 0 || len(refs) <= s.pageSize {
+		return &ua.BrowseResult{StatusCode: ua.StatusOK, References: refs}
+	}
+	if s.pages == nil {
+		s.pages = map[string][]*ua.ReferenceDescription{}
+	}
+	s.lastPage++
+	cp := fmt.Sprintf("cp%d", s.lastPage)
+	s.pages[cp] = refs[s.pageSize:]
+	return &ua.BrowseResult{StatusCode: ua.StatusOK, References: refs[:s.pageSize], ContinuationPoint: []byte(cp)}
+}
+
+// newFakePlant builds a small address space with a folder of machines, each with a few variables.
+func newFakePlant() *fakeServer {
+	s := &fakeServer{nodes: map[string]*fakeNode{}, pageSize: 2}
+	s.nodes["i=2255"] = &fakeNode{class: ua.NodeClassVariable, browseName: "NamespaceArray", value: []string{"http://opcfoundation.org/UA/", "urn:fake:plant"}}
+	s.nodes["ns=1;s=Plant"] = &fakeNode{class: ua.NodeClassObject, browseName: "Plant", refs: map[uint32][]string{}}
+	for m := 1; m <= 3; m++ {
+		machine := fmt.Sprintf("ns=1;s=Machine%d", m)
+		s.nodes["ns=1;s=Plant"].refs[id.Organizes] = append(s.nodes["ns=1;s=Plant"].refs[id.Organizes], machine)
+		s.nodes[machine] = &fakeNode{class: ua.NodeClassObject, browseName: fmt.Sprintf("Machine%d", m), refs: map[uint32][]string{}}
+		for v := 1; v <= 5; v++ {
+			variable := fmt.Sprintf("%s.Value%d", machine, v)
+			s.nodes[machine].refs[id.HasComponent] = append(s.nodes[machine].refs[id.HasComponent], variable)
+			s.nodes[variable] = &fakeNode{class: ua.NodeClassVariable, browseName: fmt.Sprintf("Value%d", v), dataType: id.Double, accessLevel: ua.AccessLevelTypeCurrentRead}
+		}
+		property := machine + ".Serial"
+		s.nodes[machine].refs[id.HasProperty] = []string{property}
+		s.nodes[property] = &fakeNode{class: ua.NodeClassVariable, browseName: "Serial", dataType: id.String}
+	}
+	return s
+}
+
+func TestBrowse(t *testing.T) {
+	for _, opts := range []BrowseOptions{
+		{Workers: 1, BatchSize: 1},
+		{Workers: 4, BatchSize: 2},
+		{Workers: 8, BatchSize: 100, RequestsPerSecond: 1000},
+	} {
+		t.Run(fmt.Sprintf("%d workers batch %d", opts.Workers, opts.BatchSize), func(t *testing.T) {
+			s := newFakePlant()
+			nodes, _, err := Browse(context.Background(), s, BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Plant"), MaxDepth: 10}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nodes) != 1 || nodes[0].BrowseName != "Plant" {
+				t.Fatalf("unexpected root %+v", nodes)
+			}
+
+			machines := nodes[0].Children
+			if len(machines) != 3 {
+				t.Fatalf("expected 3 machines, got %d", len(machines))
+			}
+			for i, machine := range machines {
+				if want := fmt.Sprintf("Plant.Machine%d", i+1); machine.Path != want {
+					t.Errorf("got path %s, want %s", machine.Path, want)
+				}
+				// HasComponent children come before HasProperty children
+				if len(machine.Children) != 6 {
+					t.Fatalf("expected 6 children of %s, got %d", machine.Path, len(machine.Children))
+				}
+				for j, child := range machine.Children[:5] {
+					if want := fmt.Sprintf("Value%d", j+1); child.BrowseName != want || child.DataType != "float64" {
+						t.Errorf("got %s (%s), want %s (float64)", child.BrowseName, child.DataType, want)
+					}
+				}
+				if serial := machine.Children[5]; serial.Path != machine.Path+".Serial" || serial.DataType != "string" {
+					t.Errorf("unexpected property %s (%s)", serial.Path, serial.DataType)
+				}
+			}
+			if s.browseNexts == 0 {
+				t.Error("expected continuation points to be followed")
+			}
+		})
+	}
+}
+
+func TestBrowseBatchesRequests(t *testing.T) {
+	s := newFakePlant()
+	opts := BrowseOptions{Workers: 2, BatchSize: 100, Namespaces: []string{"http://opcfoundation.org/UA/", "urn:fake:plant"}}
+	if _, _, err := Browse(context.Background(), s, BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Plant")}, opts); err != nil {
+		t.Fatal(err)
+	}
+	// One Read and one Browse per level of the tree
+	if s.reads != 3 || s.browses != 3 {
+		t.Errorf("expected 3 reads and 3 browses, got %d and %d", s.reads, s.browses)
+	}
+}
+
+func TestBrowseUnknownRoot(t *testing.T) {
+	s := newFakePlant()
+	_, _, err := Browse(context.Background(), s, BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Missing")}, BrowseOptions{Workers: 1, BatchSize: 10})
+	if err != ua.StatusBadNodeIDUnknown {
+		t.Fatalf("expected StatusBadNodeIDUnknown, got %v", err)
+	}
+}
+
+func TestBrowseCyclesAndSharedNodes(t *testing.T) {
+	s := newFakePlant()
+	// Machine2 organizes Machine1's first value, and Machine3 points back to the plant
+	s.nodes["ns=1;s=Machine2"].refs[id.Organizes] = []string{"ns=1;s=Machine1.Value1"}
+	s.nodes["ns=1;s=Machine3"].refs[id.Organizes] = []string{"ns=1;s=Plant"}
+
+	nodes, report, err := Browse(context.Background(), s, BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Plant")}, BrowseOptions{Workers: 4, BatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Nodes != 22 {
+		t.Errorf("expected 22 distinct nodes, got %d", report.Nodes)
+	}
+	if len(report.Cycles) != 1 || report.Cycles[0].NodeID != "ns=1;s=Machine3" || report.Cycles[0].Target != "ns=1;s=Plant" {
+		t.Errorf("unexpected cycles %+v", report.Cycles)
+	}
+
+	shared := nodes[0].Children[0].Children[0]
+	if shared.BrowseName != "Value1" || len(shared.OtherParents) != 1 || shared.OtherParents[0] != "ns=1;s=Machine2" {
+		t.Errorf("expected Value1 to record Machine2 as another parent, got %+v", shared.OtherParents)
+	}
+	if n := len(nodes[0].Children[1].Children); n != 6 {
+		t.Errorf("expected the shared node not to be duplicated under Machine2, got %d children", n)
+	}
+}
+
+func TestBrowseMaxDepth(t *testing.T) {
+	s := newFakePlant()
+	// References to visited nodes after the cut are still recorded
+	s.nodes["ns=1;s=Machine2"].refs[id.HasComponent] = append(s.nodes["ns=1;s=Machine2"].refs[id.HasComponent], "ns=1;s=Machine1", "ns=1;s=Plant")
+	nodes, report, err := Browse(context.Background(), s, BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Plant"), MaxDepth: 1}, BrowseOptions{Workers: 1, BatchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes[0].Children) != 3 || len(nodes[0].Children[0].Children) != 0 {
+		t.Fatal("expected the browse to stop below the machines")
+	}
+	if len(report.DepthLimited) != 3 || report.DepthLimited[0].Path != "Plant.Machine1" {
+		t.Errorf("unexpected depth limited nodes %+v", report.DepthLimited)
+	}
+	if parents := nodes[0].Children[0].OtherParents; len(parents) != 1 || parents[0] != "ns=1;s=Machine2" {
+		t.Errorf("expected Machine2 as other parent of Machine1, got %v", parents)
+	}
+	if len(report.Cycles) != 1 || report.Cycles[0].NodeID != "ns=1;s=Machine2" {
+		t.Errorf("unexpected cycles %+v", report.Cycles)
+	}
+}
+
+func TestBrowseReferenceTypesAndNodeClasses(t *testing.T) {
+	s := newFakePlant()
+	s.nodes["ns=1;s=Machine1"].refs[id.HasNotifier] = []string{"ns=1;s=Alarms"}
+	s.nodes["ns=1;s=Alarms"] = &fakeNode{class: ua.NodeClassObject, browseName: "Alarms"}
+	s.nodes["ns=1;s=Machine1"].refs[id.HasComponent] = append(s.nodes["ns=1;s=Machine1"].refs[id.HasComponent], "ns=1;s=Reset")
+	s.nodes["ns=1;s=Reset"] = &fakeNode{class: ua.NodeClassMethod, browseName: "Reset"}
+
+	refTypes, err := ParseReferenceTypes([]string{"Organizes", "HasComponent", "HasNotifier"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes, err := ParseNodeClasses([]string{"Object", "Variable"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Plant"), ReferenceTypes: refTypes, NodeClasses: classes}
+	nodes, _, err := Browse(context.Background(), s, root, BrowseOptions{Workers: 2, BatchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	machine := nodes[0].Children[0]
+	if machine.ReferenceType != "Organizes" {
+		t.Errorf("expected Machine1 to be reached through Organizes, got %q", machine.ReferenceType)
+	}
+	// 5 values through HasComponent and the notifier, the method and the HasProperty child are filtered out
+	if len(machine.Children) != 6 {
+		t.Fatalf("expected 6 children, got %d", len(machine.Children))
+	}
+	if alarms := machine.Children[5]; alarms.BrowseName != "Alarms" || alarms.ReferenceType != "HasNotifier" {
+		t.Errorf("unexpected last child %s reached through %s", alarms.BrowseName, alarms.ReferenceType)
+	}
+}
+
+func TestBrowseEngineeringUnits(t *testing.T) {
+	s := newFakePlant()
+	variable := "ns=1;s=Machine1.Value1"
+	s.nodes[variable].refs = map[uint32][]string{id.HasProperty: {variable + ".EngineeringUnits", variable + ".EURange", variable + ".InstrumentRange"}}
+	s.nodes[variable+".EngineeringUnits"] = &fakeNode{class: ua.NodeClassVariable, browseName: "EngineeringUnits",
+		value: ua.NewExtensionObject(&ua.EUInformation{DisplayName: &ua.LocalizedText{Text: "°C"}})}
+	s.nodes[variable+".EURange"] = &fakeNode{class: ua.NodeClassVariable, browseName: "EURange",
+		value: ua.NewExtensionObject(&ua.Range{Low: 0, High: 100})}
+	s.nodes[variable+".InstrumentRange"] = &fakeNode{class: ua.NodeClassVariable, browseName: "InstrumentRange",
+		value: ua.NewExtensionObject(&ua.Range{Low: 4, High: 20})}
+
+	nodes, _, err := Browse(context.Background(), s, BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Plant"), MaxDepth: 2},
+		BrowseOptions{Workers: 2, BatchSize: 2, EngineeringUnits: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := nodes[0].Children[0].Children[0]
+	if got.Unit != "°C" || got.Min != "0" || got.Max != "100" || got.InstrumentMin != "4" || got.InstrumentMax != "20" || got.Scale != "6.25" {
+		t.Errorf("unexpected metadata %+v", got)
+	}
+	if other := nodes[0].Children[0].Children[1]; other.Unit != "" || other.Scale != "" {
+		t.Errorf("unexpected metadata on %s: %+v", other.Path, other)
+	}
+}
+
+func TestBrowseDataTypes(t *testing.T) {
+	s := newFakePlant()
+	dataTypes := map[string]*fakeNode{
+		"i=11":        {class: ua.NodeClassDataType, browseName: "Double", refs: map[uint32][]string{id.HasSubtype: {"ns=1;i=4000"}}},
+		"ns=1;i=4000": {class: ua.NodeClassDataType, browseName: "Ratio", refs: map[uint32][]string{id.HasSubtype: {"ns=1;i=4001"}}},
+		"ns=1;i=4001": {class: ua.NodeClassDataType, browseName: "Percent"},
+		"i=29":        {class: ua.NodeClassDataType, browseName: "Enumeration", refs: map[uint32][]string{id.HasSubtype: {"ns=1;i=3000"}}},
+		"ns=1;i=3000": {class: ua.NodeClassDataType, browseName: "MachineMode", refs: map[uint32][]string{id.HasProperty: {"ns=1;i=3001"}}},
+		"ns=1;i=3001": {class: ua.NodeClassVariable, browseName: "EnumStrings",
+			value: []*ua.LocalizedText{{Text: "Off"}, {Text: "Manual"}, {Text: "Auto"}}},
+		"i=22":        {class: ua.NodeClassDataType, browseName: "Structure", refs: map[uint32][]string{id.HasSubtype: {"ns=1;i=5000"}}},
+		"ns=1;i=5000": {class: ua.NodeClassDataType, browseName: "Vector"},
+		"ns=1;i=6000": {class: ua.NodeClassDataType, browseName: "Orphan"},
+	}
+	for nodeID, n := range dataTypes {
+		s.nodes[nodeID] = n
+	}
+
+	machine := s.nodes["ns=1;s=Machine1"]
+	variables := map[string]*fakeNode{
+		"Count":   {dataType: id.Int64},
+		"Id":      {dataType: id.GUID},
+		"Started": {dataType: id.UtcTime},
+		"Level":   {dataTypeID: "ns=1;i=4001"},
+		"Mode":    {dataTypeID: "ns=1;i=3000"},
+		"Samples": {dataType: id.Double, array: true},
+		"Vector":  {dataTypeID: "ns=1;i=5000"},
+		"Custom":  {dataTypeID: "ns=1;i=6000"},
+	}
+	for name, n := range variables {
+		n.class = ua.NodeClassVariable
+		n.browseName = name
+		s.nodes["ns=1;s=Machine1."+name] = n
+		machine.refs[id.HasComponent] = append(machine.refs[id.HasComponent], "ns=1;s=Machine1."+name)
+	}
+
+	nodes, _, err := Browse(context.Background(), s, BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Plant")}, BrowseOptions{Workers: 2, BatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]NodeDef{}
+	for _, child := range nodes[0].Children[0].Children {
+		got[child.BrowseName] = child
+	}
+
+	for _, tt := range []struct {
+		name, dataType, dataTypeName string
+		storable                     bool
+	}{
+		{"Value1", "float64", "Double", true},
+		{"Count", "int64", "Int64", true},
+		{"Id", "ua.GUID", "GUID", false},
+		{"Started", "time.Time", "UtcTime", false},
+		{"Level", "float64", "Percent", true},
+		{"Mode", "int32", "MachineMode", true},
+		{"Samples", "[]float64", "Double", false},
+		{"Vector", "ua.ExtensionObject", "Vector", false},
+		{"Custom", "ns=1;i=6000", "Orphan", false},
+	} {
+		def := got[tt.name]
+		if def.DataType != tt.dataType || def.DataTypeName != tt.dataTypeName || def.Storable != tt.storable {
+			t.Errorf("%s: got %s (%s) storable %t, want %s (%s) storable %t", tt.name, def.DataType, def.DataTypeName, def.Storable, tt.dataType, tt.dataTypeName, tt.storable)
+		}
+		if def.Storable == (def.TypeWarning != "") {
+			t.Errorf("%s: storable %t with warning %q", tt.name, def.Storable, def.TypeWarning)
+		}
+	}
+	if mode := got["Mode"].EnumValues; len(mode) != 3 || mode[2] != "Auto" {
+		t.Errorf("unexpected enum values %v", mode)
+	}
+}
+
+func TestBrowseNamespaceURIs(t *testing.T) {
+	s := newFakePlant()
+	nodes, _, err := Browse(context.Background(), s, BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Plant"), MaxDepth: 1}, BrowseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := nodes[0].Children[0]
+	if machine.NamespaceURI != "urn:fake:plant" {
+		t.Fatalf("got namespace %q, want urn:fake:plant", machine.NamespaceURI)
+	}
+	if got := ExpandedNodeID(machine.NodeID, machine.NamespaceURI); got != "nsu=urn:fake:plant;s=Machine1" {
+		t.Errorf("got expanded node id %s", got)
+	}
+	if got := ExpandedNodeID(ua.NewNumericNodeID(0, 85), ""); got != "i=85" {
+		t.Errorf("got %s for a node without namespace URI", got)
+	}
+}
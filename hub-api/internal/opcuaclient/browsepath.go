@@ -0,0 +1,107 @@
+package opcuaclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxPathsPerTranslate is the number of browse paths translated in a single request.
+const maxPathsPerTranslate = 100
+
+// PathClient is the part of *opcua.Client used to translate browse paths to node ids.
+type PathClient interface {
+	Send(ctx context.Context, req ua.Request, h func(ua.Response) error) error
+}
+
+// BrowsePath is a path of browse names from a starting node, each name followed along the
+// hierarchical references of the node before it.
+type BrowsePath struct {
+	StartingNode *ua.NodeID
+	// Names are qualified names formatted by FormatQualifiedName.
+	Names []string
+}
+
+// PathResult is the node id a BrowsePath resolves to, or the status returned for a path that
+// does not resolve.
+type PathResult struct {
+	NodeID *ua.NodeID
+	Status ua.StatusCode
+}
+
+// FormatQualifiedName formats a browse name as its namespace index and name, such as 2:Speed.
+func FormatQualifiedName(qn *ua.QualifiedName) string {
+	return fmt.Sprintf("%d:%s", qn.NamespaceIndex, qn.Name)
+}
+
+// ParseQualifiedName parses a browse name formatted by FormatQualifiedName. A name without a
+// namespace index is in namespace 0.
+func ParseQualifiedName(s string) *ua.QualifiedName {
+	if i := strings.Index(s, ":"); i > 0 {
+		if ns, err := strconv.ParseUint(s[:i], 10, 16); err == nil {
+			return &ua.QualifiedName{NamespaceIndex: uint16(ns), Name: s[i+1:]}
+		}
+	}
+	return &ua.QualifiedName{Name: s}
+}
+
+// TranslateBrowsePaths resolves the paths with the TranslateBrowsePathsToNodeIds service, at
+// most maxPathsPerTranslate paths per request. The results are returned in the order of paths.
+// A path is resolved to the first target the server returns for the whole path; a path with no
+// such target has the status BadNoMatch.
+func TranslateBrowsePaths(ctx context.Context, c PathClient, paths []BrowsePath) ([]PathResult, error) {
+	results := make([]PathResult, 0, len(paths))
+	for _, b := range batch(paths, maxPathsPerTranslate) {
+		req := &ua.TranslateBrowsePathsToNodeIDsRequest{}
+		for _, p := range b {
+			req.BrowsePaths = append(req.BrowsePaths, &ua.BrowsePath{StartingNode: p.StartingNode, RelativePath: relativePath(p.Names)})
+		}
+
+		var res *ua.TranslateBrowsePathsToNodeIDsResponse
+		err := c.Send(ctx, req, func(r ua.Response) error {
+			var ok bool
+			if res, ok = r.(*ua.TranslateBrowsePathsToNodeIDsResponse); !ok {
+				return fmt.Errorf("unexpected response %T", r)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("translating browse paths: %w", err)
+		}
+		if len(res.Results) != len(b) {
+			return nil, fmt.Errorf("translate returned %d results for %d paths", len(res.Results), len(b))
+		}
+
+		for _, r := range res.Results {
+			result := PathResult{Status: r.StatusCode}
+			if r.StatusCode == ua.StatusOK {
+				result.Status = ua.StatusBadNoMatch
+				for _, target := range r.Targets {
+					if target.RemainingPathIndex == math.MaxUint32 && target.TargetID != nil && target.TargetID.ServerIndex == 0 {
+						result = PathResult{NodeID: target.TargetID.NodeID, Status: ua.StatusOK}
+						break
+					}
+				}
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// relativePath follows the names along hierarchical references and their subtypes.
+func relativePath(names []string) *ua.RelativePath {
+	path := &ua.RelativePath{Elements: []*ua.RelativePathElement{}}
+	for _, name := range names {
+		path.Elements = append(path.Elements, &ua.RelativePathElement{
+			ReferenceTypeID: ua.NewTwoByteNodeID(id.HierarchicalReferences),
+			IncludeSubtypes: true,
+			TargetName:      ParseQualifiedName(name),
+		})
+	}
+	return path
+}
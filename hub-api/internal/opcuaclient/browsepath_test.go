@@ -0,0 +1,67 @@
+package opcuaclient
+
+import (
+	"context"
+	"github.com/gopcua/opcua/ua"
+	"strings"
+	"testing"
+)
+
+func TestTranslateBrowsePaths(t *testing.T) {
+	set, err := ReadNodeSet2(strings.NewReader(machineNodeSet), []string{"http://opcfoundation.org/UA/", "urn:server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := browseNodeSet(t, set)
+
+	temperature := findDef(objects.Children, "Objects.Machine1.Temperature")
+	if want := []string{"2:Machine1", "2:Temperature"}; strings.Join(temperature.BrowsePath, "/") != strings.Join(want, "/") {
+		t.Fatalf("expected the browse path %v, got %v", want, temperature.BrowsePath)
+	}
+	if len(objects.BrowsePath) != 0 {
+		t.Errorf("expected no browse path for the root, got %v", objects.BrowsePath)
+	}
+
+	results, err := TranslateBrowsePaths(context.Background(), set, []BrowsePath{
+		{StartingNode: objects.NodeID, Names: temperature.BrowsePath},
+		{StartingNode: objects.NodeID, Names: []string{"2:Machine1", "Temperature"}},
+		{StartingNode: ua.NewStringNodeID(2, "Unknown"), Names: temperature.BrowsePath},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %+v", results)
+	}
+	if results[0].Status != ua.StatusOK || results[0].NodeID.String() != "ns=2;s=Machine1.Temperature" {
+		t.Errorf("unexpected result %+v", results[0])
+	}
+	// The browse name of the temperature is in the namespace of the document, not namespace 0
+	if results[1].Status != ua.StatusBadNoMatch {
+		t.Errorf("expected no match, got %+v", results[1])
+	}
+	if results[2].Status != ua.StatusBadNodeIDUnknown {
+		t.Errorf("expected an unknown starting node, got %+v", results[2])
+	}
+}
+
+func TestParseQualifiedName(t *testing.T) {
+	for s, want := range map[string]ua.QualifiedName{
+		"2:Speed":      {NamespaceIndex: 2, Name: "Speed"},
+		"0:Objects":    {Name: "Objects"},
+		"Speed":        {Name: "Speed"},
+		"3:Line:1":     {NamespaceIndex: 3, Name: "Line:1"},
+		"Line:1":       {Name: "Line:1"},
+		"70000:Speed":  {Name: "70000:Speed"},
+		":Speed":       {Name: ":Speed"},
+		"1:":           {NamespaceIndex: 1},
+		"12:Temp.Oven": {NamespaceIndex: 12, Name: "Temp.Oven"},
+	} {
+		if got := ParseQualifiedName(s); *got != want {
+			t.Errorf("%q: expected %+v, got %+v", s, want, *got)
+		}
+	}
+	if s := FormatQualifiedName(&ua.QualifiedName{NamespaceIndex: 3, Name: "Line:1"}); s != "3:Line:1" {
+		t.Errorf("unexpected format %q", s)
+	}
+}
@@ -0,0 +1,359 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"strings"
+)
+
+// Special values of the ValueRank attribute. Values of 1 and above are the number of array dimensions.
+const (
+	valueRankScalarOrOneDimension int32 = -3
+	valueRankAny                  int32 = -2
+	valueRankScalar               int32 = -1
+	valueRankOneOrMoreDimensions  int32 = 0
+)
+
+// maxSubtypeDepth limits how many HasSubtype references are followed to find the builtin type of a data type.
+const maxSubtypeDepth = 20
+
+// builtinTypes maps the OPC UA builtin data types, and the abstract numeric types, to the Go
+// types their values are decoded into.
+var builtinTypes = map[uint32]string{
+	id.Boolean:        "bool",
+	id.SByte:          "int8",
+	id.Byte:           "byte",
+	id.Int16:          "int16",
+	id.UInt16:         "uint16",
+	id.Int32:          "int32",
+	id.UInt32:         "uint32",
+	id.Int64:          "int64",
+	id.UInt64:         "uint64",
+	id.Float:          "float32",
+	id.Double:         "float64",
+	id.String:         "string",
+	id.DateTime:       "time.Time",
+	id.GUID:           "ua.GUID",
+	id.ByteString:     "[]byte",
+	id.XMLElement:     "ua.XMLElement",
+	id.NodeID:         "ua.NodeID",
+	id.ExpandedNodeID: "ua.ExpandedNodeID",
+	id.StatusCode:     "ua.StatusCode",
+	id.QualifiedName:  "ua.QualifiedName",
+	id.LocalizedText:  "ua.LocalizedText",
+	id.Structure:      "ua.ExtensionObject",
+	id.DataValue:      "ua.DataValue",
+	id.BaseDataType:   "ua.Variant",
+	id.DiagnosticInfo: "ua.DiagnosticInfo",
+	id.Number:         "number",
+	id.Integer:        "integer",
+	id.UInteger:       "uinteger",
+	id.Enumeration:    "int32",
+}
+
+// knownSubtypes maps frequently used subtypes from namespace 0 to their builtin type,
+// saving the requests to look them up on the server.
+var knownSubtypes = map[uint32]uint32{
+	id.UtcTime:                        id.DateTime,
+	id.Duration:                       id.Double,
+	id.IntegerID:                      id.UInt32,
+	id.Counter:                        id.UInt32,
+	id.Index:                          id.UInt32,
+	id.LocaleID:                       id.String,
+	id.NumericRange:                   id.String,
+	id.NormalizedString:               id.String,
+	id.DecimalString:                  id.String,
+	id.DurationString:                 id.String,
+	id.TimeString:                     id.String,
+	id.DateString:                     id.String,
+	id.Image:                          id.ByteString,
+	id.ImageBMP:                       id.ByteString,
+	id.ImageGIF:                       id.ByteString,
+	id.ImageJPG:                       id.ByteString,
+	id.ImagePNG:                       id.ByteString,
+	id.AudioDataType:                  id.ByteString,
+	id.ApplicationInstanceCertificate: id.ByteString,
+}
+
+// telegrafFieldTypes are the builtin types whose values Telegraf can store as fields.
+// Values of other types are dropped by Telegraf.
+var telegrafFieldTypes = map[uint32]bool{
+	id.Boolean:      true,
+	id.SByte:        true,
+	id.Byte:         true,
+	id.Int16:        true,
+	id.UInt16:       true,
+	id.Int32:        true,
+	id.UInt32:       true,
+	id.Int64:        true,
+	id.UInt64:       true,
+	id.Float:        true,
+	id.Double:       true,
+	id.String:       true,
+	id.ByteString:   true,
+	id.BaseDataType: true,
+	id.Number:       true,
+	id.Integer:      true,
+	id.UInteger:     true,
+	id.Enumeration:  true,
+}
+
+// dataType is what is known about a DataType node of the server.
+type dataType struct {
+	name string
+	// builtin is the builtin type the values are encoded as, 0 if it could not be found.
+	builtin    uint32
+	enumValues map[int64]string
+}
+
+// builtinType returns the builtin type of a data type from namespace 0 that can be resolved
+// without asking the server.
+func builtinType(dt *ua.NodeID) (uint32, bool) {
+	if dt == nil || dt.Namespace() != 0 || dt.Type() != ua.NodeIDTypeNumeric && dt.Type() != ua.NodeIDTypeTwoByte && dt.Type() != ua.NodeIDTypeFourByte {
+		return 0, false
+	}
+	if _, ok := builtinTypes[dt.IntID()]; ok {
+		return dt.IntID(), true
+	}
+	v, ok := knownSubtypes[dt.IntID()]
+	return v, ok
+}
+
+// setDataType sets the data type of the definition from its DataType attribute. Data types that
+// are not builtin keep their node id until resolveDataTypes finds their builtin type.
+func (def *NodeDef) setDataType(dt *ua.NodeID) {
+	def.DataTypeID = dt
+	if builtin, ok := builtinType(dt); ok {
+		def.DataType = builtinTypes[builtin]
+		def.DataTypeName = id.Name(dt.IntID())
+		return
+	}
+	def.DataType = dt.String()
+}
+
+// applyDataType sets the data type of the definition from a data type resolved on the server.
+func (def *NodeDef) applyDataType(t *dataType) {
+	def.DataTypeName = t.name
+	def.EnumValues = t.enumValues
+	if t.builtin != 0 {
+		def.DataType = builtinTypes[t.builtin]
+	}
+}
+
+// checkValueType adds the array dimensions to the data type of a Variable whose values are encoded
+// as builtin, and records whether Telegraf can store these values as fields.
+func (def *NodeDef) checkValueType(builtin uint32) {
+	if def.NodeClass != ua.NodeClassVariable {
+		return
+	}
+
+	switch {
+	case def.ValueRank >= valueRankOneOrMoreDimensions:
+		dims := int(def.ValueRank)
+		if dims == 0 {
+			dims = 1
+		}
+		def.DataType = strings.Repeat("[]", dims) + def.DataType
+		def.TypeWarning = fmt.Sprintf("Telegraf cannot store arrays of %s as fields", def.DataTypeName)
+	case builtin == 0:
+		def.TypeWarning = fmt.Sprintf("Telegraf cannot store values of the unknown data type %s", def.DataType)
+	case !telegrafFieldTypes[builtin]:
+		def.TypeWarning = fmt.Sprintf("Telegraf cannot store %s values as fields", def.DataTypeName)
+	}
+	def.Storable = def.TypeWarning == ""
+}
+
+// resolveDataTypes finds the builtin type of every Variable in items whose data type is not
+// builtin, and checks whether Telegraf can store the values of every Variable.
+func (b *browser) resolveDataTypes(ctx context.Context, items []*browseItem) error {
+	var unknown []*ua.NodeID
+	for _, item := range items {
+		dt := item.def.DataTypeID
+		if item.def.NodeClass != ua.NodeClassVariable || dt == nil {
+			continue
+		}
+		if _, ok := builtinType(dt); ok {
+			continue
+		}
+		if _, ok := b.types[dt.String()]; !ok {
+			b.types[dt.String()] = &dataType{name: dt.String()}
+			unknown = append(unknown, dt)
+		}
+	}
+	if len(unknown) > 0 {
+		if err := b.readDataTypes(ctx, unknown); err != nil {
+			return err
+		}
+	}
+
+	for _, item := range items {
+		if item.def.NodeClass != ua.NodeClassVariable {
+			continue
+		}
+		builtin, ok := builtinType(item.def.DataTypeID)
+		if !ok && item.def.DataTypeID != nil {
+			t := b.types[item.def.DataTypeID.String()]
+			item.def.applyDataType(t)
+			builtin = t.builtin
+		}
+		item.def.checkValueType(builtin)
+	}
+	return nil
+}
+
+// readDataTypes reads the names of the data types, follows their HasSubtype references up to the
+// nearest builtin type and reads the value names of enumerations.
+func (b *browser) readDataTypes(ctx context.Context, dts []*ua.NodeID) error {
+	names, err := b.readValues(ctx, dts, ua.AttributeIDBrowseName)
+	if err != nil {
+		return fmt.Errorf("reading data type names: %w", err)
+	}
+	for i, dt := range dts {
+		if names[i].Status == ua.StatusOK && names[i].Value != nil {
+			b.types[dt.String()].name = names[i].Value.String()
+		}
+	}
+
+	// The supertypes of all data types are requested together, one level of the type hierarchy at a time
+	type chain struct {
+		t       *dataType
+		current *ua.NodeID
+	}
+	var chains []chain
+	for _, dt := range dts {
+		chains = append(chains, chain{t: b.types[dt.String()], current: dt})
+	}
+	for depth := 0; len(chains) > 0 && depth < maxSubtypeDepth; depth++ {
+		current := make([]*ua.NodeID, len(chains))
+		for i, c := range chains {
+			current[i] = c.current
+		}
+		supertypes, err := b.supertypes(ctx, current)
+		if err != nil {
+			return err
+		}
+
+		var next []chain
+		for i, c := range chains {
+			super := supertypes[i]
+			if super == nil {
+				util.Logger.Warnf("Data type %s is not a subtype of a builtin type", c.t.name)
+				continue
+			}
+			if builtin, ok := builtinType(super); ok {
+				c.t.builtin = builtin
+				continue
+			}
+			if t, ok := b.types[super.String()]; ok && t.builtin != 0 {
+				c.t.builtin = t.builtin
+				continue
+			}
+			c.current = super
+			next = append(next, c)
+		}
+		chains = next
+	}
+	for _, c := range chains {
+		util.Logger.Warnf("Gave up looking for the builtin type of data type %s after %d supertypes", c.t.name, maxSubtypeDepth)
+	}
+
+	var enums []*ua.NodeID
+	for _, dt := range dts {
+		if b.types[dt.String()].builtin == id.Enumeration {
+			enums = append(enums, dt)
+		}
+	}
+	if len(enums) == 0 {
+		return nil
+	}
+	return b.readEnumValues(ctx, enums)
+}
+
+// supertypes returns the data type each of the data types is a subtype of, or nil for none.
+func (b *browser) supertypes(ctx context.Context, dts []*ua.NodeID) ([]*ua.NodeID, error) {
+	size := b.opts.BatchSize
+	batches := batch(dts, size)
+	supertypes := make([]*ua.NodeID, len(dts))
+	err := b.run(ctx, len(batches), func(ctx context.Context, i int) error {
+		req := &ua.BrowseRequest{View: &ua.ViewDescription{ViewID: ua.NewTwoByteNodeID(0)}}
+		for _, dt := range batches[i] {
+			req.NodesToBrowse = append(req.NodesToBrowse, &ua.BrowseDescription{
+				NodeID:          dt,
+				BrowseDirection: ua.BrowseDirectionInverse,
+				ReferenceTypeID: ua.NewNumericNodeID(0, id.HasSubtype),
+				NodeClassMask:   uint32(ua.NodeClassDataType),
+				ResultMask:      uint32(ua.BrowseResultMaskAll),
+			})
+		}
+
+		refs, err := b.browse(ctx, req)
+		if err != nil {
+			return err
+		}
+		for j := range batches[i] {
+			if len(refs[j]) > 0 {
+				supertypes[i*size+j] = refs[j][0].NodeID.NodeID
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return supertypes, nil
+}
+
+// readEnumValues reads the EnumStrings or EnumValues property of the enumerations.
+func (b *browser) readEnumValues(ctx context.Context, enums []*ua.NodeID) error {
+	props, err := b.findProperties(ctx, enums, "EnumStrings", "EnumValues")
+	if err != nil {
+		return err
+	}
+
+	var (
+		propIDs []*ua.NodeID
+		owners  []*dataType
+	)
+	for i, found := range props {
+		for _, nodeID := range found {
+			propIDs = append(propIDs, nodeID)
+			owners = append(owners, b.types[enums[i].String()])
+		}
+	}
+
+	values, err := b.readValues(ctx, propIDs, ua.AttributeIDValue)
+	if err != nil {
+		return fmt.Errorf("reading enumeration values: %w", err)
+	}
+	for i, v := range values {
+		if v.Status == ua.StatusOK && v.Value != nil {
+			owners[i].setEnumValues(v.Value)
+		}
+	}
+	return nil
+}
+
+// setEnumValues stores the value names from an EnumStrings or EnumValues property.
+func (t *dataType) setEnumValues(v *ua.Variant) {
+	values := map[int64]string{}
+	switch names := v.Value().(type) {
+	case []*ua.LocalizedText:
+		for i, name := range names {
+			if name != nil {
+				values[int64(i)] = name.Text
+			}
+		}
+	case []*ua.ExtensionObject:
+		for _, eo := range names {
+			if ev, ok := eo.Value.(*ua.EnumValueType); ok && ev.DisplayName != nil {
+				values[ev.Value] = ev.DisplayName.Text
+			}
+		}
+	}
+	if len(values) > 0 {
+		t.enumValues = values
+	}
+}
@@ -0,0 +1,225 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"net"
+	"strings"
+	"time"
+)
+
+// The problems reported by TestConnection.
+const (
+	ProblemTimeout              = "timeout"
+	ProblemUnreachable          = "unreachable"
+	ProblemNoMatchingEndpoint   = "noMatchingEndpoint"
+	ProblemTokenTypeNotAccepted = "userTokenTypeNotAccepted"
+	ProblemServerCertificate    = "serverCertificateRejected"
+	ProblemClientCertificate    = "clientCertificateRejected"
+	ProblemBadUser              = "badUser"
+	ProblemServerError          = "serverError"
+	ProblemOther                = "other"
+)
+
+// Endpoint is an endpoint of a server as returned by GetEndpoints. The security policy, mode
+// and user token types use the names accepted by the server settings.
+type Endpoint struct {
+	EndpointURL                 string   `json:"endpointURL"`
+	SecurityPolicy              string   `json:"securityPolicy"`
+	SecurityPolicyURI           string   `json:"securityPolicyURI"`
+	SecurityMode                string   `json:"securityMode"`
+	SecurityLevel               uint8    `json:"securityLevel"`
+	UserTokenTypes              []string `json:"userTokenTypes"`
+	ServerCertificateThumbprint string   `json:"serverCertificateThumbprint,omitempty"`
+}
+
+// Application is a server as returned by FindServers.
+type Application struct {
+	ApplicationURI  string   `json:"applicationURI"`
+	ProductURI      string   `json:"productURI"`
+	ApplicationName string   `json:"applicationName"`
+	ApplicationType string   `json:"applicationType"`
+	DiscoveryURLs   []string `json:"discoveryURLs"`
+}
+
+// Discovery lists the servers known to a discovery URL and the endpoints it offers.
+type Discovery struct {
+	URL       string        `json:"url"`
+	Servers   []Application `json:"servers"`
+	Endpoints []Endpoint    `json:"endpoints"`
+}
+
+// ConnectionTest is the outcome of opening a session with a server. Problem is one of the
+// Problem constants when the session could not be opened.
+type ConnectionTest struct {
+	OK          bool    `json:"ok"`
+	Problem     string  `json:"problem,omitempty"`
+	Message     string  `json:"message"`
+	ServerState string  `json:"serverState,omitempty"`
+	Seconds     float64 `json:"seconds"`
+}
+
+// Discover calls GetEndpoints and FindServers on url. Servers that do not implement
+// FindServers are listed without applications.
+func Discover(ctx context.Context, url string) (Discovery, error) {
+	d := Discovery{URL: url, Servers: []Application{}, Endpoints: []Endpoint{}}
+
+	endpoints, err := opcua.GetEndpoints(ctx, url)
+	if err != nil {
+		return d, fmt.Errorf("getting endpoints from %s: %w", url, err)
+	}
+	for _, ep := range endpoints {
+		d.Endpoints = append(d.Endpoints, newEndpoint(ep))
+	}
+
+	servers, err := opcua.FindServers(ctx, url)
+	if err != nil {
+		util.Logger.Warnf("Failed to find servers on %s: %s", url, err)
+		return d, nil
+	}
+	for _, s := range servers {
+		d.Servers = append(d.Servers, newApplication(s))
+	}
+	return d, nil
+}
+
+// newEndpoint converts an EndpointDescription into an Endpoint.
+func newEndpoint(ep *ua.EndpointDescription) Endpoint {
+	e := Endpoint{
+		EndpointURL:       ep.EndpointURL,
+		SecurityPolicy:    strings.TrimPrefix(ep.SecurityPolicyURI, ua.SecurityPolicyURIPrefix),
+		SecurityPolicyURI: ep.SecurityPolicyURI,
+		SecurityMode:      strings.TrimPrefix(ep.SecurityMode.String(), "MessageSecurityMode"),
+		SecurityLevel:     ep.SecurityLevel,
+		UserTokenTypes:    []string{},
+	}
+	seen := map[ua.UserTokenType]bool{}
+	for _, t := range ep.UserIdentityTokens {
+		if !seen[t.TokenType] {
+			seen[t.TokenType] = true
+			e.UserTokenTypes = append(e.UserTokenTypes, strings.TrimPrefix(t.TokenType.String(), "UserTokenType"))
+		}
+	}
+	if len(ep.ServerCertificate) > 0 {
+		e.ServerCertificateThumbprint = Thumbprint(ep.ServerCertificate)
+	}
+	return e
+}
+
+// newApplication converts an ApplicationDescription into an Application.
+func newApplication(s *ua.ApplicationDescription) Application {
+	a := Application{
+		ApplicationURI:  s.ApplicationURI,
+		ProductURI:      s.ProductURI,
+		ApplicationType: strings.TrimPrefix(s.ApplicationType.String(), "ApplicationType"),
+		DiscoveryURLs:   s.DiscoveryURLs,
+	}
+	if s.ApplicationName != nil {
+		a.ApplicationName = s.ApplicationName.Text
+	}
+	if a.DiscoveryURLs == nil {
+		a.DiscoveryURLs = []string{}
+	}
+	return a
+}
+
+// TestConnection opens a session with the settings in sec and reads the state of the server.
+// It reports why the session could not be opened instead of returning an error.
+func TestConnection(ctx context.Context, sec SecurityConfig) ConnectionTest {
+	start := time.Now()
+	state, err := serverState(ctx, sec)
+	t := ConnectionTest{Seconds: time.Since(start).Seconds()}
+	if err != nil {
+		t.Problem, t.Message = diagnose(err)
+		return t
+	}
+	t.OK = true
+	t.ServerState = state
+	t.Message = fmt.Sprintf("Connected to %s, the server is %s", sec.Endpoint, state)
+	return t
+}
+
+// serverState connects to the server in sec and reads the State of its ServerStatus.
+func serverState(ctx context.Context, sec SecurityConfig) (string, error) {
+	c, err := NewClient(ctx, sec)
+	if err != nil {
+		return "", err
+	}
+	if err := c.Connect(ctx); err != nil {
+		return "", fmt.Errorf("connecting to %s: %w", sec.Endpoint, err)
+	}
+	defer c.Close(ctx)
+
+	res, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: []*ua.ReadValueID{{
+		NodeID:      ua.NewNumericNodeID(0, id.Server_ServerStatus_State),
+		AttributeID: ua.AttributeIDValue,
+	}}})
+	if err != nil {
+		return "", fmt.Errorf("reading server state: %w", err)
+	}
+	if len(res.Results) != 1 || res.Results[0].Status != ua.StatusOK || res.Results[0].Value == nil {
+		return "", fmt.Errorf("reading server state: no value returned")
+	}
+	switch v := res.Results[0].Value.Value().(type) {
+	case int32:
+		return strings.TrimPrefix(ua.ServerState(v).String(), "ServerState"), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// diagnose returns the problem behind an error opening a session and a message explaining it.
+func diagnose(err error) (string, string) {
+	var code ua.StatusCode
+	isStatus := errors.As(err, &code)
+	var netErr net.Error
+	var opErr *net.OpError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), isStatus && code == ua.StatusBadTimeout,
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ProblemTimeout, "The server did not respond in time: " + err.Error()
+	case errors.Is(err, ErrNoMatchingEndpoint):
+		return ProblemNoMatchingEndpoint, "The server has no endpoint with this security policy and mode: " + err.Error()
+	case errors.Is(err, ErrTokenTypeNotAccepted):
+		return ProblemTokenTypeNotAccepted, "The endpoint does not accept this authentication method: " + err.Error()
+	case errors.Is(err, ErrServerCertificateRejected):
+		return ProblemServerCertificate, "The hub does not trust the certificate of the server: " + err.Error()
+	case isStatus && isUserStatus(code):
+		return ProblemBadUser, "The server rejected the user: " + StatusName(code)
+	case isStatus && isCertificateStatus(code):
+		return ProblemClientCertificate, "The server rejected the certificate of the hub, trust it on the server: " + StatusName(code)
+	case isStatus:
+		return ProblemServerError, "The server returned " + StatusName(code) + ": " + err.Error()
+	case errors.As(err, &opErr):
+		return ProblemUnreachable, "The server cannot be reached: " + err.Error()
+	default:
+		return ProblemOther, err.Error()
+	}
+}
+
+// isUserStatus reports whether a status code rejects the user identity.
+func isUserStatus(code ua.StatusCode) bool {
+	switch code {
+	case ua.StatusBadUserAccessDenied, ua.StatusBadIdentityTokenInvalid, ua.StatusBadIdentityTokenRejected,
+		ua.StatusBadUserSignatureInvalid:
+		return true
+	}
+	return false
+}
+
+// isCertificateStatus reports whether a status code rejects the client certificate.
+func isCertificateStatus(code ua.StatusCode) bool {
+	switch code {
+	case ua.StatusBadCertificateInvalid, ua.StatusBadCertificateTimeInvalid, ua.StatusBadCertificateURIInvalid,
+		ua.StatusBadCertificateUseNotAllowed, ua.StatusBadCertificateUntrusted, ua.StatusBadCertificateRevoked,
+		ua.StatusBadSecurityChecksFailed, ua.StatusBadSecurityPolicyRejected:
+		return true
+	}
+	return false
+}
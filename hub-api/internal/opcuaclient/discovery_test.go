@@ -0,0 +1,58 @@
+package opcuaclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua/ua"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNewEndpoint(t *testing.T) {
+	ep := newEndpoint(&ua.EndpointDescription{
+		EndpointURL:       "opc.tcp://plc:4840",
+		SecurityPolicyURI: ua.SecurityPolicyURIBasic256Sha256,
+		SecurityMode:      ua.MessageSecurityModeSignAndEncrypt,
+		SecurityLevel:     3,
+		UserIdentityTokens: []*ua.UserTokenPolicy{
+			{PolicyID: "anonymous", TokenType: ua.UserTokenTypeAnonymous},
+			{PolicyID: "username_basic256", TokenType: ua.UserTokenTypeUserName},
+			{PolicyID: "username_none", TokenType: ua.UserTokenTypeUserName},
+		},
+	})
+
+	if ep.SecurityPolicy != "Basic256Sha256" || ep.SecurityMode != "SignAndEncrypt" || ep.SecurityLevel != 3 {
+		t.Errorf("unexpected endpoint %+v", ep)
+	}
+	if want := []string{"Anonymous", "UserName"}; !reflect.DeepEqual(ep.UserTokenTypes, want) {
+		t.Errorf("token types: got %v, want %v", ep.UserTokenTypes, want)
+	}
+	for _, name := range ep.UserTokenTypes {
+		if _, err := ParseAuthMethod(name); err != nil {
+			t.Errorf("token type %s is not an auth method: %v", name, err)
+		}
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("getting endpoints: %w", context.DeadlineExceeded), ProblemTimeout},
+		{fmt.Errorf("connecting: %w", &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}), ProblemUnreachable},
+		{fmt.Errorf("%w: none with Basic256Sha256", ErrNoMatchingEndpoint), ProblemNoMatchingEndpoint},
+		{fmt.Errorf("%w: endpoint does not accept UserName", ErrTokenTypeNotAccepted), ProblemTokenTypeNotAccepted},
+		{fmt.Errorf("%w: \"plc\" is not trusted", ErrServerCertificateRejected), ProblemServerCertificate},
+		{fmt.Errorf("connecting: %w", ua.StatusBadUserAccessDenied), ProblemBadUser},
+		{fmt.Errorf("connecting: %w", ua.StatusBadIdentityTokenRejected), ProblemBadUser},
+		{fmt.Errorf("connecting: %w", ua.StatusBadSecurityChecksFailed), ProblemClientCertificate},
+		{fmt.Errorf("connecting: %w", ua.StatusBadTooManySessions), ProblemServerError},
+		{fmt.Errorf("connecting: %w", ua.StatusBadTimeout), ProblemTimeout},
+	} {
+		if got, _ := diagnose(tc.err); got != tc.want {
+			t.Errorf("diagnose(%v): got %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultEventFields are the event fields selected when OPCUA_EVENT_FIELDS is not set.
+var defaultEventFields = []string{"EventType", "Severity", "Message", "SourceName", "ConditionName", "ActiveState/Id"}
+
+// eventFieldTypes are the event types that define the fields which are not defined by BaseEventType.
+var eventFieldTypes = map[string]uint32{
+	"ConditionName":      id.ConditionType,
+	"ConditionClassName": id.ConditionType,
+	"BranchId":           id.ConditionType,
+	"Retain":             id.ConditionType,
+	"EnabledState":       id.ConditionType,
+	"Quality":            id.ConditionType,
+	"LastSeverity":       id.ConditionType,
+	"Comment":            id.ConditionType,
+	"ClientUserId":       id.ConditionType,
+	"AckedState":         id.AcknowledgeableConditionType,
+	"ConfirmedState":     id.AcknowledgeableConditionType,
+	"ActiveState":        id.AlarmConditionType,
+	"SuppressedState":    id.AlarmConditionType,
+	"InputNode":          id.AlarmConditionType,
+}
+
+// ErrEventsRefused is returned when the server refuses to report the events of some notifiers.
+var ErrEventsRefused = errors.New("server refused event subscription")
+
+// EventField is a field selected from the events of a notifier. Name is its browse path
+// separated by slashes, such as ActiveState/Id.
+type EventField struct {
+	Name           string
+	TypeDefinition *ua.NodeID
+	BrowsePath     []string
+}
+
+// EventFilterConfig is the EventFilter used to subscribe to events.
+type EventFilterConfig struct {
+	Fields []EventField
+	// MinSeverity leaves out the events with a lower Severity, 0 keeps all events.
+	MinSeverity uint16
+}
+
+// NewEventFilterConfig builds the EventFilterConfig from OPCUA_EVENT_FIELDS and
+// OPCUA_EVENT_MIN_SEVERITY.
+func NewEventFilterConfig(config util.Config) (EventFilterConfig, error) {
+	names := splitList(config.OpcUaEventFields)
+	if names == nil {
+		names = defaultEventFields
+	}
+	var filter EventFilterConfig
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		path := strings.Split(name, "/")
+		for _, part := range path {
+			if part == "" {
+				return filter, fmt.Errorf("invalid event field %q", name)
+			}
+		}
+		typeID := uint32(id.BaseEventType)
+		if t, ok := eventFieldTypes[path[0]]; ok {
+			typeID = t
+		}
+		filter.Fields = append(filter.Fields, EventField{Name: name, TypeDefinition: ua.NewNumericNodeID(0, typeID), BrowsePath: path})
+	}
+	if config.OpcUaEventMinSeverity != "" {
+		severity, err := strconv.ParseUint(config.OpcUaEventMinSeverity, 10, 16)
+		if err != nil || severity > 1000 {
+			return filter, fmt.Errorf("invalid event severity %q, expected 0 to 1000", config.OpcUaEventMinSeverity)
+		}
+		filter.MinSeverity = uint16(severity)
+	}
+	return filter, nil
+}
+
+// eventOperand selects a field of the events of typeDefinition.
+func eventOperand(typeDefinition *ua.NodeID, path []string) *ua.SimpleAttributeOperand {
+	operand := &ua.SimpleAttributeOperand{TypeDefinitionID: typeDefinition, AttributeID: ua.AttributeIDValue}
+	for _, name := range path {
+		operand.BrowsePath = append(operand.BrowsePath, &ua.QualifiedName{Name: name})
+	}
+	return operand
+}
+
+// EventFilter returns the filter sent to the server. The Time of the event is always selected
+// first, followed by the configured fields.
+func (f EventFilterConfig) EventFilter() *ua.EventFilter {
+	baseEventType := ua.NewNumericNodeID(0, id.BaseEventType)
+	filter := &ua.EventFilter{
+		SelectClauses: []*ua.SimpleAttributeOperand{eventOperand(baseEventType, []string{"Time"})},
+		WhereClause:   &ua.ContentFilter{},
+	}
+	for _, field := range f.Fields {
+		filter.SelectClauses = append(filter.SelectClauses, eventOperand(field.TypeDefinition, field.BrowsePath))
+	}
+	if f.MinSeverity > 0 {
+		filter.WhereClause.Elements = []*ua.ContentFilterElement{{
+			FilterOperator: ua.FilterOperatorGreaterThanOrEqual,
+			FilterOperands: []*ua.ExtensionObject{
+				ua.NewExtensionObject(eventOperand(baseEventType, []string{"Severity"})),
+				ua.NewExtensionObject(&ua.LiteralOperand{Value: ua.MustVariant(f.MinSeverity)}),
+			},
+		}}
+	}
+	return filter
+}
+
+// Event is an event reported by a notifier. Fields holds the selected fields the event has,
+// converted to strings, numbers and booleans.
+type Event struct {
+	NotifierID string                 `json:"notifierID"`
+	Time       time.Time              `json:"time"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+// EventSubscriber subscribes to the events of notifier nodes in one OPC UA subscription and
+// passes them to a handler.
+type EventSubscriber struct {
+	subscribe subscribeFunc
+	filter    EventFilterConfig
+	handle    func(events []Event)
+
+	mu         sync.Mutex
+	sub        subscription
+	done       chan struct{}
+	nextHandle uint32
+	notifiers  map[string]*eventNotifier
+	handles    map[uint32]*eventNotifier
+}
+
+// eventNotifier is a notifier with a monitored item in the subscription.
+type eventNotifier struct {
+	nodeID *ua.NodeID
+	handle uint32
+	itemID uint32
+}
+
+// NewEventSubscriber returns a subscriber that subscribes through session and passes the
+// events published at most once per interval to handle.
+func NewEventSubscriber(session *Session, interval time.Duration, filter EventFilterConfig, handle func(events []Event)) *EventSubscriber {
+	return newEventSubscriber(func(ctx context.Context, ch chan<- *opcua.PublishNotificationData) (subscription, error) {
+		c, err := session.Client(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return c.Subscribe(ctx, &opcua.SubscriptionParameters{Interval: interval}, ch)
+	}, filter, handle)
+}
+
+func newEventSubscriber(subscribe subscribeFunc, filter EventFilterConfig, handle func(events []Event)) *EventSubscriber {
+	return &EventSubscriber{
+		subscribe: subscribe,
+		filter:    filter,
+		handle:    handle,
+		notifiers: map[string]*eventNotifier{},
+		handles:   map[uint32]*eventNotifier{},
+	}
+}
+
+// SetNotifiers subscribes to the events of the notifiers that are not subscribed to yet and
+// stops the subscriptions of those that are not in nodeIDs. The subscription is deleted when
+// there are no notifiers. Notifiers the server refuses are reported in the error, the others
+// are still subscribed to.
+func (s *EventSubscriber) SetNotifiers(ctx context.Context, nodeIDs []*ua.NodeID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := map[string]*ua.NodeID{}
+	for _, nodeID := range nodeIDs {
+		wanted[nodeID.String()] = nodeID
+	}
+
+	var itemIDs []uint32
+	for key, notifier := range s.notifiers {
+		if _, ok := wanted[key]; !ok {
+			itemIDs = append(itemIDs, notifier.itemID)
+			s.forget(notifier)
+		}
+	}
+	if len(wanted) == 0 {
+		return s.cancelIfIdle(ctx)
+	}
+	if len(itemIDs) > 0 {
+		if _, err := s.sub.Unmonitor(ctx, itemIDs...); err != nil {
+			return fmt.Errorf("deleting monitored items: %w", err)
+		}
+	}
+
+	var requests []*ua.MonitoredItemCreateRequest
+	var created []*eventNotifier
+	for key, nodeID := range wanted {
+		if _, ok := s.notifiers[key]; ok {
+			continue
+		}
+		s.nextHandle++
+		notifier := &eventNotifier{nodeID: nodeID, handle: s.nextHandle}
+		req := opcua.NewMonitoredItemCreateRequestWithDefaults(nodeID, ua.AttributeIDEventNotifier, s.nextHandle)
+		req.RequestedParameters.Filter = ua.NewExtensionObject(s.filter.EventFilter())
+		req.RequestedParameters.QueueSize = 1000
+		requests = append(requests, req)
+		created = append(created, notifier)
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+
+	if s.sub == nil {
+		notify := make(chan *opcua.PublishNotificationData, watcherBuffer)
+		sub, err := s.subscribe(ctx, notify)
+		if err != nil {
+			return fmt.Errorf("creating subscription: %w", err)
+		}
+		s.sub = sub
+		s.done = make(chan struct{})
+		go s.dispatch(notify, s.done)
+	}
+
+	res, err := s.sub.Monitor(ctx, ua.TimestampsToReturnBoth, requests...)
+	if err == nil && len(res.Results) != len(requests) {
+		err = fmt.Errorf("monitor returned %d results for %d notifiers", len(res.Results), len(requests))
+	}
+	if err != nil {
+		s.cancelIfIdle(ctx)
+		return fmt.Errorf("creating monitored items: %w", err)
+	}
+
+	var refused []string
+	for i, result := range res.Results {
+		notifier := created[i]
+		if result.StatusCode != ua.StatusOK {
+			refused = append(refused, fmt.Sprintf("%s: %s", notifier.nodeID, StatusName(result.StatusCode)))
+			continue
+		}
+		notifier.itemID = result.MonitoredItemID
+		s.notifiers[notifier.nodeID.String()] = notifier
+		s.handles[notifier.handle] = notifier
+	}
+	if err := s.cancelIfIdle(ctx); err != nil {
+		return err
+	}
+	if len(refused) > 0 {
+		return fmt.Errorf("%w: %s", ErrEventsRefused, strings.Join(refused, ", "))
+	}
+	return nil
+}
+
+// Resubscribe subscribes to the events of the notifiers again, after the session connected
+// again and the previous subscription was lost with the old connection.
+func (s *EventSubscriber) Resubscribe(ctx context.Context) error {
+	s.mu.Lock()
+	var nodeIDs []*ua.NodeID
+	for _, notifier := range s.notifiers {
+		nodeIDs = append(nodeIDs, notifier.nodeID)
+		s.forget(notifier)
+	}
+	if s.sub != nil {
+		close(s.done)
+		s.sub = nil
+	}
+	s.mu.Unlock()
+
+	if len(nodeIDs) == 0 {
+		return nil
+	}
+	return s.SetNotifiers(ctx, nodeIDs)
+}
+
+// forget removes a notifier from the monitored items. s.mu must be held.
+func (s *EventSubscriber) forget(notifier *eventNotifier) {
+	delete(s.notifiers, notifier.nodeID.String())
+	delete(s.handles, notifier.handle)
+}
+
+// cancelIfIdle deletes the subscription when no notifier is monitored. s.mu must be held.
+func (s *EventSubscriber) cancelIfIdle(ctx context.Context) error {
+	if s.sub == nil || len(s.notifiers) > 0 {
+		return nil
+	}
+	sub := s.sub
+	s.sub = nil
+	close(s.done)
+	if err := sub.Cancel(ctx); err != nil {
+		return fmt.Errorf("deleting subscription: %w", err)
+	}
+	return nil
+}
+
+// dispatch converts the event notifications published by the server and passes them to the
+// handler until done is closed.
+func (s *EventSubscriber) dispatch(notify <-chan *opcua.PublishNotificationData, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case data := <-notify:
+			if data.Error != nil {
+				util.Logger.Warnf("Event subscription error: %s", data.Error)
+				continue
+			}
+			list, ok := data.Value.(*ua.EventNotificationList)
+			if !ok {
+				continue
+			}
+			var events []Event
+			s.mu.Lock()
+			for _, fields := range list.Events {
+				notifier, ok := s.handles[fields.ClientHandle]
+				if !ok {
+					continue
+				}
+				events = append(events, s.event(notifier.nodeID, fields.EventFields))
+			}
+			s.mu.Unlock()
+			if len(events) > 0 {
+				s.handle(events)
+			}
+		}
+	}
+}
+
+// event converts the fields selected by EventFilter. Events without a Time get the time
+// they were received.
+func (s *EventSubscriber) event(notifierID *ua.NodeID, values []*ua.Variant) Event {
+	ev := Event{NotifierID: notifierID.String(), Time: time.Now().UTC(), Fields: map[string]interface{}{}}
+	if len(values) > 0 && values[0] != nil {
+		if t, ok := values[0].Value().(time.Time); ok && !t.IsZero() {
+			ev.Time = t
+		}
+	}
+	for i, field := range s.filter.Fields {
+		if i+1 >= len(values) || values[i+1] == nil {
+			continue
+		}
+		if v := eventValue(values[i+1].Value()); v != nil {
+			ev.Fields[field.Name] = v
+		}
+	}
+	return ev
+}
+
+// eventValue converts the value of an event field into a value that can be stored as a field.
+// Fields the event does not have are nil.
+func eventValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *ua.LocalizedText:
+		return v.Text
+	case *ua.QualifiedName:
+		return v.Name
+	case *ua.NodeID:
+		return v.String()
+	case *ua.ExpandedNodeID:
+		return v.NodeID.String()
+	case []byte:
+		return hex.EncodeToString(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case ua.StatusCode:
+		return StatusName(v)
+	}
+	return value
+}
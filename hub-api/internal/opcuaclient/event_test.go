@@ -0,0 +1,119 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"testing"
+	"time"
+)
+
+func TestBrowseEventNotifiers(t *testing.T) {
+	s := newFakePlant()
+	s.nodes["ns=1;s=Plant"].notifier = ua.EventNotifierTypeSubscribeToEvents | ua.EventNotifierTypeHistoryRead
+	s.nodes["ns=1;s=Machine1"].notifier = ua.EventNotifierTypeHistoryRead
+
+	nodes, _, err := Browse(context.Background(), s, BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Plant"), MaxDepth: 1}, BrowseOptions{Workers: 1, BatchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nodes[0].EventNotifier {
+		t.Error("expected the plant to be an event notifier")
+	}
+	if nodes[0].Children[0].EventNotifier {
+		t.Error("expected a notifier that only allows reading history not to be subscribed to")
+	}
+}
+
+func TestNewEventFilterConfig(t *testing.T) {
+	filter, err := NewEventFilterConfig(util.Config{OpcUaEventFields: "Severity, ActiveState/Id", OpcUaEventMinSeverity: "500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef := filter.EventFilter()
+	if len(ef.SelectClauses) != 3 {
+		t.Fatalf("expected Time and 2 fields, got %d clauses", len(ef.SelectClauses))
+	}
+	if clause := ef.SelectClauses[0]; clause.BrowsePath[0].Name != "Time" {
+		t.Errorf("expected Time first, got %s", clause.BrowsePath[0].Name)
+	}
+	if clause := ef.SelectClauses[2]; clause.TypeDefinitionID.IntID() != id.AlarmConditionType || len(clause.BrowsePath) != 2 || clause.BrowsePath[1].Name != "Id" {
+		t.Errorf("unexpected ActiveState/Id clause %+v", clause)
+	}
+	where := ef.WhereClause.Elements
+	if len(where) != 1 || where[0].FilterOperator != ua.FilterOperatorGreaterThanOrEqual {
+		t.Fatalf("expected a severity filter, got %+v", where)
+	}
+	if literal := where[0].FilterOperands[1].Value.(*ua.LiteralOperand); literal.Value.Value() != uint16(500) {
+		t.Errorf("unexpected severity %v", literal.Value.Value())
+	}
+
+	for _, config := range []util.Config{{OpcUaEventFields: "ActiveState//Id"}, {OpcUaEventMinSeverity: "1001"}} {
+		if _, err := NewEventFilterConfig(config); err == nil {
+			t.Errorf("expected %+v to be refused", config)
+		}
+	}
+}
+
+func TestEventSubscriber(t *testing.T) {
+	ctx := context.Background()
+	filter, _ := NewEventFilterConfig(util.Config{OpcUaEventFields: "Severity,Message,SourceName,ActiveState/Id"})
+	received := make(chan []Event, 1)
+	var subs []*fakeSubscription
+	s := newEventSubscriber(func(ctx context.Context, ch chan<- *opcua.PublishNotificationData) (subscription, error) {
+		sub := &fakeSubscription{monitored: map[uint32]uint32{}, notify: ch}
+		subs = append(subs, sub)
+		return sub, nil
+	}, filter, func(events []Event) { received <- events })
+
+	plant := ua.MustParseNodeID("ns=1;s=Plant")
+	err := s.SetNotifiers(ctx, []*ua.NodeID{plant, ua.MustParseNodeID("ns=1;s=Missing")})
+	if err == nil {
+		t.Error("expected the missing notifier to be reported")
+	}
+	if len(subs) != 1 || len(subs[0].monitored) != 1 {
+		t.Fatalf("expected 1 notifier to be monitored")
+	}
+
+	var handle uint32
+	for _, h := range subs[0].monitored {
+		handle = h
+	}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	subs[0].notify <- &opcua.PublishNotificationData{Value: &ua.EventNotificationList{Events: []*ua.EventFieldList{{
+		ClientHandle: handle,
+		EventFields: []*ua.Variant{
+			ua.MustVariant(at),
+			ua.MustVariant(uint16(700)),
+			ua.MustVariant(&ua.LocalizedText{Text: "Temperature high"}),
+			ua.MustVariant("Boiler"),
+			{},
+		},
+	}}}}
+
+	select {
+	case events := <-received:
+		ev := events[0]
+		if ev.NotifierID != "ns=1;s=Plant" || !ev.Time.Equal(at) {
+			t.Errorf("unexpected event %+v", ev)
+		}
+		if ev.Fields["Severity"] != uint16(700) || ev.Fields["Message"] != "Temperature high" || ev.Fields["SourceName"] != "Boiler" {
+			t.Errorf("unexpected fields %v", ev.Fields)
+		}
+		if _, ok := ev.Fields["ActiveState/Id"]; ok {
+			t.Error("expected the missing field to be left out")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no events received")
+	}
+
+	// The subscription is deleted with the last notifier
+	if err := s.SetNotifiers(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !subs[0].cancelled {
+		t.Error("expected the subscription to be deleted")
+	}
+}
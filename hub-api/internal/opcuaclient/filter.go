@@ -0,0 +1,113 @@
+package opcuaclient
+
+import (
+	"fmt"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"strings"
+)
+
+// defaultReferenceTypes are the references followed when a root does not configure its own.
+var defaultReferenceTypes = []string{"HasComponent", "Organizes", "HasProperty"}
+
+// defaultNodeClasses are the node classes stored when a root does not configure its own.
+var defaultNodeClasses = []string{"Object", "Variable", "Method"}
+
+// referenceTypeIDs maps the names of the standard hierarchical reference types to their ids.
+var referenceTypeIDs = map[string]uint32{
+	"References":             id.References,
+	"HierarchicalReferences": id.HierarchicalReferences,
+	"HasChild":               id.HasChild,
+	"Aggregates":             id.Aggregates,
+	"Organizes":              id.Organizes,
+	"HasComponent":           id.HasComponent,
+	"HasOrderedComponent":    id.HasOrderedComponent,
+	"HasProperty":            id.HasProperty,
+	"HasSubtype":             id.HasSubtype,
+	"HasEventSource":         id.HasEventSource,
+	"HasNotifier":            id.HasNotifier,
+}
+
+// nodeClassNames maps node class names to their mask bits.
+var nodeClassNames = map[string]ua.NodeClass{
+	"Object":        ua.NodeClassObject,
+	"Variable":      ua.NodeClassVariable,
+	"Method":        ua.NodeClassMethod,
+	"ObjectType":    ua.NodeClassObjectType,
+	"VariableType":  ua.NodeClassVariableType,
+	"ReferenceType": ua.NodeClassReferenceType,
+	"DataType":      ua.NodeClassDataType,
+	"View":          ua.NodeClassView,
+	"All":           ua.NodeClassAll,
+}
+
+// ParseReferenceTypes converts reference type names such as HasComponent, or node ids
+// of custom reference types such as ns=2;i=4001, into node ids.
+func ParseReferenceTypes(names []string) ([]*ua.NodeID, error) {
+	var refTypes []*ua.NodeID
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if v, ok := referenceTypeIDs[name]; ok {
+			refTypes = append(refTypes, ua.NewNumericNodeID(0, v))
+			continue
+		}
+		nodeID, err := ua.ParseNodeID(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reference type %q", name)
+		}
+		refTypes = append(refTypes, nodeID)
+	}
+	if len(refTypes) == 0 {
+		return nil, fmt.Errorf("no reference types configured")
+	}
+	return refTypes, nil
+}
+
+// ParseNodeClasses converts node class names such as Object or Variable into a node class mask.
+func ParseNodeClasses(names []string) (ua.NodeClass, error) {
+	var mask ua.NodeClass
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		v, ok := nodeClassNames[name]
+		if !ok {
+			return 0, fmt.Errorf("invalid node class %q", name)
+		}
+		mask |= v
+	}
+	if mask == 0 {
+		return 0, fmt.Errorf("no node classes configured")
+	}
+	return mask, nil
+}
+
+// ReferenceTypeName returns the name of a standard reference type, or the node id of a custom one.
+func ReferenceTypeName(refType *ua.NodeID) string {
+	if refType == nil {
+		return ""
+	}
+	if refType.Namespace() == 0 && refType.IntID() != 0 {
+		for name, v := range referenceTypeIDs {
+			if v == refType.IntID() {
+				return name
+			}
+		}
+		if name := id.Name(refType.IntID()); name != "" {
+			return name
+		}
+	}
+	return refType.String()
+}
+
+// splitList splits a comma separated configuration value.
+func splitList(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
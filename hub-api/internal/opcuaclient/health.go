@@ -0,0 +1,273 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthNodes are the variables of the Server object read by ReadServerHealth.
+var healthNodes = []uint32{id.Server_ServerStatus, id.Server_ServiceLevel, id.Server_ServerDiagnostics_ServerDiagnosticsSummary}
+
+// BuildInfo describes the software of a server.
+type BuildInfo struct {
+	ProductURI       string    `json:"productURI"`
+	ManufacturerName string    `json:"manufacturerName"`
+	ProductName      string    `json:"productName"`
+	SoftwareVersion  string    `json:"softwareVersion"`
+	BuildNumber      string    `json:"buildNumber"`
+	BuildDate        time.Time `json:"buildDate"`
+}
+
+// SessionDiagnostics is the ServerDiagnosticsSummary of a server, which counts its sessions,
+// subscriptions and rejected requests.
+type SessionDiagnostics struct {
+	ServerViewCount               uint32 `json:"serverViewCount"`
+	CurrentSessionCount           uint32 `json:"currentSessionCount"`
+	CumulatedSessionCount         uint32 `json:"cumulatedSessionCount"`
+	SecurityRejectedSessionCount  uint32 `json:"securityRejectedSessionCount"`
+	RejectedSessionCount          uint32 `json:"rejectedSessionCount"`
+	SessionTimeoutCount           uint32 `json:"sessionTimeoutCount"`
+	SessionAbortCount             uint32 `json:"sessionAbortCount"`
+	CurrentSubscriptionCount      uint32 `json:"currentSubscriptionCount"`
+	CumulatedSubscriptionCount    uint32 `json:"cumulatedSubscriptionCount"`
+	PublishingIntervalCount       uint32 `json:"publishingIntervalCount"`
+	SecurityRejectedRequestsCount uint32 `json:"securityRejectedRequestsCount"`
+	RejectedRequestsCount         uint32 `json:"rejectedRequestsCount"`
+}
+
+// ServerHealth is the state of a server as read from its Server object.
+type ServerHealth struct {
+	ReadAt      time.Time  `json:"readAt"`
+	State       string     `json:"state,omitempty"`
+	StartTime   *time.Time `json:"startTime,omitempty"`
+	CurrentTime *time.Time `json:"currentTime,omitempty"`
+	// ClockDrift is the difference between the CurrentTime of the server and the clock of the
+	// hub in seconds, positive when the server is ahead.
+	ClockDrift          *float64            `json:"clockDrift,omitempty"`
+	BuildInfo           *BuildInfo          `json:"buildInfo,omitempty"`
+	SecondsTillShutdown uint32              `json:"secondsTillShutdown,omitempty"`
+	ShutdownReason      string              `json:"shutdownReason,omitempty"`
+	ServiceLevel        *uint8              `json:"serviceLevel,omitempty"`
+	Diagnostics         *SessionDiagnostics `json:"diagnostics,omitempty"`
+	// Restarts is the number of changes of StartTime seen by the HealthMonitor, the last one
+	// seen at LastRestart.
+	Restarts    int        `json:"restarts"`
+	LastRestart *time.Time `json:"lastRestart,omitempty"`
+	// Errors are the values the server did not return, such as a diagnostics summary that is
+	// disabled. Error is set instead when the server could not be read at all.
+	Errors []string `json:"errors,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// Reachable reports whether the server answered the last read.
+func (h ServerHealth) Reachable() bool {
+	return h.Error == ""
+}
+
+// ReadServerHealth reads the ServerStatus, ServiceLevel and ServerDiagnosticsSummary of a
+// server in one request. The clock drift is measured against the middle of the request.
+func ReadServerHealth(ctx context.Context, c ReadClient) (ServerHealth, error) {
+	req := &ua.ReadRequest{TimestampsToReturn: ua.TimestampsToReturnNeither}
+	for _, n := range healthNodes {
+		req.NodesToRead = append(req.NodesToRead, &ua.ReadValueID{NodeID: ua.NewNumericNodeID(0, n), AttributeID: ua.AttributeIDValue})
+	}
+
+	sent := time.Now()
+	res, err := c.Read(ctx, req)
+	if err != nil {
+		return ServerHealth{}, fmt.Errorf("reading server health: %w", err)
+	}
+	received := time.Now()
+	if len(res.Results) != len(healthNodes) {
+		return ServerHealth{}, fmt.Errorf("read returned %d results for %d nodes", len(res.Results), len(healthNodes))
+	}
+
+	h := ServerHealth{ReadAt: received}
+	value := func(i int, name string) interface{} {
+		dv := res.Results[i]
+		if dv.Status != ua.StatusOK {
+			h.Errors = append(h.Errors, fmt.Sprintf("%s: %s", name, StatusName(dv.Status)))
+			return nil
+		}
+		if dv.Value == nil {
+			h.Errors = append(h.Errors, fmt.Sprintf("%s: no value", name))
+			return nil
+		}
+		if eo, ok := dv.Value.Value().(*ua.ExtensionObject); ok {
+			return eo.Value
+		}
+		return dv.Value.Value()
+	}
+
+	switch v := value(0, "ServerStatus").(type) {
+	case *ua.ServerStatusDataType:
+		h.State = strings.TrimPrefix(v.State.String(), "ServerState")
+		h.StartTime = timePtr(v.StartTime)
+		h.CurrentTime = timePtr(v.CurrentTime)
+		if h.CurrentTime != nil {
+			drift := v.CurrentTime.Sub(sent.Add(received.Sub(sent) / 2)).Seconds()
+			h.ClockDrift = &drift
+		}
+		if b := v.BuildInfo; b != nil {
+			h.BuildInfo = &BuildInfo{ProductURI: b.ProductURI, ManufacturerName: b.ManufacturerName, ProductName: b.ProductName, SoftwareVersion: b.SoftwareVersion, BuildNumber: b.BuildNumber, BuildDate: b.BuildDate}
+		}
+		h.SecondsTillShutdown = v.SecondsTillShutdown
+		if v.ShutdownReason != nil {
+			h.ShutdownReason = v.ShutdownReason.Text
+		}
+	case nil:
+	default:
+		h.Errors = append(h.Errors, fmt.Sprintf("ServerStatus: unexpected value of type %T", v))
+	}
+
+	switch v := value(1, "ServiceLevel").(type) {
+	case uint8:
+		h.ServiceLevel = &v
+	case nil:
+	default:
+		h.Errors = append(h.Errors, fmt.Sprintf("ServiceLevel: unexpected value of type %T", v))
+	}
+
+	switch v := value(2, "ServerDiagnosticsSummary").(type) {
+	case *ua.ServerDiagnosticsSummaryDataType:
+		d := SessionDiagnostics(*v)
+		h.Diagnostics = &d
+	case nil:
+	default:
+		h.Errors = append(h.Errors, fmt.Sprintf("ServerDiagnosticsSummary: unexpected value of type %T", v))
+	}
+	return h, nil
+}
+
+// timePtr returns a pointer to t, or nil if it is zero.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// HealthMonitor reads the health of the servers of a SessionPool periodically and keeps the
+// last result of each, so that restarts of a server and the drift of its clock can be alarmed
+// on. Every result is passed to a handler, for example to write it to InfluxDB.
+type HealthMonitor struct {
+	pool     *SessionPool
+	servers  func(ctx context.Context) ([]int, error)
+	interval time.Duration
+	handle   func(serverID int, h ServerHealth)
+
+	mu     sync.Mutex
+	health map[int]ServerHealth
+	starts map[int]time.Time
+}
+
+// NewHealthMonitor returns a monitor that reads the health of the servers returned by servers
+// every interval, using their sessions from pool, and passes every result to handle. handle may
+// be nil.
+func NewHealthMonitor(pool *SessionPool, servers func(ctx context.Context) ([]int, error), interval time.Duration, handle func(serverID int, h ServerHealth)) *HealthMonitor {
+	if handle == nil {
+		handle = func(int, ServerHealth) {}
+	}
+	return &HealthMonitor{
+		pool:     pool,
+		servers:  servers,
+		interval: interval,
+		handle:   handle,
+		health:   map[int]ServerHealth{},
+		starts:   map[int]time.Time{},
+	}
+}
+
+// Start reads the health of the servers every interval until ctx is done. It does nothing if
+// the interval is not positive, in which case the health is read on request only.
+func (m *HealthMonitor) Start(ctx context.Context) {
+	if m.interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.checkAll(ctx)
+			}
+		}
+	}()
+}
+
+// checkAll reads the health of all servers one after the other.
+func (m *HealthMonitor) checkAll(ctx context.Context) {
+	ids, err := m.servers(ctx)
+	if err != nil {
+		util.Logger.Errorf("Failed to list the servers to check: %s", err)
+		return
+	}
+	for _, serverID := range ids {
+		if _, err := m.Check(ctx, serverID); err != nil {
+			util.Logger.Warnf("Failed to read the health of server %d: %s", serverID, err)
+		}
+	}
+}
+
+// Check reads the health of a server now. A server that cannot be read is recorded as
+// unreachable with the error, which is also returned.
+func (m *HealthMonitor) Check(ctx context.Context, serverID int) (ServerHealth, error) {
+	session, err := m.pool.Session(ctx, serverID)
+	if err != nil {
+		return ServerHealth{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, session.opts.ConnectTimeout)
+	defer cancel()
+
+	var h ServerHealth
+	c, err := session.Client(ctx)
+	if err == nil {
+		h, err = ReadServerHealth(ctx, c)
+	}
+	if err != nil {
+		h = ServerHealth{ReadAt: time.Now(), Error: err.Error()}
+	}
+	h = m.record(serverID, h)
+	m.handle(serverID, h)
+	return h, err
+}
+
+// record stores the health of a server, counting a restart when its StartTime changed since
+// the last read.
+func (m *HealthMonitor) record(serverID int, h ServerHealth) ServerHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if last, ok := m.health[serverID]; ok {
+		h.Restarts = last.Restarts
+		h.LastRestart = last.LastRestart
+	}
+	// The StartTime of an unreachable server is kept, so that its restart is seen once it answers
+	if h.StartTime != nil {
+		if start, ok := m.starts[serverID]; ok && !h.StartTime.Equal(start) {
+			h.Restarts++
+			readAt := h.ReadAt
+			h.LastRestart = &readAt
+		}
+		m.starts[serverID] = *h.StartTime
+	}
+	m.health[serverID] = h
+	return h
+}
+
+// Health returns the last health read of a server, if any.
+func (m *HealthMonitor) Health(serverID int) (ServerHealth, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.health[serverID]
+	return h, ok
+}
@@ -0,0 +1,76 @@
+package opcuaclient
+
+import (
+	"context"
+	"github.com/gopcua/opcua/ua"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReadServerHealth(t *testing.T) {
+	start := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	s := &fakeServer{nodes: map[string]*fakeNode{}}
+	s.nodes["i=2256"] = &fakeNode{class: ua.NodeClassVariable, value: ua.NewExtensionObject(&ua.ServerStatusDataType{
+		StartTime:   start,
+		CurrentTime: time.Now().Add(90 * time.Second),
+		State:       ua.ServerStateRunning,
+		BuildInfo:   &ua.BuildInfo{ProductName: "Fake PLC", SoftwareVersion: "1.2.3"},
+	})}
+	s.nodes["i=2267"] = &fakeNode{class: ua.NodeClassVariable, value: uint8(200)}
+
+	h, err := ReadServerHealth(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.reads != 1 {
+		t.Errorf("expected one read, got %d", s.reads)
+	}
+	if h.State != "Running" || h.StartTime == nil || !h.StartTime.Equal(start) || h.BuildInfo == nil || h.BuildInfo.ProductName != "Fake PLC" {
+		t.Errorf("unexpected server status %+v", h)
+	}
+	if h.ClockDrift == nil || math.Abs(*h.ClockDrift-90) > 1 {
+		t.Errorf("expected a clock drift of 90s, got %v", h.ClockDrift)
+	}
+	if h.ServiceLevel == nil || *h.ServiceLevel != 200 {
+		t.Errorf("unexpected service level %v", h.ServiceLevel)
+	}
+	// The fake server has no diagnostics summary
+	if h.Diagnostics != nil || len(h.Errors) != 1 || h.Errors[0] != "ServerDiagnosticsSummary: BadNodeIDUnknown" {
+		t.Errorf("unexpected diagnostics %+v, errors %v", h.Diagnostics, h.Errors)
+	}
+	if !h.Reachable() {
+		t.Error("expected the server to be reachable")
+	}
+}
+
+func TestHealthMonitorRestarts(t *testing.T) {
+	m := NewHealthMonitor(nil, nil, 0, nil)
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	first := at.Add(-time.Hour)
+	second := at.Add(time.Minute)
+
+	for i, read := range []ServerHealth{
+		{ReadAt: at, StartTime: &first},
+		{ReadAt: at.Add(time.Minute), Error: "connection refused"},
+		{ReadAt: at.Add(2 * time.Minute), StartTime: &second},
+		{ReadAt: at.Add(3 * time.Minute), StartTime: &second},
+	} {
+		h := m.record(1, read)
+		want := 0
+		if i >= 2 {
+			want = 1
+		}
+		if h.Restarts != want {
+			t.Errorf("read %d: got %d restarts, want %d", i, h.Restarts, want)
+		}
+	}
+
+	h, ok := m.Health(1)
+	if !ok || h.LastRestart == nil || !h.LastRestart.Equal(at.Add(2*time.Minute)) {
+		t.Errorf("unexpected last restart %+v", h)
+	}
+	if _, ok := m.Health(2); ok {
+		t.Error("expected no health for a server that was not read")
+	}
+}
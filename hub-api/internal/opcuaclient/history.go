@@ -0,0 +1,159 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"time"
+)
+
+// maxValuesPerHistoryRead is the number of values requested in a single HistoryRead. The server
+// returns a continuation point when there are more.
+const maxValuesPerHistoryRead = 1000
+
+// maxEmptyHistoryReads is the number of reads in a row that may return a continuation point
+// without any values before HistoryReadRaw gives up on the server.
+const maxEmptyHistoryReads = 5
+
+// ErrHistoryStalled is returned when the server keeps returning continuation points without
+// values.
+var ErrHistoryStalled = errors.New("history read returns no values")
+
+// HistoryClient is the part of *opcua.Client used to read the history of nodes. Send releases
+// the continuation points that are not followed.
+type HistoryClient interface {
+	HistoryReadRawModified(ctx context.Context, nodes []*ua.HistoryReadValueID, details *ua.ReadRawModifiedDetails) (*ua.HistoryReadResponse, error)
+	Send(ctx context.Context, req ua.Request, h func(ua.Response) error) error
+}
+
+// HistoryReadRaw reads the raw values the server stored for a node between start and end, oldest
+// first, following continuation points until all values are read or maxValues is reached. It
+// reports whether values were left unread, which can then be read from the timestamp of the last
+// value onwards. The continuation point of the unread values is released, as servers only hold a
+// few per session. ErrHistoryStalled is returned after maxEmptyHistoryReads reads in a row that
+// return a continuation point but no values.
+func HistoryReadRaw(ctx context.Context, c HistoryClient, nodeID *ua.NodeID, start, end time.Time, maxValues int) ([]LiveValue, bool, error) {
+	if maxValues < 1 {
+		maxValues = 1
+	}
+	values := []LiveValue{}
+	more, err := readRawHistory(ctx, c, nodeID, start, end, maxValues, func(page []LiveValue) error {
+		values = append(values, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return values, more, nil
+}
+
+// HistoryReadRawPages reads the raw values the server stored for a node between start and end like
+// HistoryReadRaw, but without a limit, and passes each page of values to page as soon as it is
+// read. If page returns an error, the continuation point is released and the error is returned.
+func HistoryReadRawPages(ctx context.Context, c HistoryClient, nodeID *ua.NodeID, start, end time.Time, page func([]LiveValue) error) error {
+	_, err := readRawHistory(ctx, c, nodeID, start, end, 0, page)
+	return err
+}
+
+// readRawHistory reads the history of a node for HistoryReadRaw and HistoryReadRawPages, reading
+// no more than maxValues values unless it is 0.
+func readRawHistory(ctx context.Context, c HistoryClient, nodeID *ua.NodeID, start, end time.Time, maxValues int, page func([]LiveValue) error) (bool, error) {
+	read := 0
+	emptyReads := 0
+	var continuationPoint []byte
+	for {
+		perRead := maxValuesPerHistoryRead
+		if remaining := maxValues - read; maxValues > 0 && remaining < perRead {
+			perRead = remaining
+		}
+		details := &ua.ReadRawModifiedDetails{StartTime: start, EndTime: end, NumValuesPerNode: uint32(perRead)}
+		res, err := c.HistoryReadRawModified(ctx, []*ua.HistoryReadValueID{{
+			NodeID:            nodeID,
+			DataEncoding:      &ua.QualifiedName{},
+			ContinuationPoint: continuationPoint,
+		}}, details)
+		if err != nil {
+			return false, fmt.Errorf("reading history of %s: %w", nodeID, err)
+		}
+		if len(res.Results) != 1 {
+			return false, fmt.Errorf("history read returned %d results for 1 node", len(res.Results))
+		}
+
+		result := res.Results[0]
+		if result.StatusCode&statusSeverityMask != 0 {
+			return false, fmt.Errorf("reading history of %s: %w", nodeID, result.StatusCode)
+		}
+		var values []LiveValue
+		if result.HistoryData != nil {
+			if data, ok := result.HistoryData.Value.(*ua.HistoryData); ok {
+				for _, dv := range data.DataValues {
+					values = append(values, liveValue(nodeID, dv))
+				}
+			}
+		}
+
+		continuationPoint = result.ContinuationPoint
+		release := func() {
+			if len(continuationPoint) == 0 {
+				return
+			}
+			if err := releaseContinuationPoint(ctx, c, nodeID, details, continuationPoint); err != nil {
+				util.Logger.Warnf("Failed to release the history continuation point of %s: %s", nodeID, err)
+			}
+		}
+		if len(values) > 0 {
+			if err := page(values); err != nil {
+				release()
+				return false, err
+			}
+			read += len(values)
+			emptyReads = 0
+		} else {
+			emptyReads++
+		}
+
+		if len(continuationPoint) == 0 {
+			return false, nil
+		}
+		if emptyReads >= maxEmptyHistoryReads {
+			release()
+			return false, fmt.Errorf("%w: %s after %d reads", ErrHistoryStalled, nodeID, emptyReads)
+		}
+		if maxValues > 0 && read >= maxValues {
+			release()
+			return true, nil
+		}
+	}
+}
+
+// releaseContinuationPoint tells the server that the history read of a node with details will
+// not be continued, so that it frees the continuation point.
+func releaseContinuationPoint(ctx context.Context, c HistoryClient, nodeID *ua.NodeID, details *ua.ReadRawModifiedDetails, continuationPoint []byte) error {
+	req := &ua.HistoryReadRequest{
+		TimestampsToReturn:        ua.TimestampsToReturnBoth,
+		ReleaseContinuationPoints: true,
+		NodesToRead: []*ua.HistoryReadValueID{{
+			NodeID:            nodeID,
+			DataEncoding:      &ua.QualifiedName{},
+			ContinuationPoint: continuationPoint,
+		}},
+		HistoryReadDetails: &ua.ExtensionObject{
+			TypeID:       ua.NewFourByteExpandedNodeID(0, id.ReadRawModifiedDetails_Encoding_DefaultBinary),
+			EncodingMask: ua.ExtensionObjectBinary,
+			Value:        details,
+		},
+	}
+	return c.Send(ctx, req, func(r ua.Response) error {
+		res, ok := r.(*ua.HistoryReadResponse)
+		if !ok {
+			return fmt.Errorf("unexpected response %T", r)
+		}
+		if len(res.Results) == 1 && res.Results[0].StatusCode&statusSeverityMask != 0 {
+			return res.Results[0].StatusCode
+		}
+		return nil
+	})
+}
@@ -0,0 +1,146 @@
+package opcuaclient
+
+import (
+	"context"
+	"errors"
+	"github.com/gopcua/opcua/ua"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// HistoryReadRawModified returns the history of a node between the start and end time, with
+// the offset of the next value as the continuation point.
+func (s *fakeServer) HistoryReadRawModified(ctx context.Context, nodes []*ua.HistoryReadValueID, details *ua.ReadRawModifiedDetails) (*ua.HistoryReadResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+
+	res := &ua.HistoryReadResponse{}
+	for _, node := range nodes {
+		n, ok := s.nodes[node.NodeID.String()]
+		if !ok || !n.historizing {
+			res.Results = append(res.Results, &ua.HistoryReadResult{StatusCode: ua.StatusBadHistoryOperationUnsupported})
+			continue
+		}
+		var values []*ua.DataValue
+		for _, dv := range n.history {
+			if !dv.SourceTimestamp.Before(details.StartTime) && dv.SourceTimestamp.Before(details.EndTime) {
+				values = append(values, dv)
+			}
+		}
+		offset, _ := strconv.Atoi(string(node.ContinuationPoint))
+		values = values[offset:]
+		result := &ua.HistoryReadResult{StatusCode: ua.StatusOK}
+		if len(values) > int(details.NumValuesPerNode) {
+			values = values[:details.NumValuesPerNode]
+			result.ContinuationPoint = []byte(strconv.Itoa(offset + len(values)))
+		}
+		result.HistoryData = ua.NewExtensionObject(&ua.HistoryData{DataValues: values})
+		res.Results = append(res.Results, result)
+	}
+	return res, nil
+}
+
+// Send records the continuation points of a HistoryRead that releases them.
+func (s *fakeServer) Send(ctx context.Context, req ua.Request, h func(ua.Response) error) error {
+	r, ok := req.(*ua.HistoryReadRequest)
+	if !ok || !r.ReleaseContinuationPoints {
+		return ua.StatusBadServiceUnsupported
+	}
+	s.mu.Lock()
+	res := &ua.HistoryReadResponse{}
+	for _, node := range r.NodesToRead {
+		s.released = append(s.released, node.ContinuationPoint)
+		res.Results = append(res.Results, &ua.HistoryReadResult{StatusCode: ua.StatusOK})
+	}
+	s.mu.Unlock()
+	return h(res)
+}
+
+func TestHistoryReadRaw(t *testing.T) {
+	s := newFakePlant()
+	value1 := s.nodes["ns=1;s=Machine1.Value1"]
+	value1.historizing = true
+	value1.accessLevel |= ua.AccessLevelTypeHistoryRead
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2500; i++ {
+		value1.history = append(value1.history, &ua.DataValue{Value: ua.MustVariant(float64(i)), Status: ua.StatusOK, SourceTimestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	nodes, _, err := Browse(context.Background(), s, BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Machine1"), MaxDepth: 1}, BrowseOptions{Namespaces: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, def := range nodes[0].Children {
+		want := def.BrowseName == "Value1"
+		if def.Historizing != want || def.HistoryReadable != want {
+			t.Errorf("expected %s historizing and history readable to be %t, got %t and %t", def.BrowseName, want, def.Historizing, def.HistoryReadable)
+		}
+	}
+
+	value1Node := ua.MustParseNodeID("ns=1;s=Machine1.Value1")
+	s.reads = 0
+	values, more, err := HistoryReadRaw(context.Background(), s, value1Node, start, start.Add(time.Hour), 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2500 || more || s.reads != 3 {
+		t.Fatalf("expected 2500 values in 3 reads, got %d in %d", len(values), s.reads)
+	}
+	if len(s.released) != 0 {
+		t.Errorf("expected no continuation point to be released, got %q", s.released)
+	}
+	if values[2499].Value != 2499.0 || !values[2499].SourceTimestamp.Equal(start.Add(2499*time.Second)) {
+		t.Errorf("unexpected last value %+v", values[2499])
+	}
+
+	values, more, err = HistoryReadRaw(context.Background(), s, value1Node, start, start.Add(time.Hour), 1500)
+	if err != nil || len(values) != 1500 || !more {
+		t.Errorf("expected the first 1500 of more values, got %d %t %v", len(values), more, err)
+	}
+	if len(s.released) != 1 || string(s.released[0]) != "1500" {
+		t.Errorf("expected the continuation point 1500 to be released, got %q", s.released)
+	}
+
+	if _, _, err := HistoryReadRaw(context.Background(), s, ua.MustParseNodeID("ns=1;s=Machine1.Value2"), start, start.Add(time.Hour), 10); err == nil {
+		t.Error("expected an error for a node without history")
+	}
+}
+
+// stalledHistory returns continuation points without values.
+type stalledHistory struct {
+	reads    int
+	released [][]byte
+}
+
+func (h *stalledHistory) HistoryReadRawModified(ctx context.Context, nodes []*ua.HistoryReadValueID, details *ua.ReadRawModifiedDetails) (*ua.HistoryReadResponse, error) {
+	h.reads++
+	return &ua.HistoryReadResponse{Results: []*ua.HistoryReadResult{{
+		StatusCode:        ua.StatusOK,
+		ContinuationPoint: []byte(strconv.Itoa(h.reads)),
+		HistoryData:       ua.NewExtensionObject(&ua.HistoryData{}),
+	}}}, nil
+}
+
+func (h *stalledHistory) Send(ctx context.Context, req ua.Request, f func(ua.Response) error) error {
+	for _, node := range req.(*ua.HistoryReadRequest).NodesToRead {
+		h.released = append(h.released, node.ContinuationPoint)
+	}
+	return f(&ua.HistoryReadResponse{Results: []*ua.HistoryReadResult{{StatusCode: ua.StatusOK}}})
+}
+
+func TestHistoryReadRawStalled(t *testing.T) {
+	h := &stalledHistory{}
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	_, _, err := HistoryReadRaw(context.Background(), h, ua.MustParseNodeID("ns=1;s=Machine1.Value1"), start, start.Add(time.Hour), 10)
+	if !errors.Is(err, ErrHistoryStalled) {
+		t.Fatalf("expected ErrHistoryStalled, got %v", err)
+	}
+	if h.reads != maxEmptyHistoryReads {
+		t.Errorf("expected %d reads, got %d", maxEmptyHistoryReads, h.reads)
+	}
+	if len(h.released) != 1 || string(h.released[0]) != strconv.Itoa(maxEmptyHistoryReads) {
+		t.Errorf("expected the last continuation point to be released, got %q", h.released)
+	}
+}
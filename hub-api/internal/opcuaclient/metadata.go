@@ -0,0 +1,176 @@
+package opcuaclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"strconv"
+)
+
+// Names of the AnalogItem properties copied into NodeDef.
+const (
+	propertyEngineeringUnits = "EngineeringUnits"
+	propertyEURange          = "EURange"
+	propertyInstrumentRange  = "InstrumentRange"
+)
+
+// readAnalogMetadata fills in the engineering units, EURange and InstrumentRange of
+// every Variable in items that has these properties.
+func (b *browser) readAnalogMetadata(ctx context.Context, items []*browseItem) error {
+	var variables []*browseItem
+	var nodeIDs []*ua.NodeID
+	for _, item := range items {
+		if item.def.NodeClass == ua.NodeClassVariable && item.def.ReferenceType != "HasProperty" {
+			variables = append(variables, item)
+			nodeIDs = append(nodeIDs, item.def.NodeID)
+		}
+	}
+	if len(variables) == 0 {
+		return nil
+	}
+
+	props, err := b.findProperties(ctx, nodeIDs, propertyEngineeringUnits, propertyEURange, propertyInstrumentRange)
+	if err != nil {
+		return err
+	}
+
+	var (
+		propIDs []*ua.NodeID
+		owners  []*browseItem
+		names   []string
+	)
+	for i, found := range props {
+		for _, name := range []string{propertyEngineeringUnits, propertyEURange, propertyInstrumentRange} {
+			if nodeID, ok := found[name]; ok {
+				propIDs = append(propIDs, nodeID)
+				owners = append(owners, variables[i])
+				names = append(names, name)
+			}
+		}
+	}
+
+	values, err := b.readValues(ctx, propIDs, ua.AttributeIDValue)
+	if err != nil {
+		return fmt.Errorf("reading analog properties: %w", err)
+	}
+	for i, v := range values {
+		if v.Status == ua.StatusOK && v.Value != nil {
+			owners[i].def.setAnalogProperty(names[i], v.Value)
+		}
+	}
+	for _, item := range variables {
+		item.def.setScale()
+	}
+	return nil
+}
+
+// findProperties browses the HasProperty references of the nodes for properties with the given
+// browse names from namespace 0. It returns the node ids of the properties found for each node.
+func (b *browser) findProperties(ctx context.Context, nodeIDs []*ua.NodeID, names ...string) ([]map[string]*ua.NodeID, error) {
+	size := b.opts.BatchSize
+	batches := batch(nodeIDs, size)
+	found := make([]map[string]*ua.NodeID, len(nodeIDs))
+	err := b.run(ctx, len(batches), func(ctx context.Context, i int) error {
+		req := &ua.BrowseRequest{View: &ua.ViewDescription{ViewID: ua.NewTwoByteNodeID(0)}}
+		for _, nodeID := range batches[i] {
+			req.NodesToBrowse = append(req.NodesToBrowse, &ua.BrowseDescription{
+				NodeID:          nodeID,
+				BrowseDirection: ua.BrowseDirectionForward,
+				ReferenceTypeID: ua.NewNumericNodeID(0, id.HasProperty),
+				IncludeSubtypes: true,
+				NodeClassMask:   uint32(ua.NodeClassVariable),
+				ResultMask:      uint32(ua.BrowseResultMaskAll),
+			})
+		}
+
+		refs, err := b.browse(ctx, req)
+		if err != nil {
+			return err
+		}
+		for j := range batches[i] {
+			props := map[string]*ua.NodeID{}
+			for _, ref := range refs[j] {
+				if ref.BrowseName != nil && ref.BrowseName.NamespaceIndex == 0 && contains(names, ref.BrowseName.Name) {
+					props[ref.BrowseName.Name] = ref.NodeID.NodeID
+				}
+			}
+			found[i*size+j] = props
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// readValues reads one attribute of every node, in batches. The results are in the order of nodeIDs.
+func (b *browser) readValues(ctx context.Context, nodeIDs []*ua.NodeID, attr ua.AttributeID) ([]*ua.DataValue, error) {
+	size := b.opts.BatchSize
+	batches := batch(nodeIDs, size)
+	values := make([]*ua.DataValue, len(nodeIDs))
+	err := b.run(ctx, len(batches), func(ctx context.Context, i int) error {
+		req := &ua.ReadRequest{TimestampsToReturn: ua.TimestampsToReturnNeither}
+		for _, nodeID := range batches[i] {
+			req.NodesToRead = append(req.NodesToRead, &ua.ReadValueID{NodeID: nodeID, AttributeID: attr})
+		}
+
+		if err := b.wait(ctx); err != nil {
+			return err
+		}
+		res, err := b.client.Read(ctx, req)
+		if err != nil {
+			return err
+		}
+		if len(res.Results) != len(req.NodesToRead) {
+			return fmt.Errorf("read returned %d results for %d nodes", len(res.Results), len(req.NodesToRead))
+		}
+		copy(values[i*size:], res.Results)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// setAnalogProperty copies the value of an AnalogItem property into the definition.
+func (def *NodeDef) setAnalogProperty(name string, v *ua.Variant) {
+	eo := v.ExtensionObject()
+	if eo == nil {
+		return
+	}
+	switch value := eo.Value.(type) {
+	case *ua.EUInformation:
+		if name == propertyEngineeringUnits && value.DisplayName != nil {
+			def.Unit = value.DisplayName.Text
+		}
+	case *ua.Range:
+		switch name {
+		case propertyEURange:
+			def.Min = formatFloat(value.Low)
+			def.Max = formatFloat(value.High)
+		case propertyInstrumentRange:
+			def.InstrumentMin = formatFloat(value.Low)
+			def.InstrumentMax = formatFloat(value.High)
+		}
+	}
+}
+
+// setScale sets the ratio of the EURange span to the InstrumentRange span, which converts a
+// change in the raw instrument value into a change in engineering units.
+func (def *NodeDef) setScale() {
+	euLow, err1 := strconv.ParseFloat(def.Min, 64)
+	euHigh, err2 := strconv.ParseFloat(def.Max, 64)
+	instLow, err3 := strconv.ParseFloat(def.InstrumentMin, 64)
+	instHigh, err4 := strconv.ParseFloat(def.InstrumentMax, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || instHigh == instLow {
+		return
+	}
+	def.Scale = formatFloat((euHigh - euLow) / (instHigh - instLow))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,229 @@
+package opcuaclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"strings"
+)
+
+// Names of the Method properties describing its arguments.
+const (
+	propertyInputArguments  = "InputArguments"
+	propertyOutputArguments = "OutputArguments"
+)
+
+// CallClient is the part of *opcua.Client used to call methods.
+type CallClient interface {
+	Call(ctx context.Context, req *ua.CallMethodRequest) (*ua.CallMethodResult, error)
+}
+
+// MethodArgument is an input or output argument of a Method. DataType is the Go type its
+// values are decoded into, like NodeDef.DataType.
+type MethodArgument struct {
+	Name            string   `json:"name"`
+	DataType        string   `json:"dataType"`
+	DataTypeName    string   `json:"dataTypeName"`
+	ValueRank       int32    `json:"valueRank"`
+	ArrayDimensions []uint32 `json:"arrayDimensions,omitempty"`
+	Description     string   `json:"description,omitempty"`
+}
+
+// MethodOutput is the value of an output argument returned by a method call.
+type MethodOutput struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// MethodResult is the result of a method call. InputArgumentResults holds the status of each
+// input argument when the server rejected some of them.
+type MethodResult struct {
+	StatusCode           string         `json:"statusCode"`
+	Good                 bool           `json:"good"`
+	InputArgumentResults []string       `json:"inputArgumentResults,omitempty"`
+	OutputArguments      []MethodOutput `json:"outputArguments"`
+}
+
+// readMethodArguments reads the InputArguments and OutputArguments properties of every
+// Method in items.
+func (b *browser) readMethodArguments(ctx context.Context, items []*browseItem) error {
+	var methods []*browseItem
+	var nodeIDs []*ua.NodeID
+	for _, item := range items {
+		if item.def.NodeClass == ua.NodeClassMethod {
+			methods = append(methods, item)
+			nodeIDs = append(nodeIDs, item.def.NodeID)
+		}
+	}
+	if len(methods) == 0 {
+		return nil
+	}
+
+	props, err := b.findProperties(ctx, nodeIDs, propertyInputArguments, propertyOutputArguments)
+	if err != nil {
+		return err
+	}
+
+	var (
+		propIDs []*ua.NodeID
+		owners  []*browseItem
+		names   []string
+	)
+	for i, found := range props {
+		for _, name := range []string{propertyInputArguments, propertyOutputArguments} {
+			if nodeID, ok := found[name]; ok {
+				propIDs = append(propIDs, nodeID)
+				owners = append(owners, methods[i])
+				names = append(names, name)
+			}
+		}
+	}
+
+	values, err := b.readValues(ctx, propIDs, ua.AttributeIDValue)
+	if err != nil {
+		return fmt.Errorf("reading method arguments: %w", err)
+	}
+
+	// The data types of the arguments are resolved like those of variables
+	args := make([][]*ua.Argument, len(values))
+	var unknown []*ua.NodeID
+	for i, v := range values {
+		if v.Status != ua.StatusOK || v.Value == nil {
+			continue
+		}
+		eos, _ := v.Value.Value().([]*ua.ExtensionObject)
+		for _, eo := range eos {
+			arg, ok := eo.Value.(*ua.Argument)
+			if !ok {
+				continue
+			}
+			args[i] = append(args[i], arg)
+			if _, ok := builtinType(arg.DataType); ok || arg.DataType == nil {
+				continue
+			}
+			if _, ok := b.types[arg.DataType.String()]; !ok {
+				b.types[arg.DataType.String()] = &dataType{name: arg.DataType.String()}
+				unknown = append(unknown, arg.DataType)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		if err := b.readDataTypes(ctx, unknown); err != nil {
+			return err
+		}
+	}
+
+	for i := range values {
+		arguments := []MethodArgument{}
+		for _, arg := range args[i] {
+			arguments = append(arguments, b.methodArgument(arg))
+		}
+		if names[i] == propertyInputArguments {
+			owners[i].def.InputArguments = arguments
+		} else {
+			owners[i].def.OutputArguments = arguments
+		}
+	}
+	return nil
+}
+
+// methodArgument converts an Argument read from the server, whose data type has been resolved.
+func (b *browser) methodArgument(arg *ua.Argument) MethodArgument {
+	a := MethodArgument{Name: arg.Name, ValueRank: arg.ValueRank, ArrayDimensions: arg.ArrayDimensions}
+	if arg.Description != nil {
+		a.Description = arg.Description.Text
+	}
+	if builtin, ok := builtinType(arg.DataType); ok {
+		a.DataType = builtinTypes[builtin]
+		a.DataTypeName = id.Name(arg.DataType.IntID())
+	} else if arg.DataType != nil {
+		t := b.types[arg.DataType.String()]
+		a.DataType = arg.DataType.String()
+		a.DataTypeName = t.name
+		if t.builtin != 0 {
+			a.DataType = builtinTypes[t.builtin]
+		}
+	}
+	if arg.ValueRank >= valueRankOneOrMoreDimensions {
+		dims := int(arg.ValueRank)
+		if dims == 0 {
+			dims = 1
+		}
+		a.DataType = strings.Repeat("[]", dims) + a.DataType
+	}
+	return a
+}
+
+// ConvertArguments converts the input arguments of a method call decoded from JSON, either an
+// array in the order of args or an object keyed by argument name, into Variants.
+func ConvertArguments(values interface{}, args []MethodArgument) ([]*ua.Variant, error) {
+	var ordered []interface{}
+	switch v := values.(type) {
+	case nil:
+	case []interface{}:
+		ordered = v
+	case map[string]interface{}:
+		for _, arg := range args {
+			value, ok := v[arg.Name]
+			if !ok {
+				return nil, fmt.Errorf("missing argument %s", arg.Name)
+			}
+			ordered = append(ordered, value)
+			delete(v, arg.Name)
+		}
+		for name := range v {
+			return nil, fmt.Errorf("unknown argument %s", name)
+		}
+	default:
+		return nil, fmt.Errorf("arguments must be an array or an object, got %T", values)
+	}
+	if len(ordered) != len(args) {
+		return nil, fmt.Errorf("expected %d arguments, got %d", len(args), len(ordered))
+	}
+
+	variants := make([]*ua.Variant, len(args))
+	for i, arg := range args {
+		v, err := ConvertValue(ordered[i], arg.DataType, nil)
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %w", arg.Name, err)
+		}
+		variants[i] = v
+	}
+	return variants, nil
+}
+
+// CallMethod calls a method on an object. The output values are named after outputs, the
+// OutputArguments of the method.
+func CallMethod(ctx context.Context, c CallClient, objectID, methodID *ua.NodeID, inputs []*ua.Variant, outputs []MethodArgument) (*MethodResult, error) {
+	res, err := c.Call(ctx, &ua.CallMethodRequest{ObjectID: objectID, MethodID: methodID, InputArguments: inputs})
+	if err != nil {
+		return nil, fmt.Errorf("calling %s on %s: %w", methodID, objectID, err)
+	}
+
+	result := &MethodResult{
+		StatusCode:      StatusName(res.StatusCode),
+		Good:            res.StatusCode&statusSeverityMask == 0,
+		OutputArguments: []MethodOutput{},
+	}
+	for _, status := range res.InputArgumentResults {
+		if status != ua.StatusOK {
+			result.InputArgumentResults = make([]string, len(res.InputArgumentResults))
+			for i, status := range res.InputArgumentResults {
+				result.InputArgumentResults[i] = StatusName(status)
+			}
+			break
+		}
+	}
+	for i, v := range res.OutputArguments {
+		output := MethodOutput{Name: fmt.Sprintf("output%d", i)}
+		if i < len(outputs) {
+			output.Name = outputs[i].Name
+		}
+		if v != nil {
+			output.Value = v.Value()
+		}
+		result.OutputArguments = append(result.OutputArguments, output)
+	}
+	return result, nil
+}
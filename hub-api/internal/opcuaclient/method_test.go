@@ -0,0 +1,84 @@
+package opcuaclient
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"testing"
+)
+
+func (s *fakeServer) Call(ctx context.Context, req *ua.CallMethodRequest) (*ua.CallMethodResult, error) {
+	if req.MethodID.String() != "ns=1;s=Machine1.Reset" || req.ObjectID.String() != "ns=1;s=Machine1" {
+		return &ua.CallMethodResult{StatusCode: ua.StatusBadMethodInvalid}, nil
+	}
+	counter := req.InputArguments[0].Value().(uint32)
+	return &ua.CallMethodResult{StatusCode: ua.StatusOK, OutputArguments: []*ua.Variant{ua.MustVariant(counter + 1)}}, nil
+}
+
+// addResetMethod adds a Reset method with a Counter input and a Count output to Machine1.
+func addResetMethod(s *fakeServer) {
+	arguments := func(name string) []*ua.ExtensionObject {
+		return []*ua.ExtensionObject{ua.NewExtensionObject(&ua.Argument{
+			Name:        name,
+			DataType:    ua.NewNumericNodeID(0, id.UInt32),
+			ValueRank:   -1,
+			Description: &ua.LocalizedText{Text: name + " description"},
+		})}
+	}
+	s.nodes["ns=1;s=Machine1"].refs[id.HasComponent] = append(s.nodes["ns=1;s=Machine1"].refs[id.HasComponent], "ns=1;s=Machine1.Reset")
+	s.nodes["ns=1;s=Machine1.Reset"] = &fakeNode{class: ua.NodeClassMethod, browseName: "Reset", refs: map[uint32][]string{
+		id.HasProperty: {"ns=1;s=Machine1.Reset.InputArguments", "ns=1;s=Machine1.Reset.OutputArguments"},
+	}}
+	s.nodes["ns=1;s=Machine1.Reset.InputArguments"] = &fakeNode{class: ua.NodeClassVariable, browseName: "InputArguments", dataType: id.Argument, array: true, value: arguments("Counter")}
+	s.nodes["ns=1;s=Machine1.Reset.OutputArguments"] = &fakeNode{class: ua.NodeClassVariable, browseName: "OutputArguments", dataType: id.Argument, array: true, value: arguments("Count")}
+}
+
+func TestBrowseAndCallMethod(t *testing.T) {
+	s := newFakePlant()
+	addResetMethod(s)
+
+	nodes, _, err := Browse(context.Background(), s, BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Machine1"), MaxDepth: 2}, BrowseOptions{Namespaces: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reset *NodeDef
+	for i, def := range nodes[0].Children {
+		if def.BrowseName == "Reset" {
+			reset = &nodes[0].Children[i]
+		}
+	}
+	if reset == nil || reset.NodeClass != ua.NodeClassMethod {
+		t.Fatalf("expected the Reset method to be browsed, got %+v", nodes[0].Children)
+	}
+	if len(reset.Children) != 2 {
+		t.Errorf("expected the argument properties below the method, got %d children", len(reset.Children))
+	}
+	want := MethodArgument{Name: "Counter", DataType: "uint32", DataTypeName: "UInt32", ValueRank: -1, Description: "Counter description"}
+	if len(reset.InputArguments) != 1 || reset.InputArguments[0].Name != want.Name || reset.InputArguments[0].DataType != want.DataType ||
+		reset.InputArguments[0].DataTypeName != want.DataTypeName || reset.InputArguments[0].Description != want.Description {
+		t.Fatalf("expected input arguments %+v, got %+v", want, reset.InputArguments)
+	}
+	if len(reset.OutputArguments) != 1 || reset.OutputArguments[0].Name != "Count" {
+		t.Fatalf("unexpected output arguments %+v", reset.OutputArguments)
+	}
+
+	if _, err := ConvertArguments([]interface{}{json.Number("-1")}, reset.InputArguments); err == nil {
+		t.Error("expected a negative counter to be refused")
+	}
+	if _, err := ConvertArguments(map[string]interface{}{"Other": json.Number("1")}, reset.InputArguments); err == nil {
+		t.Error("expected a missing argument to be refused")
+	}
+	inputs, err := ConvertArguments(map[string]interface{}{"Counter": json.Number("41")}, reset.InputArguments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := CallMethod(context.Background(), s, nodes[0].NodeID, reset.NodeID, inputs, reset.OutputArguments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Good || len(result.OutputArguments) != 1 || result.OutputArguments[0].Name != "Count" || result.OutputArguments[0].Value != uint32(42) {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
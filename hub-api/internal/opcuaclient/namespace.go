@@ -0,0 +1,49 @@
+package opcuaclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"strings"
+)
+
+// ReadNamespaces reads the NamespaceArray of the server, which holds the URI of every namespace index.
+func ReadNamespaces(ctx context.Context, c BrowseClient) ([]string, error) {
+	res, err := c.Read(ctx, &ua.ReadRequest{
+		NodesToRead:        []*ua.ReadValueID{{NodeID: ua.NewNumericNodeID(0, id.Server_NamespaceArray), AttributeID: ua.AttributeIDValue}},
+		TimestampsToReturn: ua.TimestampsToReturnNeither,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading namespace array: %w", err)
+	}
+	if len(res.Results) != 1 || res.Results[0].Status != ua.StatusOK || res.Results[0].Value == nil {
+		return nil, fmt.Errorf("reading namespace array: no value returned")
+	}
+	namespaces, ok := res.Results[0].Value.Value().([]string)
+	if !ok {
+		return nil, fmt.Errorf("reading namespace array: unexpected type %T", res.Results[0].Value.Value())
+	}
+	return namespaces, nil
+}
+
+// NamespaceURI returns the URI of the namespace of nodeID, or an empty string if the index is unknown.
+func NamespaceURI(nodeID *ua.NodeID, namespaces []string) string {
+	if nodeID == nil || int(nodeID.Namespace()) >= len(namespaces) {
+		return ""
+	}
+	return namespaces[nodeID.Namespace()]
+}
+
+// ExpandedNodeID formats a node id with the URI of its namespace instead of the index,
+// such as nsu=urn:plc;s=Temperature. The node id is returned unchanged if the URI is unknown.
+func ExpandedNodeID(nodeID *ua.NodeID, namespaceURI string) string {
+	if namespaceURI == "" {
+		return nodeID.String()
+	}
+	identifier := nodeID.String()
+	if i := strings.Index(identifier, ";"); strings.HasPrefix(identifier, "ns=") && i >= 0 {
+		identifier = identifier[i+1:]
+	}
+	return "nsu=" + namespaceURI + ";" + identifier
+}
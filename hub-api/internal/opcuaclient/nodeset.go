@@ -0,0 +1,282 @@
+package opcuaclient
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// nodeSetNamespace is the XML namespace of NodeSet2 documents.
+const nodeSetNamespace = "http://opcfoundation.org/UA/2011/03/UANodeSet.xsd"
+
+// nodeSetElements are the elements defining the nodes of each node class in a NodeSet2 document.
+var nodeSetElements = map[ua.NodeClass]string{
+	ua.NodeClassObject:        "UAObject",
+	ua.NodeClassVariable:      "UAVariable",
+	ua.NodeClassMethod:        "UAMethod",
+	ua.NodeClassView:          "UAView",
+	ua.NodeClassObjectType:    "UAObjectType",
+	ua.NodeClassVariableType:  "UAVariableType",
+	ua.NodeClassDataType:      "UADataType",
+	ua.NodeClassReferenceType: "UAReferenceType",
+}
+
+// nodeSetDocument is a NodeSet2 document. Nodes holds the elements of every node class.
+type nodeSetDocument struct {
+	XMLName       xml.Name       `xml:"http://opcfoundation.org/UA/2011/03/UANodeSet.xsd UANodeSet"`
+	NamespaceURIs []string       `xml:"NamespaceUris>Uri"`
+	Aliases       []nodeSetAlias `xml:"Aliases>Alias"`
+	Nodes         []nodeSetNode  `xml:",any"`
+}
+
+// nodeSetAlias names a node id, usually of a standard data type or reference type.
+type nodeSetAlias struct {
+	Alias  string `xml:"Alias,attr"`
+	NodeID string `xml:",chardata"`
+}
+
+// nodeSetNode is a node of a NodeSet2 document. Its element name is its node class.
+type nodeSetNode struct {
+	XMLName         xml.Name
+	NodeID          string             `xml:"NodeId,attr"`
+	BrowseName      string             `xml:"BrowseName,attr"`
+	ParentNodeID    string             `xml:"ParentNodeId,attr,omitempty"`
+	DataType        string             `xml:"DataType,attr,omitempty"`
+	ValueRank       *int32             `xml:"ValueRank,attr,omitempty"`
+	ArrayDimensions string             `xml:"ArrayDimensions,attr,omitempty"`
+	AccessLevel     *uint8             `xml:"AccessLevel,attr,omitempty"`
+	Historizing     bool               `xml:"Historizing,attr,omitempty"`
+	EventNotifier   uint8              `xml:"EventNotifier,attr,omitempty"`
+	DisplayName     string             `xml:"DisplayName"`
+	Description     string             `xml:"Description,omitempty"`
+	References      []nodeSetReference `xml:"References>Reference"`
+	Value           *xmlElement        `xml:"Value,omitempty"`
+}
+
+// xmlElement is an element of a document whose structure is not known in advance, such as the
+// Value of a node.
+type xmlElement struct {
+	XMLName  xml.Name
+	Text     string       `xml:",chardata"`
+	Children []xmlElement `xml:",any"`
+}
+
+// child returns the first child element with the local name, or an empty element.
+func (e xmlElement) child(name string) xmlElement {
+	for _, c := range e.Children {
+		if c.XMLName.Local == name {
+			return c
+		}
+	}
+	return xmlElement{}
+}
+
+// nodeSetReference is a reference of a node to the target node. References are forward unless
+// IsForward is false.
+type nodeSetReference struct {
+	ReferenceType string `xml:"ReferenceType,attr"`
+	IsForward     *bool  `xml:"IsForward,attr,omitempty"`
+	Target        string `xml:",chardata"`
+}
+
+// nodeSetEncoder builds a NodeSet2 document from node definitions.
+type nodeSetEncoder struct {
+	// namespaces maps the namespace indexes of the server to those of the document.
+	namespaces map[uint16]int
+	uris       []string
+	aliases    map[string]string
+	nodes      []nodeSetNode
+}
+
+// WriteNodeSet2 writes the nodes and their children as an OPC UA NodeSet2 document. The
+// namespaces of the nodes are numbered in the document in the order of their index on the
+// server. Nodes of namespace 0 are defined by the standard, so they are referenced by their
+// children rather than written. Every other node needs its NamespaceURI.
+func WriteNodeSet2(w io.Writer, nodes []NodeDef) error {
+	e := &nodeSetEncoder{namespaces: map[uint16]int{}, aliases: map[string]string{}}
+	uris := map[uint16]string{}
+	if err := collectNamespaces(nodes, uris); err != nil {
+		return err
+	}
+	indexes := make([]int, 0, len(uris))
+	for ns := range uris {
+		indexes = append(indexes, int(ns))
+	}
+	sort.Ints(indexes)
+	for _, ns := range indexes {
+		e.uris = append(e.uris, uris[uint16(ns)])
+		e.namespaces[uint16(ns)] = len(e.uris)
+	}
+
+	e.addNodes(nodes, "")
+
+	set := nodeSetDocument{NamespaceURIs: e.uris, Nodes: e.nodes}
+	for name, nodeID := range e.aliases {
+		set.Aliases = append(set.Aliases, nodeSetAlias{Alias: name, NodeID: nodeID})
+	}
+	sort.Slice(set.Aliases, func(i, j int) bool { return set.Aliases[i].Alias < set.Aliases[j].Alias })
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(set); err != nil {
+		return fmt.Errorf("encoding NodeSet2: %w", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// collectNamespaces adds the namespace URI of every node outside namespace 0 to uris by index.
+func collectNamespaces(nodes []NodeDef, uris map[uint16]string) error {
+	for _, n := range nodes {
+		if ns := n.NodeID.Namespace(); ns != 0 {
+			if n.NamespaceURI == "" {
+				return fmt.Errorf("node %s has no namespace URI, browse the server again", n.NodeID)
+			}
+			uris[ns] = n.NamespaceURI
+		}
+		if err := collectNamespaces(n.Children, uris); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeID formats a node id of the server with the namespace index of the document. It returns
+// false if the namespace is not in the document.
+func (e *nodeSetEncoder) nodeID(nodeID *ua.NodeID) (string, bool) {
+	identifier := nodeID.String()
+	if nodeID.Namespace() == 0 {
+		return identifier, true
+	}
+	ns, ok := e.namespaces[nodeID.Namespace()]
+	if !ok {
+		return "", false
+	}
+	if i := strings.Index(identifier, ";"); strings.HasPrefix(identifier, "ns=") && i >= 0 {
+		identifier = identifier[i+1:]
+	}
+	return fmt.Sprintf("ns=%d;%s", ns, identifier), true
+}
+
+// alias returns the name of a node of namespace 0, adding it to the aliases of the document.
+func (e *nodeSetEncoder) alias(name string, nodeID uint32) string {
+	e.aliases[name] = fmt.Sprintf("i=%d", nodeID)
+	return name
+}
+
+// addNodes adds the nodes and their children below the node parent of the document, or as
+// roots if parent is empty.
+func (e *nodeSetEncoder) addNodes(nodes []NodeDef, parent string) {
+	for _, n := range nodes {
+		nodeID, _ := e.nodeID(n.NodeID)
+		element, ok := nodeSetElements[n.NodeClass]
+		if !ok || n.NodeID.Namespace() == 0 {
+			e.addNodes(n.Children, nodeID)
+			continue
+		}
+
+		x := nodeSetNode{
+			XMLName:     xml.Name{Space: nodeSetNamespace, Local: element},
+			NodeID:      nodeID,
+			BrowseName:  fmt.Sprintf("%d:%s", e.namespaces[n.NodeID.Namespace()], n.BrowseName),
+			DisplayName: n.BrowseName,
+			Description: n.Description,
+		}
+		if parent != "" {
+			refType := e.referenceType(n)
+			x.References = append(x.References, inverseReference(refType, parent))
+			for _, other := range n.OtherParents {
+				if otherID, err := ua.ParseNodeID(other); err == nil {
+					if target, ok := e.nodeID(otherID); ok {
+						x.References = append(x.References, inverseReference(refType, target))
+					}
+				}
+			}
+			if n.NodeClass == ua.NodeClassObject || n.NodeClass == ua.NodeClassVariable || n.NodeClass == ua.NodeClassMethod {
+				x.ParentNodeID = parent
+			}
+		}
+
+		switch n.NodeClass {
+		case ua.NodeClassObject:
+			x.References = append(x.References, e.typeDefinition(id.BaseObjectType))
+			if n.EventNotifier {
+				x.EventNotifier = 1
+			}
+		case ua.NodeClassVariable, ua.NodeClassVariableType:
+			typeDefinition := uint32(id.BaseDataVariableType)
+			if n.ReferenceType == "HasProperty" {
+				typeDefinition = id.PropertyType
+			}
+			if n.NodeClass == ua.NodeClassVariable {
+				x.References = append(x.References, e.typeDefinition(typeDefinition))
+				accessLevel := uint8(n.AccessLevel)
+				x.AccessLevel = &accessLevel
+				x.Historizing = n.Historizing
+			}
+			x.DataType = e.dataType(n.DataTypeID)
+			valueRank := n.ValueRank
+			x.ValueRank = &valueRank
+			dims := make([]string, len(n.ArrayDims))
+			for i, d := range n.ArrayDims {
+				dims[i] = strconv.FormatUint(uint64(d), 10)
+			}
+			x.ArrayDimensions = strings.Join(dims, ",")
+		}
+
+		e.nodes = append(e.nodes, x)
+		e.addNodes(n.Children, nodeID)
+	}
+}
+
+// inverseReference returns a reference of type refType from target to the node holding it.
+func inverseReference(refType, target string) nodeSetReference {
+	isForward := false
+	return nodeSetReference{ReferenceType: refType, IsForward: &isForward, Target: target}
+}
+
+// typeDefinition returns a HasTypeDefinition reference to a standard type.
+func (e *nodeSetEncoder) typeDefinition(typeID uint32) nodeSetReference {
+	return nodeSetReference{ReferenceType: e.alias("HasTypeDefinition", id.HasTypeDefinition), Target: fmt.Sprintf("i=%d", typeID)}
+}
+
+// referenceType returns the type of the reference from the parent of the node to the node.
+// Unknown reference types default to Organizes for Objects and HasComponent otherwise.
+func (e *nodeSetEncoder) referenceType(n NodeDef) string {
+	if v, ok := referenceTypeIDs[n.ReferenceType]; ok {
+		return e.alias(n.ReferenceType, v)
+	}
+	if refType, err := ua.ParseNodeID(n.ReferenceType); err == nil {
+		if s, ok := e.nodeID(refType); ok {
+			return s
+		}
+	}
+	if n.NodeClass == ua.NodeClassObject {
+		return e.alias("Organizes", id.Organizes)
+	}
+	return e.alias("HasComponent", id.HasComponent)
+}
+
+// dataType returns the DataType attribute of a Variable. Data types of namespaces without nodes
+// in the document are left out.
+func (e *nodeSetEncoder) dataType(dt *ua.NodeID) string {
+	if dt == nil {
+		return ""
+	}
+	if dt.Namespace() == 0 {
+		if name := id.Name(dt.IntID()); dt.IntID() != 0 && name != strconv.FormatUint(uint64(dt.IntID()), 10) {
+			return e.alias(name, dt.IntID())
+		}
+		return dt.String()
+	}
+	s, _ := e.nodeID(dt)
+	return s
+}
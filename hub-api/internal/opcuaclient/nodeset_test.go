@@ -0,0 +1,111 @@
+package opcuaclient
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"strings"
+	"testing"
+)
+
+// exportTree returns the Objects folder organizing a machine with a temperature of namespace 3.
+func exportTree() []NodeDef {
+	return []NodeDef{{
+		NodeID:     ua.NewNumericNodeID(0, id.ObjectsFolder),
+		NodeClass:  ua.NodeClassObject,
+		BrowseName: "Objects",
+		Children: []NodeDef{{
+			NodeID:        ua.MustParseNodeID("ns=3;s=Machine1"),
+			NamespaceURI:  "urn:plc",
+			NodeClass:     ua.NodeClassObject,
+			BrowseName:    "Machine1",
+			ReferenceType: "Organizes",
+			EventNotifier: true,
+			Children: []NodeDef{{
+				NodeID:        ua.MustParseNodeID("ns=3;s=Machine1.Temperature"),
+				NamespaceURI:  "urn:plc",
+				NodeClass:     ua.NodeClassVariable,
+				BrowseName:    "Temperature",
+				Description:   "Oven temperature",
+				AccessLevel:   ua.AccessLevelTypeCurrentRead | ua.AccessLevelTypeCurrentWrite,
+				DataType:      "float64",
+				DataTypeID:    ua.NewNumericNodeID(0, id.Double),
+				DataTypeName:  "Double",
+				ValueRank:     -1,
+				Writable:      true,
+				ReferenceType: "HasComponent",
+				Unit:          "°C",
+				Min:           "0",
+				Max:           "250",
+			}},
+		}},
+	}}
+}
+
+func TestWriteNodeSet2(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteNodeSet2(&buf, exportTree()); err != nil {
+		t.Fatal(err)
+	}
+
+	var set nodeSetDocument
+	if err := xml.Unmarshal(buf.Bytes(), &set); err != nil {
+		t.Fatalf("%v\n%s", err, buf.String())
+	}
+	if len(set.NamespaceURIs) != 1 || set.NamespaceURIs[0] != "urn:plc" {
+		t.Errorf("unexpected namespaces %v", set.NamespaceURIs)
+	}
+	if len(set.Nodes) != 2 {
+		t.Fatalf("expected the machine and its temperature, got %+v", set.Nodes)
+	}
+
+	machine := set.Nodes[0]
+	if machine.XMLName.Local != "UAObject" || machine.NodeID != "ns=1;s=Machine1" || machine.BrowseName != "1:Machine1" || machine.EventNotifier != 1 {
+		t.Errorf("unexpected machine %+v", machine)
+	}
+	if r := machine.References[0]; r.ReferenceType != "Organizes" || r.Target != "i=85" || r.IsForward == nil || *r.IsForward {
+		t.Errorf("expected an inverse reference to the Objects folder, got %+v", r)
+	}
+
+	temperature := set.Nodes[1]
+	if temperature.XMLName.Local != "UAVariable" || temperature.ParentNodeID != "ns=1;s=Machine1" || temperature.DataType != "Double" || temperature.Description != "Oven temperature" {
+		t.Errorf("unexpected temperature %+v", temperature)
+	}
+	if temperature.ValueRank == nil || *temperature.ValueRank != -1 || temperature.AccessLevel == nil || *temperature.AccessLevel != 3 {
+		t.Errorf("unexpected value rank or access level %+v", temperature)
+	}
+
+	aliases := map[string]string{}
+	for _, a := range set.Aliases {
+		aliases[a.Alias] = a.NodeID
+	}
+	if aliases["Double"] != "i=11" || aliases["HasComponent"] != "i=47" || aliases["HasTypeDefinition"] != "i=40" {
+		t.Errorf("unexpected aliases %v", aliases)
+	}
+}
+
+func TestWriteNodeSet2WithoutNamespaceURI(t *testing.T) {
+	nodes := exportTree()
+	nodes[0].Children[0].NamespaceURI = ""
+	if err := WriteNodeSet2(&bytes.Buffer{}, nodes); err == nil {
+		t.Error("expected an error for a node without namespace URI")
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, exportTree()); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"BrowseName,DataType,NodeID,Unit,Scale,Min,Max,Writable,Description",
+		"Objects,,i=85,,,,,false,",
+		"Machine1,,ns=3;s=Machine1,,,,,false,",
+		"Temperature,float64,ns=3;s=Machine1.Temperature,°C,,0,250,true,Oven temperature",
+		"",
+	}, "\n")
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,584 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// standardNamespace is the URI of namespace 0.
+const standardNamespace = "http://opcfoundation.org/UA/"
+
+// standardFolders are the nodes of namespace 0 that documents organize their nodes under. A
+// NodeSet answers for them although documents do not define them.
+var standardFolders = map[uint32]string{
+	id.RootFolder:    "Root",
+	id.ObjectsFolder: "Objects",
+	id.TypesFolder:   "Types",
+	id.ViewsFolder:   "Views",
+	id.Server:        "Server",
+}
+
+// referenceSupertypes maps the standard reference types to the type they are a subtype of.
+var referenceSupertypes = map[uint32]uint32{
+	id.HierarchicalReferences:    id.References,
+	id.NonHierarchicalReferences: id.References,
+	id.HasChild:                  id.HierarchicalReferences,
+	id.Organizes:                 id.HierarchicalReferences,
+	id.HasEventSource:            id.HierarchicalReferences,
+	id.HasNotifier:               id.HasEventSource,
+	id.Aggregates:                id.HasChild,
+	id.HasSubtype:                id.HasChild,
+	id.HasComponent:              id.Aggregates,
+	id.HasProperty:               id.Aggregates,
+	id.HasOrderedComponent:       id.HasComponent,
+	id.HasTypeDefinition:         id.NonHierarchicalReferences,
+	id.HasModellingRule:          id.NonHierarchicalReferences,
+	id.HasEncoding:               id.NonHierarchicalReferences,
+	id.GeneratesEvent:            id.NonHierarchicalReferences,
+}
+
+// NodeSet is an address space read from a NodeSet2 document. It implements BrowseClient and
+// PathClient, so that Browse builds node definitions from a document as it does from a live
+// server, and TranslateBrowsePaths resolves their browse paths.
+type NodeSet struct {
+	namespaces []string
+	nodes      map[string]*nodeSetEntry
+	refs       map[string][]nodeSetRef
+	refKeys    map[string]bool
+	// supertypes maps the reference types the document defines to their supertype.
+	supertypes map[string]*ua.NodeID
+}
+
+// nodeSetEntry holds the attributes of a node of a NodeSet.
+type nodeSetEntry struct {
+	class         ua.NodeClass
+	browseName    *ua.QualifiedName
+	description   *ua.LocalizedText
+	dataType      *ua.NodeID
+	valueRank     int32
+	arrayDims     []uint32
+	accessLevel   uint8
+	historizing   bool
+	eventNotifier uint8
+	value         *ua.Variant
+}
+
+// nodeSetRef is a reference from a node of a NodeSet to the target node.
+type nodeSetRef struct {
+	refType   *ua.NodeID
+	isForward bool
+	target    *ua.NodeID
+}
+
+// nodeSetParser converts the node ids of a document to those of the server.
+type nodeSetParser struct {
+	// indexes maps the namespace indexes of the document to those of the server.
+	indexes []uint16
+	aliases map[string]string
+}
+
+// ReadNodeSet2 reads a NodeSet2 document. namespaces is the NamespaceArray of the server as far
+// as it is known, with empty entries for unknown namespaces. The nodes of the document get the
+// index of their namespace in it, and namespaces that are not in it are added after it.
+func ReadNodeSet2(r io.Reader, namespaces []string) (*NodeSet, error) {
+	var doc nodeSetDocument
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decoding NodeSet2: %w", err)
+	}
+
+	set := &NodeSet{
+		namespaces: []string{standardNamespace},
+		nodes:      map[string]*nodeSetEntry{},
+		refs:       map[string][]nodeSetRef{},
+		refKeys:    map[string]bool{},
+		supertypes: map[string]*ua.NodeID{},
+	}
+	if len(namespaces) > 1 {
+		set.namespaces = append(set.namespaces, namespaces[1:]...)
+	}
+	p := nodeSetParser{indexes: []uint16{0}, aliases: map[string]string{}}
+	for _, uri := range doc.NamespaceURIs {
+		p.indexes = append(p.indexes, set.namespaceIndex(uri))
+	}
+	for _, a := range doc.Aliases {
+		p.aliases[a.Alias] = strings.TrimSpace(a.NodeID)
+	}
+
+	classes := map[string]ua.NodeClass{}
+	for class, element := range nodeSetElements {
+		classes[element] = class
+	}
+	for _, x := range doc.Nodes {
+		class, ok := classes[x.XMLName.Local]
+		if !ok {
+			continue
+		}
+		if err := set.add(p, class, x); err != nil {
+			return nil, fmt.Errorf("node %s: %w", x.NodeID, err)
+		}
+	}
+
+	for key := range set.refs {
+		if _, ok := set.nodes[key]; ok {
+			continue
+		}
+		nodeID, err := ua.ParseNodeID(key)
+		if err != nil {
+			continue
+		}
+		if name, ok := standardFolders[nodeID.IntID()]; ok && nodeID.Namespace() == 0 {
+			set.nodes[key] = &nodeSetEntry{class: ua.NodeClassObject, browseName: &ua.QualifiedName{Name: name}}
+		}
+	}
+	return set, nil
+}
+
+// Namespaces returns the NamespaceArray of the server with the namespaces of the document.
+func (set *NodeSet) Namespaces() []string {
+	return set.namespaces
+}
+
+// namespaceIndex returns the index of a namespace on the server, adding it if it is unknown.
+func (set *NodeSet) namespaceIndex(uri string) uint16 {
+	for i, v := range set.namespaces {
+		if v == uri {
+			return uint16(i)
+		}
+	}
+	set.namespaces = append(set.namespaces, uri)
+	return uint16(len(set.namespaces) - 1)
+}
+
+// add adds a node of the document and its references.
+func (set *NodeSet) add(p nodeSetParser, class ua.NodeClass, x nodeSetNode) error {
+	nodeID, err := p.nodeID(x.NodeID)
+	if err != nil {
+		return err
+	}
+	e := &nodeSetEntry{
+		class:       class,
+		browseName:  p.qualifiedName(x.BrowseName),
+		description: ua.NewLocalizedText(strings.TrimSpace(x.Description)),
+		valueRank:   valueRankScalar,
+		accessLevel: uint8(ua.AccessLevelTypeCurrentRead),
+		historizing: x.Historizing,
+	}
+	if x.ValueRank != nil {
+		e.valueRank = *x.ValueRank
+	}
+	if x.AccessLevel != nil {
+		e.accessLevel = *x.AccessLevel
+	}
+	if class == ua.NodeClassObject || class == ua.NodeClassView {
+		e.eventNotifier = x.EventNotifier
+	}
+	if class == ua.NodeClassVariable || class == ua.NodeClassVariableType {
+		e.dataType = ua.NewNumericNodeID(0, id.BaseDataType)
+		if x.DataType != "" {
+			if e.dataType, err = p.nodeID(x.DataType); err != nil {
+				return fmt.Errorf("data type: %w", err)
+			}
+		}
+	}
+	for _, d := range strings.Split(x.ArrayDimensions, ",") {
+		if v, err := strconv.ParseUint(strings.TrimSpace(d), 10, 32); err == nil {
+			e.arrayDims = append(e.arrayDims, uint32(v))
+		}
+	}
+	if x.Value != nil && len(x.Value.Children) > 0 {
+		if e.value, err = p.variant(x.Value.Children[0]); err != nil {
+			util.Logger.Debugf("Ignoring the value of %s: %s", nodeID, err)
+		}
+	}
+	set.nodes[nodeID.String()] = e
+
+	for _, ref := range x.References {
+		refType, err := p.nodeID(ref.ReferenceType)
+		if err != nil {
+			return fmt.Errorf("reference type: %w", err)
+		}
+		target, err := p.nodeID(strings.TrimSpace(ref.Target))
+		if err != nil {
+			return fmt.Errorf("reference target: %w", err)
+		}
+		isForward := ref.IsForward == nil || *ref.IsForward
+		set.addRef(nodeID, nodeSetRef{refType: refType, isForward: isForward, target: target})
+		set.addRef(target, nodeSetRef{refType: refType, isForward: !isForward, target: nodeID})
+		if class == ua.NodeClassReferenceType && !isForward && refType.Namespace() == 0 && refType.IntID() == id.HasSubtype {
+			set.supertypes[nodeID.String()] = target
+		}
+	}
+	return nil
+}
+
+// addRef adds a reference from the node source unless it already has it. Documents often list a
+// reference on both of its nodes.
+func (set *NodeSet) addRef(source *ua.NodeID, ref nodeSetRef) {
+	key := source.String()
+	refKey := fmt.Sprintf("%s|%s|%t|%s", key, ref.refType, ref.isForward, ref.target)
+	if set.refKeys[refKey] {
+		return
+	}
+	set.refKeys[refKey] = true
+	set.refs[key] = append(set.refs[key], ref)
+}
+
+// isSubtype reports whether the reference type refType is of or a subtype of it.
+func (set *NodeSet) isSubtype(refType, of *ua.NodeID) bool {
+	for depth := 0; refType != nil && depth < maxSubtypeDepth; depth++ {
+		if refType.String() == of.String() {
+			return true
+		}
+		if refType.Namespace() == 0 {
+			super, ok := referenceSupertypes[refType.IntID()]
+			if !ok {
+				return false
+			}
+			refType = ua.NewNumericNodeID(0, super)
+			continue
+		}
+		refType = set.supertypes[refType.String()]
+	}
+	return false
+}
+
+func (set *NodeSet) Read(ctx context.Context, req *ua.ReadRequest) (*ua.ReadResponse, error) {
+	res := &ua.ReadResponse{}
+	for _, rv := range req.NodesToRead {
+		res.Results = append(res.Results, set.attribute(rv.NodeID, rv.AttributeID))
+	}
+	return res, nil
+}
+
+// attribute returns the value of an attribute of a node, as a server would.
+func (set *NodeSet) attribute(nodeID *ua.NodeID, attr ua.AttributeID) *ua.DataValue {
+	if nodeID.Namespace() == 0 && nodeID.IntID() == id.Server_NamespaceArray && attr == ua.AttributeIDValue {
+		return &ua.DataValue{Status: ua.StatusOK, Value: ua.MustVariant(set.namespaces)}
+	}
+	e, ok := set.nodes[nodeID.String()]
+	if !ok {
+		return &ua.DataValue{Status: ua.StatusBadNodeIDUnknown}
+	}
+
+	variable := e.class == ua.NodeClassVariable || e.class == ua.NodeClassVariableType
+	var v interface{}
+	switch {
+	case attr == ua.AttributeIDNodeClass:
+		v = int32(e.class)
+	case attr == ua.AttributeIDBrowseName:
+		v = e.browseName
+	case attr == ua.AttributeIDDescription && e.description != nil:
+		v = e.description
+	case attr == ua.AttributeIDDataType && variable:
+		v = e.dataType
+	case attr == ua.AttributeIDValueRank && variable:
+		v = e.valueRank
+	case attr == ua.AttributeIDArrayDimensions && variable && len(e.arrayDims) > 0:
+		v = e.arrayDims
+	case attr == ua.AttributeIDAccessLevel && e.class == ua.NodeClassVariable:
+		v = e.accessLevel
+	case attr == ua.AttributeIDHistorizing && e.class == ua.NodeClassVariable:
+		v = e.historizing
+	case attr == ua.AttributeIDEventNotifier && (e.class == ua.NodeClassObject || e.class == ua.NodeClassView):
+		v = e.eventNotifier
+	case attr == ua.AttributeIDValue && e.value != nil:
+		return &ua.DataValue{Status: ua.StatusOK, Value: e.value}
+	default:
+		return &ua.DataValue{Status: ua.StatusBadAttributeIDInvalid}
+	}
+	return &ua.DataValue{Status: ua.StatusOK, Value: ua.MustVariant(v)}
+}
+
+// Browse returns the references of the nodes in a single page. Targets that the document does
+// not define pass the node class mask if they are in namespace 0, such as the supertypes of
+// data types.
+func (set *NodeSet) Browse(ctx context.Context, req *ua.BrowseRequest) (*ua.BrowseResponse, error) {
+	res := &ua.BrowseResponse{}
+	for _, desc := range req.NodesToBrowse {
+		key := desc.NodeID.String()
+		if _, ok := set.nodes[key]; !ok && len(set.refs[key]) == 0 {
+			res.Results = append(res.Results, &ua.BrowseResult{StatusCode: ua.StatusBadNodeIDUnknown})
+			continue
+		}
+
+		refs := []*ua.ReferenceDescription{}
+		for _, r := range set.refs[key] {
+			if desc.BrowseDirection == ua.BrowseDirectionForward && !r.isForward || desc.BrowseDirection == ua.BrowseDirectionInverse && r.isForward {
+				continue
+			}
+			if !set.refTypeMatches(r.refType, desc.ReferenceTypeID, desc.IncludeSubtypes) {
+				continue
+			}
+			rd := &ua.ReferenceDescription{
+				ReferenceTypeID: r.refType,
+				IsForward:       r.isForward,
+				NodeID:          ua.NewExpandedNodeID(r.target, "", 0),
+			}
+			if target, ok := set.nodes[r.target.String()]; ok {
+				if desc.NodeClassMask != 0 && desc.NodeClassMask&uint32(target.class) == 0 {
+					continue
+				}
+				rd.BrowseName = target.browseName
+				rd.DisplayName = ua.NewLocalizedText(target.browseName.Name)
+				rd.NodeClass = target.class
+			} else if desc.NodeClassMask != 0 && r.target.Namespace() != 0 {
+				continue
+			}
+			refs = append(refs, rd)
+		}
+		res.Results = append(res.Results, &ua.BrowseResult{StatusCode: ua.StatusOK, References: refs})
+	}
+	return res, nil
+}
+
+// refTypeMatches reports whether a reference of type refType is followed for the reference type
+// of a request, which follows all references if it is null.
+func (set *NodeSet) refTypeMatches(refType, want *ua.NodeID, includeSubtypes bool) bool {
+	if want == nil || want.Namespace() == 0 && want.IntID() == 0 {
+		return true
+	}
+	return refType.String() == want.String() || includeSubtypes && set.isSubtype(refType, want)
+}
+
+// BrowseNext fails for every continuation point, as Browse returns all references at once.
+func (set *NodeSet) BrowseNext(ctx context.Context, req *ua.BrowseNextRequest) (*ua.BrowseNextResponse, error) {
+	res := &ua.BrowseNextResponse{}
+	for range req.ContinuationPoints {
+		res.Results = append(res.Results, &ua.BrowseResult{StatusCode: ua.StatusBadContinuationPointInvalid})
+	}
+	return res, nil
+}
+
+// Send answers TranslateBrowsePathsToNodeIds requests, so that the browse paths of the nodes of
+// a document resolve as they would on a server. Other services are not supported.
+func (set *NodeSet) Send(ctx context.Context, req ua.Request, h func(ua.Response) error) error {
+	r, ok := req.(*ua.TranslateBrowsePathsToNodeIDsRequest)
+	if !ok {
+		return ua.StatusBadServiceUnsupported
+	}
+	res := &ua.TranslateBrowsePathsToNodeIDsResponse{ResponseHeader: &ua.ResponseHeader{Timestamp: time.Now(), ServiceResult: ua.StatusOK}}
+	for _, p := range r.BrowsePaths {
+		res.Results = append(res.Results, set.translate(p))
+	}
+	return h(res)
+}
+
+// translate follows a browse path from its starting node through the references of the
+// document, returning every node at the end of the path.
+func (set *NodeSet) translate(p *ua.BrowsePath) *ua.BrowsePathResult {
+	start := p.StartingNode.String()
+	if _, ok := set.nodes[start]; !ok && len(set.refs[start]) == 0 {
+		return &ua.BrowsePathResult{StatusCode: ua.StatusBadNodeIDUnknown}
+	}
+
+	current := []*ua.NodeID{p.StartingNode}
+	for _, e := range p.RelativePath.Elements {
+		var next []*ua.NodeID
+		seen := map[string]bool{}
+		for _, nodeID := range current {
+			for _, r := range set.refs[nodeID.String()] {
+				if r.isForward == e.IsInverse || !set.refTypeMatches(r.refType, e.ReferenceTypeID, e.IncludeSubtypes) {
+					continue
+				}
+				target, ok := set.nodes[r.target.String()]
+				if !ok || seen[r.target.String()] || target.browseName.NamespaceIndex != e.TargetName.NamespaceIndex || target.browseName.Name != e.TargetName.Name {
+					continue
+				}
+				seen[r.target.String()] = true
+				next = append(next, r.target)
+			}
+		}
+		if len(next) == 0 {
+			return &ua.BrowsePathResult{StatusCode: ua.StatusBadNoMatch}
+		}
+		current = next
+	}
+
+	res := &ua.BrowsePathResult{StatusCode: ua.StatusOK}
+	for _, nodeID := range current {
+		res.Targets = append(res.Targets, &ua.BrowsePathTarget{TargetID: ua.NewExpandedNodeID(nodeID, "", 0), RemainingPathIndex: math.MaxUint32})
+	}
+	return res
+}
+
+// nodeID parses a node id or alias of the document and returns the node id on the server.
+func (p nodeSetParser) nodeID(s string) (*ua.NodeID, error) {
+	if v, ok := p.aliases[s]; ok {
+		s = v
+	}
+	nodeID, err := ua.ParseNodeID(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node id %q: %w", s, err)
+	}
+	ns := int(nodeID.Namespace())
+	if ns == 0 {
+		return nodeID, nil
+	}
+	if ns >= len(p.indexes) {
+		return nil, fmt.Errorf("node id %s: namespace %d is not in the NamespaceUris", s, ns)
+	}
+	identifier := s[strings.Index(s, ";")+1:]
+	return ua.ParseNodeID(fmt.Sprintf("ns=%d;%s", p.indexes[ns], identifier))
+}
+
+// qualifiedName parses a browse name of the document, such as 1:Temperature.
+func (p nodeSetParser) qualifiedName(s string) *ua.QualifiedName {
+	if i := strings.Index(s, ":"); i > 0 {
+		if ns, err := strconv.Atoi(s[:i]); err == nil && ns < len(p.indexes) {
+			return &ua.QualifiedName{NamespaceIndex: p.indexes[ns], Name: s[i+1:]}
+		}
+	}
+	return &ua.QualifiedName{Name: s}
+}
+
+// variant converts the value of a node. Arrays are ListOf elements holding values of one type.
+func (p nodeSetParser) variant(e xmlElement) (*ua.Variant, error) {
+	if !strings.HasPrefix(e.XMLName.Local, "ListOf") {
+		v, err := p.scalar(e)
+		if err != nil {
+			return nil, err
+		}
+		return ua.NewVariant(v)
+	}
+	if len(e.Children) == 0 {
+		return nil, nil
+	}
+	var values reflect.Value
+	for i, c := range e.Children {
+		v, err := p.scalar(c)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			values = reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(v)), 0, len(e.Children))
+		}
+		values = reflect.Append(values, reflect.ValueOf(v))
+	}
+	return ua.NewVariant(values.Interface())
+}
+
+// scalar converts a value of a builtin type, or one of the structures Browse reads.
+func (p nodeSetParser) scalar(e xmlElement) (interface{}, error) {
+	text := strings.TrimSpace(e.Text)
+	switch e.XMLName.Local {
+	case "Boolean":
+		return strconv.ParseBool(text)
+	case "SByte":
+		v, err := strconv.ParseInt(text, 10, 8)
+		return int8(v), err
+	case "Byte":
+		v, err := strconv.ParseUint(text, 10, 8)
+		return uint8(v), err
+	case "Int16":
+		v, err := strconv.ParseInt(text, 10, 16)
+		return int16(v), err
+	case "UInt16":
+		v, err := strconv.ParseUint(text, 10, 16)
+		return uint16(v), err
+	case "Int32":
+		v, err := strconv.ParseInt(text, 10, 32)
+		return int32(v), err
+	case "UInt32":
+		v, err := strconv.ParseUint(text, 10, 32)
+		return uint32(v), err
+	case "Int64":
+		return strconv.ParseInt(text, 10, 64)
+	case "UInt64":
+		return strconv.ParseUint(text, 10, 64)
+	case "Float":
+		v, err := strconv.ParseFloat(text, 32)
+		return float32(v), err
+	case "Double":
+		return strconv.ParseFloat(text, 64)
+	case "String":
+		return e.Text, nil
+	case "DateTime":
+		return time.Parse(time.RFC3339Nano, text)
+	case "LocalizedText":
+		return localizedText(e), nil
+	case "NodeId":
+		return p.nodeID(strings.TrimSpace(e.child("Identifier").Text))
+	case "ExtensionObject":
+		return p.extensionObject(e)
+	}
+	return nil, fmt.Errorf("unsupported value type %s", e.XMLName.Local)
+}
+
+// extensionObject converts an EUInformation, Range, Argument or EnumValueType structure.
+func (p nodeSetParser) extensionObject(e xmlElement) (*ua.ExtensionObject, error) {
+	body := e.child("Body")
+	if len(body.Children) == 0 {
+		return nil, fmt.Errorf("extension object without body")
+	}
+	b := body.Children[0]
+	switch b.XMLName.Local {
+	case "EUInformation":
+		unitID, _ := strconv.ParseInt(strings.TrimSpace(b.child("UnitId").Text), 10, 32)
+		return ua.NewExtensionObject(&ua.EUInformation{
+			NamespaceURI: strings.TrimSpace(b.child("NamespaceUri").Text),
+			UnitID:       int32(unitID),
+			DisplayName:  localizedText(b.child("DisplayName")),
+			Description:  localizedText(b.child("Description")),
+		}), nil
+	case "Range":
+		low, err := strconv.ParseFloat(strings.TrimSpace(b.child("Low").Text), 64)
+		if err != nil {
+			return nil, fmt.Errorf("range low: %w", err)
+		}
+		high, err := strconv.ParseFloat(strings.TrimSpace(b.child("High").Text), 64)
+		if err != nil {
+			return nil, fmt.Errorf("range high: %w", err)
+		}
+		return ua.NewExtensionObject(&ua.Range{Low: low, High: high}), nil
+	case "Argument":
+		dataType, err := p.nodeID(strings.TrimSpace(b.child("DataType").child("Identifier").Text))
+		if err != nil {
+			return nil, fmt.Errorf("argument data type: %w", err)
+		}
+		valueRank := int64(valueRankScalar)
+		if v := strings.TrimSpace(b.child("ValueRank").Text); v != "" {
+			if valueRank, err = strconv.ParseInt(v, 10, 32); err != nil {
+				return nil, fmt.Errorf("argument value rank: %w", err)
+			}
+		}
+		var dims []uint32
+		for _, d := range b.child("ArrayDimensions").Children {
+			if v, err := strconv.ParseUint(strings.TrimSpace(d.Text), 10, 32); err == nil {
+				dims = append(dims, uint32(v))
+			}
+		}
+		return ua.NewExtensionObject(&ua.Argument{
+			Name:            strings.TrimSpace(b.child("Name").Text),
+			DataType:        dataType,
+			ValueRank:       int32(valueRank),
+			ArrayDimensions: dims,
+			Description:     localizedText(b.child("Description")),
+		}), nil
+	case "EnumValueType":
+		value, err := strconv.ParseInt(strings.TrimSpace(b.child("Value").Text), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("enum value: %w", err)
+		}
+		return ua.NewExtensionObject(&ua.EnumValueType{
+			Value:       value,
+			DisplayName: localizedText(b.child("DisplayName")),
+			Description: localizedText(b.child("Description")),
+		}), nil
+	}
+	return nil, fmt.Errorf("unsupported structure %s", b.XMLName.Local)
+}
+
+// localizedText converts a LocalizedText element.
+func localizedText(e xmlElement) *ua.LocalizedText {
+	return ua.NewLocalizedTextWithLocale(strings.TrimSpace(e.child("Text").Text), strings.TrimSpace(e.child("Locale").Text))
+}
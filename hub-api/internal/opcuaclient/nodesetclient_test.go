@@ -0,0 +1,207 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+// machineNodeSet is a NodeSet2 document with a machine organized by the Objects folder. It has
+// an analog temperature, a mode of a custom enumeration and a Reset method.
+const machineNodeSet = `<?xml version="1.0" encoding="utf-8"?>
+<UANodeSet xmlns="http://opcfoundation.org/UA/2011/03/UANodeSet.xsd">
+  <NamespaceUris>
+    <Uri>urn:plc</Uri>
+  </NamespaceUris>
+  <Aliases>
+    <Alias Alias="Double">i=11</Alias>
+    <Alias Alias="Organizes">i=35</Alias>
+    <Alias Alias="HasComponent">i=47</Alias>
+    <Alias Alias="HasProperty">i=46</Alias>
+    <Alias Alias="HasSubtype">i=45</Alias>
+  </Aliases>
+  <UADataType NodeId="ns=1;i=3000" BrowseName="1:ModeEnum">
+    <DisplayName>ModeEnum</DisplayName>
+    <References>
+      <Reference ReferenceType="HasSubtype" IsForward="false">i=29</Reference>
+      <Reference ReferenceType="HasProperty">ns=1;i=3001</Reference>
+    </References>
+  </UADataType>
+  <UAVariable NodeId="ns=1;i=3001" BrowseName="EnumStrings" DataType="i=21" ValueRank="1">
+    <DisplayName>EnumStrings</DisplayName>
+    <Value>
+      <ListOfLocalizedText xmlns="http://opcfoundation.org/UA/2008/02/Types.xsd">
+        <LocalizedText><Text>Off</Text></LocalizedText>
+        <LocalizedText><Text>On</Text></LocalizedText>
+      </ListOfLocalizedText>
+    </Value>
+  </UAVariable>
+  <UAObject NodeId="ns=1;s=Machine1" BrowseName="1:Machine1" EventNotifier="1">
+    <DisplayName>Machine1</DisplayName>
+    <References>
+      <Reference ReferenceType="Organizes" IsForward="false">i=85</Reference>
+      <Reference ReferenceType="HasComponent">ns=1;s=Machine1.Temperature</Reference>
+    </References>
+  </UAObject>
+  <UAVariable NodeId="ns=1;s=Machine1.Temperature" BrowseName="1:Temperature" ParentNodeId="ns=1;s=Machine1" DataType="Double" AccessLevel="3" Historizing="true">
+    <DisplayName>Temperature</DisplayName>
+    <Description>Oven temperature</Description>
+    <References>
+      <Reference ReferenceType="HasProperty">ns=1;s=Machine1.Temperature.EngineeringUnits</Reference>
+      <Reference ReferenceType="HasProperty">ns=1;s=Machine1.Temperature.EURange</Reference>
+    </References>
+  </UAVariable>
+  <UAVariable NodeId="ns=1;s=Machine1.Temperature.EngineeringUnits" BrowseName="EngineeringUnits" DataType="i=887">
+    <DisplayName>EngineeringUnits</DisplayName>
+    <Value>
+      <ExtensionObject xmlns="http://opcfoundation.org/UA/2008/02/Types.xsd">
+        <TypeId><Identifier>i=888</Identifier></TypeId>
+        <Body>
+          <EUInformation>
+            <NamespaceUri>http://www.opcfoundation.org/UA/units/un/cefact</NamespaceUri>
+            <UnitId>4408652</UnitId>
+            <DisplayName><Text>°C</Text></DisplayName>
+          </EUInformation>
+        </Body>
+      </ExtensionObject>
+    </Value>
+  </UAVariable>
+  <UAVariable NodeId="ns=1;s=Machine1.Temperature.EURange" BrowseName="EURange" DataType="i=884">
+    <DisplayName>EURange</DisplayName>
+    <Value>
+      <ExtensionObject xmlns="http://opcfoundation.org/UA/2008/02/Types.xsd">
+        <TypeId><Identifier>i=885</Identifier></TypeId>
+        <Body><Range><Low>0</Low><High>250</High></Range></Body>
+      </ExtensionObject>
+    </Value>
+  </UAVariable>
+  <UAVariable NodeId="ns=1;s=Machine1.Mode" BrowseName="1:Mode" ParentNodeId="ns=1;s=Machine1" DataType="ns=1;i=3000">
+    <DisplayName>Mode</DisplayName>
+    <References>
+      <Reference ReferenceType="HasComponent" IsForward="false">ns=1;s=Machine1</Reference>
+    </References>
+  </UAVariable>
+  <UAMethod NodeId="ns=1;s=Machine1.Reset" BrowseName="1:Reset" ParentNodeId="ns=1;s=Machine1">
+    <DisplayName>Reset</DisplayName>
+    <References>
+      <Reference ReferenceType="HasComponent" IsForward="false">ns=1;s=Machine1</Reference>
+      <Reference ReferenceType="HasProperty">ns=1;s=Machine1.Reset.InputArguments</Reference>
+    </References>
+  </UAMethod>
+  <UAVariable NodeId="ns=1;s=Machine1.Reset.InputArguments" BrowseName="InputArguments" DataType="i=296" ValueRank="1">
+    <DisplayName>InputArguments</DisplayName>
+    <Value>
+      <ListOfExtensionObject xmlns="http://opcfoundation.org/UA/2008/02/Types.xsd">
+        <ExtensionObject>
+          <TypeId><Identifier>i=297</Identifier></TypeId>
+          <Body>
+            <Argument>
+              <Name>Counter</Name>
+              <DataType><Identifier>i=7</Identifier></DataType>
+              <ValueRank>-1</ValueRank>
+            </Argument>
+          </Body>
+        </ExtensionObject>
+      </ListOfExtensionObject>
+    </Value>
+  </UAVariable>
+</UANodeSet>
+`
+
+// browseNodeSet browses a document from the Objects folder with the default settings.
+func browseNodeSet(t *testing.T, set *NodeSet) NodeDef {
+	t.Helper()
+	roots, err := NewBrowseRoots(util.Config{RootNode: "i=85"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := NewBrowseOptions(util.Config{})
+	opts.Namespaces = set.Namespaces()
+	nodes, _, err := Browse(context.Background(), set, roots[0], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].BrowseName != "Objects" {
+		t.Fatalf("expected the Objects folder, got %+v", nodes)
+	}
+	return nodes[0]
+}
+
+// findDef returns the definition with the browse path in the tree of nodes, or nil.
+func findDef(nodes []NodeDef, path string) *NodeDef {
+	for i := range nodes {
+		if nodes[i].Path == path {
+			return &nodes[i]
+		}
+		if found := findDef(nodes[i].Children, path); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func TestBrowseNodeSet(t *testing.T) {
+	set, err := ReadNodeSet2(strings.NewReader(machineNodeSet), []string{"http://opcfoundation.org/UA/", "urn:server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns := set.Namespaces(); len(ns) != 3 || ns[2] != "urn:plc" {
+		t.Fatalf("expected urn:plc after the known namespaces, got %v", ns)
+	}
+	objects := browseNodeSet(t, set)
+
+	machine := findDef(objects.Children, "Objects.Machine1")
+	if machine == nil || machine.NodeID.String() != "ns=2;s=Machine1" || machine.NamespaceURI != "urn:plc" || !machine.EventNotifier {
+		t.Fatalf("unexpected machine %+v", machine)
+	}
+	if len(machine.Children) != 3 {
+		t.Fatalf("expected the temperature, mode and reset method, got %+v", machine.Children)
+	}
+
+	temperature := findDef(objects.Children, "Objects.Machine1.Temperature")
+	if temperature.DataType != "float64" || !temperature.Storable || !temperature.Writable || !temperature.Historizing || temperature.Description != "Oven temperature" {
+		t.Errorf("unexpected temperature %+v", temperature)
+	}
+	if temperature.Unit != "°C" || temperature.Min != "0" || temperature.Max != "250" {
+		t.Errorf("unexpected engineering units %q %q %q", temperature.Unit, temperature.Min, temperature.Max)
+	}
+
+	mode := findDef(objects.Children, "Objects.Machine1.Mode")
+	if mode.DataType != "int32" || mode.DataTypeName != "ModeEnum" || mode.EnumValues[1] != "On" || !mode.Storable {
+		t.Errorf("unexpected mode %+v", mode)
+	}
+
+	reset := findDef(objects.Children, "Objects.Machine1.Reset")
+	if len(reset.InputArguments) != 1 || reset.InputArguments[0].Name != "Counter" || reset.InputArguments[0].DataType != "uint32" {
+		t.Errorf("unexpected input arguments %+v", reset.InputArguments)
+	}
+}
+
+func TestNodeSet2RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteNodeSet2(&buf, exportTree()); err != nil {
+		t.Fatal(err)
+	}
+	set, err := ReadNodeSet2(&buf, []string{"", "urn:server", "", "urn:plc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := browseNodeSet(t, set)
+
+	temperature := findDef(objects.Children, "Objects.Machine1.Temperature")
+	if temperature == nil || temperature.NodeID.String() != "ns=3;s=Machine1.Temperature" {
+		t.Fatalf("expected the temperature in its namespace on the server, got %+v", temperature)
+	}
+	if temperature.DataType != "float64" || !temperature.Writable || temperature.ReferenceType != "HasComponent" || temperature.Description != "Oven temperature" {
+		t.Errorf("unexpected temperature %+v", temperature)
+	}
+}
+
+func TestReadNodeSet2UnknownNamespace(t *testing.T) {
+	doc := strings.Replace(machineNodeSet, `NodeId="ns=1;s=Machine1.Mode"`, `NodeId="ns=4;s=Machine1.Mode"`, 1)
+	if _, err := ReadNodeSet2(strings.NewReader(doc), nil); err == nil {
+		t.Error("expected an error for a namespace that is not in the NamespaceUris")
+	}
+}
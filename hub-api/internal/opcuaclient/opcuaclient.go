@@ -1,30 +1,51 @@
 package opcuaclient
 
 import (
-	"OpcUaTimeSeriesHub/hub-api/util"
-	"context"
-	"github.com/gopcua/opcua"
-	"github.com/gopcua/opcua/errors"
-	"github.com/gopcua/opcua/id"
+	"encoding/csv"
 	"github.com/gopcua/opcua/ua"
+	"io"
 	"strconv"
 )
 
 type NodeDef struct {
-	NodeID      *ua.NodeID
-	NodeIDParts *NodeIDParts
-	NodeClass   ua.NodeClass
-	BrowseName  string
-	Description string
-	AccessLevel ua.AccessLevelType
-	Path        string
-	DataType    string
-	Writable    bool
-	Unit        string
-	Scale       string
-	Min         string
-	Max         string
-	Children    []NodeDef
+	NodeID       *ua.NodeID
+	NodeIDParts  *NodeIDParts
+	NamespaceURI string
+	NodeClass    ua.NodeClass
+	BrowseName   string
+	Description  string
+	AccessLevel  ua.AccessLevelType
+	Path         string
+	// BrowsePath holds the qualified browse names from below the browse root down to the node,
+	// formatted by FormatQualifiedName, which TranslateBrowsePaths resolves from the root.
+	BrowsePath   []string
+	DataType     string
+	DataTypeID   *ua.NodeID
+	DataTypeName string
+	ValueRank    int32
+	ArrayDims    []uint32
+	EnumValues   map[int64]string
+	Storable     bool
+	TypeWarning  string
+	Writable     bool
+	// Historizing is set when the server is collecting the history of the node, and
+	// HistoryReadable when the AccessLevel allows reading it.
+	Historizing     bool
+	HistoryReadable bool
+	// EventNotifier is set on Objects that events can be subscribed to.
+	EventNotifier bool
+	Unit          string
+	Scale         string
+	Min           string
+	Max           string
+	InstrumentMin string
+	InstrumentMax string
+	OtherParents  []string
+	ReferenceType string
+	// InputArguments and OutputArguments describe the arguments of a Method.
+	InputArguments  []MethodArgument
+	OutputArguments []MethodArgument
+	Children        []NodeDef
 }
 
 type NodeIDParts struct {
@@ -49,6 +70,36 @@ func (n NodeDef) Records() []string {
 	return []string{n.BrowseName, n.DataType, n.NodeID.String(), n.Unit, n.Scale, n.Min, n.Max, strconv.FormatBool(n.Writable), n.Description}
 }
 
+// recordsHeader names the columns of Records.
+var recordsHeader = []string{"BrowseName", "DataType", "NodeID", "Unit", "Scale", "Min", "Max", "Writable", "Description"}
+
+// WriteCSV writes a header and the Records of the nodes and their children, each node before
+// its children.
+func WriteCSV(w io.Writer, nodes []NodeDef) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(recordsHeader); err != nil {
+		return err
+	}
+	if err := writeRecords(cw, nodes); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeRecords writes the Records of the nodes and their children.
+func writeRecords(cw *csv.Writer, nodes []NodeDef) error {
+	for _, n := range nodes {
+		if err := cw.Write(n.Records()); err != nil {
+			return err
+		}
+		if err := writeRecords(cw, n.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // join concatenates two strings with a period separator.
 func join(a, b string) string {
 	if a == "" {
@@ -57,24 +108,26 @@ func join(a, b string) string {
 	return a + "." + b
 }
 
-// browse recursively retrieves the attributes and children nodes of the given OPC UA node.
-func Browse(ctx context.Context, n *opcua.Node, path string, level int) ([]NodeDef, error) {
-
-	// Set the maximum recursive tree levels to a maximum of 10
-	if level > 10 {
-		return nil, nil
-	}
+// browseAttributes are the attributes read for every browsed node, in the order
+// expected by nodeDefFromAttributes.
+var browseAttributes = []ua.AttributeID{
+	ua.AttributeIDNodeClass,
+	ua.AttributeIDBrowseName,
+	ua.AttributeIDDescription,
+	ua.AttributeIDAccessLevel,
+	ua.AttributeIDDataType,
+	ua.AttributeIDValueRank,
+	ua.AttributeIDArrayDimensions,
+	ua.AttributeIDHistorizing,
+	ua.AttributeIDEventNotifier,
+}
 
-	// Get the attributes of the node
-	attrs, err := n.Attributes(ctx, ua.AttributeIDNodeClass, ua.AttributeIDBrowseName, ua.AttributeIDDescription, ua.AttributeIDAccessLevel, ua.AttributeIDDataType)
-	if err != nil {
-		util.Logger.Errorf("Failed the get the attributes of node: %s", n.ID.String())
-		return nil, err
-	}
+// nodeDefFromAttributes builds the definition of a node from the results of reading browseAttributes.
+func nodeDefFromAttributes(nodeID *ua.NodeID, attrs []*ua.DataValue) (NodeDef, error) {
 
 	// Set the definition of the node starting with the NodeID
 	var def = NodeDef{
-		NodeID: n.ID,
+		NodeID: nodeID,
 	}
 
 	// Get the Node Class
@@ -82,7 +135,7 @@ func Browse(ctx context.Context, n *opcua.Node, path string, level int) ([]NodeD
 	case ua.StatusOK:
 		def.NodeClass = ua.NodeClass(attrs[0].Value.Int())
 	default:
-		return nil, err
+		return def, err
 	}
 
 	// Get the node browse name
@@ -90,7 +143,7 @@ func Browse(ctx context.Context, n *opcua.Node, path string, level int) ([]NodeD
 	case ua.StatusOK:
 		def.BrowseName = attrs[1].Value.String()
 	default:
-		return nil, err
+		return def, err
 	}
 
 	// Get the node description
@@ -100,91 +153,75 @@ func Browse(ctx context.Context, n *opcua.Node, path string, level int) ([]NodeD
 	case ua.StatusBadAttributeIDInvalid:
 		// ignore
 	default:
-		return nil, err
+		return def, err
 	}
 
 	// Get the node Access Level
 	switch err := attrs[3].Status; err {
 	case ua.StatusOK:
-		def.AccessLevel = ua.AccessLevelType(attrs[3].Value.Int())
+		// AccessLevel is a Byte, which Int does not convert
+		def.AccessLevel = ua.AccessLevelType(attrs[3].Value.Uint())
 		def.Writable = def.AccessLevel&ua.AccessLevelTypeCurrentWrite == ua.AccessLevelTypeCurrentWrite
+		def.HistoryReadable = def.AccessLevel&ua.AccessLevelTypeHistoryRead == ua.AccessLevelTypeHistoryRead
 	case ua.StatusBadAttributeIDInvalid:
 		// ignore
 	default:
-		return nil, err
+		return def, err
 	}
 
 	// Get the node Data Type
 	switch err := attrs[4].Status; err {
 	case ua.StatusOK:
-		switch v := attrs[4].Value.NodeID().IntID(); v {
-		case id.DateTime:
-			def.DataType = "time.Time"
-		case id.Boolean:
-			def.DataType = "bool"
-		case id.SByte:
-			def.DataType = "int8"
-		case id.Int16:
-			def.DataType = "int16"
-		case id.Int32:
-			def.DataType = "int32"
-		case id.Byte:
-			def.DataType = "byte"
-		case id.UInt16:
-			def.DataType = "uint16"
-		case id.UInt32:
-			def.DataType = "uint32"
-		case id.UtcTime:
-			def.DataType = "time.Time"
-		case id.String:
-			def.DataType = "string"
-		case id.Float:
-			def.DataType = "float32"
-		case id.Double:
-			def.DataType = "float64"
-		default:
-			def.DataType = attrs[4].Value.NodeID().String()
-		}
+		def.setDataType(attrs[4].Value.NodeID())
 	case ua.StatusBadAttributeIDInvalid:
 		// ignore
 	default:
-		return nil, err
+		return def, err
 	}
 
-	// Set the node Path
-	def.Path = join(path, def.BrowseName)
-	// fmt.Printf("%d: def.Path:%s def.NodeClass:%s\n", level, def.Path, def.NodeClass)
-
-	var nodes []NodeDef
-	if def.NodeClass == ua.NodeClassVariable || def.NodeClass == ua.NodeClassObject {
-		nodes = append(nodes, def)
+	// Get the node Value Rank, scalar unless the node says otherwise
+	def.ValueRank = valueRankScalar
+	switch err := attrs[5].Status; err {
+	case ua.StatusOK:
+		def.ValueRank = int32(attrs[5].Value.Int())
+	case ua.StatusBadAttributeIDInvalid:
+		// ignore
+	default:
+		return def, err
 	}
 
-	// Browse children
-	browseChildren := func(refType uint32) error {
-		refs, err := n.ReferencedNodes(ctx, refType, ua.BrowseDirectionForward, ua.NodeClassAll, true)
-		if err != nil {
-			return errors.Errorf("References: %d: %s", refType, err)
-		}
-		for _, rn := range refs {
-			children, err := Browse(ctx, rn, join(path, def.BrowseName), level+1)
-			if err != nil {
-				return errors.Errorf("browse children: %s", err)
-			}
-			def.Children = append(def.Children, children...) // Add children directly to the parent node
+	// Get the node Array Dimensions
+	switch err := attrs[6].Status; err {
+	case ua.StatusOK:
+		if dims, ok := attrs[6].Value.Value().([]uint32); ok {
+			def.ArrayDims = dims
 		}
-		return nil
+	case ua.StatusBadAttributeIDInvalid:
+		// ignore
+	default:
+		return def, err
 	}
 
-	if err := browseChildren(id.HasComponent); err != nil {
-		return nil, err
-	}
-	if err := browseChildren(id.Organizes); err != nil {
-		return nil, err
+	// Get whether the server historizes the node
+	switch err := attrs[7].Status; err {
+	case ua.StatusOK:
+		def.Historizing = attrs[7].Value.Bool()
+	case ua.StatusBadAttributeIDInvalid:
+		// ignore
+	default:
+		return def, err
 	}
-	if err := browseChildren(id.HasProperty); err != nil {
-		return nil, err
+
+	// Get whether events can be subscribed to on the node
+	switch err := attrs[8].Status; err {
+	case ua.StatusOK:
+		notifier := ua.EventNotifierType(attrs[8].Value.Uint())
+		def.EventNotifier = notifier&ua.EventNotifierTypeSubscribeToEvents == ua.EventNotifierTypeSubscribeToEvents
+	case ua.StatusBadAttributeIDInvalid:
+		// ignore
+	default:
+		return def, err
 	}
 
-	return []NodeDef{def}, nil
+	return def, nil
 }
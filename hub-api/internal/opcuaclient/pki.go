@@ -0,0 +1,198 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrServerCertificateRejected is returned when the certificate of the server is not trusted
+// or has expired.
+var ErrServerCertificateRejected = errors.New("server certificate rejected")
+
+// certificateValidity is how long a generated client certificate is valid for.
+const certificateValidity = 5 * 365 * 24 * time.Hour
+
+// LoadOrGenerateCertificate loads the client certificate and private key from PEM files.
+// If the files do not exist and generate is true, a new self-signed certificate for
+// appURI is created and written to certFile and keyFile.
+// It returns the DER encoded certificate and the private key.
+func LoadOrGenerateCertificate(certFile, keyFile, appURI string, generate bool) ([]byte, *rsa.PrivateKey, error) {
+	if !fileExists(certFile) || !fileExists(keyFile) {
+		if !generate {
+			return nil, nil, fmt.Errorf("client certificate %s or private key %s not found", certFile, keyFile)
+		}
+		util.Logger.Infof("Generating client certificate %s for %s", certFile, appURI)
+		certPEM, keyPEM, err := GenerateCertificate(appURI)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := writeFile(certFile, certPEM, 0644); err != nil {
+			return nil, nil, err
+		}
+		if err := writeFile(keyFile, keyPEM, 0600); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading client certificate: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("private key %s is not an RSA key", keyFile)
+	}
+	return pair.Certificate[0], key, nil
+}
+
+// GenerateCertificate creates a self-signed RSA certificate suitable for an OPC UA
+// client application. The application URI is stored in the subject alternative name
+// as required by the OPC UA specification.
+func GenerateCertificate(appURI string) (certPEM, keyPEM []byte, err error) {
+	uri, err := url.Parse(appURI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid application URI %q: %w", appURI, err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating private key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating serial number: %w", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "OPC UA Time Series Hub",
+			Organization: []string{"OPC UA Time Series Hub"},
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certificateValidity),
+		KeyUsage:              x509.KeyUsageContentCommitment | x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageDataEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		URIs:                  []*url.URL{uri},
+	}
+	if host, err := os.Hostname(); err == nil {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating certificate: %w", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM, nil
+}
+
+// VerifyServerCertificate checks the DER encoded server certificate against the
+// certificates in trustedDir. Unknown certificates are either added to trustedDir
+// when autoAccept is set, or copied to rejectedDir so that an administrator can
+// trust them by moving the file into trustedDir.
+func VerifyServerCertificate(der []byte, trustedDir, rejectedDir string, autoAccept bool) error {
+	if len(der) == 0 {
+		return fmt.Errorf("%w: the server did not provide one", ErrServerCertificateRejected)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("parsing server certificate: %w", err)
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("%w: %q is not valid between %s and %s", ErrServerCertificateRejected, cert.Subject.CommonName, cert.NotBefore, cert.NotAfter)
+	}
+
+	trusted, err := loadCertificates(trustedDir)
+	if err != nil {
+		return err
+	}
+	for _, t := range trusted {
+		if bytes.Equal(t, der) {
+			return nil
+		}
+	}
+
+	name := Thumbprint(der) + ".der"
+	if autoAccept {
+		util.Logger.Warnf("Automatically trusting server certificate %q (%s)", cert.Subject.CommonName, name)
+		return writeFile(filepath.Join(trustedDir, name), der, 0644)
+	}
+
+	rejected := filepath.Join(rejectedDir, name)
+	if err := writeFile(rejected, der, 0644); err != nil {
+		util.Logger.Error("Failed to store rejected server certificate", err)
+	}
+	return fmt.Errorf("%w: %q is not trusted, move %s to %s to trust it", ErrServerCertificateRejected, cert.Subject.CommonName, rejected, trustedDir)
+}
+
+// Thumbprint returns the hex encoded SHA-1 thumbprint of a DER encoded certificate.
+func Thumbprint(der []byte) string {
+	sum := sha1.Sum(der)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// loadCertificates reads every DER or PEM encoded certificate in dir.
+// A missing directory is treated as an empty trust list.
+func loadCertificates(dir string) ([][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading certificate directory %s: %w", dir, err)
+	}
+
+	var certs [][]byte
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading certificate %s: %w", entry.Name(), err)
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		certs = append(certs, data)
+	}
+	return certs, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// writeFile writes data to path, creating the parent directory if required.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating directory for %s: %w", path, err)
+	}
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
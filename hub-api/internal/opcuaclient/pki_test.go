@@ -0,0 +1,67 @@
+package opcuaclient
+
+import (
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyServerCertificate(t *testing.T) {
+	dir := t.TempDir()
+	trusted := filepath.Join(dir, "trusted")
+	rejected := filepath.Join(dir, "rejected")
+
+	certPEM, _, err := GenerateCertificate("urn:test:server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+
+	// Unknown certificates are rejected and copied to the rejected directory
+	if err := VerifyServerCertificate(block.Bytes, trusted, rejected, false); err == nil {
+		t.Fatal("expected untrusted certificate to be rejected")
+	}
+	name := Thumbprint(block.Bytes) + ".der"
+	if _, err := os.Stat(filepath.Join(rejected, name)); err != nil {
+		t.Fatalf("rejected certificate not stored: %v", err)
+	}
+
+	// Moving the certificate into the trusted directory trusts it
+	if err := os.MkdirAll(trusted, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(rejected, name), filepath.Join(trusted, name)); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyServerCertificate(block.Bytes, trusted, rejected, false); err != nil {
+		t.Fatalf("trusted certificate rejected: %v", err)
+	}
+}
+
+func TestLoadOrGenerateCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "own", "cert.pem")
+	keyFile := filepath.Join(dir, "own", "key.pem")
+
+	if _, _, err := LoadOrGenerateCertificate(certFile, keyFile, "urn:test:client", false); err == nil {
+		t.Fatal("expected an error when the certificate is missing and generation is disabled")
+	}
+
+	cert, key, err := LoadOrGenerateCertificate(certFile, keyFile, "urn:test:client", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert) == 0 || key == nil {
+		t.Fatal("expected a certificate and private key")
+	}
+
+	// A second call loads the same certificate from disk
+	again, _, err := LoadOrGenerateCertificate(certFile, keyFile, "urn:test:client", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Thumbprint(again) != Thumbprint(cert) {
+		t.Fatal("expected the stored certificate to be reused")
+	}
+}
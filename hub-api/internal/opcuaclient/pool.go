@@ -0,0 +1,150 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"sync"
+	"time"
+)
+
+// SessionPool holds a Session per OPC UA server managed by the hub, with the subscriptions
+// for watching its nodes and for its events. The entry of a server is created on first use,
+// looking up its connection settings.
+type SessionPool struct {
+	lookup       func(ctx context.Context, serverID int) (SecurityConfig, error)
+	opts         SessionOptions
+	interval     time.Duration
+	eventFilter  EventFilterConfig
+	handleEvents func(serverID int, events []Event)
+
+	mu      sync.Mutex
+	servers map[int]*pooledServer
+}
+
+// pooledServer is the session and subscriptions of one server.
+type pooledServer struct {
+	session       *Session
+	subscriptions *SubscriptionManager
+	events        *EventSubscriber
+}
+
+// NewSessionPool returns a pool that connects to the servers with the settings returned by
+// lookup and keeps the sessions alive as set in opts. Subscriptions publish at most once per
+// interval, and the events selected by eventFilter are passed to handleEvents with the id of
+// their server.
+func NewSessionPool(lookup func(ctx context.Context, serverID int) (SecurityConfig, error), opts SessionOptions, interval time.Duration, eventFilter EventFilterConfig, handleEvents func(serverID int, events []Event)) *SessionPool {
+	return &SessionPool{
+		lookup:       lookup,
+		opts:         opts,
+		interval:     interval,
+		eventFilter:  eventFilter,
+		handleEvents: handleEvents,
+		servers:      map[int]*pooledServer{},
+	}
+}
+
+// server returns the entry of a server, creating it if required. The settings are looked up
+// without holding the lock, so that a slow lookup does not block the other servers.
+func (p *SessionPool) server(ctx context.Context, serverID int) (*pooledServer, error) {
+	p.mu.Lock()
+	s, ok := p.servers[serverID]
+	p.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	sec, err := p.lookup(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Another caller may have created the entry during the lookup
+	if s, ok := p.servers[serverID]; ok {
+		return s, nil
+	}
+	session := NewSession(sec, p.opts)
+	s = &pooledServer{
+		session:       session,
+		subscriptions: NewSubscriptionManager(session, p.interval),
+		events: NewEventSubscriber(session, p.interval, p.eventFilter, func(events []Event) {
+			p.handleEvents(serverID, events)
+		}),
+	}
+	session.OnStateChange(func(st SessionStatus) {
+		if st.State == StateConnected && st.Reconnects > 0 {
+			go s.resubscribe()
+		}
+	})
+	p.servers[serverID] = s
+	return s, nil
+}
+
+// resubscribe restores the subscriptions of a server after its session connected again.
+func (s *pooledServer) resubscribe() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.session.opts.ConnectTimeout)
+	defer cancel()
+	if err := s.subscriptions.Resubscribe(ctx); err != nil {
+		util.Logger.Errorf("Failed to watch the nodes of %s again: %s", s.session.sec.Endpoint, err)
+	}
+	if err := s.events.Resubscribe(ctx); err != nil {
+		util.Logger.Errorf("Failed to subscribe to the events of %s again: %s", s.session.sec.Endpoint, err)
+	}
+}
+
+// Session returns the shared session with a server.
+func (p *SessionPool) Session(ctx context.Context, serverID int) (*Session, error) {
+	s, err := p.server(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+	return s.session, nil
+}
+
+// Subscriptions returns the manager of the watched nodes of a server.
+func (p *SessionPool) Subscriptions(ctx context.Context, serverID int) (*SubscriptionManager, error) {
+	s, err := p.server(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+	return s.subscriptions, nil
+}
+
+// Events returns the subscriber to the events of a server.
+func (p *SessionPool) Events(ctx context.Context, serverID int) (*EventSubscriber, error) {
+	s, err := p.server(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+	return s.events, nil
+}
+
+// Status returns the connection status of a server, starting its session if required so that
+// the hub keeps connected to it.
+func (p *SessionPool) Status(ctx context.Context, serverID int) (SessionStatus, error) {
+	s, err := p.server(ctx, serverID)
+	if err != nil {
+		return SessionStatus{}, err
+	}
+	s.session.Start()
+	return s.session.Status(), nil
+}
+
+// Close stops the event subscriptions of a server and closes its session, so that its settings
+// are looked up again on next use. Watchers of its nodes stop receiving values.
+func (p *SessionPool) Close(ctx context.Context, serverID int) error {
+	p.mu.Lock()
+	s, ok := p.servers[serverID]
+	delete(p.servers, serverID)
+	p.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	err := s.events.SetNotifiers(ctx, nil)
+	if closeErr := s.session.Close(ctx); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package opcuaclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua/ua"
+	"strings"
+	"time"
+)
+
+// statusSeverityMask selects the severity bits of a status code, which are 0 for Good.
+const statusSeverityMask = 0xC0000000
+
+// maxNodesPerRead is the number of nodes read in a single request, which most servers accept.
+const maxNodesPerRead = 100
+
+// ReadClient is the part of *opcua.Client used to read values.
+type ReadClient interface {
+	Read(ctx context.Context, req *ua.ReadRequest) (*ua.ReadResponse, error)
+}
+
+// LiveValue is the current value of a node as read from the server.
+type LiveValue struct {
+	NodeID          string        `json:"nodeID"`
+	Value           interface{}   `json:"value"`
+	StatusCode      string        `json:"statusCode"`
+	Status          ua.StatusCode `json:"-"`
+	Good            bool          `json:"good"`
+	SourceTimestamp *time.Time    `json:"sourceTimestamp,omitempty"`
+	ServerTimestamp *time.Time    `json:"serverTimestamp,omitempty"`
+}
+
+// ReadLiveValues reads the Value attribute of the nodes with both timestamps, at most
+// maxNodesPerRead nodes per request. The values are returned in the order of nodeIDs.
+func ReadLiveValues(ctx context.Context, c ReadClient, nodeIDs []*ua.NodeID) ([]LiveValue, error) {
+	values := make([]LiveValue, 0, len(nodeIDs))
+	for _, ids := range batch(nodeIDs, maxNodesPerRead) {
+		req := &ua.ReadRequest{TimestampsToReturn: ua.TimestampsToReturnBoth}
+		for _, nodeID := range ids {
+			req.NodesToRead = append(req.NodesToRead, &ua.ReadValueID{NodeID: nodeID, AttributeID: ua.AttributeIDValue})
+		}
+
+		res, err := c.Read(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("reading values: %w", err)
+		}
+		if len(res.Results) != len(ids) {
+			return nil, fmt.Errorf("read returned %d results for %d nodes", len(res.Results), len(ids))
+		}
+		for i, dv := range res.Results {
+			values = append(values, liveValue(ids[i], dv))
+		}
+	}
+	return values, nil
+}
+
+// liveValue converts a DataValue into a LiveValue.
+func liveValue(nodeID *ua.NodeID, dv *ua.DataValue) LiveValue {
+	v := LiveValue{NodeID: nodeID.String(), StatusCode: StatusName(dv.Status), Status: dv.Status, Good: dv.Status&statusSeverityMask == 0}
+	if dv.Value != nil {
+		v.Value = dv.Value.Value()
+	}
+	if !dv.SourceTimestamp.IsZero() {
+		t := dv.SourceTimestamp
+		v.SourceTimestamp = &t
+	}
+	if !dv.ServerTimestamp.IsZero() {
+		t := dv.ServerTimestamp
+		v.ServerTimestamp = &t
+	}
+	return v
+}
+
+// StatusName returns the symbolic name of a status code, such as Good or BadNodeIDUnknown.
+func StatusName(code ua.StatusCode) string {
+	if d, ok := ua.StatusCodes[code]; ok {
+		return strings.TrimPrefix(d.Name, "Status")
+	}
+	return fmt.Sprintf("0x%08X", uint32(code))
+}
@@ -0,0 +1,40 @@
+package opcuaclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua/ua"
+	"testing"
+)
+
+func TestReadLiveValues(t *testing.T) {
+	s := newFakePlant()
+	s.nodes["ns=1;s=Machine1.Value1"].value = 21.5
+	s.nodes["ns=1;s=Machine1.Serial"].value = "SN-1"
+
+	nodeIDs := []*ua.NodeID{
+		ua.MustParseNodeID("ns=1;s=Machine1.Value1"),
+		ua.MustParseNodeID("ns=1;s=Machine1.Serial"),
+		ua.MustParseNodeID("ns=1;s=Missing"),
+	}
+	for i := 0; i < maxNodesPerRead; i++ {
+		nodeIDs = append(nodeIDs, ua.MustParseNodeID(fmt.Sprintf("ns=1;s=Missing%d", i)))
+	}
+
+	values, err := ReadLiveValues(context.Background(), s, nodeIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != len(nodeIDs) || s.reads != 2 {
+		t.Fatalf("expected %d values in 2 reads, got %d in %d", len(nodeIDs), len(values), s.reads)
+	}
+	if v := values[0]; v.Value != 21.5 || !v.Good || v.StatusCode != "Good" || v.NodeID != "ns=1;s=Machine1.Value1" {
+		t.Errorf("unexpected value %+v", v)
+	}
+	if v := values[1]; v.Value != "SN-1" {
+		t.Errorf("unexpected value %+v", v)
+	}
+	if v := values[2]; v.Good || v.StatusCode != "BadNodeIDUnknown" || v.Value != nil {
+		t.Errorf("unexpected value %+v", v)
+	}
+}
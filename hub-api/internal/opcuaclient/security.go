@@ -0,0 +1,224 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"strings"
+)
+
+// ErrNoMatchingEndpoint is returned when the server has no endpoint with the configured security
+// policy and mode.
+var ErrNoMatchingEndpoint = errors.New("no matching endpoint")
+
+// ErrTokenTypeNotAccepted is returned when the selected endpoint does not accept the configured
+// user identity.
+var ErrTokenTypeNotAccepted = errors.New("user token type not accepted")
+
+// ErrInvalidSecurity is returned for a security policy of None with a signing security mode, or
+// a security policy other than None with a mode of None.
+var ErrInvalidSecurity = errors.New("invalid security policy and mode")
+
+// SecurityConfig holds the settings used to open a session with an OPC UA server.
+type SecurityConfig struct {
+	Endpoint             string
+	SecurityPolicy       string
+	SecurityMode         string
+	AuthMethod           string
+	Username             string
+	Password             string
+	CertificateFile      string
+	PrivateKeyFile       string
+	GenerateCertificate  bool
+	ApplicationURI       string
+	TrustedCertsDir      string
+	RejectedCertsDir     string
+	AutoAcceptServerCert bool
+}
+
+// NewSecurityConfig builds a SecurityConfig from the application configuration.
+func NewSecurityConfig(config util.Config) SecurityConfig {
+	return SecurityConfig{
+		Endpoint:             config.TelegrafOpcUaEndpoint,
+		SecurityPolicy:       config.OpcUaSecurityPolicy,
+		SecurityMode:         config.OpcUaSecurityMode,
+		AuthMethod:           config.OpcUaAuthMethod,
+		Username:             config.OpcUaUsername,
+		Password:             config.OpcUaPassword,
+		CertificateFile:      config.OpcUaCertificateFile,
+		PrivateKeyFile:       config.OpcUaPrivateKeyFile,
+		GenerateCertificate:  config.OpcUaGenerateCertificate == "true",
+		ApplicationURI:       config.OpcUaApplicationURI,
+		TrustedCertsDir:      config.OpcUaTrustedCertsDir,
+		RejectedCertsDir:     config.OpcUaRejectedCertsDir,
+		AutoAcceptServerCert: config.OpcUaAutoAcceptServerCert == "true",
+	}
+}
+
+// NewClient creates an OPC UA client for the endpoint in sec, negotiating the
+// configured security policy, security mode and user identity.
+// The returned client is not connected yet.
+func NewClient(ctx context.Context, sec SecurityConfig) (*opcua.Client, error) {
+	opts, err := ClientOptions(ctx, sec)
+	if err != nil {
+		return nil, err
+	}
+	return opcua.NewClient(sec.Endpoint, opts...)
+}
+
+// ClientOptions queries the endpoints of the server and returns the client options
+// matching the security settings in sec.
+func ClientOptions(ctx context.Context, sec SecurityConfig) ([]opcua.Option, error) {
+	policy, mode, err := ParseSecurity(sec.SecurityPolicy, sec.SecurityMode)
+	if err != nil {
+		return nil, err
+	}
+	authType, err := ParseAuthMethod(sec.AuthMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints, err := opcua.GetEndpoints(ctx, sec.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("getting endpoints from %s: %w", sec.Endpoint, err)
+	}
+
+	ep, err := opcua.SelectEndpoint(endpoints, policy, mode)
+	if err != nil {
+		return nil, fmt.Errorf("%w: server %s has none with security policy %s and mode %s, available: %s",
+			ErrNoMatchingEndpoint, sec.Endpoint, sec.SecurityPolicy, sec.SecurityMode, describeEndpoints(endpoints))
+	}
+
+	if !supportsTokenType(ep, authType) {
+		return nil, fmt.Errorf("%w: endpoint %s (%s, %s) does not accept %s user tokens",
+			ErrTokenTypeNotAccepted, ep.EndpointURL, ep.SecurityPolicyURI, ep.SecurityMode, authType)
+	}
+
+	opts := []opcua.Option{opcua.ApplicationURI(sec.ApplicationURI)}
+
+	var cert []byte
+	var key *rsa.PrivateKey
+	if policy != ua.SecurityPolicyURINone || authType == ua.UserTokenTypeCertificate {
+		cert, key, err = LoadOrGenerateCertificate(sec.CertificateFile, sec.PrivateKeyFile, sec.ApplicationURI, sec.GenerateCertificate)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opcua.Certificate(cert), opcua.PrivateKey(key))
+	}
+
+	if policy != ua.SecurityPolicyURINone {
+		if err := VerifyServerCertificate(ep.ServerCertificate, sec.TrustedCertsDir, sec.RejectedCertsDir, sec.AutoAcceptServerCert); err != nil {
+			return nil, err
+		}
+	}
+
+	switch authType {
+	case ua.UserTokenTypeAnonymous:
+		opts = append(opts, opcua.AuthAnonymous())
+	case ua.UserTokenTypeUserName:
+		opts = append(opts, opcua.AuthUsername(sec.Username, sec.Password))
+	case ua.UserTokenTypeCertificate:
+		opts = append(opts, opcua.AuthCertificate(cert), opcua.AuthPrivateKey(key))
+	}
+	opts = append(opts, opcua.SecurityFromEndpoint(ep, authType))
+
+	util.Logger.Infof("Using endpoint %s with security policy %s, mode %s and %s authentication",
+		sec.Endpoint, ep.SecurityPolicyURI, ep.SecurityMode, authType)
+
+	return opts, nil
+}
+
+// ParseSecurity parses a security policy and mode, which must either both be None or both be
+// other than None. A mismatch is refused rather than connecting with less security than asked.
+func ParseSecurity(policy, mode string) (string, ua.MessageSecurityMode, error) {
+	uri, err := SecurityPolicyURI(policy)
+	if err != nil {
+		return "", ua.MessageSecurityModeInvalid, err
+	}
+	m, err := ParseSecurityMode(mode)
+	if err != nil {
+		return "", ua.MessageSecurityModeInvalid, err
+	}
+	if (uri == ua.SecurityPolicyURINone) != (m == ua.MessageSecurityModeNone) {
+		return "", ua.MessageSecurityModeInvalid, fmt.Errorf("%w: policy %s requires a mode of %s", ErrInvalidSecurity, policy, expectedMode(uri))
+	}
+	return uri, m, nil
+}
+
+// expectedMode describes the security modes allowed with a policy.
+func expectedMode(policy string) string {
+	if policy == ua.SecurityPolicyURINone {
+		return "None"
+	}
+	return "Sign or SignAndEncrypt"
+}
+
+// SecurityPolicyURI converts a short policy name such as Basic256Sha256 or a full
+// policy URI into the canonical security policy URI.
+func SecurityPolicyURI(policy string) (string, error) {
+	uri := ua.FormatSecurityPolicyURI(policy)
+	switch uri {
+	case ua.SecurityPolicyURINone,
+		ua.SecurityPolicyURIBasic128Rsa15,
+		ua.SecurityPolicyURIBasic256,
+		ua.SecurityPolicyURIBasic256Sha256,
+		ua.SecurityPolicyURIAes128Sha256RsaOaep,
+		ua.SecurityPolicyURIAes256Sha256RsaPss:
+		return uri, nil
+	default:
+		return "", fmt.Errorf("invalid security policy: %q", policy)
+	}
+}
+
+// ParseSecurityMode parses one of None, Sign or SignAndEncrypt.
+func ParseSecurityMode(mode string) (ua.MessageSecurityMode, error) {
+	switch strings.ToLower(mode) {
+	case "none":
+		return ua.MessageSecurityModeNone, nil
+	case "sign":
+		return ua.MessageSecurityModeSign, nil
+	case "signandencrypt":
+		return ua.MessageSecurityModeSignAndEncrypt, nil
+	default:
+		return ua.MessageSecurityModeInvalid, fmt.Errorf("invalid security mode: %q", mode)
+	}
+}
+
+// ParseAuthMethod parses one of Anonymous, UserName or Certificate.
+func ParseAuthMethod(method string) (ua.UserTokenType, error) {
+	switch strings.ToLower(method) {
+	case "anonymous":
+		return ua.UserTokenTypeAnonymous, nil
+	case "username":
+		return ua.UserTokenTypeUserName, nil
+	case "certificate":
+		return ua.UserTokenTypeCertificate, nil
+	default:
+		return ua.UserTokenTypeAnonymous, fmt.Errorf("invalid auth method: %q", method)
+	}
+}
+
+// supportsTokenType reports whether the endpoint accepts the given user token type.
+func supportsTokenType(ep *ua.EndpointDescription, authType ua.UserTokenType) bool {
+	for _, t := range ep.UserIdentityTokens {
+		if t.TokenType == authType {
+			return true
+		}
+	}
+	return false
+}
+
+// describeEndpoints returns a short summary of the policy and mode of each endpoint.
+func describeEndpoints(endpoints []*ua.EndpointDescription) string {
+	var parts []string
+	for _, ep := range endpoints {
+		policy := strings.TrimPrefix(ep.SecurityPolicyURI, ua.SecurityPolicyURIPrefix)
+		mode := strings.TrimPrefix(ep.SecurityMode.String(), "MessageSecurityMode")
+		parts = append(parts, fmt.Sprintf("%s/%s", policy, mode))
+	}
+	return strings.Join(parts, ", ")
+}
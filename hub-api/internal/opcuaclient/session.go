@@ -0,0 +1,403 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"sync"
+	"time"
+)
+
+// The states of a Session.
+const (
+	StateDisconnected = "disconnected"
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateReconnecting = "reconnecting"
+)
+
+// ErrNotConnected is returned by Session.Client while the session waits to connect again after
+// a failed attempt.
+var ErrNotConnected = errors.New("not connected")
+
+// SessionOptions controls how a Session checks its connection and connects again.
+type SessionOptions struct {
+	// KeepaliveInterval is how often the state of the server is read to check the connection.
+	KeepaliveInterval time.Duration
+	// ReconnectMinInterval is the wait after the first failed attempt to connect, doubled after
+	// every further failed attempt up to ReconnectMaxInterval.
+	ReconnectMinInterval time.Duration
+	ReconnectMaxInterval time.Duration
+	// ConnectTimeout limits a single attempt to connect.
+	ConnectTimeout time.Duration
+}
+
+// DefaultSessionOptions are the options used when the configured ones are invalid.
+var DefaultSessionOptions = SessionOptions{
+	KeepaliveInterval:    10 * time.Second,
+	ReconnectMinInterval: time.Second,
+	ReconnectMaxInterval: time.Minute,
+	ConnectTimeout:       30 * time.Second,
+}
+
+// NewSessionOptions builds the SessionOptions from OPCUA_KEEPALIVE_INTERVAL,
+// OPCUA_RECONNECT_MIN_INTERVAL and OPCUA_RECONNECT_MAX_INTERVAL.
+func NewSessionOptions(config util.Config) (SessionOptions, error) {
+	opts := DefaultSessionOptions
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"OPCUA_KEEPALIVE_INTERVAL", config.OpcUaKeepaliveInterval, &opts.KeepaliveInterval},
+		{"OPCUA_RECONNECT_MIN_INTERVAL", config.OpcUaReconnectMinInterval, &opts.ReconnectMinInterval},
+		{"OPCUA_RECONNECT_MAX_INTERVAL", config.OpcUaReconnectMaxInterval, &opts.ReconnectMaxInterval},
+	} {
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v <= 0 {
+			return DefaultSessionOptions, fmt.Errorf("invalid %s: %q", d.name, d.value)
+		}
+		*d.dst = v
+	}
+	if opts.ReconnectMaxInterval < opts.ReconnectMinInterval {
+		return DefaultSessionOptions, errors.New("OPCUA_RECONNECT_MAX_INTERVAL is shorter than OPCUA_RECONNECT_MIN_INTERVAL")
+	}
+	return opts, nil
+}
+
+// backoff returns the wait after the given number of failed attempts to connect.
+func (o SessionOptions) backoff(attempts int) time.Duration {
+	wait := o.ReconnectMinInterval
+	for i := 1; i < attempts && wait < o.ReconnectMaxInterval; i++ {
+		wait *= 2
+	}
+	if wait > o.ReconnectMaxInterval {
+		wait = o.ReconnectMaxInterval
+	}
+	return wait
+}
+
+// SessionStatus describes the connection of a Session.
+type SessionStatus struct {
+	Endpoint       string     `json:"endpoint"`
+	State          string     `json:"state"`
+	ConnectedSince *time.Time `json:"connectedSince,omitempty"`
+	// FailedAttempts is the number of attempts to connect that failed since the last connection.
+	FailedAttempts int        `json:"failedAttempts"`
+	NextAttempt    *time.Time `json:"nextAttempt,omitempty"`
+	Reconnects     int        `json:"reconnects"`
+	LastError      string     `json:"lastError,omitempty"`
+	LastErrorAt    *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// Session is a connection to the OPC UA server shared by the API handlers, the browse and the
+// subscriptions, so that every request does not have to open its own secure channel and
+// session. Once started, it connects in the background, reads the state of the server every
+// keepalive interval and connects again with an exponential backoff when the connection is
+// lost. Listeners are told about every change of state.
+type Session struct {
+	sec  SecurityConfig
+	opts SessionOptions
+
+	mu          sync.Mutex
+	client      *opcua.Client
+	status      SessionStatus
+	nextAttempt time.Time
+	attempted   chan struct{}
+	stop        chan struct{}
+	listeners   []func(SessionStatus)
+}
+
+// NewSession returns a session with the server in sec. It does not connect yet.
+func NewSession(sec SecurityConfig, opts SessionOptions) *Session {
+	return &Session{
+		sec:       sec,
+		opts:      opts,
+		status:    SessionStatus{Endpoint: sec.Endpoint, State: StateDisconnected},
+		attempted: make(chan struct{}),
+	}
+}
+
+// OnStateChange registers a function that is called with the status after every change of
+// state. It is called from the goroutine that manages the connection.
+func (s *Session) OnStateChange(f func(SessionStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, f)
+}
+
+// Status returns the current status of the session.
+func (s *Session) Status() SessionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.statusLocked()
+}
+
+// statusLocked returns a copy of the status. s.mu must be held.
+func (s *Session) statusLocked() SessionStatus {
+	st := s.status
+	if !s.nextAttempt.IsZero() && st.State != StateConnected {
+		t := s.nextAttempt
+		st.NextAttempt = &t
+	}
+	return st
+}
+
+// Start starts connecting in the background if the session is not started yet.
+func (s *Session) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startLocked()
+}
+
+// startLocked starts the goroutine managing the connection. s.mu must be held.
+func (s *Session) startLocked() {
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	go s.run(s.stop)
+}
+
+// Client returns the connected client, starting the session if required. While connecting, it
+// waits for the attempt to finish or for ctx to be done. After a failed attempt it returns
+// ErrNotConnected with the reason right away, rather than waiting for the next attempt.
+func (s *Session) Client(ctx context.Context) (*opcua.Client, error) {
+	return s.getClient(ctx, false)
+}
+
+// WaitClient returns the connected client, starting the session if required and waiting for
+// the connection or for ctx to be done.
+func (s *Session) WaitClient(ctx context.Context) (*opcua.Client, error) {
+	return s.getClient(ctx, true)
+}
+
+// getClient returns the connected client, waiting for the attempts to connect until one
+// succeeds if wait is set, or else until one fails.
+func (s *Session) getClient(ctx context.Context, wait bool) (*opcua.Client, error) {
+	for {
+		s.mu.Lock()
+		s.startLocked()
+		if s.client != nil {
+			c := s.client
+			s.mu.Unlock()
+			return c, nil
+		}
+		if !wait && s.status.FailedAttempts > 0 {
+			err := fmt.Errorf("%w to %s, next attempt at %s: %s", ErrNotConnected, s.sec.Endpoint, s.nextAttempt.Format(time.RFC3339), s.status.LastError)
+			s.mu.Unlock()
+			return nil, err
+		}
+		attempted := s.attempted
+		lastError := s.status.LastError
+		s.mu.Unlock()
+
+		select {
+		case <-attempted:
+		case <-ctx.Done():
+			if lastError != "" {
+				return nil, fmt.Errorf("%w to %s: %s", ErrNotConnected, s.sec.Endpoint, lastError)
+			}
+			return nil, fmt.Errorf("%w to %s: %w", ErrNotConnected, s.sec.Endpoint, ctx.Err())
+		}
+	}
+}
+
+// Close stops the session and closes the connection. The next call to Client starts it again.
+func (s *Session) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	c := s.client
+	s.client = nil
+	close(s.attempted)
+	s.attempted = make(chan struct{})
+	s.status = SessionStatus{Endpoint: s.sec.Endpoint, State: StateDisconnected}
+	s.nextAttempt = time.Time{}
+	s.mu.Unlock()
+	s.notify()
+
+	if c == nil {
+		return nil
+	}
+	return c.Close(ctx)
+}
+
+// run connects and checks the connection until stop is closed.
+func (s *Session) run(stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for {
+		s.mu.Lock()
+		connected := s.client != nil
+		wait := s.opts.KeepaliveInterval
+		if !connected {
+			wait = time.Until(s.nextAttempt)
+		}
+		s.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if connected {
+			s.keepalive(ctx, stop)
+		} else {
+			s.connect(ctx, stop)
+		}
+	}
+}
+
+// connect makes one attempt to connect.
+func (s *Session) connect(ctx context.Context, stop chan struct{}) {
+	s.mu.Lock()
+	if s.stop != stop {
+		s.mu.Unlock()
+		return
+	}
+	if s.status.State != StateReconnecting {
+		s.status.State = StateConnecting
+	}
+	s.mu.Unlock()
+	s.notify()
+
+	util.Logger.Infof("Opening shared session with %s", s.sec.Endpoint)
+	attemptCtx, cancel := context.WithTimeout(ctx, s.opts.ConnectTimeout)
+	defer cancel()
+	c, err := s.dial(attemptCtx)
+
+	s.mu.Lock()
+	if s.stop != stop {
+		// Closed while connecting
+		s.mu.Unlock()
+		if c != nil {
+			c.Close(context.Background())
+		}
+		return
+	}
+	now := time.Now()
+	if err != nil {
+		if s.status.State == StateConnecting {
+			s.status.State = StateDisconnected
+		}
+		s.status.FailedAttempts++
+		s.status.LastError = err.Error()
+		s.status.LastErrorAt = &now
+		s.nextAttempt = now.Add(s.opts.backoff(s.status.FailedAttempts))
+		util.Logger.Errorf("Attempt %d: Failed to connect to %s, trying again at %s: %s",
+			s.status.FailedAttempts, s.sec.Endpoint, s.nextAttempt.Format(time.RFC3339), err)
+	} else {
+		s.client = c
+		if s.status.State == StateReconnecting {
+			s.status.Reconnects++
+		}
+		s.status.State = StateConnected
+		s.status.ConnectedSince = &now
+		s.status.FailedAttempts = 0
+		s.nextAttempt = time.Time{}
+		util.Logger.Infof("Connected to %s", s.sec.Endpoint)
+	}
+	close(s.attempted)
+	s.attempted = make(chan struct{})
+	s.mu.Unlock()
+	s.notify()
+}
+
+// dial opens a new connection. The client does not reconnect on its own, the session does.
+func (s *Session) dial(ctx context.Context) (*opcua.Client, error) {
+	opts, err := ClientOptions(ctx, s.sec)
+	if err != nil {
+		return nil, err
+	}
+	c, err := opcua.NewClient(s.sec.Endpoint, append(opts, opcua.AutoReconnect(false))...)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Connect(ctx); err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", s.sec.Endpoint, err)
+	}
+	return c, nil
+}
+
+// keepalive reads the state of the server and drops the connection if that fails.
+func (s *Session) keepalive(ctx context.Context, stop chan struct{}) {
+	s.mu.Lock()
+	c := s.client
+	s.mu.Unlock()
+	if c == nil {
+		return
+	}
+
+	err := checkConnection(ctx, c, s.opts.ConnectTimeout)
+	if err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.stop != stop || s.client != c {
+		s.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	s.client = nil
+	s.status.State = StateReconnecting
+	s.status.ConnectedSince = nil
+	s.status.LastError = err.Error()
+	s.status.LastErrorAt = &now
+	s.nextAttempt = now
+	s.mu.Unlock()
+
+	util.Logger.Warnf("Lost the connection to %s, reconnecting: %s", s.sec.Endpoint, err)
+	s.notify()
+
+	closeCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	c.Close(closeCtx)
+}
+
+// checkConnection reads the State of the ServerStatus of the server.
+func checkConnection(ctx context.Context, c *opcua.Client, timeout time.Duration) error {
+	if c.State() != opcua.Connected {
+		return fmt.Errorf("client is %s", c.State())
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	res, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: []*ua.ReadValueID{{
+		NodeID:      ua.NewNumericNodeID(0, id.Server_ServerStatus_State),
+		AttributeID: ua.AttributeIDValue,
+	}}})
+	if err != nil {
+		return fmt.Errorf("reading server state: %w", err)
+	}
+	if len(res.Results) != 1 || res.Results[0].Status != ua.StatusOK {
+		return fmt.Errorf("reading server state: no value returned")
+	}
+	return nil
+}
+
+// notify calls the listeners with the current status.
+func (s *Session) notify() {
+	s.mu.Lock()
+	st := s.statusLocked()
+	listeners := append([]func(SessionStatus){}, s.listeners...)
+	s.mu.Unlock()
+
+	for _, f := range listeners {
+		f(st)
+	}
+}
@@ -0,0 +1,30 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"testing"
+	"time"
+)
+
+func TestSessionBackoff(t *testing.T) {
+	opts := SessionOptions{ReconnectMinInterval: time.Second, ReconnectMaxInterval: 10 * time.Second}
+	for attempts, want := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if got := opts.backoff(attempts); got != want {
+			t.Errorf("backoff(%d): got %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestNewSessionOptions(t *testing.T) {
+	opts, err := NewSessionOptions(util.Config{OpcUaKeepaliveInterval: "5s", OpcUaReconnectMinInterval: "500ms", OpcUaReconnectMaxInterval: "2m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.KeepaliveInterval != 5*time.Second || opts.ReconnectMinInterval != 500*time.Millisecond || opts.ReconnectMaxInterval != 2*time.Minute {
+		t.Errorf("unexpected options %+v", opts)
+	}
+
+	if _, err := NewSessionOptions(util.Config{OpcUaKeepaliveInterval: "5s", OpcUaReconnectMinInterval: "1m", OpcUaReconnectMaxInterval: "1s"}); err == nil {
+		t.Error("expected an error for a maximum shorter than the minimum")
+	}
+}
@@ -0,0 +1,357 @@
+package opcuaclient
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"fmt"
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"sync"
+	"time"
+)
+
+// watcherBuffer is the number of values queued for a watcher. Values for a watcher that
+// does not keep up are dropped rather than holding up the other watchers.
+const watcherBuffer = 64
+
+// subscription is the part of *opcua.Subscription used by the SubscriptionManager.
+type subscription interface {
+	Monitor(ctx context.Context, ts ua.TimestampsToReturn, items ...*ua.MonitoredItemCreateRequest) (*ua.CreateMonitoredItemsResponse, error)
+	Unmonitor(ctx context.Context, monitoredItemIDs ...uint32) (*ua.DeleteMonitoredItemsResponse, error)
+	Cancel(ctx context.Context) error
+}
+
+// subscribeFunc creates a subscription that publishes its notifications on ch.
+type subscribeFunc func(ctx context.Context, ch chan<- *opcua.PublishNotificationData) (subscription, error)
+
+// SubscriptionManager shares one OPC UA subscription between all watchers of live values.
+// A monitored item is created the first time a node is watched and deleted when its last
+// watcher stops, and the subscription itself is deleted when nothing is watched.
+type SubscriptionManager struct {
+	subscribe subscribeFunc
+
+	// changes serializes the requests that change the subscription, so that mu is never held
+	// while waiting for the server and the values of the watched nodes keep being dispatched.
+	changes sync.Mutex
+
+	mu         sync.Mutex
+	sub        subscription
+	done       chan struct{}
+	nextHandle uint32
+	items      map[string]*monitoredNode
+	handles    map[uint32]*monitoredNode
+}
+
+// monitoredNode is a node with a monitored item in the shared subscription.
+type monitoredNode struct {
+	nodeID   *ua.NodeID
+	handle   uint32
+	itemID   uint32
+	last     *LiveValue
+	watchers map[*Watcher]struct{}
+}
+
+// Watcher receives the values of the nodes it watches on Values until it is stopped.
+type Watcher struct {
+	Values <-chan LiveValue
+
+	ch      chan LiveValue
+	nodeIDs []string
+	stopped bool
+}
+
+// NewSubscriptionManager returns a manager that subscribes through session, publishing
+// changes at most once per interval.
+func NewSubscriptionManager(session *Session, interval time.Duration) *SubscriptionManager {
+	return newSubscriptionManager(func(ctx context.Context, ch chan<- *opcua.PublishNotificationData) (subscription, error) {
+		c, err := session.Client(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return c.Subscribe(ctx, &opcua.SubscriptionParameters{Interval: interval}, ch)
+	})
+}
+
+func newSubscriptionManager(subscribe subscribeFunc) *SubscriptionManager {
+	return &SubscriptionManager{
+		subscribe: subscribe,
+		items:     map[string]*monitoredNode{},
+		handles:   map[uint32]*monitoredNode{},
+	}
+}
+
+// Watch starts watching the nodes. The watcher first receives the last known value of nodes
+// that are already monitored, then every change. Nodes that cannot be monitored are sent
+// once with the status the server returned. Stop must be called when done.
+func (m *SubscriptionManager) Watch(ctx context.Context, nodeIDs []*ua.NodeID) (*Watcher, error) {
+	m.changes.Lock()
+	defer m.changes.Unlock()
+
+	ch := make(chan LiveValue, watcherBuffer)
+	w := &Watcher{Values: ch, ch: ch}
+
+	m.mu.Lock()
+	sub := m.sub
+	m.mu.Unlock()
+	if sub == nil {
+		if err := m.open(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create monitored items for the nodes nobody watches yet. The watcher is added to the nodes
+	// first, so that it receives the values published as soon as their items are created.
+	m.mu.Lock()
+	var requests []*ua.MonitoredItemCreateRequest
+	var created []*monitoredNode
+	for _, nodeID := range nodeIDs {
+		key := nodeID.String()
+		node, ok := m.items[key]
+		if ok {
+			if node.last != nil {
+				w.send(*node.last)
+			}
+		} else {
+			m.nextHandle++
+			node = &monitoredNode{nodeID: nodeID, handle: m.nextHandle, watchers: map[*Watcher]struct{}{}}
+			m.items[key] = node
+			m.handles[m.nextHandle] = node
+			requests = append(requests, opcua.NewMonitoredItemCreateRequestWithDefaults(nodeID, ua.AttributeIDValue, m.nextHandle))
+			created = append(created, node)
+		}
+		node.watchers[w] = struct{}{}
+		w.nodeIDs = append(w.nodeIDs, key)
+	}
+	sub = m.sub
+	m.mu.Unlock()
+
+	var results []*ua.MonitoredItemCreateResult
+	var err error
+	if len(requests) > 0 {
+		var res *ua.CreateMonitoredItemsResponse
+		res, err = sub.Monitor(ctx, ua.TimestampsToReturnBoth, requests...)
+		if err == nil && len(res.Results) != len(requests) {
+			err = fmt.Errorf("monitor returned %d results for %d nodes", len(res.Results), len(requests))
+		}
+		if err == nil {
+			results = res.Results
+		}
+	}
+
+	m.mu.Lock()
+	if err != nil {
+		for _, node := range created {
+			m.forget(node)
+		}
+		for _, key := range w.nodeIDs {
+			if node, ok := m.items[key]; ok {
+				delete(node.watchers, w)
+			}
+		}
+		idle := m.detachIfIdle()
+		m.mu.Unlock()
+		cancelSubscription(ctx, idle)
+		return nil, fmt.Errorf("creating monitored items: %w", err)
+	}
+	failed := map[string]bool{}
+	for i, result := range results {
+		node := created[i]
+		if result.StatusCode != ua.StatusOK {
+			m.forget(node)
+			failed[node.nodeID.String()] = true
+			w.send(LiveValue{NodeID: node.nodeID.String(), StatusCode: StatusName(result.StatusCode)})
+			continue
+		}
+		node.itemID = result.MonitoredItemID
+	}
+	if len(failed) > 0 {
+		var watched []string
+		for _, key := range w.nodeIDs {
+			if !failed[key] {
+				watched = append(watched, key)
+			}
+		}
+		w.nodeIDs = watched
+	}
+	idle := m.detachIfIdle()
+	m.mu.Unlock()
+	cancelSubscription(ctx, idle)
+	return w, nil
+}
+
+// Stop stops the watcher and closes its Values channel. Monitored items without watchers
+// are deleted, and the subscription too if nothing is watched anymore.
+func (m *SubscriptionManager) Stop(ctx context.Context, w *Watcher) error {
+	m.changes.Lock()
+	defer m.changes.Unlock()
+
+	m.mu.Lock()
+	if w.stopped {
+		m.mu.Unlock()
+		return nil
+	}
+	w.stopped = true
+
+	var itemIDs []uint32
+	for _, key := range w.nodeIDs {
+		node, ok := m.items[key]
+		if !ok {
+			continue
+		}
+		delete(node.watchers, w)
+		if len(node.watchers) == 0 {
+			itemIDs = append(itemIDs, node.itemID)
+			m.forget(node)
+		}
+	}
+	w.nodeIDs = nil
+	close(w.ch)
+
+	idle := m.detachIfIdle()
+	sub := m.sub
+	m.mu.Unlock()
+
+	if idle != nil {
+		return cancelSubscription(ctx, idle)
+	}
+	if len(itemIDs) > 0 && sub != nil {
+		if _, err := sub.Unmonitor(ctx, itemIDs...); err != nil {
+			return fmt.Errorf("deleting monitored items: %w", err)
+		}
+	}
+	return nil
+}
+
+// Resubscribe creates the subscription and the monitored items of the watched nodes again, after
+// the session connected again and the previous subscription was lost with the old connection.
+func (m *SubscriptionManager) Resubscribe(ctx context.Context) error {
+	m.changes.Lock()
+	defer m.changes.Unlock()
+
+	m.mu.Lock()
+	if m.sub != nil {
+		close(m.done)
+		m.sub = nil
+	}
+	watched := len(m.items)
+	m.mu.Unlock()
+	if watched == 0 {
+		return nil
+	}
+	return m.open(ctx)
+}
+
+// open creates the subscription and monitored items for the nodes that are already watched,
+// which only exist when the previous subscription was lost. m.changes must be held.
+func (m *SubscriptionManager) open(ctx context.Context) error {
+	notify := make(chan *opcua.PublishNotificationData, watcherBuffer)
+	sub, err := m.subscribe(ctx, notify)
+	if err != nil {
+		return fmt.Errorf("creating subscription: %w", err)
+	}
+
+	m.mu.Lock()
+	m.sub = sub
+	m.done = make(chan struct{})
+	go m.dispatch(notify, m.done)
+
+	var requests []*ua.MonitoredItemCreateRequest
+	var nodes []*monitoredNode
+	for _, node := range m.items {
+		requests = append(requests, opcua.NewMonitoredItemCreateRequestWithDefaults(node.nodeID, ua.AttributeIDValue, node.handle))
+		nodes = append(nodes, node)
+	}
+	m.mu.Unlock()
+	if len(requests) == 0 {
+		return nil
+	}
+
+	res, err := sub.Monitor(ctx, ua.TimestampsToReturnBoth, requests...)
+	if err == nil && len(res.Results) != len(requests) {
+		err = fmt.Errorf("monitor returned %d results for %d nodes", len(res.Results), len(requests))
+	}
+	if err != nil {
+		return fmt.Errorf("creating monitored items: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, result := range res.Results {
+		node := nodes[i]
+		if result.StatusCode != ua.StatusOK {
+			util.Logger.Warnf("Failed to monitor %s again: %s", node.nodeID, StatusName(result.StatusCode))
+			continue
+		}
+		node.itemID = result.MonitoredItemID
+	}
+	return nil
+}
+
+// forget removes a node from the monitored items. m.mu must be held.
+func (m *SubscriptionManager) forget(node *monitoredNode) {
+	delete(m.items, node.nodeID.String())
+	delete(m.handles, node.handle)
+}
+
+// detachIfIdle stops dispatching the subscription when no node is monitored and returns it, to
+// be deleted with cancelSubscription once m.mu is released. m.mu must be held.
+func (m *SubscriptionManager) detachIfIdle() subscription {
+	if m.sub == nil || len(m.items) > 0 {
+		return nil
+	}
+	sub := m.sub
+	m.sub = nil
+	close(m.done)
+	return sub
+}
+
+// cancelSubscription deletes a subscription returned by detachIfIdle, if any.
+func cancelSubscription(ctx context.Context, sub subscription) error {
+	if sub == nil {
+		return nil
+	}
+	if err := sub.Cancel(ctx); err != nil {
+		return fmt.Errorf("deleting subscription: %w", err)
+	}
+	return nil
+}
+
+// dispatch sends the data changes published by the server to the watchers of each node
+// until done is closed.
+func (m *SubscriptionManager) dispatch(notify <-chan *opcua.PublishNotificationData, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case data := <-notify:
+			if data.Error != nil {
+				util.Logger.Warnf("Subscription error: %s", data.Error)
+				continue
+			}
+			changes, ok := data.Value.(*ua.DataChangeNotification)
+			if !ok {
+				continue
+			}
+			m.mu.Lock()
+			for _, item := range changes.MonitoredItems {
+				node, ok := m.handles[item.ClientHandle]
+				if !ok || item.Value == nil {
+					continue
+				}
+				v := liveValue(node.nodeID, item.Value)
+				node.last = &v
+				for w := range node.watchers {
+					w.send(v)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// send queues a value for the watcher, dropping it if the watcher is not keeping up.
+func (w *Watcher) send(v LiveValue) {
+	select {
+	case w.ch <- v:
+	default:
+	}
+}
@@ -0,0 +1,215 @@
+package opcuaclient
+
+import (
+	"context"
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSubscription is an in-memory subscription that accepts every node except ns=1;s=Missing.
+type fakeSubscription struct {
+	mu        sync.Mutex
+	nextID    uint32
+	monitored map[uint32]uint32 // item id -> client handle
+	cancelled bool
+	notify    chan<- *opcua.PublishNotificationData
+	// block, if set, receives a value when Monitor is called and holds it until a value is sent back.
+	block chan struct{}
+}
+
+func (s *fakeSubscription) Monitor(ctx context.Context, ts ua.TimestampsToReturn, items ...*ua.MonitoredItemCreateRequest) (*ua.CreateMonitoredItemsResponse, error) {
+	if s.block != nil {
+		s.block <- struct{}{}
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := &ua.CreateMonitoredItemsResponse{}
+	for _, item := range items {
+		if item.ItemToMonitor.NodeID.String() == "ns=1;s=Missing" {
+			res.Results = append(res.Results, &ua.MonitoredItemCreateResult{StatusCode: ua.StatusBadNodeIDUnknown})
+			continue
+		}
+		s.nextID++
+		s.monitored[s.nextID] = item.RequestedParameters.ClientHandle
+		res.Results = append(res.Results, &ua.MonitoredItemCreateResult{StatusCode: ua.StatusOK, MonitoredItemID: s.nextID})
+	}
+	return res, nil
+}
+
+func (s *fakeSubscription) Unmonitor(ctx context.Context, ids ...uint32) (*ua.DeleteMonitoredItemsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		delete(s.monitored, id)
+	}
+	return &ua.DeleteMonitoredItemsResponse{}, nil
+}
+
+func (s *fakeSubscription) Cancel(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancelled = true
+	return nil
+}
+
+// publish sends a data change for every monitored item, with the item id as the value.
+func (s *fakeSubscription) publish() {
+	s.mu.Lock()
+	changes := &ua.DataChangeNotification{}
+	for id, handle := range s.monitored {
+		changes.MonitoredItems = append(changes.MonitoredItems, &ua.MonitoredItemNotification{
+			ClientHandle: handle,
+			Value:        &ua.DataValue{Value: ua.MustVariant(int32(id)), Status: ua.StatusOK},
+		})
+	}
+	s.mu.Unlock()
+	s.notify <- &opcua.PublishNotificationData{Value: changes}
+}
+
+func receive(t *testing.T, w *Watcher) LiveValue {
+	t.Helper()
+	select {
+	case v := <-w.Values:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("no value received")
+		return LiveValue{}
+	}
+}
+
+func TestSubscriptionManager(t *testing.T) {
+	ctx := context.Background()
+	var subs []*fakeSubscription
+	m := newSubscriptionManager(func(ctx context.Context, ch chan<- *opcua.PublishNotificationData) (subscription, error) {
+		sub := &fakeSubscription{monitored: map[uint32]uint32{}, notify: ch}
+		subs = append(subs, sub)
+		return sub, nil
+	})
+
+	temperature := ua.MustParseNodeID("ns=1;s=Temperature")
+	pressure := ua.MustParseNodeID("ns=1;s=Pressure")
+
+	// The first watcher creates the subscription, the missing node is reported once
+	w1, err := m.Watch(ctx, []*ua.NodeID{temperature, ua.MustParseNodeID("ns=1;s=Missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := receive(t, w1); v.NodeID != "ns=1;s=Missing" || v.StatusCode != "BadNodeIDUnknown" {
+		t.Errorf("unexpected value %+v", v)
+	}
+	subs[0].publish()
+	if v := receive(t, w1); v.NodeID != "ns=1;s=Temperature" || v.Value != int32(1) || !v.Good {
+		t.Errorf("unexpected value %+v", v)
+	}
+
+	// The second watcher shares the subscription and the temperature item, and starts with its last value
+	w2, err := m.Watch(ctx, []*ua.NodeID{temperature, pressure})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || len(subs[0].monitored) != 2 {
+		t.Fatalf("expected 2 items in 1 subscription, got %d subscriptions", len(subs))
+	}
+	if v := receive(t, w2); v.NodeID != "ns=1;s=Temperature" || v.Value != int32(1) {
+		t.Errorf("unexpected value %+v", v)
+	}
+
+	// Pressure is deleted with its only watcher, temperature is still watched
+	if err := m.Stop(ctx, w2); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-w2.Values; ok {
+		t.Error("expected the values of a stopped watcher to be closed")
+	}
+	if len(subs[0].monitored) != 1 || subs[0].cancelled {
+		t.Errorf("expected only the temperature item to remain, got %v", subs[0].monitored)
+	}
+
+	// The subscription is deleted with the last watcher, and created again when needed
+	if err := m.Stop(ctx, w1); err != nil {
+		t.Fatal(err)
+	}
+	if !subs[0].cancelled {
+		t.Error("expected the subscription to be deleted")
+	}
+	w3, err := m.Watch(ctx, []*ua.NodeID{pressure})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop(ctx, w3)
+	if len(subs) != 2 {
+		t.Errorf("expected a new subscription, got %d", len(subs))
+	}
+}
+
+func TestSubscriptionManagerResubscribe(t *testing.T) {
+	ctx := context.Background()
+	var subs []*fakeSubscription
+	m := newSubscriptionManager(func(ctx context.Context, ch chan<- *opcua.PublishNotificationData) (subscription, error) {
+		sub := &fakeSubscription{monitored: map[uint32]uint32{}, notify: ch}
+		subs = append(subs, sub)
+		return sub, nil
+	})
+
+	w, err := m.Watch(ctx, []*ua.NodeID{ua.MustParseNodeID("ns=1;s=Temperature")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop(ctx, w)
+
+	// After reconnecting the watched nodes are monitored in a new subscription
+	if err := m.Resubscribe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 2 || len(subs[1].monitored) != 1 {
+		t.Fatalf("expected the temperature item in a new subscription, got %d subscriptions", len(subs))
+	}
+	subs[1].publish()
+	if v := receive(t, w); v.NodeID != "ns=1;s=Temperature" || !v.Good {
+		t.Errorf("unexpected value %+v", v)
+	}
+}
+
+func TestSubscriptionManagerDispatchesDuringMonitor(t *testing.T) {
+	ctx := context.Background()
+	var sub *fakeSubscription
+	m := newSubscriptionManager(func(ctx context.Context, ch chan<- *opcua.PublishNotificationData) (subscription, error) {
+		sub = &fakeSubscription{monitored: map[uint32]uint32{}, notify: ch}
+		return sub, nil
+	})
+
+	w1, err := m.Watch(ctx, []*ua.NodeID{ua.MustParseNodeID("ns=1;s=Temperature")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop(ctx, w1)
+
+	// While the server creates the items of another watcher, the values of the watched nodes are still delivered
+	sub.block = make(chan struct{})
+	watched := make(chan error)
+	go func() {
+		w2, err := m.Watch(ctx, []*ua.NodeID{ua.MustParseNodeID("ns=1;s=Pressure")})
+		if err == nil {
+			defer m.Stop(ctx, w2)
+		}
+		watched <- err
+	}()
+	<-sub.block
+	sub.publish()
+	select {
+	case v := <-w1.Values:
+		if v.NodeID != "ns=1;s=Temperature" {
+			t.Errorf("unexpected value %+v", v)
+		}
+	case <-time.After(time.Second):
+		t.Error("no value received while the other items were created")
+	}
+	sub.block <- struct{}{}
+	if err := <-watched; err != nil {
+		t.Fatal(err)
+	}
+}
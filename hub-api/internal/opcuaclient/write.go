@@ -0,0 +1,254 @@
+package opcuaclient
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gopcua/opcua/ua"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteClient is the part of *opcua.Client used to write values.
+type WriteClient interface {
+	Write(ctx context.Context, req *ua.WriteRequest) (*ua.WriteResponse, error)
+}
+
+// writeTypes are the Go types of the data types, as stored in NodeDef.DataType, that
+// values can be written as.
+var writeTypes = map[string]reflect.Type{
+	"bool":      reflect.TypeOf(false),
+	"int8":      reflect.TypeOf(int8(0)),
+	"byte":      reflect.TypeOf(byte(0)),
+	"int16":     reflect.TypeOf(int16(0)),
+	"uint16":    reflect.TypeOf(uint16(0)),
+	"int32":     reflect.TypeOf(int32(0)),
+	"uint32":    reflect.TypeOf(uint32(0)),
+	"int64":     reflect.TypeOf(int64(0)),
+	"uint64":    reflect.TypeOf(uint64(0)),
+	"float32":   reflect.TypeOf(float32(0)),
+	"float64":   reflect.TypeOf(float64(0)),
+	"string":    reflect.TypeOf(""),
+	"time.Time": reflect.TypeOf(time.Time{}),
+	"[]byte":    reflect.TypeOf([]byte{}),
+	"number":    reflect.TypeOf(float64(0)),
+	"integer":   reflect.TypeOf(int64(0)),
+	"uinteger":  reflect.TypeOf(uint64(0)),
+}
+
+// ConvertValue converts a value decoded from JSON into a Variant of dataType, the Go type
+// stored in NodeDef.DataType. Numbers should be decoded as json.Number so that large integers
+// keep their precision. Timestamps are RFC 3339 strings, byte strings are base64 and
+// enumeration values can be given by name. Arrays must have one dimension.
+func ConvertValue(value interface{}, dataType string, enumValues map[int64]string) (*ua.Variant, error) {
+	if value == nil {
+		return nil, fmt.Errorf("a value is required")
+	}
+
+	if elemType := strings.TrimPrefix(dataType, "[]"); elemType != dataType && elemType != "byte" {
+		if strings.HasPrefix(elemType, "[]") && elemType != "[]byte" {
+			return nil, fmt.Errorf("writing %s values is not supported", dataType)
+		}
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected an array of %s, got %T", elemType, value)
+		}
+		t, ok := writeTypes[elemType]
+		if !ok {
+			return nil, fmt.Errorf("writing %s values is not supported", dataType)
+		}
+		array := reflect.MakeSlice(reflect.SliceOf(t), len(items), len(items))
+		for i, item := range items {
+			v, err := convertScalar(item, elemType, enumValues)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %w", i, err)
+			}
+			array.Index(i).Set(reflect.ValueOf(v))
+		}
+		return ua.NewVariant(array.Interface())
+	}
+
+	if dataType == "ua.Variant" {
+		// Any type is accepted, so the type is taken from the JSON value
+		switch value.(type) {
+		case bool:
+			dataType = "bool"
+		case string:
+			dataType = "string"
+		default:
+			dataType = "number"
+		}
+	}
+
+	v, err := convertScalar(value, dataType, enumValues)
+	if err != nil {
+		return nil, err
+	}
+	return ua.NewVariant(v)
+}
+
+// convertScalar converts a single value decoded from JSON into the Go type dataType.
+func convertScalar(value interface{}, dataType string, enumValues map[int64]string) (interface{}, error) {
+	switch dataType {
+	case "bool":
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case "int8", "int16", "int32", "int64", "integer":
+		bits := map[string]int{"int8": 8, "int16": 16, "int32": 32}[dataType]
+		if bits == 0 {
+			bits = 64
+		}
+		n, err := parseInt(value, bits, enumValues)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(n).Convert(writeTypes[dataType]).Interface(), nil
+	case "byte", "uint16", "uint32", "uint64", "uinteger":
+		bits := map[string]int{"byte": 8, "uint16": 16, "uint32": 32}[dataType]
+		if bits == 0 {
+			bits = 64
+		}
+		n, err := parseUint(value, bits)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(n).Convert(writeTypes[dataType]).Interface(), nil
+	case "float32", "float64", "number":
+		bits := 64
+		if dataType == "float32" {
+			bits = 32
+		}
+		f, err := parseFloat(value, bits)
+		if err != nil {
+			return nil, err
+		}
+		if bits == 32 {
+			return float32(f), nil
+		}
+		return f, nil
+	case "string":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case "time.Time":
+		if s, ok := value.(string); ok {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q: %w", s, err)
+			}
+			return t, nil
+		}
+	case "[]byte":
+		if s, ok := value.(string); ok {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 byte string: %w", err)
+			}
+			return b, nil
+		}
+	default:
+		return nil, fmt.Errorf("writing %s values is not supported", dataType)
+	}
+	return nil, fmt.Errorf("expected a %s value, got %T", dataType, value)
+}
+
+// parseInt returns an integer that fits in bits. Enumeration values can be given by name
+// and must be one of enumValues.
+func parseInt(value interface{}, bits int, enumValues map[int64]string) (int64, error) {
+	if name, ok := value.(string); ok && len(enumValues) > 0 {
+		for n, s := range enumValues {
+			if s == name {
+				return n, nil
+			}
+		}
+		return 0, fmt.Errorf("%q is not a value of the enumeration", name)
+	}
+
+	var n int64
+	switch v := value.(type) {
+	case json.Number:
+		i, err := strconv.ParseInt(v.String(), 10, bits)
+		if err != nil {
+			return 0, fmt.Errorf("invalid int%d value %s: %w", bits, v, err)
+		}
+		n = i
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, fmt.Errorf("invalid int%d value %v", bits, v)
+		}
+		n = int64(v)
+		if n != n<<(64-bits)>>(64-bits) {
+			return 0, fmt.Errorf("value %v out of range for int%d", v, bits)
+		}
+	default:
+		return 0, fmt.Errorf("expected an integer, got %T", value)
+	}
+
+	if len(enumValues) > 0 {
+		if _, ok := enumValues[n]; !ok {
+			return 0, fmt.Errorf("%d is not a value of the enumeration", n)
+		}
+	}
+	return n, nil
+}
+
+// parseUint returns an unsigned integer that fits in bits.
+func parseUint(value interface{}, bits int) (uint64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		n, err := strconv.ParseUint(v.String(), 10, bits)
+		if err != nil {
+			return 0, fmt.Errorf("invalid uint%d value %s: %w", bits, v, err)
+		}
+		return n, nil
+	case float64:
+		if v != math.Trunc(v) || v < 0 || v >= math.Ldexp(1, bits) {
+			return 0, fmt.Errorf("invalid uint%d value %v", bits, v)
+		}
+		return uint64(v), nil
+	}
+	return 0, fmt.Errorf("expected an unsigned integer, got %T", value)
+}
+
+// parseFloat returns a float that fits in bits.
+func parseFloat(value interface{}, bits int) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := strconv.ParseFloat(v.String(), bits)
+		if err != nil {
+			return 0, fmt.Errorf("invalid float%d value %s: %w", bits, v, err)
+		}
+		return f, nil
+	case float64:
+		if bits == 32 && math.Abs(v) > math.MaxFloat32 {
+			return 0, fmt.Errorf("value %v out of range for float32", v)
+		}
+		return v, nil
+	}
+	return 0, fmt.Errorf("expected a number, got %T", value)
+}
+
+// WriteValue writes the Value attribute of a node and returns the status the server
+// responded with for the node.
+func WriteValue(ctx context.Context, c WriteClient, nodeID *ua.NodeID, value *ua.Variant) (ua.StatusCode, error) {
+	req := &ua.WriteRequest{
+		NodesToWrite: []*ua.WriteValue{{
+			NodeID:      nodeID,
+			AttributeID: ua.AttributeIDValue,
+			Value:       &ua.DataValue{EncodingMask: ua.DataValueValue, Value: value},
+		}},
+	}
+	res, err := c.Write(ctx, req)
+	if err != nil {
+		return 0, fmt.Errorf("writing %s: %w", nodeID, err)
+	}
+	if len(res.Results) != 1 {
+		return 0, fmt.Errorf("write returned %d results for 1 node", len(res.Results))
+	}
+	return res.Results[0], nil
+}
@@ -0,0 +1,131 @@
+package opcuaclient
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gopcua/opcua/ua"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (s *fakeServer) Write(ctx context.Context, req *ua.WriteRequest) (*ua.WriteResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := &ua.WriteResponse{}
+	for _, wv := range req.NodesToWrite {
+		n, ok := s.nodes[wv.NodeID.String()]
+		switch {
+		case !ok:
+			res.Results = append(res.Results, ua.StatusBadNodeIDUnknown)
+		case n.accessLevel&ua.AccessLevelTypeCurrentWrite == 0:
+			res.Results = append(res.Results, ua.StatusBadNotWritable)
+		default:
+			n.value = wv.Value.Value.Value()
+			res.Results = append(res.Results, ua.StatusOK)
+		}
+	}
+	return res, nil
+}
+
+func TestConvertValue(t *testing.T) {
+	enum := map[int64]string{0: "Stopped", 1: "Running"}
+	for _, tt := range []struct {
+		value    string
+		dataType string
+		want     interface{}
+		err      string
+	}{
+		{`true`, "bool", true, ""},
+		{`1`, "bool", nil, "expected a bool value"},
+		{`-128`, "int8", int8(-128), ""},
+		{`128`, "int8", nil, "out of range"},
+		{`255`, "byte", byte(255), ""},
+		{`-1`, "uint32", nil, "invalid uint32"},
+		{`9007199254740993`, "int64", int64(9007199254740993), ""},
+		{`1.5`, "int32", nil, "invalid int32"},
+		{`1.5`, "float32", float32(1.5), ""},
+		{`21.5`, "float64", 21.5, ""},
+		{`"21.5"`, "float64", nil, "expected a number"},
+		{`"pump"`, "string", "pump", ""},
+		{`"2024-05-01T12:00:00Z"`, "time.Time", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), ""},
+		{`"AQI="`, "[]byte", []byte{1, 2}, ""},
+		{`[1, 2.5]`, "[]float64", []float64{1, 2.5}, ""},
+		{`[1, "a"]`, "[]int16", nil, "element 1"},
+		{`[[1]]`, "[][]int16", nil, "not supported"},
+		{`"x"`, "ua.GUID", nil, "not supported"},
+		{`"a"`, "ua.Variant", "a", ""},
+		{`null`, "float64", nil, "value is required"},
+	} {
+		t.Run(tt.dataType+" "+tt.value, func(t *testing.T) {
+			v, err := ConvertValue(decodeNumber(t, tt.value), tt.dataType, nil)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := v.Value()
+			if b, ok := got.([]byte); ok && string(b) == string(tt.want.([]byte)) {
+				return
+			}
+			if f, ok := got.([]float64); ok && len(f) == 2 && f[0] == 1 && f[1] == 2.5 {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("expected %#v, got %#v", tt.want, got)
+			}
+		})
+	}
+
+	if v, err := ConvertValue("Running", "int32", enum); err != nil || v.Value() != int32(1) {
+		t.Errorf("expected Running to be 1, got %v %v", v, err)
+	}
+	if _, err := ConvertValue(json.Number("2"), "int32", enum); err == nil {
+		t.Error("expected an error for a value that is not in the enumeration")
+	}
+}
+
+func decodeNumber(t *testing.T, s string) interface{} {
+	t.Helper()
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestWriteValue(t *testing.T) {
+	s := newFakePlant()
+	s.nodes["ns=1;s=Machine1.Value1"].accessLevel |= ua.AccessLevelTypeCurrentWrite
+
+	nodes, _, err := Browse(context.Background(), s, BrowseRoot{NodeID: ua.MustParseNodeID("ns=1;s=Machine1"), MaxDepth: 1}, BrowseOptions{Namespaces: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, def := range nodes[0].Children {
+		if want := def.BrowseName == "Value1"; def.Writable != want {
+			t.Errorf("expected %s writable to be %t", def.BrowseName, want)
+		}
+	}
+
+	value := ua.MustVariant(42.0)
+	status, err := WriteValue(context.Background(), s, ua.MustParseNodeID("ns=1;s=Machine1.Value1"), value)
+	if err != nil || status != ua.StatusOK {
+		t.Fatalf("expected the write to succeed, got %v %v", status, err)
+	}
+	if v := s.nodes["ns=1;s=Machine1.Value1"].value; v != 42.0 {
+		t.Errorf("expected 42 to be written, got %v", v)
+	}
+
+	status, err = WriteValue(context.Background(), s, ua.MustParseNodeID("ns=1;s=Machine1.Value2"), value)
+	if err != nil || status != ua.StatusBadNotWritable {
+		t.Errorf("expected BadNotWritable, got %v %v", status, err)
+	}
+}
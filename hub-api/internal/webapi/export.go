@@ -0,0 +1,81 @@
+package webapi
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/database"
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// exportFormat is how ExportHandler writes the nodes of a format.
+type exportFormat struct {
+	contentType string
+	extension   string
+	write       func(w io.Writer, nodes []opcuaclient.NodeDef) error
+}
+
+// exportFormats are the formats of the format query parameter of ExportHandler.
+var exportFormats = map[string]exportFormat{
+	"csv":      {"text/csv", "csv", opcuaclient.WriteCSV},
+	"nodeset2": {"application/xml", "xml", opcuaclient.WriteNodeSet2},
+	"json": {"application/json", "json", func(w io.Writer, nodes []opcuaclient.NodeDef) error {
+		return json.NewEncoder(w).Encode(nodes)
+	}},
+}
+
+// ExportHandler streams the stored hierarchy of a server as a CSV tag list, an OPC UA NodeSet2
+// document or JSON node definitions, depending on the format query parameter. The root
+// parameter limits the export to the subtree of a node, and history=true to the nodes with
+// history enabled and their ancestors.
+func ExportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Exporting nodes")
+
+		query := r.URL.Query()
+		name := query.Get("format")
+		if name == "" {
+			name = "json"
+		}
+		format, ok := exportFormats[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("invalid format %q, expected csv, nodeset2 or json", name), http.StatusBadRequest)
+			return
+		}
+
+		serverID, err := requestServerID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := database.GetServer(db, serverID); err != nil {
+			http.Error(w, err.Error(), serverErrorStatus(err))
+			return
+		}
+
+		nodes, err := database.ExportNodes(db, serverID, query.Get("root"), query.Get("history") == "true")
+		if errors.Is(err, database.ErrNodeNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			util.Logger.Error("Failed to load node hierarchy", err)
+			http.Error(w, "Failed to load node hierarchy", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", format.contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="server-%d-nodes.%s"`, serverID, format.extension))
+		if err := format.write(w, nodes); err != nil {
+			util.Logger.Error("Failed to export nodes", err)
+			w.Header().Del("Content-Disposition")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -1,13 +1,25 @@
 package webapi
 
 import (
+	"OpcUaTimeSeriesHub/hub-api/internal/browsejob"
 	"OpcUaTimeSeriesHub/hub-api/internal/configupdate"
 	"OpcUaTimeSeriesHub/hub-api/internal/database"
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
 	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/gopcua/opcua/ua"
+	"github.com/gorilla/mux"
+	"io"
+	"net"
 	"net/http"
-	"os"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ErrorResponse struct {
@@ -15,190 +27,984 @@ type ErrorResponse struct {
 	Message string `json:"message"`
 }
 
-var RequestData struct {
+// NodeHistoryRequest is the body of UpdateNodeHistoryHandler. It is decoded per request, so that
+// concurrent requests do not see each other's fields.
+type NodeHistoryRequest struct {
+	ServerID       int    `json:"serverID"`
 	NodeID         string `json:"nodeID"`
 	HistoryEnabled bool   `json:"historyEnabled"`
 	NodePath       string `json:"nodePath"`
+	// BindPath, if set, binds the selection to the browse path of the node or back to its node id.
+	BindPath *bool `json:"bindPath"`
 }
 
-// GetNodesHandler handles requests for the nodes hierarchy.
-func GetNodesHandler(w http.ResponseWriter, r *http.Request) {
+// GetNodesHandler handles requests for the nodes hierarchy. Every server is a root node of class
+// Server, named after the server, whose children are the roots browsed on it.
+func GetNodesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Getting nodes hierarchy")
+
+		servers, err := database.GetServers(db)
+		if err != nil {
+			util.Logger.Error("Failed to load servers", err)
+			http.Error(w, "Failed to load servers", http.StatusInternalServerError)
+			return
+		}
+
+		roots := []*database.Node{}
+		for _, s := range servers {
+			children, err := database.LoadHierarchy(db, s.ID)
+			if err != nil {
+				util.Logger.Error("Failed to load node hierarchy", err)
+				http.Error(w, "Failed to load node hierarchy", http.StatusInternalServerError)
+				return
+			}
+			roots = append(roots, &database.Node{
+				ServerID:   s.ID,
+				NodeID:     s.Endpoint,
+				ParentID:   s.Endpoint,
+				BrowseName: s.Name,
+				NodeClass:  serverNodeClass,
+				NodePath:   s.Name,
+				Children:   children,
+			})
+		}
+
+		telegrafUpToDate, err := database.IsTelegrafUpToDate(db)
+		if err != nil {
+			util.Logger.Error("Failed to telegraf current state from database", err)
+			http.Error(w, "Failed to telegraf current state from database", http.StatusInternalServerError)
+			return
+		}
+
+		util.Logger.Info("Successfully loaded node hierarchy")
+		util.Logger.Info("Successfully loaded telegraf current state from database")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Nodes            []*database.Node `json:"nodes"`
+			TelegrafUpToDate bool             `json:"telegrafUpToDate"`
+		}{roots, telegrafUpToDate})
 
-	util.Logger.Info("Getting nodes hierarchy")
+	}
+}
 
-	db, err := database.LoadDatabase()
-	if err != nil {
-		util.Logger.Error("Failed to initialize DB", err)
-		http.Error(w, "Failed to initialize DB", http.StatusInternalServerError)
-		return
+func UpdateNodeHistoryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Updating node history")
+
+		// Requests without a server are for the default server
+		request := NodeHistoryRequest{ServerID: database.DefaultServerID}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			util.Logger.Error("Invalid request body", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		err := database.UpdateNodeHistory(db, request.ServerID, request.NodeID, request.HistoryEnabled)
+		if errors.Is(err, database.ErrNodeNotStorable) {
+			util.Logger.Warn("Refusing to enable history", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			util.Logger.Error("Failed to update node", err)
+			http.Error(w, "Failed to update node", http.StatusInternalServerError)
+			return
+		}
+
+		if request.BindPath != nil {
+			err = database.SetNodeBindPath(db, request.ServerID, request.NodeID, *request.BindPath)
+			if errors.Is(err, database.ErrNodeNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, database.ErrNoBrowsePath) {
+				util.Logger.Warn("Refusing to bind the node to its browse path", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				util.Logger.Error("Failed to update node", err)
+				http.Error(w, "Failed to update node", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		var modifyType string
+
+		if request.HistoryEnabled {
+			modifyType = "Enabled"
+		} else {
+			modifyType = "Disabled"
+		}
+
+		util.Logger.WithField("ServerID", request.ServerID).WithField("NodeID", request.NodeID).WithField("HistoryEnabled", request.HistoryEnabled).Info("Node history updated")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(
+			struct {
+				Status  string `json:"status"`
+				Message string `json:"message"`
+			}{"success", fmt.Sprintf("History for node %s: %s", request.NodePath, modifyType)})
 	}
+}
+
+// UpdateConfigFileWithHistoryNodes writes the history enabled nodes of every server to the
+// Telegraf config and subscribes to the events of the history enabled notifiers. The selections
+// bound to a browse path are first moved to the node id their path resolves to on servers that
+// are connected, and the response lists those that moved or no longer resolve. When
+// OPCUA_BACKFILL_LOOKBACK is set, the history the servers stored for the added nodes is then
+// written to InfluxDB in the background, so that their series do not start empty.
+func UpdateConfigFileWithHistoryNodes(db *sql.DB, config util.Config, pool *opcuaclient.SessionPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Updating config file with history nodes")
+
+		servers, err := database.GetServers(db)
+		if err != nil {
+			util.Logger.Error("Failed to load servers", err)
+			http.Error(w, "Failed to load servers", http.StatusInternalServerError)
+			return
+		}
+
+		paths := database.PathResolution{Rebound: []database.PathBinding{}, Unresolved: []database.PathBinding{}}
+		for _, s := range servers {
+			if !s.Enabled {
+				continue
+			}
+			resolution, err := database.ResolveBoundPaths(r.Context(), db, pool, s)
+			if err != nil {
+				util.Logger.Warnf("Keeping the node ids of the bound nodes of server %s: %s", s.Name, err)
+				continue
+			}
+			paths.Rebound = append(paths.Rebound, resolution.Rebound...)
+			paths.Unresolved = append(paths.Unresolved, resolution.Unresolved...)
+		}
+
+		nodes, err := database.GetHistoryNodes(db)
+		if err != nil {
+			util.Logger.Error("Failed to fetch nodes", err)
+			http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
+		}
+
+		// This will update the configuration with all existing and added nodes
+		err = configupdate.UpdateConfig(config, config.TelegrafConfigPath, database.FilterNodesByAction(nodes, []database.Action{database.Added, database.HistoryEnabledNoChange}), servers)
+		if err != nil {
+			util.Logger.Error("Failed to update config file", err)
+			http.Error(w, "Failed to update config file", http.StatusInternalServerError)
+			return
+		}
+
+		err = database.SetDatabaseNodeStates(db, nodes)
+		if err != nil {
+			util.Logger.Error("Failed to update node states in database", err)
+			http.Error(w, "Failed to update node states in database", http.StatusInternalServerError)
+			return
+		}
+
+		for _, s := range servers {
+			if !s.Enabled {
+				continue
+			}
+			serverNodes := serverNodes(nodes, s.ID)
+			notifiers := database.FilterNodesByAction(serverNodes, []database.Action{database.Added, database.HistoryEnabledNoChange})
+			if err := subscribeServerEvents(r.Context(), pool, s.ID, notifiers); err != nil {
+				util.Logger.Errorf("Failed to subscribe to events of server %s: %s", s.Name, err)
+			}
+			backfillHistory(config, pool, *s, configupdate.BackfillNodes(serverNodes))
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(
+			struct {
+				Status     string                 `json:"status"`
+				Message    string                 `json:"message"`
+				Rebound    []database.PathBinding `json:"rebound"`
+				Unresolved []database.PathBinding `json:"unresolved"`
+			}{"success", fmt.Sprintf("Config file updated with history nodes"), paths.Rebound, paths.Unresolved})
 
-	roots, err := database.LoadHierarchy(db)
-	if err != nil {
-		util.Logger.Error("Failed to load node hierarchy", err)
-		http.Error(w, "Failed to load node hierarchy", http.StatusInternalServerError)
-		return
 	}
+}
 
-	telegrafUpToDate, err := database.IsTelegrafUpToDate(db)
+// SubscribeEventNotifiers subscribes to the events of the notifiers whose history is enabled in
+// the applied Telegraf config, on every enabled server.
+func SubscribeEventNotifiers(ctx context.Context, db *sql.DB, pool *opcuaclient.SessionPool) error {
+	nodes, err := database.GetHistoryNodes(db)
 	if err != nil {
-		util.Logger.Error("Failed to telegraf current state from database", err)
-		http.Error(w, "Failed to telegraf current state from database", http.StatusInternalServerError)
-		return
+		return err
 	}
+	servers, err := database.GetServers(db)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, s := range servers {
+		if !s.Enabled {
+			continue
+		}
+		notifiers := database.FilterNodesByAction(serverNodes(nodes, s.ID), []database.Action{database.HistoryEnabledNoChange})
+		if err := subscribeServerEvents(ctx, pool, s.ID, notifiers); err != nil {
+			errs = append(errs, fmt.Errorf("server %s: %w", s.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
 
-	util.Logger.Info("Successfully loaded node hierarchy")
-	util.Logger.Info("Successfully loaded telegraf current state from database")
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(struct {
-		Nodes            []*database.Node `json:"nodes"`
-		TelegrafUpToDate bool             `json:"telegrafUpToDate"`
-	}{roots, telegrafUpToDate})
-
+// subscribeServerEvents subscribes to the events of the notifiers among the nodes of a server,
+// and stops the subscriptions of its other notifiers.
+func subscribeServerEvents(ctx context.Context, pool *opcuaclient.SessionPool, serverID int, nodes []*database.Node) error {
+	events, err := pool.Events(ctx, serverID)
+	if err != nil {
+		return err
+	}
+	return events.SetNotifiers(ctx, eventNotifierIDs(nodes))
 }
 
-func UpdateNodeHistoryHandler(w http.ResponseWriter, r *http.Request) {
+// serverNodes returns the nodes of a server.
+func serverNodes(nodes []*database.Node, serverID int) []*database.Node {
+	var filtered []*database.Node
+	for _, node := range nodes {
+		if node.ServerID == serverID {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
 
-	util.Logger.Info("Updating node history")
+// eventNotifierIDs returns the node ids of the event notifiers among nodes.
+func eventNotifierIDs(nodes []*database.Node) []*ua.NodeID {
+	var nodeIDs []*ua.NodeID
+	for _, node := range nodes {
+		if !node.EventNotifier {
+			continue
+		}
+		nodeID, err := ua.ParseNodeID(node.NodeID)
+		if err != nil {
+			util.Logger.Warnf("Not subscribing to events of %s: %s", node.NodeID, err)
+			continue
+		}
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	return nodeIDs
+}
 
-	db, err := database.LoadDatabase()
-	if err != nil {
-		util.Logger.Error("Failed to initialize DB", err)
-		http.Error(w, "Failed to initialize DB", http.StatusInternalServerError)
+// backfillHistory backfills the nodes of a server in the background over the configured lookback.
+func backfillHistory(config util.Config, pool *opcuaclient.SessionPool, server database.Server, nodes []*database.Node) {
+	if config.OpcUaBackfillLookback == "" || len(nodes) == 0 {
 		return
 	}
-
-	if err := json.NewDecoder(r.Body).Decode(&RequestData); err != nil {
-		util.Logger.Error("Invalid request body", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	lookback, err := time.ParseDuration(config.OpcUaBackfillLookback)
+	if err != nil || lookback < 0 {
+		util.Logger.Warnf("Not backfilling, invalid OPCUA_BACKFILL_LOOKBACK %q", config.OpcUaBackfillLookback)
 		return
 	}
-
-	err = database.UpdateNodeHistory(db, RequestData.NodeID, RequestData.HistoryEnabled)
-	if err != nil {
-		util.Logger.Error("Failed to update node", err)
-		http.Error(w, "Failed to update node", http.StatusInternalServerError)
+	if lookback == 0 {
 		return
 	}
 
-	var modifyType string
+	end := time.Now()
+	go func() {
+		ctx := context.Background()
+		session, err := pool.Session(ctx, server.ID)
+		if err != nil {
+			util.Logger.Error("Failed to connect to OPC UA server for backfill", err)
+			return
+		}
+		c, err := session.Client(ctx)
+		if err != nil {
+			util.Logger.Error("Failed to connect to OPC UA server for backfill", err)
+			return
+		}
+		written, err := configupdate.Backfill(ctx, c, config, server, configupdate.NewInfluxOutput(config), nodes, end.Add(-lookback), end)
+		if err != nil {
+			util.Logger.Error("Failed to backfill history", err)
+		}
+		util.Logger.Infof("Backfilled %d values of %d nodes of server %s", written, len(nodes), server.Name)
+	}()
+}
 
-	if RequestData.HistoryEnabled {
-		modifyType = "Enabled"
-	} else {
-		modifyType = "Disabled"
+func GetUpdatesRequired(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Getting updates required")
+
+		nodes, err := database.GetHistoryNodes(db)
+		if err != nil {
+			util.Logger.Error("Failed to fetch nodes", err)
+			http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
+		}
+
+		modifiedNodes := database.FilterNodesByAction(nodes, []database.Action{database.Added, database.Removed})
+		if err != nil {
+			util.Logger.Error("Failed to fetch nodes", err)
+			http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
+		}
+
+		servers, err := database.GetServers(db)
+		if err != nil {
+			util.Logger.Error("Failed to load servers", err)
+			http.Error(w, "Failed to load servers", http.StatusInternalServerError)
+			return
+		}
+		serverNames := map[int]string{}
+		for _, s := range servers {
+			serverNames[s.ID] = s.Name
+		}
+
+		// Create a new slice of anonymous structs containing only the server, NodeID and DBActionRequired
+		output := make([]struct {
+			Server           string `json:"server"`
+			NodeID           string `json:"nodeID"`
+			DBActionRequired string `json:"dbActionRequired"`
+		}, len(modifiedNodes))
+
+		for i, node := range modifiedNodes {
+			output[i].Server = serverNames[node.ServerID]
+			output[i].NodeID = node.BrowseName
+			output[i].DBActionRequired = node.DBActionRequired.String()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(output)
 	}
+}
+
+// maxNodesPerRequest limits how many nodes can be read with ReadNodesHandler at once.
+const maxNodesPerRequest = 1000
 
-	util.Logger.WithField("NodeID", RequestData.NodeID).WithField("HistoryEnabled", RequestData.HistoryEnabled).Info("Node history updated")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(
-		struct {
-			Status  string `json:"status"`
-			Message string `json:"message"`
-		}{"success", fmt.Sprintf("History for node %s: %s", RequestData.NodePath, modifyType)})
+// NodeDetail is a stored node together with its current value on the server.
+// Node is nil for nodes that are not stored.
+type NodeDetail struct {
+	Node  *database.Node         `json:"node"`
+	Value *opcuaclient.LiveValue `json:"value"`
 }
 
-func UpdateConfigFileWithHistoryNodes(w http.ResponseWriter, r *http.Request) {
+// GetSingleNodeHandler handles requests for a single node's data: its stored attributes and
+// a live read of its value through the shared session with its server.
+func GetSingleNodeHandler(db *sql.DB, pool *opcuaclient.SessionPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Getting single node")
+
+		serverID, session, ok := requestSession(w, r, pool)
+		if !ok {
+			return
+		}
+		vars := mux.Vars(r)
+		details, status, err := readNodeDetails(r.Context(), db, session, serverID, []string{vars["nodeID"]})
+		if err != nil {
+			util.Logger.Error("Failed to read node", err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if details[0].Node == nil && details[0].Value.StatusCode == opcuaclient.StatusName(ua.StatusBadNodeIDUnknown) {
+			http.Error(w, "Failed to find node", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(details[0])
+	}
+}
 
-	util.Logger.Info("Updating config file with history nodes")
+// ReadNodesHandler reads the stored attributes and live values of many nodes of a server at once.
+// The request body is {"nodeIDs": ["ns=3;s=Temperature", ...]}.
+func ReadNodesHandler(db *sql.DB, pool *opcuaclient.SessionPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Reading nodes")
+
+		var request struct {
+			NodeIDs []string `json:"nodeIDs"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			util.Logger.Error("Invalid request body", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if len(request.NodeIDs) == 0 || len(request.NodeIDs) > maxNodesPerRequest {
+			http.Error(w, fmt.Sprintf("Between 1 and %d node ids are required", maxNodesPerRequest), http.StatusBadRequest)
+			return
+		}
+
+		serverID, session, ok := requestSession(w, r, pool)
+		if !ok {
+			return
+		}
+		details, status, err := readNodeDetails(r.Context(), db, session, serverID, request.NodeIDs)
+		if err != nil {
+			util.Logger.Error("Failed to read nodes", err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(details)
+	}
+}
 
-	db, err := database.LoadDatabase()
-	if err != nil {
-		util.Logger.Error("Failed to initialize DB", err)
-		http.Error(w, "Failed to initialize DB", http.StatusInternalServerError)
-		return
+// readNodeDetails loads the stored nodes and reads their current values. On error it also
+// returns the HTTP status to respond with.
+func readNodeDetails(ctx context.Context, db *sql.DB, session *opcuaclient.Session, serverID int, ids []string) ([]NodeDetail, int, error) {
+	nodeIDs := make([]*ua.NodeID, len(ids))
+	for i, id := range ids {
+		nodeID, err := ua.ParseNodeID(id)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid node id %q: %w", id, err)
+		}
+		nodeIDs[i] = nodeID
 	}
 
-	nodes, err := database.GetHistoryNodes(db)
+	details := make([]NodeDetail, len(ids))
+	for i, id := range ids {
+		node, err := database.GetNode(db, serverID, id)
+		if err != nil && !errors.Is(err, database.ErrNodeNotFound) {
+			return nil, http.StatusInternalServerError, err
+		}
+		details[i].Node = node
+	}
+
+	c, err := session.Client(ctx)
 	if err != nil {
-		util.Logger.Error("Failed to fetch nodes", err)
-		http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
+		return nil, http.StatusBadGateway, err
 	}
-	telegrafConfigFilePath := os.Getenv("TELEGRAF_CONFIG_FILE")
+	values, err := opcuaclient.ReadLiveValues(ctx, c, nodeIDs)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	for i := range values {
+		details[i].Value = &values[i]
+	}
+	return details, http.StatusOK, nil
+}
+
+// GetBrowseReportHandler returns where the last browse of a server stopped because of the depth
+// limit or a cycle.
+func GetBrowseReportHandler(w http.ResponseWriter, r *http.Request) {
+
+	util.Logger.Info("Getting browse report")
 
-	// This will update the configuration with all existing and added nodes
-	err = configupdate.UpdateConfig(telegrafConfigFilePath, database.FilterNodesByAction(nodes, []database.Action{database.Added, database.HistoryEnabledNoChange}))
+	serverID, err := requestServerID(r)
 	if err != nil {
-		util.Logger.Error("Failed to update config file", err)
-		http.Error(w, "Failed to update config file", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = database.SetDatabaseNodeStates(db, nodes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(database.GetBrowseReports(serverID))
+}
+
+// GetBrowseChangesHandler returns the nodes the last browse of a server added, removed or changed.
+func GetBrowseChangesHandler(w http.ResponseWriter, r *http.Request) {
+
+	util.Logger.Info("Getting browse changes")
+
+	serverID, err := requestServerID(r)
 	if err != nil {
-		util.Logger.Error("Failed to update node states in database", err)
-		http.Error(w, "Failed to update node states in database", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(
-		struct {
-			Status  string `json:"status"`
-			Message string `json:"message"`
-		}{"success", fmt.Sprintf("Config file updated with history nodes")})
+	changes := database.GetBrowseChanges(serverID)
+	if changes == nil {
+		http.Error(w, "No browse has completed yet", http.StatusNotFound)
+		return
+	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
 }
 
-func GetUpdatesRequired(w http.ResponseWriter, r *http.Request) {
+// TriggerBrowseHandler starts a browse of the OPC UA server in the server query parameter in the
+// background, or of every enabled server without it. It responds with 202 and the new job, or 409
+// and the running job if a browse is already running.
+func TriggerBrowseHandler(scheduler *browsejob.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Triggering browse")
+
+		serverID := 0
+		if r.URL.Query().Has("server") {
+			var err error
+			if serverID, err = requestServerID(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		triggerBrowse(w, scheduler, serverID)
+	}
+}
 
-	util.Logger.Info("Getting updates required")
+// triggerBrowse starts a browse and responds with the job.
+func triggerBrowse(w http.ResponseWriter, scheduler *browsejob.Scheduler, serverID int) {
+	job, started := scheduler.Trigger(serverID)
+	w.Header().Set("Content-Type", "application/json")
+	if started {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(job)
+}
 
-	db, err := database.LoadDatabase()
-	if err != nil {
-		util.Logger.Error("Failed to initialize DB", err)
-		http.Error(w, "Failed to initialize DB", http.StatusInternalServerError)
-		return
+// GetBrowseJobsHandler returns the running and recent browse jobs, newest first.
+func GetBrowseJobsHandler(scheduler *browsejob.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Getting browse jobs")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scheduler.Jobs())
 	}
-	nodes, err := database.GetHistoryNodes(db)
-	if err != nil {
-		util.Logger.Error("Failed to fetch nodes", err)
-		http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
+}
+
+// watchKeepAlive is how often a comment is sent to idle watch streams so that proxies do not
+// close them.
+const watchKeepAlive = 15 * time.Second
+
+// WatchNodesHandler streams the values of the nodes in the nodeID query parameters as
+// server-sent events, e.g. /api/nodes/watch?nodeID=ns%3D3%3Bs%3DTemperature. Each event is
+// a live value in JSON. The nodes are no longer monitored once the client disconnects.
+func WatchNodesHandler(pool *opcuaclient.SessionPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Watching nodes")
+
+		ids := r.URL.Query()["nodeID"]
+		if len(ids) == 0 || len(ids) > maxNodesPerRequest {
+			http.Error(w, fmt.Sprintf("Between 1 and %d node ids are required", maxNodesPerRequest), http.StatusBadRequest)
+			return
+		}
+		nodeIDs := make([]*ua.NodeID, len(ids))
+		for i, id := range ids {
+			nodeID, err := ua.ParseNodeID(id)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid node id %q: %s", id, err), http.StatusBadRequest)
+				return
+			}
+			nodeIDs[i] = nodeID
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		serverID, err := requestServerID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		subscriptions, err := pool.Subscriptions(r.Context(), serverID)
+		if err != nil {
+			http.Error(w, err.Error(), serverErrorStatus(err))
+			return
+		}
+
+		watcher, err := subscriptions.Watch(r.Context(), nodeIDs)
+		if err != nil {
+			util.Logger.Error("Failed to watch nodes", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer func() {
+			if err := subscriptions.Stop(context.Background(), watcher); err != nil {
+				util.Logger.Warn("Failed to stop watching nodes", err)
+			}
+		}()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(watchKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case value := <-watcher.Values:
+				data, err := json.Marshal(value)
+				if err != nil {
+					util.Logger.Error("Failed to encode value", err)
+					continue
+				}
+				fmt.Fprintf(w, "data: %s\n\n", data)
+			}
+			flusher.Flush()
+		}
 	}
+}
 
-	modifiedNodes := database.FilterNodesByAction(nodes, []database.Action{database.Added, database.Removed})
+// maxWritesPerRequest limits how many recorded writes GetNodeWritesHandler returns.
+const maxWritesPerRequest = 100
+
+// WriteNodeHandler writes a value to a node through the shared session. The request body is
+// {"value": 21.5}; the value is converted to the stored data type of the node. Nodes that are
+// not writable are refused with 403. Every write is recorded with the previous value, the client
+// address and the user named by a proxy in proxies, and the response holds the status the server
+// returned.
+func WriteNodeHandler(db *sql.DB, pool *opcuaclient.SessionPool, proxies []netip.Prefix) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Writing node")
+
+		id := mux.Vars(r)["nodeID"]
+		nodeID, err := ua.ParseNodeID(id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid node id %q: %s", id, err), http.StatusBadRequest)
+			return
+		}
+
+		var request struct {
+			Value interface{} `json:"value"`
+		}
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(&request); err != nil {
+			util.Logger.Error("Invalid request body", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		serverID, session, ok := requestSession(w, r, pool)
+		if !ok {
+			return
+		}
+
+		node, err := database.GetNode(db, serverID, id)
+		if errors.Is(err, database.ErrNodeNotFound) || err == nil && node.Removed {
+			http.Error(w, "Failed to find node", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			util.Logger.Error("Failed to load node", err)
+			http.Error(w, "Failed to load node", http.StatusInternalServerError)
+			return
+		}
+		if !node.Writable {
+			http.Error(w, fmt.Sprintf("Node %s is not writable", id), http.StatusForbidden)
+			return
+		}
+
+		value, err := opcuaclient.ConvertValue(request.Value, node.DataType, node.EnumValues)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for %s: %s", node.DataType, err), http.StatusBadRequest)
+			return
+		}
+
+		c, err := session.Client(r.Context())
+		if err != nil {
+			util.Logger.Error("Failed to connect", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		old, err := opcuaclient.ReadLiveValues(r.Context(), c, []*ua.NodeID{nodeID})
+		if err != nil {
+			util.Logger.Error("Failed to read node", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		caller := requestCaller(r, proxies)
+		status, err := opcuaclient.WriteValue(r.Context(), c, nodeID, value)
+		if err != nil {
+			// The server may have applied a write it did not answer, so the attempt is recorded too
+			util.Logger.WithField("NodeID", id).WithField("Caller", caller).WithField("RemoteAddr", r.RemoteAddr).Error("Failed to write node", err)
+			if err := database.InsertNodeWrite(db, serverID, id, old[0].Value, value.Value(), "", err.Error(), caller, r.RemoteAddr); err != nil {
+				util.Logger.Error("Failed to record write", err)
+			}
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		util.Logger.WithField("NodeID", id).WithField("Caller", caller).WithField("RemoteAddr", r.RemoteAddr).WithField("StatusCode", opcuaclient.StatusName(status)).Info("Node written")
+		if err := database.InsertNodeWrite(db, serverID, id, old[0].Value, value.Value(), opcuaclient.StatusName(status), "", caller, r.RemoteAddr); err != nil {
+			util.Logger.Error("Failed to record write", err)
+			http.Error(w, "Value written but failed to record the write", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			NodeID     string      `json:"nodeID"`
+			StatusCode string      `json:"statusCode"`
+			Good       bool        `json:"good"`
+			OldValue   interface{} `json:"oldValue"`
+			NewValue   interface{} `json:"newValue"`
+		}{id, opcuaclient.StatusName(status), status == ua.StatusOK, old[0].Value, value.Value()})
+	}
+}
+
+// GetNodeWritesHandler returns the most recent writes to a node, newest first.
+func GetNodeWritesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Getting node writes")
+
+		serverID, err := requestServerID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writes, err := database.GetNodeWrites(db, serverID, mux.Vars(r)["nodeID"], maxWritesPerRequest)
+		if err != nil {
+			util.Logger.Error("Failed to load node writes", err)
+			http.Error(w, "Failed to load node writes", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(writes)
+	}
+}
+
+// requestCaller returns the user an authenticating proxy named in the X-Forwarded-User header,
+// or an empty string. Any client can set the header, so it is only trusted on requests that come
+// from an address in proxies.
+func requestCaller(r *http.Request, proxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(host)
 	if err != nil {
-		util.Logger.Error("Failed to fetch nodes", err)
-		http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
+		return ""
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(addr.Unmap()) {
+			return r.Header.Get("X-Forwarded-User")
+		}
 	}
+	return ""
+}
 
-	// Create a new slice of anonymous structs containing only NodeID and DBActionRequired
-	output := make([]struct {
-		NodeID           string `json:"nodeID"`
-		DBActionRequired string `json:"dbActionRequired"`
-	}, len(modifiedNodes))
+// parseTrustedProxies parses a comma separated list of addresses and CIDR ranges, such as
+// HUB_TRUSTED_PROXIES. Invalid entries are logged and left out.
+func parseTrustedProxies(list string) []netip.Prefix {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			util.Logger.Warnf("Ignoring invalid trusted proxy %q", entry)
+			continue
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies
+}
 
-	for i, node := range modifiedNodes {
-		output[i].NodeID = node.BrowseName
-		output[i].DBActionRequired = node.DBActionRequired.String()
+// CallMethodHandler calls a Method node on its parent object through the shared session. The
+// request body is {"arguments": [...]} in the order of the InputArguments, or {"arguments":
+// {"name": value}}; set "objectID" to call the method on another object. The arguments are
+// converted to their data types before the call, and the response holds the status and the
+// named output arguments. Calls are logged with the client address and the user named by a proxy
+// in proxies.
+func CallMethodHandler(db *sql.DB, pool *opcuaclient.SessionPool, proxies []netip.Prefix) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Calling method")
+
+		id := mux.Vars(r)["nodeID"]
+		methodID, err := ua.ParseNodeID(id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid node id %q: %s", id, err), http.StatusBadRequest)
+			return
+		}
+
+		var request struct {
+			ObjectID  string      `json:"objectID"`
+			Arguments interface{} `json:"arguments"`
+		}
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			util.Logger.Error("Invalid request body", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		serverID, session, ok := requestSession(w, r, pool)
+		if !ok {
+			return
+		}
+
+		node, err := database.GetNode(db, serverID, id)
+		if errors.Is(err, database.ErrNodeNotFound) || err == nil && (node.Removed || node.NodeClass != ua.NodeClassMethod.String()) {
+			http.Error(w, "Failed to find method", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			util.Logger.Error("Failed to load node", err)
+			http.Error(w, "Failed to load node", http.StatusInternalServerError)
+			return
+		}
+
+		if request.ObjectID == "" {
+			request.ObjectID = node.ParentID
+		}
+		objectID, err := ua.ParseNodeID(request.ObjectID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid object id %q: %s", request.ObjectID, err), http.StatusBadRequest)
+			return
+		}
+
+		inputs, err := opcuaclient.ConvertArguments(request.Arguments, node.InputArguments)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid arguments: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		c, err := session.Client(r.Context())
+		if err != nil {
+			util.Logger.Error("Failed to connect", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		result, err := opcuaclient.CallMethod(r.Context(), c, objectID, methodID, inputs, node.OutputArguments)
+		if err != nil {
+			util.Logger.Error("Failed to call method", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		util.Logger.WithField("MethodID", id).WithField("ObjectID", request.ObjectID).WithField("Caller", requestCaller(r, proxies)).WithField("RemoteAddr", r.RemoteAddr).WithField("StatusCode", result.StatusCode).Info("Method called")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(output)
-}
-
-// GetSingleNodeHandler handles requests for a single node's data
-//func GetSingleNodeHandler(w http.ResponseWriter, r *http.Request) {
-//
-//	util.Logger.Info("Getting single node")
-//
-//	db, err := database.LoadDatabase()
-//	if err != nil {
-//		util.Logger.Error("Failed to initialize DB", err)
-//		http.Error(w, "Failed to initialize DB", http.StatusInternalServerError)
-//		return
-//	}
-//
-//	vars := mux.Vars(r)
-//	nodeID := vars["nodeID"]
-//
-//	// Function to query your database for a single node by NodeID
-//	node, err := database.GetSingleNode(db, nodeID)
-//	if err != nil {
-//		http.Error(w, "Failed to find node", http.StatusNotFound)
-//		return
-//	}
-//
-//	w.Header().Set("Content-Type", "application/json")
-//	json.NewEncoder(w).Encode(node)
-//}
+// Limits of GetNodeHistoryHandler.
+const (
+	defaultHistoryPeriod = time.Hour
+	defaultHistoryLimit  = 10000
+	maxHistoryLimit      = 100000
+)
+
+// GetNodeHistoryHandler returns the history the server stored for a node, read with HistoryReadRaw.
+// The query parameters start and end are RFC 3339 timestamps, by default the last hour, and limit
+// is the maximum number of values. When more values are available, next and skip are the start and
+// skip of the following request: skip is the number of values at the start time that were
+// already returned, so that values sharing a timestamp are neither repeated nor lost.
+func GetNodeHistoryHandler(db *sql.DB, pool *opcuaclient.SessionPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Getting node history")
+
+		id := mux.Vars(r)["nodeID"]
+		nodeID, err := ua.ParseNodeID(id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid node id %q: %s", id, err), http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		end := time.Now().UTC()
+		if v := query.Get("end"); v != "" {
+			if end, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid end %q: %s", v, err), http.StatusBadRequest)
+				return
+			}
+		}
+		start := end.Add(-defaultHistoryPeriod)
+		if v := query.Get("start"); v != "" {
+			if start, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid start %q: %s", v, err), http.StatusBadRequest)
+				return
+			}
+		}
+		if !start.Before(end) {
+			http.Error(w, "start must be before end", http.StatusBadRequest)
+			return
+		}
+		limit := defaultHistoryLimit
+		if v := query.Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxHistoryLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit), http.StatusBadRequest)
+				return
+			}
+		}
+		skip := 0
+		if v := query.Get("skip"); v != "" {
+			if skip, err = strconv.Atoi(v); err != nil || skip < 0 || skip > maxHistoryLimit {
+				http.Error(w, fmt.Sprintf("skip must be between 0 and %d", maxHistoryLimit), http.StatusBadRequest)
+				return
+			}
+		}
+
+		serverID, session, ok := requestSession(w, r, pool)
+		if !ok {
+			return
+		}
+
+		node, err := database.GetNode(db, serverID, id)
+		if err != nil && !errors.Is(err, database.ErrNodeNotFound) {
+			util.Logger.Error("Failed to load node", err)
+			http.Error(w, "Failed to load node", http.StatusInternalServerError)
+			return
+		}
+		if node != nil && !node.HistoryReadable {
+			http.Error(w, fmt.Sprintf("Node %s does not allow reading its history", id), http.StatusBadRequest)
+			return
+		}
+
+		c, err := session.Client(r.Context())
+		if err != nil {
+			util.Logger.Error("Failed to connect", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		values, more, err := opcuaclient.HistoryReadRaw(r.Context(), c, nodeID, start, end, limit+skip)
+		if err != nil {
+			util.Logger.Error("Failed to read history", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		read := values
+		for skip > 0 && len(values) > 0 && values[0].SourceTimestamp != nil && values[0].SourceTimestamp.Equal(start) {
+			values = values[1:]
+			skip--
+		}
+
+		response := struct {
+			NodeID string                  `json:"nodeID"`
+			Start  time.Time               `json:"start"`
+			End    time.Time               `json:"end"`
+			Values []opcuaclient.LiveValue `json:"values"`
+			More   bool                    `json:"more"`
+			Next   *time.Time              `json:"next,omitempty"`
+			Skip   int                     `json:"skip,omitempty"`
+		}{NodeID: id, Start: start, End: end, Values: values, More: more}
+		if more {
+			last := values[len(values)-1]
+			if last.SourceTimestamp == nil {
+				util.Logger.Errorf("History of %s has more values after a value without a source timestamp", id)
+				http.Error(w, "the server returned a value without a source timestamp, so the history cannot be continued", http.StatusBadGateway)
+				return
+			}
+			next := *last.SourceTimestamp
+			response.Next = &next
+			// the values read from start onwards at the last timestamp, including those skipped
+			for i := len(read) - 1; i >= 0 && read[i].SourceTimestamp != nil && read[i].SourceTimestamp.Equal(next); i-- {
+				response.Skip++
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
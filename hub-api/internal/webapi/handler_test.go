@@ -1,21 +1,591 @@
 package webapi
 
 import (
+	"OpcUaTimeSeriesHub/hub-api/internal/browsejob"
+	"OpcUaTimeSeriesHub/hub-api/internal/configupdate"
 	"OpcUaTimeSeriesHub/hub-api/internal/database"
-	"OpcUaTimeSeriesHub/hub-api/util"
-	"fmt"
+	"OpcUaTimeSeriesHub/hub-api/internal/hubtest"
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/BurntSushi/toml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
 	"testing"
 )
 
-func TestYourFunction(t *testing.T) {
+// startAPI starts a hub with a line of a plant and serves its API once the startup browse is done.
+func startAPI(t *testing.T) (*hubtest.Hub, *httptest.Server) {
+	hub := hubtest.StartHub(t,
+		hubtest.Folder("Line1",
+			hubtest.Variable("Speed", 1.5),
+			hubtest.Variable("Count", int32(3)),
+			hubtest.Variable("Recipe", "bread"),
+		),
+		hubtest.Variable("Site", "north"),
+	)
+	api := httptest.NewServer(NewRouter(hub.DB, hub.Config, hub.Pool, hub.Scheduler, hub.Health))
+	t.Cleanup(api.Close)
+	if job := hub.WaitForBrowse(t); job.State != browsejob.StateSucceeded {
+		t.Fatalf("startup browse %s: %v", job.State, job.Errors)
+	}
+	return hub, api
+}
+
+// call sends a request with body encoded as JSON and decodes the response into out if it is
+// not nil. It fails the test if the response does not have the status want.
+func call(t *testing.T, method, url string, body, out interface{}, want int) {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != want {
+		t.Fatalf("%s %s: got status %d, want %d", method, url, res.StatusCode, want)
+	}
+	if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+}
+
+// findNode returns the node with nodeID in the tree of nodes, or nil.
+func findNode(nodes []*database.Node, nodeID string) *database.Node {
+	for _, n := range nodes {
+		if n.NodeID == nodeID {
+			return n
+		}
+		if found := findNode(n.Children, nodeID); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// download returns the body of a GET request, failing the test if the status is not OK.
+func download(t *testing.T, url string) string {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: got status %d: %s", url, res.StatusCode, body)
+	}
+	return string(body)
+}
+
+// readConfig decodes the Telegraf config written by the hub.
+func readConfig(t *testing.T, hub *hubtest.Hub) configupdate.Config {
+	t.Helper()
+	var config configupdate.Config
+	if _, err := toml.DecodeFile(hub.ConfigFile, &config); err != nil {
+		t.Fatalf("decoding the Telegraf config: %v", err)
+	}
+	return config
+}
+
+func TestBrowseSelectApply(t *testing.T) {
+	hub, api := startAPI(t)
+	speed := hub.Server.NodeID("Line1", "Speed")
+	recipe := hub.Server.NodeID("Line1", "Recipe")
+
+	// Browse the default server again through the API
+	var job browsejob.Job
+	call(t, "POST", api.URL+"/api/servers/1/browse", nil, &job, http.StatusAccepted)
+	if job := hub.WaitForBrowse(t); job.State != browsejob.StateSucceeded {
+		t.Fatalf("browse %s: %v", job.State, job.Errors)
+	}
+
+	var tree struct {
+		Nodes            []*database.Node `json:"nodes"`
+		TelegrafUpToDate bool             `json:"telegrafUpToDate"`
+	}
+	call(t, "GET", api.URL+"/api/nodes", nil, &tree, http.StatusOK)
+	if len(tree.Nodes) != 1 || tree.Nodes[0].BrowseName != "default" {
+		t.Fatalf("expected the default server as the only root, got %+v", tree.Nodes)
+	}
+	node := findNode(tree.Nodes, speed)
+	if node == nil {
+		t.Fatalf("%s was not browsed", speed)
+	}
+	if node.NodePath != "Plant.Line1.Speed" || node.DataTypeName != "Double" || !node.Storable {
+		t.Errorf("unexpected node %+v", node)
+	}
+	for _, nodeID := range []string{hub.Server.NodeID("Line1", "Count"), recipe, hub.Server.NodeID("Site")} {
+		if findNode(tree.Nodes, nodeID) == nil {
+			t.Errorf("%s was not browsed", nodeID)
+		}
+	}
+
+	// Select two nodes and apply them to the Telegraf config
+	for _, nodeID := range []string{speed, recipe} {
+		call(t, "POST", api.URL+"/api/update-node-history", map[string]interface{}{"serverID": 1, "nodeID": nodeID, "historyEnabled": true}, nil, http.StatusOK)
+	}
+	call(t, "GET", api.URL+"/api/nodes", nil, &tree, http.StatusOK)
+	if tree.TelegrafUpToDate {
+		t.Error("the Telegraf config is up to date before applying the selection")
+	}
+	call(t, "POST", api.URL+"/api/update-telegraf-config", nil, nil, http.StatusOK)
+
+	config := readConfig(t, hub)
+	if len(config.Inputs.Opcua) != 1 {
+		t.Fatalf("expected one inputs.opcua section, got %d", len(config.Inputs.Opcua))
+	}
+	input := config.Inputs.Opcua[0]
+	if input.Endpoint != hub.Server.Endpoint || input.SecurityPolicy != "None" || input.Tags["server"] != "default" {
+		t.Errorf("unexpected input %+v", input)
+	}
+	identifiers := map[string]*configupdate.SimpleNode{}
+	for _, n := range input.Nodes {
+		identifiers[n.Identifier] = n
+	}
+	if len(identifiers) != 2 || identifiers["Plant.Line1.Speed"] == nil || identifiers["Plant.Line1.Recipe"] == nil {
+		t.Fatalf("unexpected nodes in the Telegraf config: %+v", input.Nodes)
+	}
+	if n := identifiers["Plant.Line1.Speed"]; n.IdentifierType != "s" || n.Namespace != "1" {
+		t.Errorf("unexpected node %+v", n)
+	}
+	if config.Agent.Interval != "10s" || len(config.Outputs["influxdb_v2"]) != 1 {
+		t.Errorf("the agent and outputs were not kept: %+v", config)
+	}
+
+	call(t, "GET", api.URL+"/api/nodes", nil, &tree, http.StatusOK)
+	if !tree.TelegrafUpToDate {
+		t.Error("the Telegraf config is not up to date after applying the selection")
+	}
+}
+
+func TestDeselectApply(t *testing.T) {
+	hub, api := startAPI(t)
+	speed := hub.Server.NodeID("Line1", "Speed")
+
+	call(t, "POST", api.URL+"/api/update-node-history", map[string]interface{}{"serverID": 1, "nodeID": speed, "historyEnabled": true}, nil, http.StatusOK)
+	call(t, "POST", api.URL+"/api/update-telegraf-config", nil, nil, http.StatusOK)
+	if config := readConfig(t, hub); len(config.Inputs.Opcua) != 1 || len(config.Inputs.Opcua[0].Nodes) != 1 {
+		t.Fatalf("expected %s in the Telegraf config, got %+v", speed, config.Inputs.Opcua)
+	}
+
+	var updates []struct {
+		NodeID           string `json:"nodeID"`
+		DBActionRequired string `json:"dbActionRequired"`
+	}
+	call(t, "POST", api.URL+"/api/update-node-history", map[string]interface{}{"serverID": 1, "nodeID": speed, "historyEnabled": false}, nil, http.StatusOK)
+	call(t, "GET", api.URL+"/api/updated-required", nil, &updates, http.StatusOK)
+	if len(updates) != 1 || updates[0].NodeID != "Speed" || updates[0].DBActionRequired != database.Removed.String() {
+		t.Errorf("unexpected updates required %+v", updates)
+	}
+
+	call(t, "POST", api.URL+"/api/update-telegraf-config", nil, nil, http.StatusOK)
+	if config := readConfig(t, hub); len(config.Inputs.Opcua) != 0 {
+		t.Errorf("expected no inputs.opcua sections, got %+v", config.Inputs.Opcua)
+	}
+}
+
+func TestReadNodes(t *testing.T) {
+	hub, api := startAPI(t)
+	hub.Server.SetValue(t, 2.5, "Line1", "Speed")
+
+	var details []NodeDetail
+	call(t, "POST", api.URL+"/api/nodes/read?server=1", map[string]interface{}{"nodeIDs": []string{hub.Server.NodeID("Line1", "Speed")}}, &details, http.StatusOK)
+	if len(details) != 1 || details[0].Node == nil || details[0].Value == nil {
+		t.Fatalf("unexpected details %+v", details)
+	}
+	if details[0].Value.Value != 2.5 {
+		t.Errorf("got value %v, want 2.5", details[0].Value.Value)
+	}
+}
+
+func TestWriteNode(t *testing.T) {
+	hub := hubtest.StartHub(t, hubtest.Node{Name: "Setpoint", Value: 1.5, Writable: true}, hubtest.Variable("Speed", 1.5))
+	api := httptest.NewServer(NewRouter(hub.DB, hub.Config, hub.Pool, hub.Scheduler, hub.Health))
+	t.Cleanup(api.Close)
+	if job := hub.WaitForBrowse(t); job.State != browsejob.StateSucceeded {
+		t.Fatalf("startup browse %s: %v", job.State, job.Errors)
+	}
+	setpoint := api.URL + "/api/nodes/" + url.PathEscape(hub.Server.NodeID("Setpoint"))
+
+	var written struct {
+		StatusCode string `json:"statusCode"`
+		Good       bool   `json:"good"`
+	}
+	call(t, "POST", setpoint+"/write", map[string]interface{}{"value": 21.5}, &written, http.StatusOK)
+	if !written.Good {
+		t.Errorf("unexpected write status %s", written.StatusCode)
+	}
+	call(t, "POST", api.URL+"/api/nodes/"+url.PathEscape(hub.Server.NodeID("Speed"))+"/write", map[string]interface{}{"value": 2}, nil, http.StatusForbidden)
+
+	var writes []database.NodeWrite
+	call(t, "GET", setpoint+"/writes", nil, &writes, http.StatusOK)
+	if len(writes) != 1 || writes[0].OldValue != "1.5" || writes[0].NewValue != "21.5" || writes[0].StatusCode != "Good" || writes[0].Error != "" {
+		t.Errorf("unexpected writes %+v", writes)
+	}
+	if len(writes) == 1 && (writes[0].Caller != "" || !strings.HasPrefix(writes[0].RemoteAddr, "127.0.0.1:")) {
+		t.Errorf("expected the write recorded with the client address only, got %+v", writes[0])
+	}
+}
+
+func TestRequestCaller(t *testing.T) {
+	proxies := parseTrustedProxies("10.0.0.0/8, 192.0.2.7, invalid")
+	if len(proxies) != 2 {
+		t.Fatalf("expected 2 trusted proxies, got %v", proxies)
+	}
+	for _, tt := range []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"10.1.2.3:4000", "alice"},
+		{"192.0.2.7:4000", "alice"},
+		{"[::ffff:192.0.2.7]:4000", "alice"},
+		{"192.0.2.8:4000", ""},
+		{"unix", ""},
+	} {
+		r := httptest.NewRequest("POST", "/api/nodes/ns=1;s=Setpoint/write", nil)
+		r.RemoteAddr = tt.remoteAddr
+		r.Header.Set("X-Forwarded-User", "alice")
+		r.SetBasicAuth("mallory", "")
+		if got := requestCaller(r, proxies); got != tt.want {
+			t.Errorf("requestCaller from %s = %q, want %q", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	hub, api := startAPI(t)
+	speed := hub.Server.NodeID("Line1", "Speed")
+	call(t, "POST", api.URL+"/api/update-node-history", map[string]interface{}{"serverID": 1, "nodeID": speed, "historyEnabled": true}, nil, http.StatusOK)
+
+	rows := strings.Split(strings.TrimSpace(download(t, api.URL+"/api/export?format=csv")), "\n")
+	if len(rows) != 7 || rows[0] != "BrowseName,DataType,NodeID,Unit,Scale,Min,Max,Writable,Description" {
+		t.Fatalf("expected a header and 6 nodes, got %q", rows)
+	}
+	if rows[1] != "Plant,,ns=1;s=Plant,,,,,false," || rows[5] != "Speed,float64,ns=1;s=Plant.Line1.Speed,,,,,false," {
+		t.Errorf("unexpected rows %q", rows)
+	}
+
+	var nodes []opcuaclient.NodeDef
+	if err := json.Unmarshal([]byte(download(t, api.URL+"/api/export?format=json&history=true")), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || len(nodes[0].Children) != 1 || len(nodes[0].Children[0].Children) != 1 || nodes[0].Children[0].Children[0].NodeID.String() != speed {
+		t.Fatalf("expected only the path to %s, got %+v", speed, nodes)
+	}
+
+	nodeSet := download(t, api.URL+"/api/export?format=nodeset2&root="+url.QueryEscape(hub.Server.NodeID("Line1")))
+	for _, want := range []string{"<Uri>" + hubtest.NamespaceURI + "</Uri>", `<UAObject xmlns="http://opcfoundation.org/UA/2011/03/UANodeSet.xsd" NodeId="ns=1;s=Plant.Line1" BrowseName="1:Line1">`, `NodeId="ns=1;s=Plant.Line1.Speed"`, `DataType="Double"`} {
+		if !strings.Contains(nodeSet, want) {
+			t.Errorf("NodeSet2 document does not contain %s:\n%s", want, nodeSet)
+		}
+	}
+	if strings.Contains(nodeSet, "Plant.Site") {
+		t.Errorf("NodeSet2 document contains a node outside the subtree:\n%s", nodeSet)
+	}
+
+	call(t, "GET", api.URL+"/api/export?format=xlsx", nil, nil, http.StatusBadRequest)
+	call(t, "GET", api.URL+"/api/export?root=ns%3D1%3Bs%3DUnknown", nil, nil, http.StatusNotFound)
+	call(t, "GET", api.URL+"/api/export?server=9", nil, nil, http.StatusNotFound)
+}
+
+func TestServerHealth(t *testing.T) {
+	_, api := startAPI(t)
 
-	db, err := database.LoadDatabase()
+	var status ServerHealthStatus
+	call(t, "GET", api.URL+"/api/servers/1/health", nil, &status, http.StatusOK)
+	h := status.Health
+	if h == nil || !h.Reachable() || h.State != "Running" || h.StartTime == nil {
+		t.Fatalf("unexpected health %+v", h)
+	}
+	if h.ClockDrift == nil || *h.ClockDrift < -5 || *h.ClockDrift > 5 {
+		t.Errorf("expected no clock drift with a server on the same host, got %v", h.ClockDrift)
+	}
+	if status.Session.State != opcuaclient.StateConnected {
+		t.Errorf("unexpected session %+v", status.Session)
+	}
+
+	readAt := h.ReadAt
+	status = ServerHealthStatus{}
+	call(t, "GET", api.URL+"/api/servers/1/health?refresh=true", nil, &status, http.StatusOK)
+	if status.Health == nil || status.Health.Restarts != 0 || !status.Health.ReadAt.After(readAt) {
+		t.Errorf("expected the health to be read again without a restart, got %+v", status.Health)
+	}
+	call(t, "GET", api.URL+"/api/servers/9/health", nil, nil, http.StatusNotFound)
+}
+
+// upload posts a document to url and decodes the response into out.
+func upload(t *testing.T, url, body string, out interface{}, want int) {
+	t.Helper()
+	res, err := http.Post(url, "application/octet-stream", strings.NewReader(body))
 	if err != nil {
-		util.Logger.Error("Failed to initialize DB", err)
-		return
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != want {
+		msg, _ := io.ReadAll(res.Body)
+		t.Fatalf("POST %s: got status %d, want %d: %s", url, res.StatusCode, want, msg)
+	}
+	if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatalf("POST %s: %v", url, err)
+		}
+	}
+}
+
+// serverInput returns the inputs.opcua section of the Telegraf config tagged with the server name.
+func serverInput(t *testing.T, hub *hubtest.Hub, name string) configupdate.Opcua {
+	t.Helper()
+	for _, input := range readConfig(t, hub).Inputs.Opcua {
+		if input.Tags["server"] == name {
+			return input
+		}
 	}
-	hierarchy, _ := database.LoadHierarchy(db)
+	t.Fatalf("no inputs.opcua section for server %s", name)
+	return configupdate.Opcua{}
+}
 
-	fmt.Println(hierarchy)
+func TestImport(t *testing.T) {
+	hub, api := startAPI(t)
+	speed := hub.Server.NodeID("Line1", "Speed")
+	t.Cleanup(func() { hub.Pool.Close(context.Background(), 2) })
 
+	// Add the same server again, offline, and import the address space of the first one
+	line2 := database.Server{Name: "line2", Endpoint: hub.Server.Endpoint, RootNode: hub.Server.NodeID(), SecurityPolicy: "None", SecurityMode: "None", AuthMethod: "Anonymous"}
+	var created database.Server
+	call(t, "POST", api.URL+"/api/servers", line2, &created, http.StatusCreated)
+	if created.ID != 2 {
+		t.Fatalf("expected server 2, got %+v", created)
+	}
+
+	var result ImportResult
+	upload(t, api.URL+"/api/servers/2/import?format=nodeset2", download(t, api.URL+"/api/export?format=nodeset2"), &result, http.StatusOK)
+	if result.Nodes != 6 || len(result.Changes.Added) != 6 {
+		t.Fatalf("expected 6 nodes to be added, got %+v", result)
+	}
+	var tree struct {
+		Nodes            []*database.Node `json:"nodes"`
+		TelegrafUpToDate bool             `json:"telegrafUpToDate"`
+	}
+	call(t, "GET", api.URL+"/api/nodes", nil, &tree, http.StatusOK)
+	if len(tree.Nodes) != 2 || tree.Nodes[1].BrowseName != "line2" {
+		t.Fatalf("expected line2 as the second root, got %+v", tree.Nodes)
+	}
+	if node := findNode(tree.Nodes[1].Children, speed); node == nil || node.DataTypeName != "Double" || !node.Storable {
+		t.Fatalf("unexpected imported node %+v", node)
+	}
+
+	// Import a snapshot where the namespace has another index and select a node from it
+	snapshot := strings.ReplaceAll(download(t, api.URL+"/api/export?format=json"), "ns=1;", "ns=5;")
+	upload(t, api.URL+"/api/servers/2/import", snapshot, &result, http.StatusOK)
+	if result.Nodes != 6 {
+		t.Fatalf("expected 6 nodes, got %+v", result)
+	}
+	call(t, "POST", api.URL+"/api/update-node-history", map[string]interface{}{"serverID": 2, "nodeID": "ns=5;s=Plant.Line1.Speed", "historyEnabled": true}, nil, http.StatusOK)
+	call(t, "POST", api.URL+"/api/update-telegraf-config", nil, nil, http.StatusOK)
+	if input := serverInput(t, hub, "line2"); len(input.Nodes) != 1 || input.Nodes[0].Namespace != "5" {
+		t.Fatalf("expected the imported node in namespace 5, got %+v", input.Nodes)
+	}
+
+	// Once the server is online, its browse moves the node to the actual namespace index
+	line2.Enabled = true
+	call(t, "PUT", api.URL+"/api/servers/2", line2, nil, http.StatusOK)
+	call(t, "POST", api.URL+"/api/servers/2/browse", nil, nil, http.StatusAccepted)
+	if job := hub.WaitForBrowse(t); job.State != browsejob.StateSucceeded {
+		t.Fatalf("browse %s: %v", job.State, job.Errors)
+	}
+	call(t, "GET", api.URL+"/api/nodes", nil, &tree, http.StatusOK)
+	if tree.TelegrafUpToDate {
+		t.Error("the Telegraf config is up to date although the node moved to another namespace")
+	}
+	call(t, "POST", api.URL+"/api/update-telegraf-config", nil, nil, http.StatusOK)
+	if input := serverInput(t, hub, "line2"); len(input.Nodes) != 1 || input.Nodes[0].Namespace != "1" {
+		t.Errorf("expected the node in namespace 1, got %+v", input.Nodes)
+	}
+
+	upload(t, api.URL+"/api/servers/2/import?format=csv", "", nil, http.StatusBadRequest)
+	upload(t, api.URL+"/api/servers/2/import?format=nodeset2", "<UANodeSet", nil, http.StatusBadRequest)
+	upload(t, api.URL+"/api/servers/9/import", "[]", nil, http.StatusNotFound)
+}
+
+func TestRemapOntoStoredNode(t *testing.T) {
+	hub, api := startAPI(t)
+	speed := hub.Server.NodeID("Line1", "Speed")
+
+	// A selection stored when the namespace had another index moves onto the browsed node
+	stale := database.Node{ServerID: 1, NodeID: "ns=7;s=Plant.Line1.Speed", Namespace: 7, IdentifierType: "s", Identifier: "Plant.Line1.Speed", NamespaceURI: hubtest.NamespaceURI, HistoryEnabled: true, Storable: true}
+	if err := database.InsertOrUpdateNode(hub.DB, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	call(t, "POST", api.URL+"/api/servers/1/browse", nil, nil, http.StatusAccepted)
+	if job := hub.WaitForBrowse(t); job.State != browsejob.StateSucceeded {
+		t.Fatalf("browse %s: %v", job.State, job.Errors)
+	}
+	var tree struct {
+		Nodes []*database.Node `json:"nodes"`
+	}
+	call(t, "GET", api.URL+"/api/nodes", nil, &tree, http.StatusOK)
+	if node := findNode(tree.Nodes, speed); node == nil || !node.HistoryEnabled {
+		t.Fatalf("expected %s with history enabled, got %+v", speed, node)
+	}
+	if node := findNode(tree.Nodes, stale.NodeID); node != nil {
+		t.Errorf("expected %s to be moved, got %+v", stale.NodeID, node)
+	}
+}
+
+func TestTestServer(t *testing.T) {
+	hub, api := startAPI(t)
+
+	var result opcuaclient.ConnectionTest
+	call(t, "POST", api.URL+"/api/servers/test", map[string]interface{}{"id": 1, "endpoint": hub.Server.Endpoint}, &result, http.StatusOK)
+	if !result.OK || result.ServerState != "Running" {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	// The stored password of a server is not sent to another endpoint or user
+	other := "opc.tcp://127.0.0.1:1"
+	call(t, "POST", api.URL+"/api/servers/test", map[string]interface{}{"id": 1, "endpoint": other, "authMethod": "UserName", "username": "admin"}, nil, http.StatusBadRequest)
+	call(t, "POST", api.URL+"/api/servers/test", map[string]interface{}{"id": 1, "endpoint": hub.Server.Endpoint, "authMethod": "UserName", "username": "admin"}, nil, http.StatusBadRequest)
+	call(t, "POST", api.URL+"/api/servers/test", map[string]interface{}{"id": 9, "endpoint": hub.Server.Endpoint}, nil, http.StatusNotFound)
+
+	// Passwords are stored encrypted
+	line2 := database.Server{Name: "line2", Endpoint: other, RootNode: "i=85", SecurityPolicy: "None", SecurityMode: "None", AuthMethod: "UserName", Username: "admin", Password: "line2 secret"}
+	var created database.Server
+	call(t, "POST", api.URL+"/api/servers", line2, &created, http.StatusCreated)
+	if !created.HasPassword || created.Password != "" {
+		t.Errorf("expected the password to be stored and not returned, got %+v", created)
+	}
+	var stored string
+	if err := hub.DB.QueryRow(`SELECT password FROM servers WHERE id = ?`, created.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored == "" || strings.Contains(stored, "line2 secret") {
+		t.Errorf("expected the password to be encrypted, got %q", stored)
+	}
+	server, err := database.GetServer(hub.DB, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sec, err := server.SecurityConfig(hub.Config); err != nil || sec.Password != "line2 secret" {
+		t.Errorf("expected the stored password to be decrypted, got %q: %v", sec.Password, err)
+	}
+}
+
+func TestBindPath(t *testing.T) {
+	hub, api := startAPI(t)
+	speed := hub.Server.NodeID("Line1", "Speed")
+	count := hub.Server.NodeID("Line1", "Count")
+	for _, nodeID := range []string{speed, count} {
+		call(t, "POST", api.URL+"/api/update-node-history", map[string]interface{}{"serverID": 1, "nodeID": nodeID, "historyEnabled": true, "bindPath": true}, nil, http.StatusOK)
+	}
+	call(t, "POST", api.URL+"/api/update-telegraf-config", nil, nil, http.StatusOK)
+
+	identifiers := func() []string {
+		var ids []string
+		for _, n := range serverInput(t, hub, "default").Nodes {
+			ids = append(ids, n.Identifier)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	var applied struct {
+		Rebound    []database.PathBinding `json:"rebound"`
+		Unresolved []database.PathBinding `json:"unresolved"`
+	}
+
+	// Updating the config follows the browse path of the speed to its new node id
+	moved := hub.Server.Renumber(t, speed, "Speed#2")
+	call(t, "POST", api.URL+"/api/update-telegraf-config", nil, &applied, http.StatusOK)
+	if len(applied.Rebound) != 1 || applied.Rebound[0].NodeID != speed || applied.Rebound[0].ResolvedID != moved || applied.Rebound[0].Path != "Plant.Line1.Speed" {
+		t.Fatalf("expected %s to move to %s, got %+v", speed, moved, applied)
+	}
+	if ids := identifiers(); strings.Join(ids, ",") != "Plant.Line1.Count,Speed#2" {
+		t.Errorf("unexpected nodes in the Telegraf config: %v", ids)
+	}
+
+	// So does a browse, which marks the node left behind as removed
+	speed, moved = moved, hub.Server.Renumber(t, moved, "Speed#3")
+	call(t, "POST", api.URL+"/api/servers/1/browse", nil, nil, http.StatusAccepted)
+	if job := hub.WaitForBrowse(t); job.State != browsejob.StateSucceeded {
+		t.Fatalf("browse %s: %v", job.State, job.Errors)
+	}
+	var changes database.BrowseChanges
+	call(t, "GET", api.URL+"/api/browse/changes?server=1", nil, &changes, http.StatusOK)
+	if len(changes.Rebound) != 1 || changes.Rebound[0].ResolvedID != moved || len(changes.PendingRemoval) != 1 || changes.PendingRemoval[0] != speed {
+		t.Fatalf("unexpected browse changes %+v", changes)
+	}
+	var tree struct {
+		Nodes []*database.Node `json:"nodes"`
+	}
+	call(t, "GET", api.URL+"/api/nodes", nil, &tree, http.StatusOK)
+	if node := findNode(tree.Nodes, moved); node == nil || !node.HistoryEnabled || !node.BindPath || strings.Join(node.BrowsePath, "/") != "0:Line1/0:Speed" {
+		t.Fatalf("unexpected node %+v", node)
+	}
+	call(t, "POST", api.URL+"/api/update-telegraf-config", nil, &applied, http.StatusOK)
+	if ids := identifiers(); strings.Join(ids, ",") != "Plant.Line1.Count,Speed#3" {
+		t.Errorf("unexpected nodes in the Telegraf config: %v", ids)
+	}
+
+	// A path that no longer resolves is reported and its node left alone
+	hub.Server.Remove(t, "Line1", "Count")
+	call(t, "POST", api.URL+"/api/update-telegraf-config", nil, &applied, http.StatusOK)
+	if len(applied.Rebound) != 0 || len(applied.Unresolved) != 1 || applied.Unresolved[0].NodeID != count || applied.Unresolved[0].Status != "BadNoMatch" {
+		t.Errorf("expected %s to be unresolved, got %+v", count, applied)
+	}
+
+	call(t, "POST", api.URL+"/api/update-node-history", map[string]interface{}{"serverID": 1, "nodeID": hub.Server.NodeID(), "historyEnabled": false, "bindPath": true}, nil, http.StatusBadRequest)
+	call(t, "POST", api.URL+"/api/update-node-history", map[string]interface{}{"serverID": 1, "nodeID": "ns=1;s=Unknown", "historyEnabled": false, "bindPath": true}, nil, http.StatusNotFound)
+}
+
+func TestBindPathSwap(t *testing.T) {
+	hub, api := startAPI(t)
+	speed := hub.Server.NodeID("Line1", "Speed")
+	count := hub.Server.NodeID("Line1", "Count")
+	call(t, "POST", api.URL+"/api/update-node-history", map[string]interface{}{"serverID": 1, "nodeID": speed, "historyEnabled": true, "bindPath": true}, nil, http.StatusOK)
+	call(t, "POST", api.URL+"/api/update-telegraf-config", nil, nil, http.StatusOK)
+
+	// The speed and the count swap node ids, so the browse stores each under the id of the other
+	tmp := hub.Server.Renumber(t, speed, "tmp")
+	hub.Server.Renumber(t, count, "Plant.Line1.Speed")
+	hub.Server.Renumber(t, tmp, "Plant.Line1.Count")
+	call(t, "POST", api.URL+"/api/servers/1/browse", nil, nil, http.StatusAccepted)
+	if job := hub.WaitForBrowse(t); job.State != browsejob.StateSucceeded {
+		t.Fatalf("browse %s: %v", job.State, job.Errors)
+	}
+
+	var tree struct {
+		Nodes []*database.Node `json:"nodes"`
+	}
+	call(t, "GET", api.URL+"/api/nodes", nil, &tree, http.StatusOK)
+	if node := findNode(tree.Nodes, count); node == nil || node.BrowseName != "Speed" || !node.HistoryEnabled || !node.BindPath {
+		t.Errorf("expected the selection to follow the speed to %s, got %+v", count, node)
+	}
+	if node := findNode(tree.Nodes, speed); node == nil || node.BrowseName != "Count" || node.HistoryEnabled || node.BindPath {
+		t.Errorf("expected the count at %s without a selection, got %+v", speed, node)
+	}
+
+	call(t, "POST", api.URL+"/api/update-telegraf-config", nil, nil, http.StatusOK)
+	if input := serverInput(t, hub, "default"); len(input.Nodes) != 1 || input.Nodes[0].Identifier != "Plant.Line1.Count" || input.Nodes[0].Name != "Speed" {
+		t.Errorf("expected the speed at its new node id, got %+v", input.Nodes)
+	}
 }
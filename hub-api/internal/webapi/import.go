@@ -0,0 +1,79 @@
+package webapi
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/browsejob"
+	"OpcUaTimeSeriesHub/hub-api/internal/database"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// maxImportSize limits the size of an imported document.
+const maxImportSize = 256 << 20
+
+// ImportResult is the response of ImportHandler.
+type ImportResult struct {
+	Nodes   int                     `json:"nodes"`
+	Changes *database.BrowseChanges `json:"changes"`
+}
+
+// ImportHandler builds the hierarchy of a server from the request body instead of the server, so
+// that nodes can be selected before the server is online. The format query parameter is
+// nodeset2 for a NodeSet2 document, or json (the default) for a JSON export. It responds with
+// 409 and the job while a browse is running.
+func ImportHandler(db *sql.DB, config util.Config, scheduler *browsejob.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Importing nodes")
+
+		id, err := pathServerID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "nodeset2" && format != "json" {
+			http.Error(w, fmt.Sprintf("invalid format %q, expected nodeset2 or json", format), http.StatusBadRequest)
+			return
+		}
+
+		for _, job := range scheduler.Jobs() {
+			if job.State == browsejob.StateRunning {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(job)
+				return
+			}
+		}
+
+		body := http.MaxBytesReader(w, r.Body, maxImportSize)
+		var nodes int
+		if format == "nodeset2" {
+			nodes, err = database.ImportNodeSet2(r.Context(), db, config, id, body)
+		} else {
+			nodes, err = database.ImportSnapshot(db, id, body)
+		}
+		switch {
+		case errors.Is(err, database.ErrInvalidImport):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, database.ErrServerNotFound):
+			http.Error(w, err.Error(), serverErrorStatus(err))
+			return
+		case err != nil:
+			util.Logger.Error("Failed to import nodes", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		util.Logger.Infof("Imported %d nodes into server %d", nodes, id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ImportResult{Nodes: nodes, Changes: database.GetBrowseChanges(id)})
+	}
+}
@@ -0,0 +1,45 @@
+package webapi
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/browsejob"
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"database/sql"
+	"github.com/gorilla/mux"
+)
+
+// NewRouter returns the routes of the API, served from db with the settings in config, the
+// sessions in pool, the browses of scheduler and the server health read by monitor.
+func NewRouter(db *sql.DB, config util.Config, pool *opcuaclient.SessionPool, scheduler *browsejob.Scheduler, monitor *opcuaclient.HealthMonitor) *mux.Router {
+	proxies := parseTrustedProxies(config.HubTrustedProxies)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/servers", GetServersHandler(db)).Methods("GET")
+	r.HandleFunc("/api/servers", CreateServerHandler(db, config, scheduler)).Methods("POST")
+	r.HandleFunc("/api/servers/test", TestServerHandler(db, config)).Methods("POST")
+	r.HandleFunc("/api/servers/{id:[0-9]+}", GetServerHandler(db)).Methods("GET")
+	r.HandleFunc("/api/servers/{id:[0-9]+}", UpdateServerHandler(db, config, pool)).Methods("PUT")
+	r.HandleFunc("/api/servers/{id:[0-9]+}", DeleteServerHandler(db, pool)).Methods("DELETE")
+	r.HandleFunc("/api/servers/{id:[0-9]+}/browse", BrowseServerHandler(db, scheduler)).Methods("POST")
+	r.HandleFunc("/api/servers/{id:[0-9]+}/import", ImportHandler(db, config, scheduler)).Methods("POST")
+	r.HandleFunc("/api/servers/{id:[0-9]+}/status", GetServerStatusHandler(db, pool)).Methods("GET")
+	r.HandleFunc("/api/servers/{id:[0-9]+}/health", GetServerHealthHandler(db, pool, monitor)).Methods("GET")
+	r.HandleFunc("/api/discovery", DiscoveryHandler).Methods("POST")
+	r.HandleFunc("/api/nodes", GetNodesHandler(db)).Methods("GET")
+	r.HandleFunc("/api/export", ExportHandler(db)).Methods("GET")
+	r.HandleFunc("/api/nodes/read", ReadNodesHandler(db, pool)).Methods("POST")
+	r.HandleFunc("/api/nodes/watch", WatchNodesHandler(pool)).Methods("GET")
+	r.HandleFunc("/api/nodes/{nodeID:.+}/write", WriteNodeHandler(db, pool, proxies)).Methods("POST")
+	r.HandleFunc("/api/nodes/{nodeID:.+}/writes", GetNodeWritesHandler(db)).Methods("GET")
+	r.HandleFunc("/api/nodes/{nodeID:.+}/history", GetNodeHistoryHandler(db, pool)).Methods("GET")
+	r.HandleFunc("/api/nodes/{nodeID:.+}", GetSingleNodeHandler(db, pool)).Methods("GET")
+	r.HandleFunc("/api/methods/{nodeID:.+}/call", CallMethodHandler(db, pool, proxies)).Methods("POST")
+	r.HandleFunc("/api/updated-required", GetUpdatesRequired(db)).Methods("GET")
+	r.HandleFunc("/api/update-node-history", UpdateNodeHistoryHandler(db)).Methods("POST")
+	r.HandleFunc("/api/update-telegraf-config", UpdateConfigFileWithHistoryNodes(db, config, pool)).Methods("POST")
+	r.HandleFunc("/api/browse/report", GetBrowseReportHandler).Methods("GET")
+	r.HandleFunc("/api/browse/changes", GetBrowseChangesHandler).Methods("GET")
+	r.HandleFunc("/api/browse", TriggerBrowseHandler(scheduler)).Methods("POST")
+	r.HandleFunc("/api/browse/jobs", GetBrowseJobsHandler(scheduler)).Methods("GET")
+	return r
+}
@@ -0,0 +1,504 @@
+package webapi
+
+import (
+	"OpcUaTimeSeriesHub/hub-api/internal/browsejob"
+	"OpcUaTimeSeriesHub/hub-api/internal/database"
+	"OpcUaTimeSeriesHub/hub-api/internal/opcuaclient"
+	"OpcUaTimeSeriesHub/hub-api/util"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// connectionTestTimeout limits how long discovery and connection tests wait for a server.
+const connectionTestTimeout = 15 * time.Second
+
+// serverNodeClass is the node class of the root nodes GetNodesHandler returns for the servers.
+const serverNodeClass = "Server"
+
+// requestServerID returns the server in the server query parameter, or the default server if
+// there is none.
+func requestServerID(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("server")
+	if v == "" {
+		return database.DefaultServerID, nil
+	}
+	id, err := strconv.Atoi(v)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid server %q", v)
+	}
+	return id, nil
+}
+
+// requestSession returns the server of the request and the shared session with it. On error it
+// responds and returns false.
+func requestSession(w http.ResponseWriter, r *http.Request, pool *opcuaclient.SessionPool) (int, *opcuaclient.Session, bool) {
+	serverID, err := requestServerID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, nil, false
+	}
+	session, err := pool.Session(r.Context(), serverID)
+	if err != nil {
+		util.Logger.Error("Failed to get session", err)
+		http.Error(w, err.Error(), serverErrorStatus(err))
+		return 0, nil, false
+	}
+	return serverID, session, true
+}
+
+// serverErrorStatus returns the HTTP status for an error looking up a server.
+func serverErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrServerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrNoSecretKey):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrServerDisabled), errors.Is(err, database.ErrServerInUse):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// pathServerID returns the server in the id path variable.
+func pathServerID(r *http.Request) (int, error) {
+	v := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(v)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid server %q", v)
+	}
+	return id, nil
+}
+
+// withoutPassword returns a copy of a server that is safe to respond with.
+func withoutPassword(s *database.Server) *database.Server {
+	c := *s
+	c.Password = ""
+	return &c
+}
+
+// decodeServer reads the settings of a server from the request body and validates them.
+func decodeServer(r *http.Request) (database.Server, error) {
+	s, err := decodeServerSettings(r)
+	if err != nil {
+		return s, err
+	}
+	return s, database.ValidateServer(s)
+}
+
+// decodeServerSettings reads the settings of a server from the request body, defaulting to an
+// anonymous connection without security to the Objects folder.
+func decodeServerSettings(r *http.Request) (database.Server, error) {
+	s := database.Server{
+		RootNode:       "i=85",
+		SecurityPolicy: "None",
+		SecurityMode:   "None",
+		AuthMethod:     "Anonymous",
+		Enabled:        true,
+	}
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		return s, fmt.Errorf("invalid request body: %w", err)
+	}
+	return s, nil
+}
+
+// GetServersHandler returns the servers managed by the hub.
+func GetServersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Getting servers")
+
+		servers, err := database.GetServers(db)
+		if err != nil {
+			util.Logger.Error("Failed to load servers", err)
+			http.Error(w, "Failed to load servers", http.StatusInternalServerError)
+			return
+		}
+		for i, s := range servers {
+			servers[i] = withoutPassword(s)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(servers)
+	}
+}
+
+// GetServerHandler returns a server.
+func GetServerHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Getting server")
+
+		id, err := pathServerID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s, err := database.GetServer(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), serverErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withoutPassword(s))
+	}
+}
+
+// CreateServerHandler adds a server from the settings in the request body and starts browsing it
+// unless a browse is already running. It responds with 201 and the new server.
+func CreateServerHandler(db *sql.DB, config util.Config, scheduler *browsejob.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Creating server")
+
+		s, err := decodeServer(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id, err := database.InsertServer(db, config, s)
+		if errors.Is(err, database.ErrNoSecretKey) {
+			http.Error(w, "set HUB_SECRET_KEY to store passwords", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			util.Logger.Error("Failed to add server", err)
+			http.Error(w, "Failed to add server", http.StatusInternalServerError)
+			return
+		}
+		created, err := database.GetServer(db, id)
+		if err != nil {
+			util.Logger.Error("Failed to load server", err)
+			http.Error(w, "Failed to load server", http.StatusInternalServerError)
+			return
+		}
+		util.Logger.WithField("ServerID", id).WithField("Endpoint", created.Endpoint).Info("Server added")
+
+		if created.Enabled {
+			scheduler.Trigger(id)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(withoutPassword(created))
+	}
+}
+
+// UpdateServerHandler replaces the settings of a server with those in the request body. The
+// stored password is kept unless a new one is given. The session with the server is closed, so
+// that the next request connects with the new settings, and its events are subscribed to again.
+func UpdateServerHandler(db *sql.DB, config util.Config, pool *opcuaclient.SessionPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Updating server")
+
+		id, err := pathServerID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s, err := decodeServer(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.ID = id
+
+		if err := database.UpdateServer(db, config, s); err != nil {
+			util.Logger.Error("Failed to update server", err)
+			http.Error(w, err.Error(), serverErrorStatus(err))
+			return
+		}
+		if err := pool.Close(r.Context(), id); err != nil {
+			util.Logger.Warn("Failed to close session", err)
+		}
+
+		updated, err := database.GetServer(db, id)
+		if err != nil {
+			util.Logger.Error("Failed to load server", err)
+			http.Error(w, "Failed to load server", http.StatusInternalServerError)
+			return
+		}
+		if updated.Enabled {
+			nodes, err := database.GetHistoryNodes(db)
+			if err == nil {
+				notifiers := database.FilterNodesByAction(serverNodes(nodes, id), []database.Action{database.HistoryEnabledNoChange})
+				err = subscribeServerEvents(r.Context(), pool, id, notifiers)
+			}
+			if err != nil {
+				util.Logger.Errorf("Failed to subscribe to events of server %s: %s", updated.Name, err)
+			}
+		}
+		util.Logger.WithField("ServerID", id).Info("Server updated")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withoutPassword(updated))
+	}
+}
+
+// DeleteServerHandler deletes a server with its nodes. It responds with 409 while nodes of the
+// server are history enabled or in the Telegraf config. The default server cannot be deleted.
+func DeleteServerHandler(db *sql.DB, pool *opcuaclient.SessionPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Deleting server")
+
+		id, err := pathServerID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if id == database.DefaultServerID {
+			http.Error(w, "The default server cannot be deleted", http.StatusBadRequest)
+			return
+		}
+
+		if err := database.DeleteServer(db, id); err != nil {
+			util.Logger.Error("Failed to delete server", err)
+			http.Error(w, err.Error(), serverErrorStatus(err))
+			return
+		}
+		if err := pool.Close(r.Context(), id); err != nil {
+			util.Logger.Warn("Failed to close session", err)
+		}
+		util.Logger.WithField("ServerID", id).Info("Server deleted")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// BrowseServerHandler starts a browse of a server in the background, as TriggerBrowseHandler.
+func BrowseServerHandler(db *sql.DB, scheduler *browsejob.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Triggering server browse")
+
+		id, err := pathServerID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s, err := database.GetServer(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), serverErrorStatus(err))
+			return
+		}
+		if !s.Enabled {
+			http.Error(w, fmt.Sprintf("Server %s is disabled", s.Name), http.StatusConflict)
+			return
+		}
+
+		triggerBrowse(w, scheduler, id)
+	}
+}
+
+// DiscoveryRequest is the body of a discovery request.
+type DiscoveryRequest struct {
+	URL string `json:"url"`
+}
+
+// DiscoveryHandler lists the endpoints of the server at the URL in the request body, with their
+// security policies, modes and user token types, and the servers known to it. It responds with
+// 502 when the server cannot be reached.
+func DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+
+	util.Logger.Info("Discovering endpoints")
+
+	var req DiscoveryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(req.URL, "opc.tcp://") {
+		http.Error(w, fmt.Sprintf("invalid url %q, expected opc.tcp://host:port", req.URL), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), connectionTestTimeout)
+	defer cancel()
+	discovery, err := opcuaclient.Discover(ctx, req.URL)
+	if err != nil {
+		util.Logger.Error("Failed to discover endpoints", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(discovery)
+}
+
+// TestServerHandler opens a session with the server settings in the request body and responds
+// with the outcome, explaining why the session could not be opened. The name is optional. When
+// the id of a stored server is given without a password, its stored password is used, but only
+// if the endpoint, auth method and username are those of the stored server. Other settings
+// authenticating with a username must come with their password, so that the stored password
+// cannot be sent to another server.
+func TestServerHandler(db *sql.DB, config util.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Testing server connection")
+
+		s, err := decodeServerSettings(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.Name == "" {
+			s.Name = s.Endpoint
+		}
+		if err := database.ValidateServer(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if s.ID != 0 && s.Password == "" {
+			stored, err := database.GetServer(db, s.ID)
+			if err != nil {
+				http.Error(w, err.Error(), serverErrorStatus(err))
+				return
+			}
+			switch {
+			case sameIdentity(s, *stored):
+				s.StoredPassword = stored.StoredPassword
+			case strings.EqualFold(s.AuthMethod, "UserName"):
+				http.Error(w, "a password is required to test settings other than the stored endpoint, auth method and username", http.StatusBadRequest)
+				return
+			default:
+				// Nothing of the stored server is used, not even the OPCUA_PASSWORD of the default server
+				s.ID = 0
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), connectionTestTimeout)
+		defer cancel()
+		sec, err := s.SecurityConfig(config)
+		if err != nil {
+			util.Logger.Error("Failed to read the stored password", err)
+			http.Error(w, err.Error(), serverErrorStatus(err))
+			return
+		}
+		result := opcuaclient.TestConnection(ctx, sec)
+		util.Logger.WithField("Endpoint", s.Endpoint).WithField("Problem", result.Problem).Info(result.Message)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// sameIdentity reports whether the settings s connect to the stored server with the same user.
+func sameIdentity(s, stored database.Server) bool {
+	return s.Endpoint == stored.Endpoint && strings.EqualFold(s.AuthMethod, stored.AuthMethod) && s.Username == stored.Username
+}
+
+// ServerStatus is the connection status of a server.
+type ServerStatus struct {
+	ServerID int    `json:"serverID"`
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	opcuaclient.SessionStatus
+}
+
+// GetServerStatusHandler returns the state of the session with a server, with the last error and
+// the time of the next attempt while it is not connected. Asking for the status of an enabled
+// server starts its session.
+func GetServerStatusHandler(db *sql.DB, pool *opcuaclient.SessionPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Getting server status")
+
+		id, err := pathServerID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s, err := database.GetServer(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), serverErrorStatus(err))
+			return
+		}
+
+		status := ServerStatus{ServerID: s.ID, Name: s.Name, Enabled: s.Enabled}
+		if s.Enabled {
+			status.SessionStatus, err = pool.Status(r.Context(), id)
+			if err != nil {
+				util.Logger.Error("Failed to get session status", err)
+				http.Error(w, err.Error(), serverErrorStatus(err))
+				return
+			}
+		} else {
+			status.SessionStatus = opcuaclient.SessionStatus{Endpoint: s.Endpoint, State: opcuaclient.StateDisconnected}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// ServerHealthStatus is the health of a server with the status of the session with it.
+type ServerHealthStatus struct {
+	ServerID int                       `json:"serverID"`
+	Name     string                    `json:"name"`
+	Enabled  bool                      `json:"enabled"`
+	Session  opcuaclient.SessionStatus `json:"session"`
+	Health   *opcuaclient.ServerHealth `json:"health,omitempty"`
+}
+
+// GetServerHealthHandler returns the last health read of a server by the monitor: its state,
+// start and current time, clock drift, build info, service level and session diagnostics. The
+// health is read right away if the monitor has not read it yet, or if refresh=true. A server that
+// cannot be read is reported with the error rather than failing the request, and disabled
+// servers are not read.
+func GetServerHealthHandler(db *sql.DB, pool *opcuaclient.SessionPool, monitor *opcuaclient.HealthMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		util.Logger.Info("Getting server health")
+
+		id, err := pathServerID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s, err := database.GetServer(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), serverErrorStatus(err))
+			return
+		}
+
+		status := ServerHealthStatus{ServerID: s.ID, Name: s.Name, Enabled: s.Enabled}
+		if s.Enabled {
+			health, ok := monitor.Health(id)
+			if !ok || r.URL.Query().Get("refresh") == "true" {
+				health, err = monitor.Check(r.Context(), id)
+				if err != nil {
+					util.Logger.Warnf("Failed to read the health of server %s: %s", s.Name, err)
+				}
+			}
+			status.Health = &health
+			status.Session, err = pool.Status(r.Context(), id)
+			if err != nil {
+				util.Logger.Error("Failed to get session status", err)
+				http.Error(w, err.Error(), serverErrorStatus(err))
+				return
+			}
+		} else {
+			status.Session = opcuaclient.SessionStatus{Endpoint: s.Endpoint, State: opcuaclient.StateDisconnected}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -31,6 +31,46 @@ type Config struct {
 	TelegrafInputsReportActive   string
 	TelegrafInputsCoreTags       string
 	TelegrafInputsPerCPU         string
+	OpcUaSecurityPolicy          string
+	OpcUaSecurityMode            string
+	OpcUaAuthMethod              string
+	OpcUaUsername                string
+	OpcUaPassword                string
+	OpcUaCertificateFile         string
+	OpcUaPrivateKeyFile          string
+	OpcUaGenerateCertificate     string
+	OpcUaApplicationURI          string
+	OpcUaTrustedCertsDir         string
+	OpcUaRejectedCertsDir        string
+	OpcUaAutoAcceptServerCert    string
+	TelegrafOpcUaConnectTimeout  string
+	TelegrafOpcUaRequestTimeout  string
+	TelegrafOpcUaCertificate     string
+	TelegrafOpcUaPrivateKey      string
+	TelegrafSecretStoreID        string
+	TelegrafOpcUaNamespaceURIs   string
+	OpcUaBrowseWorkers           string
+	OpcUaBrowseBatchSize         string
+	OpcUaBrowseRequestsPerSecond string
+	OpcUaBrowseMaxDepth          string
+	OpcUaBrowseRoots             string
+	OpcUaBrowseReferenceTypes    string
+	OpcUaBrowseIncludeSubtypes   string
+	OpcUaBrowseNodeClasses       string
+	OpcUaBrowseEngineeringUnits  string
+	OpcUaBrowseInterval          string
+	OpcUaSubscriptionInterval    string
+	OpcUaKeepaliveInterval       string
+	OpcUaReconnectMinInterval    string
+	OpcUaReconnectMaxInterval    string
+	OpcUaBackfillLookback        string
+	OpcUaEventFields             string
+	OpcUaEventMinSeverity        string
+	OpcUaEventMeasurement        string
+	OpcUaHealthInterval          string
+	OpcUaHealthMeasurement       string
+	HubTrustedProxies            string
+	HubSecretKey                 string
 }
 
 func LoadConfig() Config {
@@ -61,6 +101,46 @@ func LoadConfig() Config {
 		TelegrafInputsReportActive:   getEnv("TELEGRAF_REPORT_ACTIVE", ""),
 		TelegrafInputsCoreTags:       getEnv("TELEGRAF_CORE_TAGS", ""),
 		RootNode:                     getEnv("ROOT_NODE", ""),
+		OpcUaSecurityPolicy:          getEnv("OPCUA_SECURITY_POLICY", "None"),
+		OpcUaSecurityMode:            getEnv("OPCUA_SECURITY_MODE", "None"),
+		OpcUaAuthMethod:              getEnv("OPCUA_AUTH_METHOD", "Anonymous"),
+		OpcUaUsername:                getOptionalEnv("OPCUA_USERNAME"),
+		OpcUaPassword:                getSecretEnv("OPCUA_PASSWORD"),
+		OpcUaCertificateFile:         getEnv("OPCUA_CERTIFICATE_FILE", "pki/own/cert.pem"),
+		OpcUaPrivateKeyFile:          getEnv("OPCUA_PRIVATE_KEY_FILE", "pki/own/key.pem"),
+		OpcUaGenerateCertificate:     getEnv("OPCUA_GENERATE_CERTIFICATE", "true"),
+		OpcUaApplicationURI:          getEnv("OPCUA_APPLICATION_URI", "urn:opc-ua-time-series-hub:client"),
+		OpcUaTrustedCertsDir:         getEnv("OPCUA_TRUSTED_CERTS_DIR", "pki/trusted"),
+		OpcUaRejectedCertsDir:        getEnv("OPCUA_REJECTED_CERTS_DIR", "pki/rejected"),
+		OpcUaAutoAcceptServerCert:    getEnv("OPCUA_AUTO_ACCEPT_SERVER_CERT", "false"),
+		TelegrafOpcUaConnectTimeout:  getEnv("TELEGRAF_OPCUA_CONNECT_TIMEOUT", "10s"),
+		TelegrafOpcUaRequestTimeout:  getEnv("TELEGRAF_OPCUA_REQUEST_TIMEOUT", "5s"),
+		TelegrafOpcUaCertificate:     getOptionalEnv("TELEGRAF_OPCUA_CERTIFICATE"),
+		TelegrafOpcUaPrivateKey:      getOptionalEnv("TELEGRAF_OPCUA_PRIVATE_KEY"),
+		TelegrafSecretStoreID:        getOptionalEnv("TELEGRAF_SECRETSTORE_ID"),
+		TelegrafOpcUaNamespaceURIs:   getEnv("TELEGRAF_OPCUA_NAMESPACE_URIS", "false"),
+		OpcUaBrowseWorkers:           getEnv("OPCUA_BROWSE_WORKERS", "4"),
+		OpcUaBrowseBatchSize:         getEnv("OPCUA_BROWSE_BATCH_SIZE", "100"),
+		OpcUaBrowseRequestsPerSecond: getEnv("OPCUA_BROWSE_REQUESTS_PER_SECOND", "20"),
+		OpcUaBrowseMaxDepth:          getEnv("OPCUA_BROWSE_MAX_DEPTH", "10"),
+		OpcUaBrowseRoots:             getOptionalEnv("OPCUA_BROWSE_ROOTS"),
+		OpcUaBrowseReferenceTypes:    getEnv("OPCUA_BROWSE_REFERENCE_TYPES", "HasComponent,Organizes,HasProperty"),
+		OpcUaBrowseIncludeSubtypes:   getEnv("OPCUA_BROWSE_INCLUDE_SUBTYPES", "true"),
+		OpcUaBrowseNodeClasses:       getEnv("OPCUA_BROWSE_NODE_CLASSES", "Object,Variable,Method"),
+		OpcUaBrowseEngineeringUnits:  getEnv("OPCUA_BROWSE_ENGINEERING_UNITS", "true"),
+		OpcUaBrowseInterval:          getEnv("OPCUA_BROWSE_INTERVAL", "30m"),
+		OpcUaSubscriptionInterval:    getEnv("OPCUA_SUBSCRIPTION_INTERVAL", "1s"),
+		OpcUaKeepaliveInterval:       getEnv("OPCUA_KEEPALIVE_INTERVAL", "10s"),
+		OpcUaReconnectMinInterval:    getEnv("OPCUA_RECONNECT_MIN_INTERVAL", "1s"),
+		OpcUaReconnectMaxInterval:    getEnv("OPCUA_RECONNECT_MAX_INTERVAL", "1m"),
+		OpcUaBackfillLookback:        getOptionalEnv("OPCUA_BACKFILL_LOOKBACK"),
+		OpcUaEventFields:             getOptionalEnv("OPCUA_EVENT_FIELDS"),
+		OpcUaEventMinSeverity:        getOptionalEnv("OPCUA_EVENT_MIN_SEVERITY"),
+		OpcUaEventMeasurement:        getEnv("OPCUA_EVENT_MEASUREMENT", "opcua_events"),
+		OpcUaHealthInterval:          getEnv("OPCUA_HEALTH_INTERVAL", "1m"),
+		OpcUaHealthMeasurement:       getOptionalEnv("OPCUA_HEALTH_MEASUREMENT"),
+		HubTrustedProxies:            getOptionalEnv("HUB_TRUSTED_PROXIES"),
+		HubSecretKey:                 getSecretEnv("HUB_SECRET_KEY"),
 	}
 }
 
@@ -75,3 +155,21 @@ func getEnv(key string, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getOptionalEnv returns the value of key, or an empty string if it is not set.
+func getOptionalEnv(key string) string {
+	value, exists := os.LookupEnv(key)
+	if exists {
+		Logger.Infof("Environment variable %s set to %s", key, value)
+	}
+	return value
+}
+
+// getSecretEnv behaves like getOptionalEnv but never writes the value to the log.
+func getSecretEnv(key string) string {
+	value, exists := os.LookupEnv(key)
+	if exists {
+		Logger.Infof("Environment variable %s set", key)
+	}
+	return value
+}
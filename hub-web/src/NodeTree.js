@@ -1,5 +1,5 @@
 // Import necessary modules from React, Axios for HTTP requests, and Font Awesome for icons
-import React, {useState, useEffect, useCallback} from 'react';
+import React, {useState, useEffect, useCallback, useRef} from 'react';
 import axios from 'axios';
 import './App.css'; // Importing CSS for styling
 import { FontAwesomeIcon } from '@fortawesome/react-fontawesome'; // Component for icons
@@ -7,6 +7,10 @@ import { faPlusSquare, faMinusSquare } from '@fortawesome/free-solid-svg-icons';
 import Modal from 'react-modal'; // Importing Modal from react-modal
 
 Modal.setAppElement('#root');
+
+// Node ids are only unique within a server, so nodes are identified by both
+const nodeKey = (node) => `${node.ServerID}:${node.NodeID}`;
+
 // Main functional component for rendering the node tree
 const NodeTree = () => {
     // State for storing all nodes, expanded nodes, and the current search term
@@ -19,6 +23,8 @@ const NodeTree = () => {
     const [modalIsOpen, setModalIsOpen] = useState(false); // State for controlling the modal
     const [updatesRequired, setUpdatesRequired] = useState([]); // State for storing the updates required
     const [errorMessage, setErrorMessage] = useState(null);
+    const [watchedNodeKey, setWatchedNodeKey] = useState(null); // Variable whose value is streamed from the server
+    const watchSource = useRef(null);
 
     // Function to initially set or update node visibility
     const augmentNodesWithVisibility = useCallback((nodes, isVisible) => {
@@ -105,15 +111,15 @@ const NodeTree = () => {
     };
 
 
-    // Function to find a node by ID and update its history enabled state
-    const findAndUpdateNode = (nodes, nodeID, isChecked) => {
+    // Function to find a node by key and update its history enabled state
+    const findAndUpdateNode = (nodes, key, isChecked) => {
         return nodes.map(node => {
-          if (node.NodeID === nodeID) {
+          if (nodeKey(node) === key) {
             // Logs the update and returns the node with updated history enabled state
             return { ...node, HistoryEnabled: isChecked };
           } else if (node.Children) {
             // Recursively updates children nodes
-            return { ...node, Children: findAndUpdateNode(node.Children, nodeID, isChecked) };
+            return { ...node, Children: findAndUpdateNode(node.Children, key, isChecked) };
           }
           return node;
         });
@@ -129,13 +135,13 @@ const NodeTree = () => {
             }
       }
 
-      const toggleHistoryEnabled = (nodeID, isChecked, nodePath) => {
-        axios.post('/api/update-node-history', { nodeID, historyEnabled: isChecked, nodePath })
+      const toggleHistoryEnabled = (node, isChecked) => {
+        axios.post('/api/update-node-history', { serverID: node.ServerID, nodeID: node.NodeID, historyEnabled: isChecked, nodePath: node.NodePath })
           .then(response => {
             // Assuming the response includes a status and message
             if (response.data && response.data.status === 'success') {
             // Updates the node state locally without re-fetching from the server
-            setNodes(currentNodes => findAndUpdateNode(currentNodes, nodeID, isChecked));
+            setNodes(currentNodes => findAndUpdateNode(currentNodes, nodeKey(node), isChecked));
             setResponseMessage(response.data.message); // Set the success message
             setIsErrorMessage(false); // Indicate that this is not an error message
             setTelegrafConfigStatus(false); // If the update was a success, we konw it is not up to date. No need to read the database. 
@@ -148,20 +154,119 @@ const NodeTree = () => {
           })
           .catch(error => {
             console.error('Error updating node:', error);
-            setResponseMessage(error.message || 'Failed to update node.'); // Set the error message
+            setResponseMessage((error.response && error.response.data) || error.message || 'Failed to update node.'); // Set the error message
             setIsErrorMessage(true); // Indicate that this is an error message
           });
       };
 
+    // Function to read the current value of a variable from the OPC UA server
+    const readLiveValue = (node) => {
+        axios.get(`/api/nodes/${encodeURIComponent(node.NodeID)}?server=${node.ServerID}`)
+            .then(response => {
+                const value = response.data.value;
+                setResponseMessage(`${node.NodePath} = ${JSON.stringify(value.value)} (${value.statusCode}${value.sourceTimestamp ? `, ${value.sourceTimestamp}` : ''})`);
+                setIsErrorMessage(!value.good);
+            })
+            .catch(error => {
+                setResponseMessage((error.response && error.response.data) || error.message || 'Failed to read value.');
+                setIsErrorMessage(true);
+            });
+    };
+
+    // Function to stream the value of a variable as it changes on the OPC UA server. Clicking the
+    // watched variable again stops watching it.
+    const toggleWatch = (node) => {
+        if (watchSource.current) {
+            watchSource.current.close();
+            watchSource.current = null;
+        }
+        if (watchedNodeKey === nodeKey(node)) {
+            setWatchedNodeKey(null);
+            return;
+        }
+        const source = new EventSource(`/api/nodes/watch?server=${node.ServerID}&nodeID=${encodeURIComponent(node.NodeID)}`);
+        source.onmessage = (event) => {
+            const value = JSON.parse(event.data);
+            setResponseMessage(`${node.NodePath} = ${JSON.stringify(value.value)} (${value.statusCode}${value.sourceTimestamp ? `, ${value.sourceTimestamp}` : ''})`);
+            setIsErrorMessage(!value.good);
+        };
+        source.onerror = () => {
+            if (source.readyState === EventSource.CLOSED) {
+                setResponseMessage(`Stopped watching ${node.NodePath}.`);
+                setIsErrorMessage(true);
+                setWatchedNodeKey(null);
+            }
+        };
+        watchSource.current = source;
+        setWatchedNodeKey(nodeKey(node));
+        readLiveValue(node);
+    };
+
+    // Effect hook to stop watching when the component unmounts
+    useEffect(() => {
+        return () => {
+            if (watchSource.current) {
+                watchSource.current.close();
+            }
+        };
+    }, []);
+
+    // Function to call a method on its parent object, asking for its input arguments as JSON
+    const callMethod = (node) => {
+        const inputs = node.InputArguments || [];
+        let args = {};
+        if (inputs.length > 0) {
+            const example = JSON.stringify(Object.fromEntries(inputs.map(arg => [arg.name, arg.dataType])));
+            const answer = window.prompt(`Arguments for ${node.BrowseName}, e.g. ${example}`, '{}');
+            if (answer === null) return;
+            try {
+                args = JSON.parse(answer);
+            } catch (e) {
+                setResponseMessage(`Invalid JSON: ${e.message}`);
+                setIsErrorMessage(true);
+                return;
+            }
+        } else if (!window.confirm(`Call ${node.NodePath}?`)) {
+            return;
+        }
+        axios.post(`/api/methods/${encodeURIComponent(node.NodeID)}/call?server=${node.ServerID}`, { arguments: args })
+            .then(response => {
+                const outputs = response.data.outputArguments.map(output => `${output.name}=${JSON.stringify(output.value)}`).join(', ');
+                setResponseMessage(`${node.NodePath}: ${response.data.statusCode}${outputs ? ` (${outputs})` : ''}`);
+                setIsErrorMessage(!response.data.good);
+            })
+            .catch(error => {
+                setResponseMessage((error.response && error.response.data) || error.message || 'Failed to call method.');
+                setIsErrorMessage(true);
+            });
+    };
+
+    // Function to start a browse of every OPC UA server in the background
+    const triggerBrowse = () => {
+        axios.post('/api/browse')
+            .then(response => {
+                setResponseMessage(`Browse job ${response.data.id} started.`);
+                setIsErrorMessage(false);
+            })
+            .catch(error => {
+                if (error.response && error.response.status === 409) {
+                    setResponseMessage(`Browse job ${error.response.data.id} is already running.`);
+                } else {
+                    setResponseMessage(error.message || 'Failed to start browse.');
+                }
+                setIsErrorMessage(true);
+            });
+    };
+
     // Function to toggle the expansion of nodes to show/hide children
-    const toggleExpansion = (nodeID) => {
+    const toggleExpansion = (key) => {
         // Updates the set of expanded nodes based on user interaction
         setExpandedNodes(expandedNodes => {
             const newExpandedNodes = new Set(expandedNodes);
-            if (newExpandedNodes.has(nodeID)) {
-                newExpandedNodes.delete(nodeID);
+            if (newExpandedNodes.has(key)) {
+                newExpandedNodes.delete(key);
             } else {
-                newExpandedNodes.add(nodeID);
+                newExpandedNodes.add(key);
             }
             return newExpandedNodes;
         });
@@ -171,31 +276,45 @@ const renderNode = (node, depth = 0) => {
     if (!node.visible) return null;
 
     const hasChildren = node.Children && node.Children.length > 0;
-    const isExpanded = expandedNodes.has(node.NodeID);
-    const tooltipText = `Path: ${node.NodePath}\nID: ${node.NodeID}`;
+    const key = nodeKey(node);
+    const isExpanded = expandedNodes.has(key);
+    const tooltipText = (node.NodeClass === "Server" ? `Server: ${node.BrowseName}\nEndpoint: ${node.NodeID}` : `Path: ${node.NodePath}\nID: ${node.NodeID}`) + (node.ExpandedNodeID && node.ExpandedNodeID !== node.NodeID ? `\nExpanded ID: ${node.ExpandedNodeID}` : '') + (node.ReferenceType ? `\nReference: ${node.ReferenceType}` : '')
+        + (node.Unit ? `\nUnit: ${node.Unit}` : '')
+        + (node.EUMin || node.EUMax ? `\nRange: ${node.EUMin} to ${node.EUMax}` : '')
+        + (node.DataTypeName ? `\nData type: ${node.DataTypeName}` : '')
+        + (node.EnumValues ? `\nValues: ${Object.entries(node.EnumValues).map(([value, name]) => `${value}=${name}`).join(', ')}` : '')
+        + (node.Historizing ? `\nServer history: yes` : node.HistoryReadable ? `\nServer history: readable` : '')
+        + (node.EventNotifier ? `\nEvents: checking stores the events of this notifier` : '')
+        + (node.InputArguments && node.InputArguments.length ? `\nInputs: ${node.InputArguments.map(arg => `${arg.name} (${arg.dataTypeName})`).join(', ')}` : '')
+        + (node.OutputArguments && node.OutputArguments.length ? `\nOutputs: ${node.OutputArguments.map(arg => `${arg.name} (${arg.dataTypeName})`).join(', ')}` : '')
+        + (node.TypeWarning ? `\nWarning: ${node.TypeWarning}` : '');
 
     // Calculate indentation based on depth
     const marginLeft = depth * 10; // 10px per depth level
 
     return (
-        <div key={node.NodeID} title={tooltipText} style={{ marginLeft: `${marginLeft}px` }}>
+        <div key={key} title={tooltipText} style={{ marginLeft: `${marginLeft}px` }}>
             <div className="node-item">
                 <div className="node-content">
                     {hasChildren && (
-                        <span className="toggle-btn" onClick={() => toggleExpansion(node.NodeID)}>
+                        <span className="toggle-btn" onClick={() => toggleExpansion(key)}>
                             {isExpanded ? <FontAwesomeIcon icon={faMinusSquare} /> : <FontAwesomeIcon icon={faPlusSquare} />}
                         </span>
                     )}
-                    <span>{node.BrowseName}</span>
+                    <span
+                        className={watchedNodeKey === key ? 'watched-node' : undefined}
+                        onClick={node.NodeClass === "NodeClassVariable" ? () => toggleWatch(node) : node.NodeClass === "NodeClassMethod" ? () => callMethod(node) : undefined}
+                    >{node.BrowseName}</span>
                 </div>
                 <div className="node-details">
                     {node.DataType && <span className="node-data-type">{node.DataType}</span>}
-                    {node.NodeClass === "NodeClassVariable" && (
+                    {(node.NodeClass === "NodeClassVariable" || node.EventNotifier) && (
                         <input
                             type="checkbox"
                             className="history-checkbox"
                             checked={node.HistoryEnabled}
-                            onChange={(e) => toggleHistoryEnabled(node.NodeID, e.target.checked, node.NodePath)}
+                            disabled={!node.Storable && !node.EventNotifier && !node.HistoryEnabled}
+                            onChange={(e) => toggleHistoryEnabled(node, e.target.checked)}
                         />
                     )}
                 </div>
@@ -217,6 +336,9 @@ const renderNode = (node, depth = 0) => {
                     onChange={e => setSearchTerm(e.target.value)}
                     className="search-box"
                 />
+                <button onClick={triggerBrowse} className="update-config-button">
+                    Browse Servers
+                </button>
                 <button onClick={getUpdatesRequired} className="update-config-button">
                     Update Telegraf Config
                 </button>
@@ -252,6 +374,7 @@ const renderNode = (node, depth = 0) => {
                     <table className="updates-required">
                         <thead>
                         <tr>
+                            <th>Server</th>
                             <th>Node ID</th>
                             <th>Action Required</th>
                         </tr>
@@ -259,6 +382,7 @@ const renderNode = (node, depth = 0) => {
                         <tbody>
                         {updatesRequired.map((update, index) => (
                             <tr key={index}>
+                                <td>{update.server}</td>
                                 <td>{update.nodeID}</td>
                                 <td>{update.dbActionRequired}</td>
                             </tr>